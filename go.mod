@@ -2,4 +2,7 @@ module myGodis
 
 go 1.20
 
-require github.com/shopspring/decimal v1.2.0
+require (
+	github.com/shopspring/decimal v1.2.0
+	github.com/yuin/gopher-lua v1.1.1
+)
@@ -0,0 +1,581 @@
+package cluster
+
+import (
+	"errors"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Gossip on the cluster bus, the bus port is the client port + 10000 by default.
+ * Every node pings all members each gossipInterval, a ping carries what the sender knows about members,
+ * so nodes joined by CLUSTER MEET spread to the whole cluster.
+ * A member not replying PONG in nodeTimeout is marked PFAIL by the node pinging it. Once the majority of nodes
+ * report PFAIL, it is marked FAIL and FAIL is broadcast. A failing node is cleared once it replies again.
+ * Messages are RESP arrays: PING|PONG|MEET sender sender-bus [node bus flag]..., FAIL sender node, FORGET sender node
+ */
+
+const busPortOffset = 10000
+
+var (
+	gossipInterval = time.Second
+	nodeTimeout    = 15 * time.Second
+	// forgotten nodes are not added by gossip again in this period
+	forgetBanTime = time.Minute
+)
+
+const (
+	flagOK    = "ok"
+	flagPFail = "pfail"
+	flagFail  = "fail"
+)
+
+type member struct {
+	addr    string
+	busAddr string
+
+	pingSent     time.Time // zero if no ping is waiting for pong
+	pongReceived time.Time
+	pinging      bool
+	pfail        bool
+	fail         bool
+	failReports  map[string]time.Time // reporter -> report time
+
+	sending sync.Mutex // messages to a member are sent one by one
+	conn    net.Conn
+	replies <-chan *parser.Payload
+}
+
+// closeConn invoker should hold b.mu
+func (m *member) closeConn() {
+	if m.conn != nil {
+		_ = m.conn.Close()
+		m.conn = nil
+		m.replies = nil
+	}
+}
+
+func (m *member) flag() string {
+	if m.fail {
+		return flagFail
+	} else if m.pfail {
+		return flagPFail
+	}
+	return flagOK
+}
+
+type bus struct {
+	cluster  *Cluster
+	addr     string
+	listener net.Listener
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	members map[string]*member    // node addr -> member, self excluded
+	banned  map[string]time.Time  // node addr -> ban expiration
+	conns   map[net.Conn]struct{} // accepted connections
+	closeCh chan struct{}
+}
+
+// busAddrOf returns the default bus address of node
+func busAddrOf(node string) string {
+	host, port := splitAddr(node)
+	return host + ":" + strconv.Itoa(port+busPortOffset)
+}
+
+// startBus listens on busAddr and starts gossip with known nodes
+func (cluster *Cluster) startBus(busAddr string) error {
+	listener, err := net.Listen("tcp", busAddr)
+	if err != nil {
+		return err
+	}
+	b := &bus{
+		cluster:  cluster,
+		addr:     listener.Addr().String(),
+		listener: listener,
+		interval: gossipInterval,
+		timeout:  nodeTimeout,
+		conns:    make(map[net.Conn]struct{}),
+		members:  make(map[string]*member),
+		banned:   make(map[string]time.Time),
+		closeCh:  make(chan struct{}),
+	}
+	for _, node := range cluster.getNodes() {
+		if node != cluster.self {
+			b.members[node] = &member{addr: node, busAddr: busAddrOf(node), pongReceived: time.Now()}
+		}
+	}
+	cluster.mu.Lock()
+	cluster.bus = b
+	cluster.mu.Unlock()
+	go b.serve()
+	go b.cron()
+	return nil
+}
+
+func (b *bus) close() {
+	close(b.closeCh)
+	_ = b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, m := range b.members {
+		m.closeConn()
+	}
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+}
+
+func (b *bus) isFailing(node string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.members[node]
+	return ok && m.fail
+}
+
+/* ---- server side ---- */
+
+func (b *bus) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handleConn(conn)
+	}
+}
+
+func (b *bus) handleConn(conn net.Conn) {
+	b.mu.Lock()
+	select {
+	case <-b.closeCh:
+		b.mu.Unlock()
+		_ = conn.Close()
+		return
+	default:
+	}
+	b.conns[conn] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		_ = conn.Close()
+	}()
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			if _, ok := payload.Err.(*reply.ProtocolErrReply); ok {
+				_, _ = conn.Write(reply.MakeErrReply(payload.Err.Error()).ToBytes())
+			}
+			return
+		}
+		msg, ok := payload.Data.(*reply.MultiBulkReply)
+		if !ok || len(msg.Args) < 2 {
+			_, _ = conn.Write(reply.MakeErrReply("ERR illegal message").ToBytes())
+			continue
+		}
+		if _, err := conn.Write(b.handleMessage(msg.Args).ToBytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (b *bus) handleMessage(args [][]byte) redis.Reply {
+	msgType := strings.ToUpper(string(args[0]))
+	sender := string(args[1])
+	switch msgType {
+	case "PING", "MEET":
+		if len(args) < 3 || (len(args)-3)%3 != 0 {
+			return reply.MakeErrReply("ERR illegal message")
+		}
+		b.receivePing(sender, string(args[2]), args[3:], msgType == "MEET")
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return reply.MakeMultiBulkReply(b.makeGossip("PONG"))
+	case "FAIL":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR illegal message")
+		}
+		b.markFail(string(args[2]))
+	case "FORGET":
+		if len(args) != 3 {
+			return reply.MakeErrReply("ERR illegal message")
+		}
+		b.forget(string(args[2]), false)
+	default:
+		return reply.MakeErrReply("ERR unknown message " + msgType)
+	}
+	return &reply.OkReply{}
+}
+
+// receivePing handles a ping, an unknown sender joins the cluster
+func (b *bus) receivePing(sender string, senderBus string, gossip [][]byte, meet bool) {
+	b.mu.Lock()
+	joined := false
+	if _, ok := b.members[sender]; !ok && b.canJoin(sender) && (meet || !b.isBanned(sender)) {
+		delete(b.banned, sender)
+		b.members[sender] = &member{addr: sender, busAddr: senderBus, pongReceived: time.Now()}
+		joined = true
+		logger.Info("node " + sender + " joined")
+	}
+	joined = b.handleGossip(sender, gossip) || joined
+	b.mu.Unlock()
+	if joined {
+		b.onMembersChanged()
+	}
+}
+
+// canJoin returns whether node may become a member,
+// nodes of consistent hash mode are fixed by config since keys are not migrated
+func (b *bus) canJoin(node string) bool {
+	if node == b.cluster.self {
+		return false
+	}
+	return b.cluster.slots != nil || containsNode(b.cluster.getNodes(), node)
+}
+
+/* ---- client side ---- */
+
+func (b *bus) cron() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.tick()
+		case <-b.closeCh:
+			return
+		}
+	}
+}
+
+func (b *bus) tick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, m := range b.members {
+		if !m.pinging {
+			m.pinging = true
+			if m.pingSent.IsZero() {
+				m.pingSent = now
+			}
+			go b.ping(m, b.makeGossip("PING"))
+		}
+		if !m.pingSent.IsZero() && now.Sub(m.pingSent) > b.timeout && !m.pfail {
+			logger.Warn("node " + m.addr + " is possibly failing")
+			m.pfail = true
+		}
+		for reporter, reportTime := range m.failReports {
+			if now.Sub(reportTime) > b.timeout*2 {
+				delete(m.failReports, reporter)
+			}
+		}
+		b.checkFail(m)
+	}
+	for node, expiration := range b.banned {
+		if now.After(expiration) {
+			delete(b.banned, node)
+		}
+	}
+}
+
+// ping sends msg to m and handles its pong
+func (b *bus) ping(m *member, msg [][]byte) {
+	result, err := b.send(m, msg)
+	b.mu.Lock()
+	m.pinging = false
+	if err != nil {
+		b.mu.Unlock()
+		return
+	}
+	b.handlePong(m, result)
+	b.mu.Unlock()
+	b.onMembersChanged()
+}
+
+// send sends msg to m and waits for its reply, invoker should not hold b.mu
+func (b *bus) send(m *member, msg [][]byte) ([][]byte, error) {
+	m.sending.Lock()
+	defer m.sending.Unlock()
+	b.mu.Lock()
+	conn, replies := m.conn, m.replies
+	busAddr := m.busAddr
+	b.mu.Unlock()
+	if conn == nil {
+		var err error
+		conn, err = net.DialTimeout("tcp", busAddr, b.timeout)
+		if err != nil {
+			return nil, err
+		}
+		replies = parser.ParseStream(conn)
+		b.mu.Lock()
+		m.conn, m.replies = conn, replies
+		b.mu.Unlock()
+	}
+	result, err := b.roundTrip(conn, replies, msg)
+	b.mu.Lock()
+	if (err != nil || b.members[m.addr] != m) && m.conn == conn {
+		// drop broken connection and connection of removed member
+		m.closeConn()
+	}
+	b.mu.Unlock()
+	return result, err
+}
+
+func (b *bus) roundTrip(conn net.Conn, replies <-chan *parser.Payload, msg [][]byte) ([][]byte, error) {
+	_ = conn.SetDeadline(time.Now().Add(b.timeout))
+	if _, err := conn.Write(reply.MakeMultiBulkReply(msg).ToBytes()); err != nil {
+		return nil, err
+	}
+	payload, ok := <-replies
+	if !ok {
+		return nil, errors.New("connection closed")
+	} else if payload.Err != nil {
+		return nil, payload.Err
+	}
+	if errReply, ok := payload.Data.(reply.ErrorReply); ok {
+		return nil, errReply
+	}
+	multiBulk, ok := payload.Data.(*reply.MultiBulkReply)
+	if !ok {
+		return nil, errors.New("illegal reply")
+	}
+	return multiBulk.Args, nil
+}
+
+// handlePong marks m alive and merges its gossip, invoker should hold b.mu
+func (b *bus) handlePong(m *member, pong [][]byte) bool {
+	m.pingSent = time.Time{}
+	m.pongReceived = time.Now()
+	if m.pfail || m.fail {
+		logger.Info("node " + m.addr + " is reachable again")
+	}
+	m.pfail = false
+	m.fail = false
+	m.failReports = nil
+	if len(pong) < 3 || (len(pong)-3)%3 != 0 {
+		return false
+	}
+	return b.handleGossip(m.addr, pong[3:])
+}
+
+// makeGossip builds a message carrying states of all members, invoker should hold b.mu
+func (b *bus) makeGossip(msgType string) [][]byte {
+	msg := [][]byte{[]byte(msgType), []byte(b.cluster.self), []byte(b.addr)}
+	for _, m := range b.members {
+		msg = append(msg, []byte(m.addr), []byte(m.busAddr), []byte(m.flag()))
+	}
+	return msg
+}
+
+// handleGossip merges member states reported by sender, returns whether new nodes joined.
+// invoker should hold b.mu
+func (b *bus) handleGossip(sender string, gossip [][]byte) bool {
+	joined := false
+	for i := 0; i+2 < len(gossip); i += 3 {
+		node, busAddr, flag := string(gossip[i]), string(gossip[i+1]), string(gossip[i+2])
+		if node == b.cluster.self || node == sender {
+			continue
+		}
+		m, ok := b.members[node]
+		if !ok {
+			if !b.canJoin(node) || b.isBanned(node) || flag == flagFail {
+				continue
+			}
+			m = &member{addr: node, busAddr: busAddr, pongReceived: time.Now()}
+			b.members[node] = m
+			joined = true
+			logger.Info("node " + node + " joined by gossip from " + sender)
+		}
+		if flag == flagPFail || flag == flagFail {
+			if m.failReports == nil {
+				m.failReports = make(map[string]time.Time)
+			}
+			m.failReports[sender] = time.Now()
+			b.checkFail(m)
+		} else {
+			delete(m.failReports, sender)
+		}
+	}
+	return joined
+}
+
+// checkFail marks m FAIL if the majority of nodes think it is failing, invoker should hold b.mu
+func (b *bus) checkFail(m *member) {
+	if !m.pfail || m.fail {
+		return
+	}
+	quorum := (len(b.members)+1)/2 + 1
+	if len(m.failReports)+1 < quorum {
+		return
+	}
+	logger.Warn("node " + m.addr + " is failing")
+	m.fail = true
+	for _, other := range b.members {
+		if other != m {
+			go b.send(other, [][]byte{[]byte("FAIL"), []byte(b.cluster.self), []byte(m.addr)})
+		}
+	}
+}
+
+func (b *bus) markFail(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.members[node]; ok && !m.fail {
+		logger.Warn("node " + node + " is failing")
+		m.pfail = true
+		m.fail = true
+	}
+}
+
+// isBanned invoker should hold b.mu
+func (b *bus) isBanned(node string) bool {
+	expiration, ok := b.banned[node]
+	return ok && time.Now().Before(expiration)
+}
+
+// meet adds node by handshaking with its bus
+func (b *bus) meet(node string, busAddr string) error {
+	if node == b.cluster.self {
+		return nil
+	} else if !b.canJoin(node) {
+		return errFixedRing
+	}
+	b.mu.Lock()
+	m, ok := b.members[node]
+	if !ok {
+		m = &member{addr: node, busAddr: busAddr, pongReceived: time.Now()}
+	}
+	msg := b.makeGossip("MEET")
+	b.mu.Unlock()
+
+	pong, err := b.send(m, msg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	delete(b.banned, node)
+	if _, ok := b.members[node]; !ok {
+		b.members[node] = m
+		logger.Info("node " + node + " joined by meet")
+	}
+	b.handlePong(m, pong)
+	b.mu.Unlock()
+	b.onMembersChanged()
+	return nil
+}
+
+// forget removes node and bans it for a while, forget is broadcast to other members if broadcast is true
+func (b *bus) forget(node string, broadcast bool) {
+	b.mu.Lock()
+	m, ok := b.members[node]
+	if ok {
+		delete(b.members, node)
+		m.closeConn()
+		logger.Info("node " + node + " left")
+	}
+	b.banned[node] = time.Now().Add(forgetBanTime)
+	var others []*member
+	for _, other := range b.members {
+		others = append(others, other)
+	}
+	b.mu.Unlock()
+	if broadcast {
+		for _, other := range others {
+			go b.send(other, [][]byte{[]byte("FORGET"), []byte(b.cluster.self), []byte(node)})
+		}
+	}
+	if ok {
+		b.onMembersChanged()
+	}
+}
+
+// onMembersChanged rebuilds nodes of cluster by members
+func (b *bus) onMembersChanged() {
+	b.mu.Lock()
+	nodes := []string{b.cluster.self}
+	for node := range b.members {
+		nodes = append(nodes, node)
+	}
+	b.mu.Unlock()
+	current := b.cluster.getNodes()
+	if sameNodes(current, nodes) {
+		return
+	}
+	if b.cluster.slots == nil {
+		// the ring of consistent hash mode is fixed, members only take part in failure detection
+		return
+	}
+	b.cluster.slots.addNodes(nodes...)
+	for _, node := range current {
+		if !containsNode(nodes, node) {
+			b.cluster.slots.removeNode(node)
+		}
+	}
+	b.cluster.saveSlots()
+	_ = b.cluster.setNodes(nodes)
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func sameNodes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, node := range a {
+		if !containsNode(b, node) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cluster *Cluster) getBus() *bus {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.bus
+}
+
+// memberInfo is a snapshot of member state shown by CLUSTER NODES
+type memberInfo struct {
+	busAddr      string
+	pingSent     time.Time
+	pongReceived time.Time
+	pfail        bool
+	fail         bool
+}
+
+func (cluster *Cluster) memberState(node string) (memberInfo, bool) {
+	b := cluster.getBus()
+	if b == nil {
+		return memberInfo{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.members[node]
+	if !ok {
+		return memberInfo{}, false
+	}
+	return memberInfo{
+		busAddr:      m.busAddr,
+		pingSent:     m.pingSent,
+		pongReceived: m.pongReceived,
+		pfail:        m.pfail,
+		fail:         m.fail,
+	}, true
+}
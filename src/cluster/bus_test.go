@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	DBImpl "myGodis/src/db"
+	"myGodis/src/redis/reply"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeBusNodes starts size standalone nodes with cluster bus on random ports
+func makeBusNodes(t *testing.T, size int, mode string) []*Cluster {
+	interval, timeout := gossipInterval, nodeTimeout
+	gossipInterval, nodeTimeout = 20*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() {
+		gossipInterval, nodeTimeout = interval, timeout
+	})
+	nodes := make([]*Cluster, size)
+	for i := range nodes {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := listener.Addr().String()
+		nodes[i] = makeCluster(addr, nil, mode, "", DBImpl.MakeDB())
+		if err := nodes[i].startBus("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		go serve(listener, nodes[i])
+		node := nodes[i]
+		t.Cleanup(func() {
+			_ = listener.Close()
+			select {
+			case <-node.closeCh: // closed by test
+			default:
+				node.Close()
+			}
+		})
+	}
+	return nodes
+}
+
+func meetArgs(node *Cluster, other *Cluster) [][]byte {
+	host, port := splitAddr(other.self)
+	_, busPort := splitAddr(other.bus.addr)
+	return toArgs("CLUSTER", "MEET", host, strconv.Itoa(port), strconv.Itoa(busPort))
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	nodes := makeBusNodes(t, 3, slotMode)
+	assertReply(t, nodes[0].Exec(nil, meetArgs(nodes[0], nodes[1])), "+OK\r\n")
+	assertReply(t, nodes[1].Exec(nil, meetArgs(nodes[1], nodes[2])), "+OK\r\n")
+	waitFor(t, "all nodes joined", func() bool {
+		for _, node := range nodes {
+			if len(node.getNodes()) != 3 {
+				return false
+			}
+		}
+		return true
+	})
+	nodesInfo := string(nodes[0].Exec(nil, toArgs("CLUSTER", "NODES")).ToBytes())
+	for _, node := range nodes {
+		if !strings.Contains(nodesInfo, nodeID(node.self)) {
+			t.Errorf("CLUSTER NODES should contain %s: %s", node.self, nodesInfo)
+		}
+	}
+
+	// node 2 fails
+	nodes[2].Close()
+	waitFor(t, "node marked failing", func() bool {
+		return nodes[0].bus.isFailing(nodes[2].self) && nodes[1].bus.isFailing(nodes[2].self)
+	})
+	nodesInfo = string(nodes[0].Exec(nil, toArgs("CLUSTER", "NODES")).ToBytes())
+	if !strings.Contains(nodesInfo, "master,fail -") {
+		t.Errorf("CLUSTER NODES should show fail flag: %s", nodesInfo)
+	}
+
+	// forget node 2 on all nodes
+	assertReply(t, nodes[0].Exec(nil, toArgs("CLUSTER", "FORGET", nodeID(nodes[2].self))), "+OK\r\n")
+	waitFor(t, "node forgotten", func() bool {
+		return len(nodes[0].getNodes()) == 2 && len(nodes[1].getNodes()) == 2
+	})
+}
+
+func TestMeetErr(t *testing.T) {
+	nodes := makeBusNodes(t, 1, slotMode)
+	result := nodes[0].Exec(nil, toArgs("CLUSTER", "MEET", "127.0.0.1", "abc"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual %q", result.ToBytes())
+	}
+	result = nodes[0].Exec(nil, toArgs("CLUSTER", "FORGET", nodes[0].self))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual %q", result.ToBytes())
+	}
+}
+
+func TestMeetInHashMode(t *testing.T) {
+	nodes := makeBusNodes(t, 2, hashMode)
+	assertReply(t, nodes[0].Exec(nil, meetArgs(nodes[0], nodes[1])), "-ERR "+errFixedRing.Error()+"\r\n")
+	assertReply(t, nodes[0].Exec(nil, toArgs("CLUSTER", "FORGET", nodes[1].self)), "-ERR "+errFixedRing.Error()+"\r\n")
+
+	// nodes not in config can not join by ping or gossip
+	gossip := toArgs("127.0.0.1:1", "127.0.0.1:10001", flagOK)
+	nodes[0].bus.receivePing(nodes[1].self, nodes[1].bus.addr, gossip, true)
+	nodes[0].bus.mu.Lock()
+	members := len(nodes[0].bus.members)
+	nodes[0].bus.mu.Unlock()
+	if members != 0 || len(nodes[0].getNodes()) != 1 {
+		t.Errorf("nodes should be fixed, actual %v", nodes[0].getNodes())
+	}
+}
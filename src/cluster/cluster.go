@@ -1,13 +1,273 @@
 package cluster
 
 import (
-	"myGodis/src/interface/db"
+	"errors"
+	"fmt"
+	"myGodis/src/config"
+	"myGodis/src/datastruct/dict"
+	"myGodis/src/datastruct/lock"
+	DBImpl "myGodis/src/db"
+	"myGodis/src/interface/redis"
 	"myGodis/src/lib/consistenthash"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/reply"
+	"runtime/debug"
+	"strings"
+	"sync"
 )
 
+/*
+ * Cluster routes commands to the node owning the keys, nodes are picked by consistent hash.
+ * Commands of keys owned by self are executed by the embed db.
+ */
+
 type Cluster struct {
-	self       string
-	db         *db.DB
-	peerPicker *consistenthash.Map
-	peers      map[string]*client.Client
+	self string
+	db   *DBImpl.DB
+
+	// guards nodes, peerPicker and peers, they are changed when nodes join or leave
+	mu         sync.RWMutex
+	nodes      []string
+	peerPicker picker
+	peers      map[string]*clientPool // peer addr -> connection pool, self excluded
+	slots      *slotTable             // not nil in slot mode
+	bus        *bus                   // not nil if gossip is started
+
+	// slot mode only, commands hold read lock of slot and keys so that resharding waits for them
+	slotLocks  *lock.Locks
+	keyLocks   *lock.Locks
+	asking     sync.Map // client -> true, clients sent ASKING
+	configFile string   // slot table is saved here
+	migrateCh  chan struct{}
+	closeCh    chan struct{}
+
+	// id -> *Transaction, transactions participated by this node
+	transactions dict.Dict
+}
+
+const (
+	replicas         = 4
+	transactionsSize = 256
+)
+
+var crossSlotErr = reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+
+// MakeCluster makes a cluster node by self, peers and cluster-mode in config, then starts gossip on the bus port
+func MakeCluster() *Cluster {
+	cluster := makeCluster(config.Properties.Self, config.Properties.Peers, config.Properties.ClusterMode,
+		config.Properties.ClusterConfigFile, DBImpl.MakeDB())
+	if err := cluster.startBus(busAddrOf(cluster.self)); err != nil {
+		logger.Error("start cluster bus failed: " + err.Error())
+	}
+	return cluster
+}
+
+// makeCluster makes a cluster node, slot table is loaded from configFile in slot mode if it is not empty
+func makeCluster(self string, peers []string, mode string, configFile string, localDB *DBImpl.DB) *Cluster {
+	cluster := &Cluster{
+		self:         self,
+		db:           localDB,
+		peers:        make(map[string]*clientPool),
+		transactions: dict.MakeConcurrent(transactionsSize),
+		closeCh:      make(chan struct{}),
+	}
+	nodes := []string{self}
+	for _, peer := range peers {
+		peer = strings.TrimSpace(peer)
+		if peer != "" {
+			nodes = append(nodes, peer)
+		}
+	}
+	if mode == slotMode {
+		cluster.initSlots(configFile, nodes)
+	} else {
+		_ = cluster.setNodes(nodes)
+	}
+	return cluster
+}
+
+// errFixedRing is returned when nodes of consistent hash mode are changed. Keys are not migrated in this mode,
+// so keys whose owner changed by the rebuilt ring would be stranded on their old owners
+var errFixedRing = errors.New("nodes can not be changed in consistent hash mode, use slot mode to reshard")
+
+// setNodes updates connection pools and rebuilds the consistent hash ring by nodes,
+// in consistent hash mode the ring is built only once by config
+func (cluster *Cluster) setNodes(nodes []string) error {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if cluster.slots == nil && cluster.peerPicker != nil {
+		if !sameNodes(cluster.nodes, nodes) {
+			return errFixedRing
+		}
+		return nil
+	}
+	alive := make(map[string]bool)
+	cluster.nodes = make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if alive[node] {
+			continue
+		}
+		alive[node] = true
+		cluster.nodes = append(cluster.nodes, node)
+		if _, ok := cluster.peers[node]; !ok && node != cluster.self {
+			cluster.peers[node] = makeClientPool(node)
+		}
+	}
+	for peer, pool := range cluster.peers {
+		if !alive[peer] {
+			pool.close()
+			delete(cluster.peers, peer)
+		}
+	}
+	if cluster.slots != nil {
+		cluster.peerPicker = cluster.slots
+		return nil
+	}
+	ring := consistenthash.New(replicas, nil)
+	ring.Add(cluster.nodes...)
+	cluster.peerPicker = ring
+	return nil
+}
+
+func (cluster *Cluster) getNodes() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	nodes := make([]string, len(cluster.nodes))
+	copy(nodes, cluster.nodes)
+	return nodes
+}
+
+// pickNode returns the node owning key
+func (cluster *Cluster) pickNode(key string) string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.peerPicker.Get(key)
+}
+
+// CmdFunc relays a command line of cmd, args includes command name
+type CmdFunc func(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply
+
+func (cluster *Cluster) Exec(c redis.Client, args [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &reply.UnknownErrReply{}
+		}
+	}()
+
+	cmd := strings.ToLower(string(args[0]))
+	if cluster.slots != nil && cmd != "cluster" && cmd != "asking" {
+		// clients follow MOVED in slot mode, commands are never relayed
+		return redirect(cluster, c, args)
+	}
+	if c != nil && c.InMultiState() && cmd != "exec" {
+		// queued by local db, keys are routed by EXEC
+		return cluster.db.Exec(c, args)
+	}
+	cmdFunc, ok := router[cmd]
+	if !ok {
+		cmdFunc = defaultFunc
+	}
+	return cmdFunc(cluster, c, args)
+}
+
+func (cluster *Cluster) AfterClientClose(c redis.Client) {
+	cluster.asking.Delete(c)
+	cluster.db.AfterClientClose(c)
+}
+
+func (cluster *Cluster) Close() {
+	close(cluster.closeCh)
+	cluster.mu.RLock()
+	bus := cluster.bus
+	cluster.mu.RUnlock()
+	if bus != nil {
+		bus.close()
+	}
+	cluster.db.Close()
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	for _, pool := range cluster.peers {
+		pool.close()
+	}
+}
+
+// relay executes args on peer, peer may be self
+func (cluster *Cluster) relay(peer string, c redis.Client, args [][]byte) redis.Reply {
+	if peer == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+	results, errReply := cluster.relayPipeline(peer, [][][]byte{args})
+	if errReply != nil {
+		return errReply
+	}
+	return results[0]
+}
+
+// relayPipeline sends command lines to peer at once through one connection, peer should not be self
+func (cluster *Cluster) relayPipeline(peer string, cmdLines [][][]byte) ([]redis.Reply, redis.Reply) {
+	cluster.mu.RLock()
+	pool, ok := cluster.peers[peer]
+	bus := cluster.bus
+	cluster.mu.RUnlock()
+	if bus != nil && bus.isFailing(peer) {
+		return nil, reply.MakeErrReply("CLUSTERDOWN node " + peer + " is failing")
+	}
+	if !ok {
+		return nil, reply.MakeErrReply("ERR unknown peer " + peer)
+	}
+	peerClient, err := pool.get()
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR connect to " + peer + " failed: " + err.Error())
+	}
+	defer pool.put(peerClient)
+	return peerClient.SendPipeline(cmdLines), nil
+}
+
+// relayTx sends transaction commands to peer, they are handled by cluster instead of db if peer is self
+func (cluster *Cluster) relayTx(peer string, c redis.Client, args [][]byte) redis.Reply {
+	if peer == cluster.self {
+		return cluster.Exec(c, args)
+	}
+	return cluster.relay(peer, c, args)
+}
+
+// broadcast executes args on all nodes, returns replies by node
+func (cluster *Cluster) broadcast(c redis.Client, args [][]byte) map[string]redis.Reply {
+	result := make(map[string]redis.Reply)
+	for _, node := range cluster.getNodes() {
+		result[node] = cluster.relay(node, c, args)
+	}
+	return result
+}
+
+// groupBy groups keys by the node owning them
+func (cluster *Cluster) groupBy(keys []string) map[string][]string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	result := make(map[string][]string)
+	for _, key := range keys {
+		peer := cluster.peerPicker.Get(key)
+		result[peer] = append(result[peer], key)
+	}
+	return result
+}
+
+// defaultFunc relays command to the node owning its keys, commands without key are executed locally
+func defaultFunc(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	keys, ok := DBImpl.GetRelatedKeys(args)
+	if !ok || len(keys) == 0 {
+		// unknown commands and arity errors are reported by local db
+		return cluster.db.Exec(c, args)
+	}
+	groups := cluster.groupBy(keys)
+	if len(groups) > 1 {
+		return crossSlotErr
+	}
+	peer := cluster.pickNode(keys[0])
+	if peer != cluster.self && DBImpl.IsBlocking(args) {
+		// relayed requests time out while the client is waiting
+		return reply.MakeErrReply("ERR blocking commands on keys of other nodes are not supported")
+	}
+	return cluster.relay(peer, c, args)
 }
@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	DBImpl "myGodis/src/db"
+	"myGodis/src/interface/db"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConn is a minimal redis.Client serving one connection
+type testConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+
+	multiState bool
+	queue      [][][]byte
+	txErrors   []error
+	watching   map[string]uint32
+}
+
+func (c *testConn) Write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *testConn) Close() error                 { return c.conn.Close() }
+func (c *testConn) RemoteAddr() string           { return c.conn.RemoteAddr().String() }
+func (c *testConn) SubsChannel(channel string)   {}
+func (c *testConn) UnSubsChannel(channel string) {}
+func (c *testConn) SubsCount() int               { return 0 }
+func (c *testConn) GetChannels() []string        { return nil }
+func (c *testConn) GetProtocol() int             { return reply.RESP2 }
+func (c *testConn) SetProtocol(protocol int)     {}
+func (c *testConn) InMultiState() bool           { return c.multiState }
+func (c *testConn) GetQueuedCmdLine() [][][]byte { return c.queue }
+func (c *testConn) EnqueueCmd(cmdLine [][]byte)  { c.queue = append(c.queue, cmdLine) }
+func (c *testConn) AddTxError(err error)         { c.txErrors = append(c.txErrors, err) }
+func (c *testConn) GetTxErrors() []error         { return c.txErrors }
+func (c *testConn) Closed() <-chan struct{}      { return nil }
+func (c *testConn) SetMultiState(state bool) {
+	c.multiState = state
+	c.queue = nil
+	c.txErrors = nil
+}
+func (c *testConn) GetWatching() map[string]uint32 {
+	if c.watching == nil {
+		c.watching = make(map[string]uint32)
+	}
+	return c.watching
+}
+
+func serve(listener net.Listener, node db.DB) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			c := &testConn{conn: conn}
+			for payload := range parser.ParseStream(conn) {
+				if payload.Err != nil {
+					_ = conn.Close()
+					continue
+				}
+				cmdLine, ok := payload.Data.(*reply.MultiBulkReply)
+				if !ok {
+					continue
+				}
+				_ = c.Write(node.Exec(c, cmdLine.Args).ToBytes())
+			}
+		}()
+	}
+}
+
+// makeTestCluster starts size nodes on random ports
+func makeTestCluster(t *testing.T, size int) []*Cluster {
+	return makeModeCluster(t, size, hashMode)
+}
+
+func makeModeCluster(t *testing.T, size int, mode string) []*Cluster {
+	listeners := make([]net.Listener, size)
+	addrs := make([]string, size)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		addrs[i] = listener.Addr().String()
+	}
+	nodes := make([]*Cluster, size)
+	for i, listener := range listeners {
+		nodes[i] = makeCluster(addrs[i], addrs, mode, "", DBImpl.MakeDB())
+		go serve(listener, nodes[i])
+		t.Cleanup(func() {
+			_ = listener.Close()
+		})
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	})
+	return nodes
+}
+
+func toArgs(cmd ...string) [][]byte {
+	args := make([][]byte, len(cmd))
+	for i, s := range cmd {
+		args[i] = []byte(s)
+	}
+	return args
+}
+
+func TestRelay(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		nodes[i%3].Exec(nil, toArgs("SET", key, strconv.Itoa(i)))
+	}
+	for i := 0; i < 20; i++ {
+		key := "k" + strconv.Itoa(i)
+		result := nodes[(i+1)%3].Exec(nil, toArgs("GET", key))
+		if string(result.ToBytes()) != string(reply.MakeBulkReply([]byte(strconv.Itoa(i))).ToBytes()) {
+			t.Errorf("expected %d, actual %q", i, result.ToBytes())
+		}
+		// key is stored only on its owner
+		owner := nodes[0].pickNode(key)
+		for _, node := range nodes {
+			local := node.db.Exec(nil, toArgs("EXISTS", key))
+			stored := string(local.ToBytes()) == ":1\r\n"
+			if stored != (node.self == owner) {
+				t.Errorf("key %s should only be stored on %s", key, owner)
+			}
+		}
+	}
+}
+
+func TestFixedRing(t *testing.T) {
+	nodes := makeTestCluster(t, 2)
+	before := nodes[0].getNodes()
+	if err := nodes[0].setNodes(append(before, "127.0.0.1:1")); err != errFixedRing {
+		t.Errorf("expected errFixedRing, actual %v", err)
+	}
+	if err := nodes[0].setNodes(before[:1]); err != errFixedRing {
+		t.Errorf("expected errFixedRing, actual %v", err)
+	}
+	if !sameNodes(nodes[0].getNodes(), before) {
+		t.Errorf("nodes should not be changed, actual %v", nodes[0].getNodes())
+	}
+	if err := nodes[0].setNodes(before); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiKeys(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	args := []string{"MSET"}
+	keys := []string{"MGET"}
+	for i := 0; i < 10; i++ {
+		args = append(args, "k"+strconv.Itoa(i), strconv.Itoa(i))
+		keys = append(keys, "k"+strconv.Itoa(i))
+	}
+	result := nodes[0].Exec(nil, toArgs(args...))
+	if _, ok := result.(*reply.OkReply); !ok {
+		t.Fatalf("mset failed: %q", result.ToBytes())
+	}
+	result = nodes[1].Exec(nil, toArgs(keys...))
+	multiBulk, ok := result.(*reply.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != 10 {
+		t.Fatalf("mget failed: %q", result.ToBytes())
+	}
+	for i, arg := range multiBulk.Args {
+		if string(arg) != strconv.Itoa(i) {
+			t.Errorf("expected %d, actual %s", i, arg)
+		}
+	}
+
+	keys[0] = "DEL"
+	result = nodes[2].Exec(nil, toArgs(keys...))
+	if string(result.ToBytes()) != ":10\r\n" {
+		t.Errorf("expected 10 deleted, actual %q", result.ToBytes())
+	}
+}
+
+func TestEvalRelay(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	for i := 0; i < 10; i++ {
+		key := "k" + strconv.Itoa(i)
+		result := nodes[i%3].Exec(nil, toArgs("EVAL", "return redis.call('incr', KEYS[1])", "1", key))
+		if string(result.ToBytes()) != ":1\r\n" {
+			t.Errorf("%s: expected 1, actual %q", key, result.ToBytes())
+		}
+		// script is executed by the owner of its keys
+		owner := nodes[0].pickNode(key)
+		for _, node := range nodes {
+			stored := string(node.db.Exec(nil, toArgs("EXISTS", key)).ToBytes()) == ":1\r\n"
+			if stored != (node.self == owner) {
+				t.Errorf("key %s should only be stored on %s", key, owner)
+			}
+		}
+	}
+}
+
+func TestBlockingInHashMode(t *testing.T) {
+	nodes := makeTestCluster(t, 2)
+	local := keyOwnedBy(t, nodes[0], nodes[0].self)
+	remote := keyOwnedBy(t, nodes[0], nodes[1].self)
+	assertReply(t, nodes[0].Exec(nil, toArgs("BLPOP", remote, "0")),
+		"-ERR blocking commands on keys of other nodes are not supported\r\n")
+
+	result := make(chan redis.Reply, 1)
+	go func() {
+		result <- nodes[0].Exec(&testConn{}, toArgs("BLPOP", local, "0"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// pushed through the other node
+	nodes[1].Exec(nil, toArgs("RPUSH", local, "a"))
+	select {
+	case actual := <-result:
+		assertReply(t, actual, string(reply.MakeMultiBulkReply([][]byte{[]byte(local), []byte("a")}).ToBytes()))
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is still blocked")
+	}
+}
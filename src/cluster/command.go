@@ -0,0 +1,394 @@
+package cluster
+
+import (
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * CLUSTER command, describes the slot table in the same format as redis cluster
+ */
+
+var slotDisabledErr = reply.MakeErrReply("ERR This instance has slot mode disabled")
+
+// ClusterCmd CLUSTER MEET ip port [bus-port] | FORGET node | NODES | MYID | KEYSLOT key |
+// SLOTS | SHARDS | COUNTKEYSINSLOT slot | GETKEYSINSLOT slot count |
+// SETSLOT slot IMPORTING|MIGRATING|NODE node | SETSLOT slot STABLE | MIGRATESLOTS node start end | RESTOREKEY key payload...
+func ClusterCmd(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return &reply.ArgNumErrReply{Cmd: "cluster"}
+	}
+	subCommand := strings.ToLower(string(args[1]))
+	switch subCommand {
+	case "keyslot":
+		if len(args) != 3 {
+			return &reply.ArgNumErrReply{Cmd: "cluster|keyslot"}
+		}
+		return reply.MakeIntReply(int64(HashSlot(string(args[2]))))
+	case "myid":
+		return reply.MakeBulkReply([]byte(nodeID(cluster.self)))
+	case "nodes":
+		return clusterNodes(cluster)
+	case "meet":
+		return clusterMeet(cluster, args)
+	case "forget":
+		return clusterForget(cluster, args)
+	}
+	if cluster.slots == nil {
+		return slotDisabledErr
+	}
+	switch subCommand {
+	case "slots":
+		return clusterSlots(cluster)
+	case "shards":
+		return clusterShards(cluster)
+	case "countkeysinslot":
+		if len(args) != 3 {
+			return &reply.ArgNumErrReply{Cmd: "cluster|countkeysinslot"}
+		}
+		slot, errReply := parseSlot(args[2])
+		if errReply != nil {
+			return errReply
+		}
+		return reply.MakeIntReply(int64(len(keysInSlot(cluster, slot, -1))))
+	case "getkeysinslot":
+		if len(args) != 4 {
+			return &reply.ArgNumErrReply{Cmd: "cluster|getkeysinslot"}
+		}
+		slot, errReply := parseSlot(args[2])
+		if errReply != nil {
+			return errReply
+		}
+		count, err := strconv.Atoi(string(args[3]))
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR Invalid number of keys")
+		}
+		keys := keysInSlot(cluster, slot, count)
+		result := make([][]byte, len(keys))
+		for i, key := range keys {
+			result[i] = []byte(key)
+		}
+		return reply.MakeMultiBulkReply(result)
+	case "setslot":
+		return clusterSetSlot(cluster, args)
+	case "migrateslots":
+		return clusterMigrateSlots(cluster, args)
+	case "restorekey":
+		return clusterRestoreKey(cluster, args)
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[1]) + "'. Try CLUSTER HELP.")
+	}
+}
+
+func nodeAddrReply(node string) []redis.Reply {
+	host, port := splitAddr(node)
+	return []redis.Reply{
+		reply.MakeBulkReply([]byte(host)),
+		reply.MakeIntReply(int64(port)),
+		reply.MakeBulkReply([]byte(nodeID(node))),
+	}
+}
+
+func parseSlot(arg []byte) (int, redis.Reply) {
+	slot, err := strconv.Atoi(string(arg))
+	if err != nil || slot < 0 || slot >= slotCount {
+		return 0, reply.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// clusterSlots replies [start, end, [host, port, id]] of each slot range
+func clusterSlots(cluster *Cluster) redis.Reply {
+	ranges := cluster.slots.ranges()
+	replies := make([]redis.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		replies = append(replies, reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeIntReply(int64(r.start)),
+			reply.MakeIntReply(int64(r.end)),
+			reply.MakeMultiRawReply(nodeAddrReply(r.node)),
+		}))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func bulkReplies(values ...string) []redis.Reply {
+	replies := make([]redis.Reply, len(values))
+	for i, value := range values {
+		replies[i] = reply.MakeBulkReply([]byte(value))
+	}
+	return replies
+}
+
+// clusterShards replies a map of slots and nodes for each node, every node is a shard without replica
+func clusterShards(cluster *Cluster) redis.Reply {
+	nodes := cluster.slots.getNodes()
+	shards := make([]redis.Reply, 0, len(nodes))
+	for _, node := range nodes {
+		var slots []redis.Reply
+		for _, r := range cluster.slots.rangesOf(node) {
+			slots = append(slots, reply.MakeIntReply(int64(r.start)), reply.MakeIntReply(int64(r.end)))
+		}
+		host, port := splitAddr(node)
+		nodeInfo := reply.MakeMapReply(
+			bulkReplies("id", "port", "ip", "endpoint", "role", "replication-offset", "health"),
+			[]redis.Reply{
+				reply.MakeBulkReply([]byte(nodeID(node))),
+				reply.MakeIntReply(int64(port)),
+				reply.MakeBulkReply([]byte(host)),
+				reply.MakeBulkReply([]byte(host)),
+				reply.MakeBulkReply([]byte("master")),
+				reply.MakeIntReply(0),
+				reply.MakeBulkReply([]byte("online")),
+			},
+		)
+		shards = append(shards, reply.MakeMapReply(
+			bulkReplies("slots", "nodes"),
+			[]redis.Reply{
+				reply.MakeMultiRawReply(slots),
+				reply.MakeMultiRawReply([]redis.Reply{nodeInfo}),
+			},
+		))
+	}
+	return reply.MakeMultiRawReply(shards)
+}
+
+// clusterNodes replies one line for each node:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot-range> ...
+// migrating and importing slots are shown in the line of myself as [slot->-id] and [slot-<-id]
+func clusterNodes(cluster *Cluster) redis.Reply {
+	var builder strings.Builder
+	now := time.Now()
+	for _, node := range cluster.getNodes() {
+		host, port := splitAddr(node)
+		busPort := port + busPortOffset
+		flags := "master"
+		pingSent, pongReceived := int64(0), now
+		linkState := "connected"
+		if node == cluster.self {
+			flags = "myself,master"
+		} else if state, ok := cluster.memberState(node); ok {
+			_, busPort = splitAddr(state.busAddr)
+			if state.fail {
+				flags += ",fail"
+				linkState = "disconnected"
+			} else if state.pfail {
+				flags += ",fail?"
+				linkState = "disconnected"
+			}
+			if !state.pingSent.IsZero() {
+				pingSent = state.pingSent.UnixNano() / 1e6
+			}
+			pongReceived = state.pongReceived
+		}
+		builder.WriteString(nodeID(node) + " " + host + ":" + strconv.Itoa(port) + "@" + strconv.Itoa(busPort) +
+			" " + flags + " - " + strconv.FormatInt(pingSent, 10) + " " +
+			strconv.FormatInt(pongReceived.UnixNano()/1e6, 10) + " 0 " + linkState)
+		if cluster.slots != nil {
+			for _, r := range cluster.slots.rangesOf(node) {
+				builder.WriteString(" " + strconv.Itoa(r.start))
+				if r.end != r.start {
+					builder.WriteString("-" + strconv.Itoa(r.end))
+				}
+			}
+			if node == cluster.self {
+				builder.WriteString(migrationStates(cluster))
+			}
+		}
+		builder.WriteString("\n")
+	}
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+func migrationStates(cluster *Cluster) string {
+	cluster.slots.mu.RLock()
+	defer cluster.slots.mu.RUnlock()
+	var builder strings.Builder
+	for slot, target := range cluster.slots.migrating {
+		builder.WriteString(" [" + strconv.Itoa(slot) + "->-" + nodeID(target) + "]")
+	}
+	for slot, source := range cluster.slots.importing {
+		builder.WriteString(" [" + strconv.Itoa(slot) + "-<-" + nodeID(source) + "]")
+	}
+	return builder.String()
+}
+
+// keysInSlot returns at most count keys of slot, count < 0 means no limit
+func keysInSlot(cluster *Cluster, slot int, count int) []string {
+	var keys []string
+	now := time.Now()
+	cluster.db.Data.ForEach(func(key string, val interface{}) bool {
+		if count >= 0 && len(keys) >= count {
+			return false
+		}
+		if HashSlot(key) != slot {
+			return true
+		}
+		if raw, ok := cluster.db.TTLMap.Get(key); ok {
+			if expireTime, _ := raw.(time.Time); now.After(expireTime) {
+				return true
+			}
+		}
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// clusterSetSlot CLUSTER SETSLOT slot IMPORTING|MIGRATING|NODE node, CLUSTER SETSLOT slot STABLE
+func clusterSetSlot(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|setslot"}
+	}
+	slot, errReply := parseSlot(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	action := strings.ToLower(string(args[3]))
+	if action == "stable" {
+		cluster.slots.setStable(slot)
+		cluster.saveSlots()
+		return &reply.OkReply{}
+	}
+	if len(args) != 5 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|setslot"}
+	}
+	node, ok := cluster.slots.findNode(string(args[4]))
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + string(args[4]))
+	}
+	switch action {
+	case "migrating":
+		return cluster.setSlotMigrating(slot, node)
+	case "importing":
+		if owner := cluster.slots.getNodeBySlot(slot); owner == cluster.self {
+			return reply.MakeErrReply("ERR I'm already the owner of hash slot " + string(args[2]))
+		}
+		cluster.slots.setImporting(slot, node)
+	case "node":
+		slotLock := strconv.Itoa(slot)
+		cluster.slotLocks.Lock(slotLock)
+		cluster.slots.setOwner(slot, node)
+		cluster.slotLocks.UnLock(slotLock)
+	default:
+		return &reply.SyntaxErrReply{}
+	}
+	cluster.saveSlots()
+	return &reply.OkReply{}
+}
+
+// clusterMigrateSlots moves slots in [start, end] owned by self to node, CLUSTER MIGRATESLOTS node start end
+func clusterMigrateSlots(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 5 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|migrateslots"}
+	}
+	node, ok := cluster.slots.findNode(string(args[2]))
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	start, errReply := parseSlot(args[3])
+	if errReply != nil {
+		return errReply
+	}
+	end, errReply := parseSlot(args[4])
+	if errReply != nil {
+		return errReply
+	}
+	migrating := 0
+	for slot := start; slot <= end; slot++ {
+		if cluster.slots.getNodeBySlot(slot) != cluster.self {
+			continue
+		}
+		result := cluster.setSlotMigrating(slot, node)
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			return errReply
+		}
+		migrating++
+	}
+	return reply.MakeIntReply(int64(migrating))
+}
+
+// clusterRestoreKey replaces key by the command lines in payload, it is sent by the node migrating slot of key
+func clusterRestoreKey(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|restorekey"}
+	}
+	key := string(args[2])
+	owner, _, importingFrom := cluster.slots.getState(HashSlot(key))
+	if owner != cluster.self && importingFrom == "" {
+		return reply.MakeErrReply("ERR slot of " + key + " is not importing")
+	}
+	cmdLines, err := decodePayload(args[3:])
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	cluster.db.Lock(key)
+	defer cluster.db.UnLock(key)
+	if err := cluster.db.RestoreKey(key, cmdLines); err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return &reply.OkReply{}
+}
+
+// clusterMeet adds node into cluster, CLUSTER MEET ip port [bus-port]
+func clusterMeet(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 4 && len(args) != 5 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|meet"}
+	}
+	bus := cluster.getBus()
+	if bus == nil {
+		return reply.MakeErrReply("ERR cluster bus is not started")
+	}
+	if cluster.slots == nil {
+		return reply.MakeErrReply("ERR " + errFixedRing.Error())
+	}
+	port, err := strconv.Atoi(string(args[3]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid TCP base port specified: " + string(args[3]))
+	}
+	busPort := port + busPortOffset
+	if len(args) == 5 {
+		busPort, err = strconv.Atoi(string(args[4]))
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			return reply.MakeErrReply("ERR Invalid TCP bus port specified: " + string(args[4]))
+		}
+	}
+	host := string(args[2])
+	node := host + ":" + strconv.Itoa(port)
+	if err := bus.meet(node, host+":"+strconv.Itoa(busPort)); err != nil {
+		return reply.MakeErrReply("ERR meet " + node + " failed: " + err.Error())
+	}
+	return &reply.OkReply{}
+}
+
+// clusterForget removes node from the whole cluster, CLUSTER FORGET node
+func clusterForget(cluster *Cluster, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return &reply.ArgNumErrReply{Cmd: "cluster|forget"}
+	}
+	bus := cluster.getBus()
+	if bus == nil {
+		return reply.MakeErrReply("ERR cluster bus is not started")
+	}
+	if cluster.slots == nil {
+		return reply.MakeErrReply("ERR " + errFixedRing.Error())
+	}
+	var node string
+	for _, n := range cluster.getNodes() {
+		if n == string(args[2]) || nodeID(n) == string(args[2]) {
+			node = n
+		}
+	}
+	if node == "" {
+		return reply.MakeErrReply("ERR Unknown node " + string(args[2]))
+	} else if node == cluster.self {
+		return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	if cluster.slots != nil && len(cluster.slots.rangesOf(node)) > 0 {
+		return reply.MakeErrReply("ERR node " + node + " still owns slots, migrate them first")
+	}
+	bus.forget(node, true)
+	return &reply.OkReply{}
+}
@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"errors"
+	"myGodis/src/datastruct/lock"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"time"
+)
+
+/*
+ * Online resharding of slot mode. The source node marks a slot MIGRATING and the target IMPORTING,
+ * then keys of the slot are moved one by one: the source dumps a key as command lines, the target restores it
+ * and the source deletes it. Commands of keys already moved get ASK, so that clients retry on the target.
+ * At last the slot is handed over to the target and other nodes are told to send MOVED to the target.
+ * States are saved in cluster-config-file, migration continues after restart.
+ * Consistent hash mode has no migration, its ring is fixed by config and never rebuilt.
+ */
+
+const (
+	slotLockSize   = 1024
+	keyLockSize    = 1024
+	migrateRetryIn = time.Second
+)
+
+// initSlots loads slot table from configFile or divides slots equally between nodes if it not exists,
+// then continues migrating
+func (cluster *Cluster) initSlots(configFile string, nodes []string) {
+	cluster.configFile = configFile
+	cluster.slotLocks = lock.Make(slotLockSize)
+	cluster.keyLocks = lock.Make(keyLockSize)
+	cluster.migrateCh = make(chan struct{}, 1)
+
+	var table *slotTable
+	if configFile != "" {
+		var err error
+		table, err = loadSlotTable(configFile)
+		if err != nil {
+			logger.Error("load " + configFile + " failed: " + err.Error())
+		}
+	}
+	if table == nil {
+		table = makeSlotTable(nodes)
+	}
+	// nodes in config have no slot until resharding
+	for _, node := range nodes {
+		table.addNode(node)
+	}
+	cluster.slots = table
+	_ = cluster.setNodes(table.getNodes())
+	cluster.saveSlots()
+
+	go cluster.migrateWorker()
+	cluster.kickMigration()
+}
+
+func (cluster *Cluster) saveSlots() {
+	if cluster.configFile == "" {
+		return
+	}
+	if err := cluster.slots.save(cluster.configFile); err != nil {
+		logger.Warn("save " + cluster.configFile + " failed: " + err.Error())
+	}
+}
+
+// kickMigration wakes up migrateWorker if it is idle
+func (cluster *Cluster) kickMigration() {
+	select {
+	case cluster.migrateCh <- struct{}{}:
+	default:
+	}
+}
+
+func (cluster *Cluster) migrateWorker() {
+	for {
+		select {
+		case <-cluster.migrateCh:
+		case <-cluster.closeCh:
+			return
+		}
+		if !cluster.migrateSlots() {
+			// retry later
+			time.AfterFunc(migrateRetryIn, cluster.kickMigration)
+		}
+	}
+}
+
+// migrateSlots moves all migrating slots to their targets, returns false if some slots failed
+func (cluster *Cluster) migrateSlots() bool {
+	slots := cluster.slots.migratingSlots()
+	if len(slots) == 0 {
+		return true
+	}
+	keysOfSlot := cluster.keysOfSlots(slots)
+	ok := true
+	for slot, target := range slots {
+		err := cluster.migrateSlot(slot, target, keysOfSlot[slot])
+		if err != nil {
+			logger.Warn("migrate slot " + strconv.Itoa(slot) + " to " + target + " failed: " + err.Error())
+			ok = false
+		}
+	}
+	return ok
+}
+
+// keysOfSlots scans local keys of the given slots
+func (cluster *Cluster) keysOfSlots(slots map[int]string) map[int][]string {
+	result := make(map[int][]string)
+	cluster.db.Data.ForEach(func(key string, val interface{}) bool {
+		slot := HashSlot(key)
+		if _, ok := slots[slot]; ok {
+			result[slot] = append(result[slot], key)
+		}
+		return true
+	})
+	return result
+}
+
+func (cluster *Cluster) migrateSlot(slot int, target string, keys []string) error {
+	for _, key := range keys {
+		if err := cluster.migrateKey(key, target); err != nil {
+			return err
+		}
+	}
+	// no new keys are created in a migrating slot, since commands of absent keys are redirected by ASK
+	slotLock := strconv.Itoa(slot)
+	cluster.slotLocks.Lock(slotLock)
+	defer cluster.slotLocks.UnLock(slotLock)
+	if _, migratingTo, _ := cluster.slots.getState(slot); migratingTo != target {
+		return errors.New("migration is cancelled")
+	}
+	result := cluster.relay(target, nil, makeArgs("CLUSTER", "SETSLOT", slotLock, "NODE", target))
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		return errReply
+	}
+	cluster.slots.setOwner(slot, target)
+	cluster.saveSlots()
+	for _, node := range cluster.slots.getNodes() {
+		if node == cluster.self || node == target {
+			continue
+		}
+		result := cluster.relay(node, nil, makeArgs("CLUSTER", "SETSLOT", slotLock, "NODE", target))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			// the node will be redirected by MOVED from self
+			logger.Warn("notify " + node + " failed: " + errReply.Error())
+		}
+	}
+	return nil
+}
+
+// migrateKey restores key on target then removes it locally
+func (cluster *Cluster) migrateKey(key string, target string) error {
+	cluster.keyLocks.Lock(key)
+	defer cluster.keyLocks.UnLock(key)
+	cluster.db.Lock(key)
+	defer cluster.db.UnLock(key)
+
+	cmdLines, err := cluster.db.DumpKey(key)
+	if err != nil {
+		return err
+	}
+	if cmdLines == nil {
+		return nil // expired or deleted
+	}
+	args := append(makeArgs("CLUSTER", "RESTOREKEY", key), encodePayload(cmdLines)...)
+	result := cluster.relay(target, nil, args)
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		return errReply
+	}
+	cluster.db.Remove(key)
+	cluster.db.AddAof(makeArgs("DEL", key))
+	return nil
+}
+
+// setSlotMigrating asks target to import slot, then starts moving keys
+func (cluster *Cluster) setSlotMigrating(slot int, target string) redis.Reply {
+	slotLock := strconv.Itoa(slot)
+	cluster.slotLocks.Lock(slotLock)
+	defer cluster.slotLocks.UnLock(slotLock)
+	owner, _, _ := cluster.slots.getState(slot)
+	if owner != cluster.self {
+		return reply.MakeErrReply("ERR I'm not the owner of hash slot " + slotLock)
+	}
+	if target == cluster.self {
+		return reply.MakeErrReply("ERR I'm already the owner of hash slot " + slotLock)
+	}
+	result := cluster.relay(target, nil, makeArgs("CLUSTER", "SETSLOT", slotLock, "IMPORTING", cluster.self))
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		return errReply
+	}
+	cluster.slots.setMigrating(slot, target)
+	cluster.saveSlots()
+	cluster.kickMigration()
+	return &reply.OkReply{}
+}
@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	DBImpl "myGodis/src/db"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+)
+
+/*
+ * In consistent hash mode MULTI and queued commands are handled by the local db of the node connected by client.
+ * EXEC executes the transaction on the node owning all its keys, locally or relayed to the peer
+ * as MULTI, queued commands and EXEC in one pipeline. Transactions whose keys are owned by several nodes are discarded.
+ * WATCH is supported for keys owned by self only, so transactions with watched keys are always executed locally.
+ */
+
+// Watch watches keys owned by self, WATCH key [key ...]
+func Watch(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	for _, arg := range args[1:] {
+		if cluster.pickNode(string(arg)) != cluster.self {
+			return reply.MakeErrReply("ERR WATCH keys owned by other nodes is not supported")
+		}
+	}
+	return cluster.db.Exec(c, args)
+}
+
+// ExecMulti executes queued commands on the node owning their keys, EXEC
+func ExecMulti(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if c == nil || !c.InMultiState() || len(c.GetTxErrors()) > 0 {
+		// errors and EXECABORT are replied by local db
+		return cluster.db.Exec(c, args)
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	var keys []string
+	for key := range c.GetWatching() {
+		keys = append(keys, key)
+	}
+	for _, cmdLine := range cmdLines {
+		cmdKeys, _ := DBImpl.GetRelatedKeys(cmdLine)
+		keys = append(keys, cmdKeys...)
+	}
+	groups := cluster.groupBy(keys)
+	if len(groups) > 1 {
+		cluster.db.Exec(c, makeArgs("DISCARD"))
+		return crossSlotErr
+	}
+	peer := cluster.self
+	for node := range groups {
+		peer = node
+	}
+	if peer == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+
+	// no watched keys here, since they are owned by self
+	cluster.db.Exec(c, makeArgs("DISCARD"))
+	pipeline := make([][][]byte, 0, len(cmdLines)+2)
+	pipeline = append(pipeline, makeArgs("MULTI"))
+	pipeline = append(pipeline, cmdLines...)
+	pipeline = append(pipeline, args)
+	results, errReply := cluster.relayPipeline(peer, pipeline)
+	if errReply != nil {
+		return errReply
+	}
+	return results[len(results)-1]
+}
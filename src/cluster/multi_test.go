@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func assertExec(t *testing.T, node *Cluster, c *testConn, args []string, expected string) {
+	t.Helper()
+	result := string(node.Exec(c, toArgs(args...)).ToBytes())
+	if result != expected {
+		t.Errorf("%v: expected %q, actual %q", args, expected, result)
+	}
+}
+
+// keyOwnedBy returns a key owned by node
+func keyOwnedBy(t *testing.T, cluster *Cluster, node string) string {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		key := "k" + strconv.Itoa(i)
+		if cluster.pickNode(key) == node {
+			return key
+		}
+	}
+	t.Fatal("no key owned by " + node)
+	return ""
+}
+
+func TestMulti(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	local := keyOwnedBy(t, nodes[0], nodes[0].self)
+	remote := keyOwnedBy(t, nodes[0], nodes[1].self)
+	c := &testConn{}
+
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"set", local, "1"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"incr", local}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "*2\r\n+OK\r\n:2\r\n")
+
+	// relayed to the owner
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"set", remote, "a"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"get", remote}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "*2\r\n+OK\r\n$1\r\na\r\n")
+	if result := string(nodes[1].db.Exec(nil, toArgs("get", remote)).ToBytes()); result != "$1\r\na\r\n" {
+		t.Errorf("%s should be stored by its owner, actual %q", remote, result)
+	}
+
+	// keys of several nodes
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"set", local, "x"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"set", remote, "y"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "-ERR EXEC without MULTI\r\n")
+	assertExec(t, nodes[0], c, []string{"get", local}, "$1\r\n2\r\n")
+
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"nosuchcommand"}, "-ERR unknown command 'nosuchcommand'\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+
+	// watch
+	assertExec(t, nodes[0], c, []string{"watch", remote}, "-ERR WATCH keys owned by other nodes is not supported\r\n")
+	assertExec(t, nodes[0], c, []string{"watch", local}, "+OK\r\n")
+	nodes[2].Exec(nil, toArgs("set", local, "changed"))
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"set", local, "v"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "*-1\r\n")
+	assertExec(t, nodes[0], c, []string{"get", local}, "$7\r\nchanged\r\n")
+
+	assertExec(t, nodes[0], c, []string{"watch", local}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"multi"}, "+OK\r\n")
+	assertExec(t, nodes[0], c, []string{"set", remote, "v"}, "+QUEUED\r\n")
+	assertExec(t, nodes[0], c, []string{"exec"}, "-CROSSSLOT Keys in request don't hash to the same slot\r\n")
+}
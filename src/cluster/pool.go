@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"errors"
+	"myGodis/src/redis/client"
+	"sync"
+)
+
+const maxIdle = 16
+
+// clientPool keeps idle connections to one peer
+type clientPool struct {
+	addr  string
+	idles chan *client.Client
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func makeClientPool(addr string) *clientPool {
+	return &clientPool{
+		addr:  addr,
+		idles: make(chan *client.Client, maxIdle),
+	}
+}
+
+func (pool *clientPool) get() (*client.Client, error) {
+	select {
+	case c, ok := <-pool.idles:
+		if ok {
+			return c, nil
+		}
+	default:
+	}
+	pool.mu.Lock()
+	closed := pool.closed
+	pool.mu.Unlock()
+	if closed {
+		return nil, errors.New("pool closed")
+	}
+	c, err := client.MakeClient(pool.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Start()
+	return c, nil
+}
+
+// put returns c to pool, c will be closed if the pool is full or closed
+func (pool *clientPool) put(c *client.Client) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		c.Close()
+		return
+	}
+	select {
+	case pool.idles <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (pool *clientPool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.idles)
+	for c := range pool.idles {
+		c.Close()
+	}
+}
@@ -0,0 +1,223 @@
+package cluster
+
+import (
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+)
+
+// commands need special relay, other commands are relayed by defaultFunc
+var router map[string]CmdFunc
+
+func init() {
+	// initialized in init() since transactions are executed through router
+	router = makeRouter()
+}
+
+func makeRouter() map[string]CmdFunc {
+	routerMap := make(map[string]CmdFunc)
+
+	routerMap["del"] = Del
+	routerMap["rename"] = Rename
+	routerMap["mget"] = MGet
+	routerMap["mset"] = MSet
+	routerMap["msetnx"] = MSetNX
+
+	routerMap["cluster"] = ClusterCmd
+	routerMap["asking"] = Asking
+
+	routerMap["prepare"] = Prepare
+	routerMap["commit"] = Commit
+	routerMap["rollback"] = Rollback
+
+	routerMap["flushdb"] = FlushDB
+	routerMap["flushall"] = FlushAll
+
+	// transactions are queued locally then executed by the node owning their keys
+	routerMap["exec"] = ExecMulti
+	routerMap["watch"] = Watch
+
+	return routerMap
+}
+
+// Del deletes keys of several nodes in a transaction
+func Del(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return &reply.ArgNumErrReply{Cmd: "del"}
+	}
+	keys := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		keys[i-1] = string(args[i])
+	}
+	groups := cluster.groupBy(keys)
+	if len(groups) == 1 {
+		for peer := range groups {
+			return cluster.relay(peer, c, args)
+		}
+	}
+
+	co := cluster.startTx(c)
+	for _, peer := range sortedPeers(groups) {
+		result := co.prepare(peer, makeArgs("DEL", groups[peer]...))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			co.rollback()
+			return errReply
+		}
+	}
+	results, errReply := co.commit()
+	if errReply != nil {
+		return errReply
+	}
+	var deleted int64
+	for _, result := range results {
+		if intReply, ok := result.(*reply.IntReply); ok {
+			deleted += intReply.Code
+		}
+	}
+	return reply.MakeIntReply(deleted)
+}
+
+// Rename moves src to the node owning dest in a transaction
+func Rename(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return &reply.ArgNumErrReply{Cmd: "rename"}
+	}
+	src := string(args[1])
+	dest := string(args[2])
+	srcPeer := cluster.pickNode(src)
+	destPeer := cluster.pickNode(dest)
+	if srcPeer == destPeer {
+		return cluster.relay(srcPeer, c, args)
+	}
+
+	co := cluster.startTx(c)
+	result := co.prepare(srcPeer, makeArgs("RENAMEFROM", src, dest))
+	payload, ok := result.(*reply.MultiBulkReply)
+	if !ok {
+		co.rollback()
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			return errReply
+		}
+		return reply.MakeErrReply("ERR unexpected reply from " + srcPeer)
+	}
+	renameTo := make([][]byte, 0, len(payload.Args)+2)
+	renameTo = append(renameTo, []byte("RENAMETO"), args[2])
+	renameTo = append(renameTo, payload.Args...)
+	result = co.prepare(destPeer, renameTo)
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		co.rollback()
+		return errReply
+	}
+	if _, errReply := co.commit(); errReply != nil {
+		return errReply
+	}
+	return &reply.OkReply{}
+}
+
+// MGet splits keys by node then merges values in the order of keys
+func MGet(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return &reply.ArgNumErrReply{Cmd: "mget"}
+	}
+	keys := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		keys[i-1] = string(args[i])
+	}
+	values := make(map[string][]byte)
+	for peer, group := range cluster.groupBy(keys) {
+		result := cluster.relay(peer, c, makeArgs("MGET", group...))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			return errReply
+		}
+		multiBulk, ok := result.(*reply.MultiBulkReply)
+		if !ok || len(multiBulk.Args) != len(group) {
+			return reply.MakeErrReply("ERR unexpected reply from " + peer)
+		}
+		for i, key := range group {
+			values[key] = multiBulk.Args[i]
+		}
+	}
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = values[key]
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// MSet sets key-value pairs of several nodes in a transaction
+func MSet(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	return mSet(cluster, c, args, "mset")
+}
+
+// MSetNX sets key-value pairs of several nodes in a transaction only if none of the keys exists
+func MSetNX(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	return mSet(cluster, c, args, "msetnx")
+}
+
+func mSet(cluster *Cluster, c redis.Client, args [][]byte, cmd string) redis.Reply {
+	argCount := len(args) - 1
+	if argCount == 0 || argCount%2 != 0 {
+		return &reply.ArgNumErrReply{Cmd: cmd}
+	}
+	size := argCount / 2
+	keys := make([]string, size)
+	valueMap := make(map[string]string)
+	for i := 0; i < size; i++ {
+		keys[i] = string(args[2*i+1])
+		valueMap[keys[i]] = string(args[2*i+2])
+	}
+	groups := cluster.groupBy(keys)
+	if len(groups) == 1 {
+		for peer := range groups {
+			return cluster.relay(peer, c, args)
+		}
+	}
+
+	co := cluster.startTx(c)
+	for _, peer := range sortedPeers(groups) {
+		peerArgs := make([]string, 0, len(groups[peer])*2)
+		for _, key := range groups[peer] {
+			peerArgs = append(peerArgs, key, valueMap[key])
+		}
+		result := co.prepare(peer, makeArgs(cmd, peerArgs...))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			co.rollback()
+			return errReply
+		}
+		if cmd == "msetnx" {
+			if intReply, ok := result.(*reply.IntReply); !ok || intReply.Code != 1 {
+				// some keys exist
+				co.rollback()
+				return reply.MakeIntReply(0)
+			}
+		}
+	}
+	if _, errReply := co.commit(); errReply != nil {
+		return errReply
+	}
+	if cmd == "msetnx" {
+		return reply.MakeIntReply(1)
+	}
+	return &reply.OkReply{}
+}
+
+func FlushDB(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	for _, result := range cluster.broadcast(c, args) {
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			return errReply
+		}
+	}
+	return &reply.OkReply{}
+}
+
+func FlushAll(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	return FlushDB(cluster, c, args)
+}
+
+func makeArgs(cmd string, args ...string) [][]byte {
+	result := make([][]byte, len(args)+1)
+	result[0] = []byte(cmd)
+	for i, arg := range args {
+		result[i+1] = []byte(arg)
+	}
+	return result
+}
@@ -0,0 +1,410 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	DBImpl "myGodis/src/db"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/crc16"
+	"myGodis/src/redis/reply"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * Slot mode is compatible with redis cluster: keys are sharded by CRC16 into 16384 slots,
+ * slots are divided equally between nodes sorted by address.
+ * Nodes reply MOVED for keys of other nodes instead of relaying them, so cluster clients could follow.
+ */
+
+const (
+	slotCount = 16384
+
+	hashMode = "hash"
+	slotMode = "slot"
+)
+
+// picker returns the node owning key
+type picker interface {
+	Get(key string) string
+}
+
+// slotRange is a range of slots [start, end] owned by node
+type slotRange struct {
+	start int
+	end   int
+	node  string
+}
+
+// slotTable records the owner of each slot and slots being migrated, it could be changed by resharding
+type slotTable struct {
+	mu        sync.RWMutex
+	owners    []string       // slot -> node
+	nodes     []string       // sorted
+	migrating map[int]string // slot -> target node, slots moving out of self
+	importing map[int]string // slot -> source node, slots moving into self
+}
+
+// makeSlotTable divides slots equally between nodes sorted by address
+func makeSlotTable(nodes []string) *slotTable {
+	table := &slotTable{
+		owners:    make([]string, slotCount),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+	for _, node := range nodes {
+		table.addNode(node)
+	}
+	for i, node := range table.nodes {
+		for slot := i * slotCount / len(table.nodes); slot < (i+1)*slotCount/len(table.nodes); slot++ {
+			table.owners[slot] = node
+		}
+	}
+	return table
+}
+
+// HashSlot returns the slot of key, only the hash tag is hashed if key contains one, eg. {user1000}.following
+func HashSlot(key string) int {
+	if begin := strings.IndexByte(key, '{'); begin >= 0 {
+		if end := strings.IndexByte(key[begin+1:], '}'); end > 0 {
+			key = key[begin+1 : begin+1+end]
+		}
+	}
+	return int(crc16.Checksum([]byte(key))) % slotCount
+}
+
+// addNode adds a node without slots
+func (table *slotTable) addNode(node string) {
+	i := sort.SearchStrings(table.nodes, node)
+	if i < len(table.nodes) && table.nodes[i] == node {
+		return
+	}
+	table.nodes = append(table.nodes, "")
+	copy(table.nodes[i+1:], table.nodes[i:])
+	table.nodes[i] = node
+}
+
+func (table *slotTable) addNodes(nodes ...string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, node := range nodes {
+		table.addNode(node)
+	}
+}
+
+// removeNode removes a node without slots, returns false if it owns slots
+func (table *slotTable) removeNode(node string) bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, owner := range table.owners {
+		if owner == node {
+			return false
+		}
+	}
+	i := sort.SearchStrings(table.nodes, node)
+	if i < len(table.nodes) && table.nodes[i] == node {
+		table.nodes = append(table.nodes[:i], table.nodes[i+1:]...)
+	}
+	return true
+}
+
+func (table *slotTable) getNodeBySlot(slot int) string {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.owners[slot]
+}
+
+func (table *slotTable) Get(key string) string {
+	return table.getNodeBySlot(HashSlot(key))
+}
+
+// getState returns owner of slot and the peer it is migrating to or importing from
+func (table *slotTable) getState(slot int) (owner string, migratingTo string, importingFrom string) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.owners[slot], table.migrating[slot], table.importing[slot]
+}
+
+func (table *slotTable) getNodes() []string {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	nodes := make([]string, len(table.nodes))
+	copy(nodes, table.nodes)
+	return nodes
+}
+
+// ranges returns continuous slot ranges sorted by start
+func (table *slotTable) ranges() []*slotRange {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	var ranges []*slotRange
+	for slot, node := range table.owners {
+		if node == "" {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := ranges[len(ranges)-1]
+			if last.node == node && last.end == slot-1 {
+				last.end = slot
+				continue
+			}
+		}
+		ranges = append(ranges, &slotRange{start: slot, end: slot, node: node})
+	}
+	return ranges
+}
+
+// rangesOf returns slot ranges owned by node
+func (table *slotTable) rangesOf(node string) []*slotRange {
+	var ranges []*slotRange
+	for _, r := range table.ranges() {
+		if r.node == node {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// setOwner hands slot over to node and clears its migrating or importing state
+func (table *slotTable) setOwner(slot int, node string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.addNode(node)
+	table.owners[slot] = node
+	delete(table.migrating, slot)
+	delete(table.importing, slot)
+}
+
+func (table *slotTable) setMigrating(slot int, target string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.migrating[slot] = target
+}
+
+func (table *slotTable) setImporting(slot int, source string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.importing[slot] = source
+}
+
+func (table *slotTable) setStable(slot int) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	delete(table.migrating, slot)
+	delete(table.importing, slot)
+}
+
+// migratingSlots returns a copy of migrating slots
+func (table *slotTable) migratingSlots() map[int]string {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	result := make(map[int]string, len(table.migrating))
+	for slot, target := range table.migrating {
+		result[slot] = target
+	}
+	return result
+}
+
+// findNode finds node by its address or id
+func (table *slotTable) findNode(name string) (string, bool) {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	for _, node := range table.nodes {
+		if node == name || nodeID(node) == name {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+/*
+ * Slot table is saved in cluster-config-file, so that resharding survives restarts:
+ *   node <addr> <start>-<end> ...
+ *   migrating <slot> <addr>
+ *   importing <slot> <addr>
+ */
+
+func (table *slotTable) save(filename string) error {
+	table.mu.RLock()
+	var buf bytes.Buffer
+	for _, node := range table.nodes {
+		buf.WriteString("node " + node)
+		for slot := 0; slot < slotCount; slot++ {
+			if table.owners[slot] != node {
+				continue
+			}
+			end := slot
+			for end+1 < slotCount && table.owners[end+1] == node {
+				end++
+			}
+			buf.WriteString(" " + strconv.Itoa(slot) + "-" + strconv.Itoa(end))
+			slot = end
+		}
+		buf.WriteString("\n")
+	}
+	for slot, target := range table.migrating {
+		buf.WriteString("migrating " + strconv.Itoa(slot) + " " + target + "\n")
+	}
+	for slot, source := range table.importing {
+		buf.WriteString("importing " + strconv.Itoa(slot) + " " + source + "\n")
+	}
+	table.mu.RUnlock()
+
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// loadSlotTable reads slot table from file, returns nil if file not exists
+func loadSlotTable(filename string) (*slotTable, error) {
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	table := &slotTable{
+		owners:    make([]string, slotCount),
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "node":
+			table.addNode(fields[1])
+			for _, field := range fields[2:] {
+				bounds := strings.SplitN(field, "-", 2)
+				start, err1 := strconv.Atoi(bounds[0])
+				end, err2 := strconv.Atoi(bounds[len(bounds)-1])
+				if err1 != nil || err2 != nil || start < 0 || end >= slotCount || start > end {
+					return nil, errors.New("illegal slot range: " + field)
+				}
+				for slot := start; slot <= end; slot++ {
+					table.owners[slot] = fields[1]
+				}
+			}
+		case "migrating", "importing":
+			slot, err := strconv.Atoi(fields[1])
+			if err != nil || slot < 0 || slot >= slotCount || len(fields) != 3 {
+				return nil, errors.New("illegal line: " + line)
+			}
+			if fields[0] == "migrating" {
+				table.migrating[slot] = fields[2]
+			} else {
+				table.importing[slot] = fields[2]
+			}
+		default:
+			return nil, errors.New("illegal line: " + line)
+		}
+	}
+	return table, nil
+}
+
+// nodeID returns a 40 characters id of node like redis cluster
+func nodeID(node string) string {
+	sum := sha1.Sum([]byte(node))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitAddr(node string) (string, int) {
+	i := strings.LastIndexByte(node, ':')
+	if i < 0 {
+		return node, 0
+	}
+	port, _ := strconv.Atoi(node[i+1:])
+	return node[:i], port
+}
+
+// redirect executes commands of keys owned by self, replies MOVED for others.
+// While slot is migrating, commands of keys already moved are redirected by ASK
+func redirect(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	asking := cluster.takeAsking(c)
+	keys, ok := DBImpl.GetRelatedKeys(args)
+	if !ok || len(keys) == 0 {
+		return cluster.db.Exec(c, args)
+	}
+	slot := HashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if HashSlot(key) != slot {
+			return crossSlotErr
+		}
+	}
+	if DBImpl.IsBlocking(args) && (c == nil || !c.InMultiState()) {
+		// slot is locked while trying only, waiting clients don't stall resharding
+		return cluster.db.ExecBlocking(c, args, func(args [][]byte) redis.Reply {
+			return cluster.execOnSlot(slot, keys, asking, func() redis.Reply {
+				return cluster.db.TryBlocking(args)
+			})
+		})
+	}
+	return cluster.execOnSlot(slot, keys, asking, func() redis.Reply {
+		return cluster.db.Exec(c, args)
+	})
+}
+
+// execOnSlot calls exec if keys of slot can be accessed on self, otherwise replies MOVED, ASK or TRYAGAIN
+func (cluster *Cluster) execOnSlot(slot int, keys []string, asking bool, exec func() redis.Reply) redis.Reply {
+	// prevent slot state changing during executing
+	slotLock := strconv.Itoa(slot)
+	cluster.slotLocks.RLock(slotLock)
+	defer cluster.slotLocks.RUnlock(slotLock)
+
+	owner, migratingTo, importingFrom := cluster.slots.getState(slot)
+	if owner == cluster.self {
+		if migratingTo == "" {
+			return exec()
+		}
+		// prevent keys being moved during executing
+		cluster.keyLocks.RLocks(keys...)
+		defer cluster.keyLocks.RUnlocks(keys...)
+		existed := 0
+		for _, key := range keys {
+			if _, ok := cluster.db.Get(key); ok {
+				existed++
+			}
+		}
+		if existed == len(keys) {
+			return exec()
+		} else if existed > 0 {
+			return tryAgainErr
+		}
+		return reply.MakeErrReply("ASK " + slotLock + " " + migratingTo)
+	}
+	if importingFrom != "" && asking {
+		return exec()
+	}
+	return reply.MakeErrReply("MOVED " + slotLock + " " + owner)
+}
+
+var tryAgainErr = reply.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+
+// Asking allows the next command of client executing on importing slots, ASKING
+func Asking(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return &reply.ArgNumErrReply{Cmd: "asking"}
+	}
+	if c != nil {
+		cluster.asking.Store(c, true)
+	}
+	return &reply.OkReply{}
+}
+
+// takeAsking returns whether client sent ASKING just now, the flag is only valid for one command
+func (cluster *Cluster) takeAsking(c redis.Client) bool {
+	if c == nil {
+		return false
+	}
+	_, asking := cluster.asking.LoadAndDelete(c)
+	return asking
+}
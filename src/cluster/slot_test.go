@@ -0,0 +1,234 @@
+package cluster
+
+import (
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashSlot(t *testing.T) {
+	cases := map[string]int{
+		"foo":                  12182,
+		"123456789":            12739,
+		"{user1000}.following": HashSlot("user1000"),
+		"{user1000}.followers": HashSlot("user1000"),
+		"foo{}{bar}":           HashSlot("foo{}{bar}"),
+		"foo{{bar}}zap":        HashSlot("{bar"),
+		"foo{bar}{zap}":        HashSlot("bar"),
+	}
+	for key, expected := range cases {
+		if actual := HashSlot(key); actual != expected {
+			t.Errorf("slot of %s: expected %d, actual %d", key, expected, actual)
+		}
+	}
+}
+
+func TestSlotTable(t *testing.T) {
+	table := makeSlotTable([]string{"c:3", "a:1", "b:2"})
+	if table.getNodeBySlot(0) != "a:1" || table.getNodeBySlot(slotCount-1) != "c:3" {
+		t.Error("slots should be divided by sorted nodes")
+	}
+	prev := -1
+	for _, r := range table.ranges() {
+		if r.start != prev+1 || r.end < r.start {
+			t.Errorf("illegal range %d-%d", r.start, r.end)
+		}
+		prev = r.end
+	}
+	if prev != slotCount-1 {
+		t.Errorf("slots are not fully covered")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	nodes := makeModeCluster(t, 3, slotMode)
+	key := "foo"
+	owner := nodes[0].slots.Get(key)
+	for _, node := range nodes {
+		result := node.Exec(nil, toArgs("SET", key, "bar"))
+		if node.self == owner {
+			assertReply(t, result, "+OK\r\n")
+		} else {
+			assertReply(t, result, "-MOVED 12182 "+owner+"\r\n")
+		}
+	}
+	for _, node := range nodes {
+		if node.self != owner {
+			continue
+		}
+		assertReply(t, node.Exec(nil, toArgs("MSET", "{foo}a", "1", "{foo}b", "2")), "+OK\r\n")
+		assertReply(t, node.Exec(nil, toArgs("MGET", "foo", "bar")), string(crossSlotErr.ToBytes()))
+		assertReply(t, node.Exec(nil, toArgs("CLUSTER", "COUNTKEYSINSLOT", "12182")), ":3\r\n")
+		assertReply(t, node.Exec(nil, toArgs("CLUSTER", "KEYSLOT", "{foo}a")), ":12182\r\n")
+	}
+}
+
+func TestClusterCmd(t *testing.T) {
+	nodes := makeModeCluster(t, 3, slotMode)
+	result, ok := nodes[0].Exec(nil, toArgs("CLUSTER", "SLOTS")).(*reply.MultiRawReply)
+	if !ok || len(result.Replies) != 3 {
+		t.Fatalf("illegal CLUSTER SLOTS reply")
+	}
+	for i, raw := range result.Replies {
+		slotReply := raw.(*reply.MultiRawReply)
+		node := nodes[0].slots.nodes[i]
+		host, port := splitAddr(node)
+		expected := reply.MakeMultiRawReply(nodeAddrReply(node))
+		if string(slotReply.Replies[2].ToBytes()) != string(expected.ToBytes()) || host == "" || port == 0 {
+			t.Errorf("illegal node of slot range %d", i)
+		}
+	}
+
+	nodesReply := nodes[1].Exec(nil, toArgs("CLUSTER", "NODES")).(*reply.VerbatimReply)
+	lines := strings.Split(strings.TrimSpace(string(nodesReply.Text)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 nodes, actual %d", len(lines))
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 9 || len(fields[0]) != 40 {
+			t.Errorf("illegal line: %s", line)
+		}
+		if strings.HasPrefix(fields[1], nodes[1].self+"@") != strings.Contains(fields[2], "myself") {
+			t.Errorf("illegal flags: %s", line)
+		}
+	}
+
+	shards := nodes[2].Exec(nil, toArgs("CLUSTER", "SHARDS")).(*reply.MultiRawReply)
+	if len(shards.Replies) != 3 {
+		t.Errorf("expected 3 shards, actual %d", len(shards.Replies))
+	}
+	hashNodes := makeTestCluster(t, 1)
+	assertReply(t, hashNodes[0].Exec(nil, toArgs("CLUSTER", "SLOTS")), string(slotDisabledErr.ToBytes()))
+	assertReply(t, hashNodes[0].Exec(nil, toArgs("CLUSTER", "KEYSLOT", "123456789")), ":"+strconv.Itoa(12739)+"\r\n")
+}
+
+func TestSaveSlotTable(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "nodes.conf")
+	table := makeSlotTable([]string{"a:1", "b:2"})
+	table.addNode("c:3")
+	table.setOwner(100, "c:3")
+	table.setMigrating(1, "c:3")
+	table.setImporting(16000, "c:3")
+	if err := table.save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSlotTable(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table.owners, loaded.owners) || !reflect.DeepEqual(table.nodes, loaded.nodes) {
+		t.Error("slots are not restored")
+	}
+	if !reflect.DeepEqual(table.migrating, loaded.migrating) || !reflect.DeepEqual(table.importing, loaded.importing) {
+		t.Error("migrating states are not restored")
+	}
+	if table, err := loadSlotTable(filename + ".absent"); table != nil || err != nil {
+		t.Error("absent file should be ignored")
+	}
+}
+
+func TestAsk(t *testing.T) {
+	nodes := makeModeCluster(t, 2, slotMode)
+	key := "foo"
+	slot := HashSlot(key)
+	source, target := nodes[0], nodes[1]
+	if source.slots.Get(key) != source.self {
+		source, target = target, source
+	}
+	source.Exec(nil, toArgs("SET", "{foo}1", "1"))
+	source.slots.setMigrating(slot, target.self)
+	target.slots.setImporting(slot, source.self)
+
+	c := &testConn{}
+	assertReply(t, source.Exec(c, toArgs("GET", "{foo}1")), "$1\r\n1\r\n")
+	assertReply(t, source.Exec(c, toArgs("SET", key, "bar")), "-ASK 12182 "+target.self+"\r\n")
+	assertReply(t, source.Exec(c, toArgs("MGET", key, "{foo}1")), string(tryAgainErr.ToBytes()))
+	assertReply(t, target.Exec(c, toArgs("SET", key, "bar")), "-MOVED 12182 "+source.self+"\r\n")
+	assertReply(t, target.Exec(c, toArgs("ASKING")), "+OK\r\n")
+	assertReply(t, target.Exec(c, toArgs("SET", key, "bar")), "+OK\r\n")
+	// ASKING is only valid for one command
+	assertReply(t, target.Exec(c, toArgs("GET", key)), "-MOVED 12182 "+source.self+"\r\n")
+}
+
+func TestMigrateSlots(t *testing.T) {
+	nodes := makeModeCluster(t, 2, slotMode)
+	source, target := nodes[0], nodes[1]
+	if source.slots.getNodeBySlot(0) != source.self {
+		source, target = target, source
+	}
+	// keys of slot 0 and 1
+	keys := []string{"{3560}a", "{3560}b", "{22179}a"}
+	source.Exec(nil, toArgs("SET", keys[0], "1"))
+	source.Exec(nil, toArgs("RPUSH", keys[1], "a", "b"))
+	source.Exec(nil, toArgs("SET", keys[2], "3"))
+	source.Exec(nil, toArgs("EXPIRE", keys[2], "100"))
+	if HashSlot(keys[0]) != 0 || HashSlot(keys[2]) != 1 {
+		t.Fatal("illegal slot of test keys")
+	}
+
+	assertReply(t, source.Exec(nil, toArgs("CLUSTER", "MIGRATESLOTS", nodeID(target.self), "0", "1")), ":2\r\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for source.slots.getNodeBySlot(0) != target.self || source.slots.getNodeBySlot(1) != target.self {
+		if time.Now().After(deadline) {
+			t.Fatal("migration timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range keys {
+		if _, ok := source.db.Get(key); ok {
+			t.Errorf("%s is not removed from source", key)
+		}
+		assertReply(t, source.Exec(nil, toArgs("TYPE", key)), "-MOVED "+strconv.Itoa(HashSlot(key))+" "+target.self+"\r\n")
+	}
+	assertReply(t, target.Exec(nil, toArgs("GET", keys[0])), "$1\r\n1\r\n")
+	assertReply(t, target.Exec(nil, toArgs("LRANGE", keys[1], "0", "-1")), "*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+	ttl, ok := target.Exec(nil, toArgs("TTL", keys[2])).(*reply.IntReply)
+	if !ok || ttl.Code <= 0 {
+		t.Error("ttl is not migrated")
+	}
+	owner, migrating, importing := target.slots.getState(0)
+	if owner != target.self || migrating != "" || importing != "" {
+		t.Error("slot state of target is not stable")
+	}
+}
+
+func TestBlockingInSlotMode(t *testing.T) {
+	nodes := makeModeCluster(t, 2, slotMode)
+	key := "foo"
+	owner, other := nodes[0], nodes[1]
+	if owner.slots.Get(key) != owner.self {
+		owner, other = other, owner
+	}
+	assertReply(t, other.Exec(nil, toArgs("BLPOP", key, "0")), "-MOVED 12182 "+owner.self+"\r\n")
+
+	result := make(chan redis.Reply, 1)
+	go func() {
+		result <- owner.Exec(&testConn{}, toArgs("BLPOP", key, "0"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the waiting client doesn't hold the slot, so resharding can go on
+	locked := make(chan struct{})
+	go func() {
+		owner.slotLocks.Lock("12182")
+		owner.slotLocks.UnLock("12182")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("slot is locked by the blocked client")
+	}
+	owner.Exec(nil, toArgs("RPUSH", key, "a"))
+	select {
+	case actual := <-result:
+		assertReply(t, actual, "*2\r\n$3\r\nfoo\r\n$1\r\na\r\n")
+	case <-time.After(3 * time.Second):
+		t.Fatal("client is still blocked")
+	}
+}
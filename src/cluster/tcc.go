@@ -0,0 +1,392 @@
+package cluster
+
+import (
+	"errors"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Try-Commit-Cancel transaction for commands whose keys are owned by several nodes.
+ * Coordinator sends `PREPARE id cmd args...` to each participant, the participant locks the keys
+ * and checks the command. Then coordinator sends `COMMIT id` to all participants,
+ * or `ROLLBACK id` if any of them failed. Participants roll back by themselves if no commit arrives in maxLockTime.
+ * A committed participant has released its locks, so it is never undone: if a later commit fails
+ * the rest are rolled back and the partial commit is reported to client as an error.
+ */
+
+const (
+	createdStatus = iota
+	preparedStatus
+	committedStatus
+	rolledBackStatus
+)
+
+// maxLockTime is how long participants hold locks waiting for commit
+var maxLockTime = 5 * time.Second
+
+type Transaction struct {
+	id      string
+	cmdLine [][]byte // sub command to execute in transaction
+	spec    *txCmd
+	cluster *Cluster
+	keys    []string
+
+	status int8
+	timer  *time.Timer
+	mu     sync.Mutex
+}
+
+// txCmd describes how to execute a sub command in transaction, keys are locked during prepare and commit
+type txCmd struct {
+	minArgs int
+	keys    func(cmdLine [][]byte) []string
+	// prepare checks command under locks, its reply is returned to coordinator
+	prepare func(cluster *Cluster, cmdLine [][]byte) redis.Reply
+	commit  func(cluster *Cluster, cmdLine [][]byte) redis.Reply
+}
+
+var txCmds = map[string]*txCmd{
+	"del": {
+		minArgs: 2,
+		keys:    keysFrom(1, 1),
+		commit:  commitDel,
+	},
+	"mset": {
+		minArgs: 3,
+		keys:    keysFrom(1, 2),
+		prepare: prepareMSet,
+		commit:  commitMSet,
+	},
+	"msetnx": {
+		minArgs: 3,
+		keys:    keysFrom(1, 2),
+		prepare: prepareMSetNX,
+		commit:  commitMSet,
+	},
+	"renamefrom": {
+		minArgs: 3,
+		keys:    keysFrom(1, 0), // RENAMEFROM src dest
+		prepare: prepareRenameFrom,
+		commit:  commitRenameFrom,
+	},
+	"renameto": {
+		minArgs: 2,
+		keys:    keysFrom(1, 0), // RENAMETO dest payload...
+		prepare: prepareRenameTo,
+		commit:  commitRenameTo,
+	},
+}
+
+// keysFrom returns keys from args[first] by step, step 0 means only one key
+func keysFrom(first int, step int) func(cmdLine [][]byte) []string {
+	return func(cmdLine [][]byte) []string {
+		if step == 0 {
+			return []string{string(cmdLine[first])}
+		}
+		keys := make([]string, 0, (len(cmdLine)-first)/step+1)
+		for i := first; i < len(cmdLine); i += step {
+			keys = append(keys, string(cmdLine[i]))
+		}
+		return keys
+	}
+}
+
+/* ---- participant ---- */
+
+// Prepare locks keys and checks the sub command, PREPARE id cmd args...
+func Prepare(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return &reply.ArgNumErrReply{Cmd: "prepare"}
+	}
+	txID := string(args[1])
+	cmdLine := args[2:]
+	cmd := strings.ToLower(string(cmdLine[0]))
+	spec, ok := txCmds[cmd]
+	if !ok {
+		return reply.MakeErrReply("ERR command '" + cmd + "' cannot be executed in transaction")
+	}
+	if len(cmdLine) < spec.minArgs {
+		return &reply.ArgNumErrReply{Cmd: cmd}
+	}
+	tx := &Transaction{
+		id:      txID,
+		cmdLine: cmdLine,
+		spec:    spec,
+		cluster: cluster,
+		keys:    spec.keys(cmdLine),
+	}
+	return tx.prepare()
+}
+
+func (tx *Transaction) prepare() redis.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.cluster.db.LocksForWrite(tx.keys...)
+	var result redis.Reply = &reply.OkReply{}
+	if tx.spec.prepare != nil {
+		result = tx.spec.prepare(tx.cluster, tx.cmdLine)
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			tx.cluster.db.UnLocksForWrite(tx.keys...)
+			return errReply
+		}
+	}
+	if tx.cluster.transactions.PutIfAbsent(tx.id, tx) == 0 {
+		tx.cluster.db.UnLocksForWrite(tx.keys...)
+		return reply.MakeErrReply("ERR transaction " + tx.id + " already exists")
+	}
+	tx.status = preparedStatus
+	// roll back by itself if coordinator disappears
+	tx.timer = time.AfterFunc(maxLockTime, tx.timeout)
+	return result
+}
+
+// Commit executes the prepared sub command then releases locks, COMMIT id
+func Commit(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return &reply.ArgNumErrReply{Cmd: "commit"}
+	}
+	tx, ok := cluster.getTransaction(string(args[1]))
+	if !ok {
+		return reply.MakeErrReply("ERR transaction " + string(args[1]) + " not found")
+	}
+	return tx.commit()
+}
+
+func (tx *Transaction) commit() redis.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != preparedStatus {
+		return reply.MakeErrReply("ERR transaction " + tx.id + " is not prepared")
+	}
+	defer tx.cluster.db.UnLocksForWrite(tx.keys...)
+	tx.status = committedStatus
+	tx.timer.Stop()
+	tx.cluster.transactions.Remove(tx.id)
+	return tx.spec.commit(tx.cluster, tx.cmdLine)
+}
+
+// Rollback releases locks of a prepared transaction, ROLLBACK id
+func Rollback(cluster *Cluster, c redis.Client, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return &reply.ArgNumErrReply{Cmd: "rollback"}
+	}
+	tx, ok := cluster.getTransaction(string(args[1]))
+	if !ok {
+		// prepare failed or transaction has timed out
+		return &reply.OkReply{}
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.rollback()
+	return &reply.OkReply{}
+}
+
+// rollback should be invoked with tx.mu held
+func (tx *Transaction) rollback() {
+	if tx.status != preparedStatus {
+		return
+	}
+	tx.cluster.db.UnLocksForWrite(tx.keys...)
+	tx.status = rolledBackStatus
+	tx.timer.Stop()
+	tx.cluster.transactions.Remove(tx.id)
+}
+
+func (tx *Transaction) timeout() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status == preparedStatus {
+		logger.Warn("transaction " + tx.id + " timeout, roll back")
+		tx.rollback()
+	}
+}
+
+func (cluster *Cluster) getTransaction(id string) (*Transaction, bool) {
+	raw, ok := cluster.transactions.Get(id)
+	if !ok {
+		return nil, false
+	}
+	tx, _ := raw.(*Transaction)
+	return tx, true
+}
+
+/* ---- sub commands ---- */
+
+// commitDel deletes keys of cmdLine, whose keys are locked by prepare
+func commitDel(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	args := make([][]byte, len(cmdLine))
+	args[0] = []byte("DEL")
+	copy(args[1:], cmdLine[1:])
+	return cluster.db.ExecLocked(args)
+}
+
+func prepareMSet(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine)%2 != 1 {
+		return &reply.ArgNumErrReply{Cmd: "mset"}
+	}
+	return &reply.OkReply{}
+}
+
+// commitMSet sets keys of MSET or MSETNX, whose keys are locked by prepare
+func commitMSet(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	args := make([][]byte, len(cmdLine))
+	args[0] = []byte("MSET")
+	copy(args[1:], cmdLine[1:])
+	return cluster.db.ExecLocked(args)
+}
+
+// prepareMSetNX replies 1 if none of keys exists, otherwise 0
+func prepareMSetNX(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	if len(cmdLine)%2 != 1 {
+		return &reply.ArgNumErrReply{Cmd: "msetnx"}
+	}
+	for i := 1; i < len(cmdLine); i += 2 {
+		if _, exists := cluster.db.Get(string(cmdLine[i])); exists {
+			return reply.MakeIntReply(0)
+		}
+	}
+	return reply.MakeIntReply(1)
+}
+
+// prepareRenameFrom replies the value of src as command lines of dest, each encoded in RESP
+func prepareRenameFrom(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	cmdLines, err := cluster.db.DumpKeyAs(string(cmdLine[1]), string(cmdLine[2]))
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	if cmdLines == nil {
+		return reply.MakeErrReply("no such key")
+	}
+	return reply.MakeMultiBulkReply(encodePayload(cmdLines))
+}
+
+// encodePayload encodes each command line in RESP, so that a key could be sent as arguments
+func encodePayload(cmdLines [][][]byte) [][]byte {
+	payload := make([][]byte, len(cmdLines))
+	for i, line := range cmdLines {
+		payload[i] = reply.MakeMultiBulkReply(line).ToBytes()
+	}
+	return payload
+}
+
+func decodePayload(payload [][]byte) ([][][]byte, error) {
+	cmdLines := make([][][]byte, len(payload))
+	for i, raw := range payload {
+		result, err := parser.ParseOne(raw)
+		if err != nil {
+			return nil, err
+		}
+		multiBulk, ok := result.(*reply.MultiBulkReply)
+		if !ok {
+			return nil, errors.New("ERR illegal payload")
+		}
+		cmdLines[i] = multiBulk.Args
+	}
+	return cmdLines, nil
+}
+
+func commitRenameFrom(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	return commitDel(cluster, cmdLine[:2])
+}
+
+func prepareRenameTo(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	if _, err := decodePayload(cmdLine[2:]); err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return &reply.OkReply{}
+}
+
+func commitRenameTo(cluster *Cluster, cmdLine [][]byte) redis.Reply {
+	cmdLines, err := decodePayload(cmdLine[2:])
+	if err == nil {
+		err = cluster.db.RestoreKey(string(cmdLine[1]), cmdLines)
+	}
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return &reply.OkReply{}
+}
+
+/* ---- coordinator ---- */
+
+var txSeq uint64
+
+type coordinator struct {
+	id      string
+	cluster *Cluster
+	c       redis.Client
+	peers   []string // participants which have been asked to prepare
+}
+
+func (cluster *Cluster) startTx(c redis.Client) *coordinator {
+	seq := atomic.AddUint64(&txSeq, 1)
+	return &coordinator{
+		id:      cluster.self + "-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(seq, 10),
+		cluster: cluster,
+		c:       c,
+	}
+}
+
+// prepare sends cmdLine to peer, the transaction fails if an error reply is returned
+func (co *coordinator) prepare(peer string, cmdLine [][]byte) redis.Reply {
+	// the participant may have prepared even if the request failed, so it is always rolled back on failure
+	co.peers = append(co.peers, peer)
+	args := make([][]byte, len(cmdLine)+2)
+	args[0] = []byte("PREPARE")
+	args[1] = []byte(co.id)
+	copy(args[2:], cmdLine)
+	return co.cluster.relayTx(peer, co.c, args)
+}
+
+// commit commits all participants, if any commit fails the participants not committed yet are rolled back
+// and an error is returned, committed ones can not be undone since they have released their locks
+func (co *coordinator) commit() (map[string]redis.Reply, reply.ErrorReply) {
+	results := make(map[string]redis.Reply)
+	for i, peer := range co.peers {
+		result := co.cluster.relayTx(peer, co.c, makeArgs("COMMIT", co.id))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			co.rollback(co.peers[i:]...)
+			if i == 0 {
+				return nil, errReply
+			}
+			return nil, reply.MakeErrReply("ERR transaction " + co.id + " is partially committed, commit on " +
+				peer + " failed: " + errReply.Error())
+		}
+		results[peer] = result
+	}
+	return results, nil
+}
+
+// rollback rolls back the given participants, or all of them if none is given
+func (co *coordinator) rollback(peers ...string) {
+	if len(peers) == 0 {
+		peers = co.peers
+	}
+	for _, peer := range peers {
+		result := co.cluster.relayTx(peer, co.c, makeArgs("ROLLBACK", co.id))
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			// participant will roll back by itself after timeout
+			logger.Warn("rollback " + co.id + " on " + peer + " failed: " + errReply.Error())
+		}
+	}
+}
+
+// sortedPeers returns peers of groups in a fixed order, so that concurrent transactions lock nodes in the same order
+func sortedPeers(groups map[string][]string) []string {
+	peers := make([]string, 0, len(groups))
+	for peer := range groups {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
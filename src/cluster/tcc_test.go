@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keysOfDifferentNodes returns 2 keys owned by different nodes
+func keysOfDifferentNodes(cluster *Cluster) (string, string) {
+	k1 := "k0"
+	for i := 1; ; i++ {
+		k2 := "k" + strconv.Itoa(i)
+		if cluster.pickNode(k1) != cluster.pickNode(k2) {
+			return k1, k2
+		}
+	}
+}
+
+func assertReply(t *testing.T, result interface{ ToBytes() []byte }, expected string) {
+	t.Helper()
+	if string(result.ToBytes()) != expected {
+		t.Errorf("expected %q, actual %q", expected, result.ToBytes())
+	}
+}
+
+func TestTxRename(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	src, dest := keysOfDifferentNodes(nodes[0])
+	nodes[0].Exec(nil, toArgs("RPUSH", src, "a", "b", "c"))
+	nodes[0].Exec(nil, toArgs("EXPIRE", src, "100"))
+	nodes[0].Exec(nil, toArgs("SET", dest, "v"))
+
+	assertReply(t, nodes[1].Exec(nil, toArgs("RENAME", src, dest)), "+OK\r\n")
+	assertReply(t, nodes[2].Exec(nil, toArgs("EXISTS", src)), ":0\r\n")
+	assertReply(t, nodes[2].Exec(nil, toArgs("LRANGE", dest, "0", "-1")), "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	ttl, ok := nodes[2].Exec(nil, toArgs("TTL", dest)).(*reply.IntReply)
+	if !ok || ttl.Code <= 0 || ttl.Code > 100 {
+		t.Errorf("ttl of %s is not renamed", dest)
+	}
+
+	result := nodes[1].Exec(nil, toArgs("RENAME", src, dest))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual %q", result.ToBytes())
+	}
+	// locks have been released
+	assertReply(t, nodes[2].Exec(nil, toArgs("SET", src, "v")), "+OK\r\n")
+	assertReply(t, nodes[2].Exec(nil, toArgs("SET", dest, "v")), "+OK\r\n")
+}
+
+func TestTxMSetNX(t *testing.T) {
+	nodes := makeTestCluster(t, 3)
+	k1, k2 := keysOfDifferentNodes(nodes[0])
+	nodes[0].Exec(nil, toArgs("SET", k2, "old"))
+	assertReply(t, nodes[1].Exec(nil, toArgs("MSETNX", k1, "1", k2, "2")), ":0\r\n")
+	assertReply(t, nodes[1].Exec(nil, toArgs("EXISTS", k1)), ":0\r\n")
+	assertReply(t, nodes[1].Exec(nil, toArgs("GET", k2)), "$3\r\nold\r\n")
+
+	nodes[0].Exec(nil, toArgs("DEL", k2))
+	assertReply(t, nodes[1].Exec(nil, toArgs("MSETNX", k1, "1", k2, "2")), ":1\r\n")
+	assertReply(t, nodes[2].Exec(nil, toArgs("MGET", k1, k2)), "*2\r\n$1\r\n1\r\n$1\r\n2\r\n")
+}
+
+func TestTxRollback(t *testing.T) {
+	nodes := makeTestCluster(t, 1)
+	node := nodes[0]
+	node.Exec(nil, toArgs("SET", "a", "1"))
+
+	assertReply(t, node.Exec(nil, toArgs("PREPARE", "tx1", "MSET", "a", "2", "b", "2")), "+OK\r\n")
+	assertReply(t, node.Exec(nil, toArgs("ROLLBACK", "tx1")), "+OK\r\n")
+	assertReply(t, node.Exec(nil, toArgs("MGET", "a", "b")), "*2\r\n$1\r\n1\r\n$-1\r\n")
+	result := node.Exec(nil, toArgs("COMMIT", "tx1"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("rolled back transaction should not be committed")
+	}
+
+	// committed transaction is not undone, writes after commit are kept
+	assertReply(t, node.Exec(nil, toArgs("PREPARE", "tx2", "MSET", "a", "2", "b", "2")), "+OK\r\n")
+	assertReply(t, node.Exec(nil, toArgs("COMMIT", "tx2")), "+OK\r\n")
+	node.Exec(nil, toArgs("SET", "b", "3"))
+	assertReply(t, node.Exec(nil, toArgs("ROLLBACK", "tx2")), "+OK\r\n")
+	assertReply(t, node.Exec(nil, toArgs("MGET", "a", "b")), "*2\r\n$1\r\n2\r\n$1\r\n3\r\n")
+}
+
+func TestTxPartialCommit(t *testing.T) {
+	nodes := makeTestCluster(t, 2)
+	k1, k2 := keysOfDifferentNodes(nodes[0])
+	co := nodes[0].startTx(nil)
+	assertReply(t, co.prepare(nodes[0].pickNode(k1), makeArgs("MSET", k1, "1")), "+OK\r\n")
+	assertReply(t, co.prepare(nodes[0].pickNode(k2), makeArgs("MSET", k2, "2")), "+OK\r\n")
+	// the second participant loses its transaction
+	nodes[0].relayTx(nodes[0].pickNode(k2), nil, makeArgs("ROLLBACK", co.id))
+	_, errReply := co.commit()
+	if errReply == nil || !strings.Contains(errReply.Error(), "partially committed") {
+		t.Errorf("expected partial commit error, actual %v", errReply)
+	}
+	assertReply(t, nodes[1].Exec(nil, toArgs("MGET", k1, k2)), "*2\r\n$1\r\n1\r\n$-1\r\n")
+	// locks have been released
+	assertReply(t, nodes[1].Exec(nil, toArgs("SET", k2, "v")), "+OK\r\n")
+}
+
+func TestTxTimeout(t *testing.T) {
+	lockTime := maxLockTime
+	maxLockTime = 100 * time.Millisecond
+	defer func() {
+		maxLockTime = lockTime
+	}()
+	nodes := makeTestCluster(t, 1)
+	node := nodes[0]
+	assertReply(t, node.Exec(nil, toArgs("PREPARE", "tx1", "DEL", "a")), "+OK\r\n")
+	time.Sleep(300 * time.Millisecond)
+	result := node.Exec(nil, toArgs("COMMIT", "tx1"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected timeout, actual %q", result.ToBytes())
+	}
+	// locks have been released
+	assertReply(t, node.Exec(nil, toArgs("SET", "a", "1")), "+OK\r\n")
+}
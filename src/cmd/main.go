@@ -5,12 +5,31 @@ import (
 	"myGodis/src/config"
 	"myGodis/src/lib/logger"
 	RedisServer "myGodis/src/redis/server"
+	"myGodis/src/sentinel"
 	"myGodis/src/tcp"
+	"os"
 	"time"
 )
 
+// usage: myGodis [config file] [--sentinel]
 func main() {
-	config.SetupConfig("redis.conf")
+	configFile := ""
+	sentinelMode := false
+	for _, arg := range os.Args[1:] {
+		if arg == "--sentinel" {
+			sentinelMode = true
+		} else {
+			configFile = arg
+		}
+	}
+	if configFile == "" {
+		configFile = "redis.conf"
+		if sentinelMode {
+			configFile = "sentinel.conf"
+		}
+	}
+
+	config.SetupConfig(configFile)
 	settings := &logger.Settings{
 		Path:       "logs",
 		Name:       "Godis",
@@ -25,5 +44,13 @@ func main() {
 		Timeout:    2 * time.Second,
 	}
 
+	if sentinelMode {
+		s, err := sentinel.MakeSentinel(configFile)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		tcp.ListenAndServe(cfg, RedisServer.MakeHandlerWithDB(s))
+		return
+	}
 	tcp.ListenAndServe(cfg, RedisServer.MakeHandler())
 }
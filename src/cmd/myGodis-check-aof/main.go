@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	DBImpl "myGodis/src/db"
+	"os"
+	"strings"
+)
+
+/*
+ * myGodis-check-aof [--fix] <file.aof|file.manifest>
+ * validates aof file offline, --fix cuts off everything after the last valid command.
+ * Given a manifest of multi part aof, all listed files are validated and only the last one could be fixed.
+ */
+
+func main() {
+	fix := false
+	var filename string
+	switch {
+	case len(os.Args) == 2:
+		filename = os.Args[1]
+	case len(os.Args) == 3 && os.Args[1] == "--fix":
+		fix = true
+		filename = os.Args[2]
+	default:
+		fmt.Println("Usage: myGodis-check-aof [--fix] <file.aof|file.manifest>")
+		os.Exit(1)
+	}
+
+	files := []string{filename}
+	if strings.HasSuffix(filename, ".manifest") {
+		var err error
+		if files, err = DBImpl.ReadAofManifest(filename); err != nil {
+			fmt.Println("Cannot read manifest " + filename + ": " + err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Manifest %s lists %d files\n", filename, len(files))
+	}
+	for i, file := range files {
+		if !checkFile(file, fix, i == len(files)-1) {
+			os.Exit(1)
+		}
+	}
+}
+
+// checkFile returns false if the file is not valid and not fixed
+func checkFile(filename string, fix bool, last bool) bool {
+	size, valid, err := DBImpl.CheckAof(filename)
+	if os.IsNotExist(err) {
+		fmt.Println("Cannot open file: " + filename)
+		return false
+	}
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", filename, size, valid, size-valid)
+	if err == nil {
+		fmt.Println("AOF is valid")
+		return true
+	}
+	fmt.Printf("AOF is not valid at offset %d: %v\n", valid, err)
+	if !last {
+		fmt.Println("Only the last file could be fixed, please check it manually")
+		return false
+	}
+	if !fix {
+		fmt.Println("Use the --fix option to try fixing it.")
+		return false
+	}
+	if err := os.Truncate(filename, valid); err != nil {
+		fmt.Println("Failed to truncate AOF: " + err.Error())
+		return false
+	}
+	fmt.Println("Successfully truncated AOF")
+	return true
+}
@@ -10,17 +10,51 @@ import (
 )
 
 type PropertyHolder struct {
-	Bind           string   `cfg:"bind"`
-	Port           int      `cfg:"port"`
-	AppendOnly     bool     `cfg:"appendonly"`
-	AppendFilename string   `cfg:"appendfilename"`
-	MaxClients     int      `cfg:"maxclients"`
-	Peers          []string `cfg:"peers"`
-	Self           string   `cfg:"self"`
+	Bind               string   `cfg:"bind"`
+	Port               int      `cfg:"port"`
+	AppendOnly         bool     `cfg:"appendonly"`
+	AppendFilename     string   `cfg:"appendfilename"`
+	AppendDirname      string   `cfg:"appenddirname"`         // directory of base, incr files and manifest
+	AppendFsync        string   `cfg:"appendfsync"`           // always, everysec or no
+	AofUseRdbPreamble  bool     `cfg:"aof-use-rdb-preamble"`  // rewrite aof as rdb snapshot and incremental commands
+	AofLoadTruncated   bool     `cfg:"aof-load-truncated"`    // cut off truncated last command instead of refusing to start
+	ReplicaOf          string   `cfg:"replicaof"`             // <host> <port>, start as a replica
+	ReplBacklogSize    int      `cfg:"repl-backlog-size"`     // bytes
+	ReplTimeout        int      `cfg:"repl-timeout"`          // seconds
+	ReplicaReadOnly    bool     `cfg:"replica-read-only"`     // reject writes from clients on replicas
+	MinReplicasToWrite int      `cfg:"min-replicas-to-write"` // refuse writes if fewer good replicas are connected, 0 disables it
+	MinReplicasMaxLag  int      `cfg:"min-replicas-max-lag"`  // seconds since the last ack of a good replica
+	DBFilename         string   `cfg:"dbfilename"`
+	Save               string   `cfg:"save"` // <seconds> <changes> pairs, eg. 3600 1 300 100
+	MaxClients         int      `cfg:"maxclients"`
+	Peers              []string `cfg:"peers"`
+	Self               string   `cfg:"self"`
+	ClusterMode        string   `cfg:"cluster-mode"`        // hash or slot
+	ClusterConfigFile  string   `cfg:"cluster-config-file"` // slot table is saved here in slot mode
 }
 
 var Properties *PropertyHolder
 
+func init() {
+	// default config
+	Properties = &PropertyHolder{
+		Bind:           "127.0.0.1",
+		Port:           6379,
+		AppendOnly:     false,
+		AppendFilename: "appendonly.aof",
+		AppendDirname:  "appendonlydir",
+		AppendFsync:    "everysec",
+		DBFilename:     "dump.rdb",
+
+		ReplBacklogSize:   1024 * 1024,
+		ReplTimeout:       60,
+		ReplicaReadOnly:   true,
+		MinReplicasMaxLag: 10,
+		AofLoadTruncated:  true,
+		ClusterConfigFile: "nodes.conf",
+	}
+}
+
 func LoadConfig(configFilename string) *PropertyHolder {
 	config := Properties
 	// open config file
@@ -74,9 +108,17 @@ func LoadConfig(configFilename string) *PropertyHolder {
 					fieldVal.SetInt(intValue)
 				}
 			case reflect.Bool:
-				boolValue, err := strconv.ParseBool(value)
-				if err == nil {
-					fieldVal.SetBool(boolValue)
+				// yes and no like redis.conf
+				switch strings.ToLower(value) {
+				case "yes":
+					fieldVal.SetBool(true)
+				case "no":
+					fieldVal.SetBool(false)
+				default:
+					boolValue, err := strconv.ParseBool(value)
+					if err == nil {
+						fieldVal.SetBool(boolValue)
+					}
 				}
 			case reflect.Slice:
 				if field.Type.Elem().Kind() == reflect.String {
@@ -171,6 +171,7 @@ func (d *ConcurrentDict) Remove(key string) (result int) {
 
 	if _, ok := shard.m[key]; ok {
 		delete(shard.m, key)
+		d.decreaseCount()
 		result = 1
 	} else {
 		result = 0
@@ -183,6 +184,10 @@ func (d *ConcurrentDict) addCount() int32 {
 	return atomic.AddInt32(&d.count, 1)
 }
 
+func (d *ConcurrentDict) decreaseCount() int32 {
+	return atomic.AddInt32(&d.count, -1)
+}
+
 /*
  * may not contain new entry inserted during traversal
  */
@@ -191,13 +196,16 @@ func (dict *ConcurrentDict) ForEach(consumer Consumer) {
 		panic("dict is nil")
 	}
 	for _, shard := range dict.table {
+		shard.mutex.RLock()
+		continues := true
 		for key, value := range shard.m {
-			shard.mutex.RLock()
-			continues := consumer(key, value)
-			shard.mutex.RUnlock()
-			if !continues {
-				return
+			if continues = consumer(key, value); !continues {
+				break
 			}
 		}
+		shard.mutex.RUnlock()
+		if !continues {
+			return
+		}
 	}
 }
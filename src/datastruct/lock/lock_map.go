@@ -7,8 +7,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"testing"
-	"time"
 )
 
 const (
@@ -59,7 +57,7 @@ func (locks *Locks) RLock(key string) {
 func (locks *Locks) UnLock(key string) {
 	index := locks.spread(fnv32(key))
 	mu := locks.table[index]
-	mu.RUnlock()
+	mu.Unlock()
 }
 
 func (locks *Locks) RUnlock(key string) {
@@ -68,43 +66,90 @@ func (locks *Locks) RUnlock(key string) {
 	mu.RUnlock()
 }
 
+// different keys may share one mutex, so multi-key locking works on distinct sorted indices
+func (locks *Locks) toLockIndices(keys []string, reverse bool) []uint32 {
+	indexMap := make(map[uint32]bool)
+	for _, key := range keys {
+		index := locks.spread(fnv32(key))
+		indexMap[index] = true
+	}
+	indices := make([]uint32, 0, len(indexMap))
+	for index := range indexMap {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		if !reverse {
+			return indices[i] < indices[j]
+		}
+		return indices[i] > indices[j]
+	})
+	return indices
+}
+
 func (locks *Locks) Locks(keys ...string) {
-	keySlice := make(sort.StringSlice, len(keys))
-	copy(keySlice, keys)
-	sort.Sort(keySlice)
-	for _, key := range keySlice {
-		locks.Lock(key)
+	indices := locks.toLockIndices(keys, false)
+	for _, index := range indices {
+		locks.table[index].Lock()
 	}
 }
 
 func (locks *Locks) RLocks(keys ...string) {
-	keySlice := make(sort.StringSlice, len(keys))
-	copy(keySlice, keys)
-	sort.Sort(keySlice)
-	for _, key := range keySlice {
-		locks.RLock(key)
+	indices := locks.toLockIndices(keys, false)
+	for _, index := range indices {
+		locks.table[index].RLock()
 	}
 }
 
 func (locks *Locks) UnLocks(keys ...string) {
-	size := len(keys)
-	keySlice := make(sort.StringSlice, size)
-	copy(keySlice, keys)
-	sort.Sort(keySlice)
-	for i := size - 1; i >= 0; i-- {
-		key := keySlice[i]
-		locks.UnLock(key)
+	indices := locks.toLockIndices(keys, true)
+	for _, index := range indices {
+		locks.table[index].Unlock()
 	}
 }
 
 func (locks *Locks) RUnlocks(keys ...string) {
-	size := len(keys)
-	keySlice := make(sort.StringSlice, size)
-	copy(keySlice, keys)
-	sort.Sort(keySlice)
-	for i := size - 1; i >= 0; i-- {
-		key := keySlice[i]
-		locks.RUnlock(key)
+	indices := locks.toLockIndices(keys, true)
+	for _, index := range indices {
+		locks.table[index].RUnlock()
+	}
+}
+
+// RWLocks write-locks writeKeys and read-locks readKeys, a key in both is write-locked
+func (locks *Locks) RWLocks(writeKeys []string, readKeys []string) {
+	keys := make([]string, 0, len(writeKeys)+len(readKeys))
+	keys = append(keys, writeKeys...)
+	keys = append(keys, readKeys...)
+	indices := locks.toLockIndices(keys, false)
+	writeIndices := locks.toLockIndices(writeKeys, false)
+	writeIndexSet := make(map[uint32]bool)
+	for _, index := range writeIndices {
+		writeIndexSet[index] = true
+	}
+	for _, index := range indices {
+		if writeIndexSet[index] {
+			locks.table[index].Lock()
+		} else {
+			locks.table[index].RLock()
+		}
+	}
+}
+
+func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
+	keys := make([]string, 0, len(writeKeys)+len(readKeys))
+	keys = append(keys, writeKeys...)
+	keys = append(keys, readKeys...)
+	indices := locks.toLockIndices(keys, true)
+	writeIndices := locks.toLockIndices(writeKeys, true)
+	writeIndexSet := make(map[uint32]bool)
+	for _, index := range writeIndices {
+		writeIndexSet[index] = true
+	}
+	for _, index := range indices {
+		if writeIndexSet[index] {
+			locks.table[index].Unlock()
+		} else {
+			locks.table[index].RUnlock()
+		}
 	}
 }
 
@@ -118,22 +163,3 @@ func GoID() int {
 	}
 	return id
 }
-
-func debug(t testing.T) {
-	lm := Locks{}
-	size := 10
-	var wg sync.WaitGroup
-	wg.Add(size)
-	for i := 0; i < size; i++ {
-		go func(i int) {
-			lm.Locks("1", "2")
-			println("go: " + strconv.Itoa(GoID()))
-			time.Sleep(time.Second)
-			println("go: " + strconv.Itoa(GoID()))
-			lm.UnLocks("1", "2")
-			wg.Done()
-		}(i)
-	}
-
-	wg.Wait()
-}
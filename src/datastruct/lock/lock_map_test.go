@@ -0,0 +1,54 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocks(t *testing.T) {
+	lm := Make(8)
+	size := 10
+	counter := 0
+	var wg sync.WaitGroup
+	wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			// duplicated keys and keys sharing one mutex must not deadlock
+			lm.Locks("1", "2", "1", "a", "b")
+			counter++
+			lm.UnLocks("1", "2", "1", "a", "b")
+			wg.Done()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("locks timeout, maybe deadlock")
+	}
+	if counter != size {
+		t.Errorf("expected counter %d, actual %d", size, counter)
+	}
+}
+
+func TestRWLocks(t *testing.T) {
+	lm := Make(8)
+	done := make(chan struct{})
+	go func() {
+		lm.RWLocks([]string{"dest"}, []string{"src1", "src2", "dest"})
+		lm.RWUnLocks([]string{"dest"}, []string{"src1", "src2", "dest"})
+		lm.Lock("dest")
+		lm.UnLock("dest")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rw locks timeout, maybe deadlock")
+	}
+}
@@ -78,7 +78,8 @@ func (skiplist *skiplist) insert(member string, score float64) *Node {
 		if node.level[i] != nil {
 			// traverse the skip list
 			for node.level[i].forward != nil &&
-				(node.level[i].forward.Score < score || node.level[i].forward.Member < member) { // same score, different key
+				(node.level[i].forward.Score < score ||
+					(node.level[i].forward.Score == score && node.level[i].forward.Member < member)) { // same score, different key
 				rank[i] += node.level[i].span
 				node = node.level[i].forward
 			}
@@ -104,7 +105,7 @@ func (skiplist *skiplist) insert(member string, score float64) *Node {
 		update[i].level[i].forward = node
 
 		// update span covered by update[i] as node is inserted here
-		node.level[i].span = update[i].level[i].span - (rank[i+1] - rank[i])
+		node.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
 		update[i].level[i].span = (rank[0] - rank[i]) + 1
 	}
 
@@ -176,15 +177,16 @@ func (skiplist *skiplist) remove(member string, score float64) bool {
 	return false
 }
 
+// getRank returns 1-based rank of the element, 0 if not found
 func (skiplist *skiplist) getRank(member string, score float64) int64 {
 	var rank int64 = 0
 	x := skiplist.header
 	for i := skiplist.level - 1; i >= 0; i-- {
-		for x.level[i].forward != nil && (x.level[i].forward.Score < score || (x.level[i].forward.Score == score && x.level[i].forward.Member < member)) {
+		for x.level[i].forward != nil && (x.level[i].forward.Score < score || (x.level[i].forward.Score == score && x.level[i].forward.Member <= member)) {
 			rank += x.level[i].span
 			x = x.level[i].forward
 		}
-		if x.Member == member {
+		if x != skiplist.header && x.Member == member {
 			return rank
 		}
 	}
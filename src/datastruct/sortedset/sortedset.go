@@ -23,7 +23,7 @@ func (sortedSet *SortedSet) Add(member string, score float64) bool {
 	}
 	if ok {
 		if score != element.Score {
-			sortedSet.skiplist.remove(member, score)
+			sortedSet.skiplist.remove(member, element.Score)
 			sortedSet.skiplist.insert(member, score)
 		}
 		return false
@@ -71,3 +71,12 @@ func (sortedSet *SortedSet) GetRank(member string, desc bool) (rank int64) {
 	}
 	return r
 }
+
+// ForEach visits all elements in no particular order, stops if consumer returns false
+func (sortedSet *SortedSet) ForEach(consumer func(element *Element) bool) {
+	for _, element := range sortedSet.dict {
+		if !consumer(element) {
+			break
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package sortedset
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestRank(t *testing.T) {
+	set := Make()
+	var elements []*Element
+	for i := 0; i < 200; i++ {
+		// few distinct scores, so that members with the same score are ordered by name
+		element := &Element{Member: "m" + strconv.Itoa(i), Score: float64(rand.Intn(10))}
+		elements = append(elements, element)
+		set.Add(element.Member, element.Score)
+	}
+	// update scores and remove some members
+	for i := 0; i < 50; i++ {
+		elements[i].Score = float64(rand.Intn(10))
+		set.Add(elements[i].Member, elements[i].Score)
+	}
+	for i := 50; i < 60; i++ {
+		set.Remove(elements[i].Member)
+	}
+	elements = append(elements[:50], elements[60:]...)
+
+	sort.Slice(elements, func(i, j int) bool {
+		if elements[i].Score != elements[j].Score {
+			return elements[i].Score < elements[j].Score
+		}
+		return elements[i].Member < elements[j].Member
+	})
+	if set.Len() != int64(len(elements)) {
+		t.Fatalf("expected len %d, actual %d", len(elements), set.Len())
+	}
+	for i, element := range elements {
+		if rank := set.GetRank(element.Member, false); rank != int64(i) {
+			t.Errorf("%s: expected rank %d, actual %d", element.Member, i, rank)
+		}
+		if rank := set.GetRank(element.Member, true); rank != int64(len(elements)-1-i) {
+			t.Errorf("%s: expected desc rank %d, actual %d", element.Member, len(elements)-1-i, rank)
+		}
+	}
+	if rank := set.GetRank("", false); rank != -1 {
+		t.Errorf("expected -1 for missing member, actual %d", rank)
+	}
+}
@@ -1,23 +1,29 @@
 package db
 
 import (
-	"bufio"
+	"errors"
 	"io"
 	"myGodis/src/config"
 	"myGodis/src/datastruct/dict"
 	List "myGodis/src/datastruct/list"
-	"myGodis/src/datastruct/lock"
 	"myGodis/src/datastruct/set"
+	SortedSet "myGodis/src/datastruct/sortedset"
 	"myGodis/src/lib/logger"
 	"myGodis/src/redis/reply"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var pExpireAtCmd = []byte("PEXPIREAT")
 
+// rdbMagic is the head of rdb preamble in aof file
+const rdbMagic = "REDIS"
+
 func makeExpireCmd(key string, expireAt time.Time) *reply.MultiBulkReply {
 	args := make([][]byte, 3)
 	args[0] = pExpireAtCmd
@@ -34,190 +40,374 @@ func makeAofCmd(cmd string, args [][]byte) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(params)
 }
 
-// send command to aof
+/*
+ * appendfsync policies:
+ *   always: addAof returns after the command is written and fsynced, commands queued together share one fsync
+ *   everysec: fsync in background every second, at most 1 second of writes are lost
+ *   no: never fsync, leave it to the OS
+ */
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+
+	// max commands written before one fsync of appendfsync always
+	aofBatchSize = 1024
+)
+
+type aofPayload struct {
+	data   []byte          // serialized command lines, nil for barrier of flushAofQueue
+	synced *sync.WaitGroup // not nil if invoker waits for fsync
+}
+
+// parseFsyncPolicy returns everysec for illegal values
+func parseFsyncPolicy(value string) string {
+	policy := strings.ToLower(value)
+	switch policy {
+	case fsyncAlways, fsyncEverySec, fsyncNo:
+		return policy
+	case "":
+		return fsyncEverySec
+	}
+	logger.Warn("illegal appendfsync " + value + ", use everysec")
+	return fsyncEverySec
+}
+
+// send command to aof, returns after the command is fsynced if appendfsync is always
 func (db *DB) addAof(args *reply.MultiBulkReply) {
+	if db.bufferTxAof(args) {
+		return
+	}
+	db.appendAof(args.ToBytes())
+}
+
+// appendAof sends serialized commands to replicas and aof file as a unit
+func (db *DB) appendAof(data []byte) {
+	db.feedReplicas(data)
 	if config.Properties.AppendOnly && db.aofFile != nil {
-		db.aofChan <- args
+		payload := &aofPayload{data: data}
+		if db.fsyncPolicy == fsyncAlways {
+			payload.synced = &sync.WaitGroup{}
+			payload.synced.Add(1)
+		}
+		db.aofChan <- payload
+		if payload.synced != nil {
+			payload.synced.Wait()
+		}
 	}
 }
 
 // listen aof file and write into file
 func (db *DB) handleAof() {
-	for cmd := range db.aofChan {
+	for payload := range db.aofChan {
+		batch := []*aofPayload{payload}
+		if db.fsyncPolicy == fsyncAlways {
+			// write all queued commands then fsync once
+		loop:
+			for len(batch) < aofBatchSize {
+				select {
+				case payload := <-db.aofChan:
+					batch = append(batch, payload)
+				default:
+					break loop
+				}
+			}
+		}
 		db.pausingAof.RLock() // prevent other goroutines from pausing aof
-		if db.aofRewriteChan != nil {
-			db.aofRewriteChan <- cmd // replica during rewrite
+		for _, payload := range batch {
+			if payload.data == nil {
+				// barrier of flushAofQueue
+				continue
+			}
+			_, err := db.aofFile.Write(payload.data)
+			if err != nil {
+				logger.Warn(err)
+			}
 		}
-		_, err := db.aofFile.Write(cmd.ToBytes())
-		if err != nil {
-			logger.Warn(err)
+		atomic.StoreInt32(&db.aofUnsynced, 1)
+		if db.fsyncPolicy == fsyncAlways {
+			db.fsyncAof()
 		}
 		db.pausingAof.RUnlock()
+		for _, payload := range batch {
+			if payload.synced != nil {
+				payload.synced.Done()
+			}
+		}
 	}
 }
 
-func trim(msg []byte) string {
-	return strings.TrimRight(string(msg), "\r\n")
-}
-
-func (db *DB) loadAof() {
-	// delete aofChan to prevent write again
-	aofChan := db.aofChan
-	db.aofChan = nil
-	defer func(aofChan chan *reply.MultiBulkReply) {
-		db.aofChan = aofChan
-	}(aofChan)
+// fsyncAof flushes aof file to disk and records latency, invoker should hold pausingAof
+func (db *DB) fsyncAof() {
+	if atomic.SwapInt32(&db.aofUnsynced, 0) == 0 {
+		return
+	}
+	start := time.Now()
+	err := db.aofFile.Sync()
+	latency := time.Since(start)
 
-	file, err := os.Open(db.aofFilename)
+	db.fsyncStats.mu.Lock()
+	defer db.fsyncStats.mu.Unlock()
+	stats := &db.fsyncStats
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
-		}
-		logger.Warn(err)
+		logger.Warn("fsync aof failed: " + err.Error())
+		stats.lastErr = err
 		return
 	}
-	defer file.Close()
+	stats.lastErr = nil
+	stats.count++
+	stats.total += latency
+	stats.last = latency
+	if latency > stats.max {
+		stats.max = latency
+	}
+}
 
-	reader := bufio.NewReader(file)
-	var fixedLen int64 = 0
-	var expectedArgsCount uint32
-	var receivedCount uint32
-	var args [][]byte
-	processing := false
-	var msg []byte
+// fsyncEverySec fsyncs aof every second for appendfsync everysec
+func (db *DB) fsyncEverySec() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		if fixedLen == 0 {
-			msg, err = reader.ReadBytes('\n')
-			if err == io.EOF {
-				return
-			}
-			if len(msg) == 0 {
-				logger.Warn("invalid format: line should end with \\r\\n")
-				return
-			}
-		} else {
-			msg = make([]byte, fixedLen+2)
-			_, err = io.ReadFull(reader, msg)
-			if err == io.EOF {
-				return
-			}
-			if len(msg) == 0 {
-				logger.Warn("invalid format: line should end with \\r\\n")
-				return
-			}
-			fixedLen = 0
-		}
-		if err != nil {
-			logger.Warn(err)
+		select {
+		case <-ticker.C:
+		case <-db.closeCh:
 			return
 		}
+		db.pausingAof.RLock()
+		db.fsyncAof()
+		db.pausingAof.RUnlock()
+	}
+}
 
-		if !processing {
-			// new request
-			if msg[0] == '*' {
-				// bulk multi msg
-				expectedLine, err := strconv.ParseUint(trim(msg[1:]), 10, 32)
-				if err != nil {
-					logger.Warn(err)
-					return
-				}
-				expectedArgsCount = uint32(expectedLine)
-				receivedCount = 0
-				processing = true
-				args = make([][]byte, expectedLine)
-			} else {
-				logger.Warn("msg should start with '*'")
-				return
-			}
-		} else {
-			// receive following part of a request
-			line := msg[0 : len(msg)-2]
-			if line[0] == '$' {
-				fixedLen, err = strconv.ParseInt(trim(line[1:]), 10, 64)
-				if err != nil {
-					logger.Warn(err)
-					return
-				}
-				if fixedLen <= 0 {
-					logger.Warn("invalid multibulk length")
-					return
-				}
-			} else {
-				args[receivedCount] = line
-				receivedCount++
-			}
+// loadAof replays aof files listed by manifest at startup, the single aof file of older versions is upgraded.
+// A truncated last command is cut off if aof-load-truncated is yes, otherwise error is returned and server should refuse to start
+func (db *DB) loadAof() error {
+	if err := os.MkdirAll(db.aofDir, 0755); err != nil {
+		return err
+	}
+	manifest, err := readManifest(db.manifestFilename())
+	if os.IsNotExist(err) {
+		manifest, err = db.upgradeAof()
+	}
+	if err != nil {
+		return err
+	}
+	db.aofManifest = manifest
+	files := manifest.files()
+	for i, info := range files {
+		// only the last file could be truncated by crash
+		last := i == len(files)-1
+		if err := db.loadAofFile(filepath.Join(db.aofDir, info.name), last && config.Properties.AofLoadTruncated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// if sending finished
-			if receivedCount == expectedArgsCount {
-				processing = false
+func (db *DB) manifestFilename() string {
+	return filepath.Join(db.aofDir, db.aofFilename+manifestSuffix)
+}
 
-				cmd := strings.ToLower(string(args[0]))
-				cmdFunc, ok := router[cmd]
-				if ok {
-					cmdFunc(db, args[1:])
-				}
+// upgradeAof moves the single aof file of older versions into aof dir as base,
+// returns an empty manifest if there is no aof file
+func (db *DB) upgradeAof() (*aofManifest, error) {
+	legacy := config.Properties.AppendFilename
+	base := &aofFileInfo{name: db.aofFilename, seq: 1, fileType: aofBaseType}
+	filename := filepath.Join(db.aofDir, base.name)
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, filename); err != nil {
+			return nil, err
+		}
+		logger.Info("upgrade " + legacy + " to multi part aof in " + db.aofDir)
+	}
+	// the file is moved but manifest is not written if crashed during upgrading
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return &aofManifest{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &aofManifest{base: base}, nil
+}
 
-				// finish
-				expectedArgsCount = 0
-				receivedCount = 0
-				args = nil
-			}
+// loadAofFile replays an aof file, truncated last command is cut off if canTruncate
+func (db *DB) loadAofFile(filename string, canTruncate bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	valid, err := db.replayAof(file)
+	_ = file.Close()
+	if err == io.ErrUnexpectedEOF {
+		if !canTruncate {
+			return errors.New("unexpected end of file reading the append only file " + filename +
+				", run myGodis-check-aof --fix or set aof-load-truncated yes")
 		}
+		logger.Warn("!!! Warning: short read while loading the append only file " + filename +
+			", truncate it to " + strconv.FormatInt(valid, 10) + " bytes !!!")
+		return os.Truncate(filename, valid)
+	} else if err != nil {
+		return errors.New("bad file format reading the append only file " + filename + " at offset " +
+			strconv.FormatInt(valid, 10) + ": " + err.Error() + ", run myGodis-check-aof --fix")
 	}
+	return nil
 }
 
-/* -- aof rewrite -- */
-func (db *DB) aofRewrite() {
-	file, err := db.startRewrite()
+// openAof opens the last incr file for appending, creates one if there is none
+func (db *DB) openAof() (*os.File, error) {
+	if n := len(db.aofManifest.incrs); n > 0 {
+		filename := filepath.Join(db.aofDir, db.aofManifest.incrs[n-1].name)
+		return os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	}
+	return db.addIncrFile()
+}
+
+// addIncrFile creates the next incr file and persists manifest including it
+func (db *DB) addIncrFile() (*os.File, error) {
+	manifest := db.aofManifest.clone()
+	info := manifest.nextIncr(db.aofFilename)
+	file, err := os.OpenFile(filepath.Join(db.aofDir, info.name), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		logger.Warn(err)
-		return
+		return nil, err
+	}
+	manifest.incrs = append(manifest.incrs, info)
+	if err := writeManifest(db.manifestFilename(), manifest); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
 	}
+	db.aofManifest = manifest
+	return file, nil
+}
 
-	// load aof file
-	tmpDB := &DB{
-		Data:     dict.MakeSimple(),
-		TTLMap:   dict.MakeSimple(),
-		Locker:   lock.Make(lockerSize),
-		interval: 5 * time.Second,
-
-		aofFilename: db.aofFilename,
-	}
-
-	tmpDB.loadAof()
-
-	// rewrite aof file
-	tmpDB.Data.ForEach(func(key string, raw interface{}) bool {
-		var cmd *reply.MultiBulkReply
-		entity, _ := raw.(*DataEntity)
-		switch val := entity.Data.(type) {
-		case []byte:
-			cmd = persistString(key, val)
-		case *List.LinkedList:
-			cmd = persistList(key, val)
-		case *set.Set:
-			cmd = persistSet(key, val)
-		case dict.Dict:
-			cmd = persistHash(key, val)
-			// case *SortedSet.SortedSet:
-			// 	cmd = persistSortedSet(key, val)
-		}
-		if cmd != nil {
-			_, _ = file.Write(cmd.ToBytes())
+// replayAof executes commands from reader, returns length of the valid prefix
+func (db *DB) replayAof(reader io.Reader) (int64, error) {
+	// delete aofChan to prevent write again
+	aofChan := db.aofChan
+	db.aofChan = nil
+	// keys are not expired during loading, otherwise commands executed before expiration would be replayed on nothing.
+	// expiration after the commands is logged as DEL
+	db.loading = true
+	defer func(aofChan chan *aofPayload) {
+		db.aofChan = aofChan
+		db.loading = false
+	}(aofChan)
+
+	return scanAof(reader, db.readRDB, func(cmdLine [][]byte) {
+		cmd := strings.ToLower(string(cmdLine[0]))
+		cmdSpec, ok := router[cmd]
+		if !ok || cmdSpec.executor == nil || !cmdSpec.validateArity(cmdLine) {
+			logger.Warn("illegal command in aof: " + cmd)
+			return
 		}
-		return true
+		cmdSpec.executor(db, cmdLine[1:])
 	})
+}
+
+/* -- aof rewrite -- */
+
+// aofRewrite rewrites aof synchronously
+func (db *DB) aofRewrite() error {
+	rewritten, snap, err := db.startRewrite()
+	if err != nil {
+		return err
+	}
+	return db.doRewrite(rewritten, snap)
+}
+
+// doRewrite writes snap as a new base, then replaces files of rewritten by the base
+func (db *DB) doRewrite(rewritten *aofManifest, snap *snapshot) error {
+	tmpFile, err := db.writeBase(snap)
+	db.releaseSnapshot(snap)
+	if err != nil {
+		logger.Warn("aof rewrite failed: " + err.Error())
+		db.pausingAof.Lock()
+		db.aofRewriting = false
+		db.pausingAof.Unlock()
+		return err
+	}
+	if err := db.finishRewrite(tmpFile, rewritten, config.Properties.AofUseRdbPreamble); err != nil {
+		logger.Warn("aof rewrite failed: " + err.Error())
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	logger.Info("background aof rewrite terminated with success")
+	return nil
+}
 
-	// add ttl
-	tmpDB.TTLMap.ForEach(func(key string, raw interface{}) bool {
-		expireTime, _ := raw.(time.Time)
-		cmd := makeExpireCmd(key, expireTime)
-		if cmd != nil {
-			_, _ = file.Write(cmd.ToBytes())
+// writeBase writes data set of snap into a tmp file, returns name of the tmp file
+func (db *DB) writeBase(snap *snapshot) (filename string, err error) {
+	// create tmp file in aof dir, so that it could be renamed
+	file, err := os.CreateTemp(db.aofDir, "temp-rewriteaof-*.aof")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
 		}
-		return true
+	}()
+	if config.Properties.AofUseRdbPreamble {
+		err = db.writeRDB(file, snap)
+	} else {
+		err = db.writeCommands(file, snap)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err = file.Sync(); err != nil {
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// writeCommands writes commands rebuilding data set of snap
+func (db *DB) writeCommands(writer io.Writer, snap *snapshot) error {
+	for _, code := range snap.libraries {
+		cmd := reply.MakeMultiBulkReply([][]byte{[]byte("FUNCTION"), []byte("LOAD"), []byte("REPLACE"), code})
+		if _, err := writer.Write(cmd.ToBytes()); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	var err error
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if !expireAt.IsZero() && now.After(expireAt) {
+			return true
+		}
+		cmd := entityToCmd(key, entity)
+		if cmd == nil {
+			return true
+		}
+		if _, err = writer.Write(cmd.ToBytes()); err != nil {
+			return false
+		}
+		if !expireAt.IsZero() {
+			_, err = writer.Write(makeExpireCmd(key, expireAt).ToBytes())
+		}
+		return err == nil
 	})
-	db.finishRewrite(file)
+	return err
+}
+
+// entityToCmd returns a command line which rebuilds entity, returns nil if the type is not supported
+func entityToCmd(key string, entity *DataEntity) *reply.MultiBulkReply {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return persistString(key, val)
+	case *List.LinkedList:
+		return persistList(key, val)
+	case *set.Set:
+		return persistSet(key, val)
+	case dict.Dict:
+		return persistHash(key, val)
+	case *SortedSet.SortedSet:
+		return persistZSet(key, val)
+	}
+	return nil
 }
 
 var setCmd = []byte("SET")
@@ -230,11 +420,11 @@ func persistString(key string, bytes []byte) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(args)
 }
 
-var rPushAllCmd = []byte("RPUSHALL")
+var rPushCmd = []byte("RPUSH")
 
 func persistList(key string, list *List.LinkedList) *reply.MultiBulkReply {
 	args := make([][]byte, 2+list.Len())
-	args[0] = rPushAllCmd
+	args[0] = rPushCmd
 	args[1] = []byte(key)
 	list.ForEach(func(i int, val interface{}) bool {
 		bytes, _ := val.([]byte)
@@ -276,69 +466,99 @@ func persistHash(key string, hash dict.Dict) *reply.MultiBulkReply {
 	return reply.MakeMultiBulkReply(args)
 }
 
-// var zAddCmd = []byte("ZADD")
-
-// func persistZSet(key string, zset *SortedSet.SortedSet) *reply.MultiBulkReply {
-// 	args := make([][]byte, 2+zset.Len()*2)
-// 	args[0] = zAddCmd
-// 	args[1] = []byte(key)
-// 	i := 0
-// 	zset.ForEach(int64(0), int64(zset.Len()), true, func(element *SortedSet.Element) bool {
-// 		value := strconv.FormatFloat(element.Score, 'f', -1, 64)
-// 		args[2+i*2] = []byte(value)
-// 		args[3+i*2] = []byte(element.Member)
-// 		i++
-// 		return true
-// 	})
-// 	return reply.MakeMultiBulkReply(args)
-// }
-
-func (db *DB) startRewrite() (*os.File, error) {
-	db.pausingAof.Lock() // pausing aof
-	defer db.pausingAof.Unlock()
+var zAddCmd = []byte("ZADD")
 
-	// create rewrite channel
-	db.aofRewriteChan = make(chan *reply.MultiBulkReply, aofQueueSize)
+func persistZSet(key string, zset *SortedSet.SortedSet) *reply.MultiBulkReply {
+	args := make([][]byte, 2+zset.Len()*2)
+	args[0] = zAddCmd
+	args[1] = []byte(key)
+	i := 0
+	zset.ForEach(func(element *SortedSet.Element) bool {
+		value := strconv.FormatFloat(element.Score, 'f', -1, 64)
+		args[2+i*2] = []byte(value)
+		args[3+i*2] = []byte(element.Member)
+		i++
+		return true
+	})
+	return reply.MakeMultiBulkReply(args)
+}
 
-	// create tmp file
-	file, err := os.CreateTemp("", "aof")
+// startRewrite takes a snapshot and switches aof to a new incr file at the same point,
+// returns manifest of files to be replaced and the snapshot
+func (db *DB) startRewrite() (*aofManifest, *snapshot, error) {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	// commands before the snapshot must not be written into the new incr file
+	db.flushAofQueue()
+	rewritten, err := db.rotateAof()
 	if err != nil {
-		logger.Warn("tmp file create failed")
-		return nil, err
+		return nil, nil, err
 	}
-	return file, nil
+	return rewritten, db.addSnapshot(), nil
+}
+
+// flushAofQueue returns after queued commands are written
+func (db *DB) flushAofQueue() {
+	if db.aofChan == nil || db.aofFile == nil {
+		return
+	}
+	barrier := &aofPayload{synced: &sync.WaitGroup{}}
+	barrier.synced.Add(1)
+	db.aofChan <- barrier
+	barrier.synced.Wait()
 }
 
-func (db *DB) finishRewrite(tmpFile *os.File) {
+// rotateAof switches aof to a new incr file, returns manifest of files before it
+func (db *DB) rotateAof() (*aofManifest, error) {
 	db.pausingAof.Lock() // pausing aof
 	defer db.pausingAof.Unlock()
 
-	// write commands created during rewriting to tmp file
-loop:
-	for {
-		// aof is pausing, there won't be any new commands in aofRewriteChan
-		select {
-		case cmd := <-db.aofRewriteChan:
-			_, err := tmpFile.Write(cmd.ToBytes())
-			if err != nil {
-				logger.Warn(err)
-			}
-		default:
-			// channel is empty, break loop
-			break loop
-		}
+	if db.aofFile == nil {
+		return nil, errors.New("append only file is disabled")
+	}
+	if db.aofRewriting {
+		return nil, errors.New("Background append only file rewriting already in progress")
+	}
+	rewritten := db.aofManifest
+	file, err := db.addIncrFile()
+	if err != nil {
+		return nil, err
+	}
+	// the old incr file is complete on disk before being rewritten
+	if db.fsyncPolicy != fsyncNo {
+		db.fsyncAof()
 	}
-	close(db.aofRewriteChan)
-	db.aofRewriteChan = nil
-
-	// replace current aof file by tmp file
 	_ = db.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), db.aofFilename)
+	db.aofFile = file
+	db.aofRewriting = true
+	return rewritten, nil
+}
 
-	// reopen aof file for further write
-	aofFile, err := os.OpenFile(db.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		logger.Warn(err)
+// finishRewrite renames tmp file to the new base, then replaces rewritten files by it in manifest
+func (db *DB) finishRewrite(tmpFile string, rewritten *aofManifest, rdbBase bool) error {
+	db.pausingAof.Lock()
+	defer db.pausingAof.Unlock()
+	db.aofRewriting = false
+
+	manifest := db.aofManifest.clone()
+	base := manifest.nextBase(db.aofFilename, rdbBase)
+	filename := filepath.Join(db.aofDir, base.name)
+	if err := os.Rename(tmpFile, filename); err != nil {
+		return err
+	}
+	manifest.base = base
+	// incr files created during rewriting are kept
+	manifest.incrs = manifest.incrs[len(rewritten.incrs):]
+	if err := writeManifest(db.manifestFilename(), manifest); err != nil {
+		_ = os.Remove(filename)
+		return err
+	}
+	db.aofManifest = manifest
+
+	for _, info := range rewritten.files() {
+		if err := os.Remove(filepath.Join(db.aofDir, info.name)); err != nil {
+			logger.Warn(err)
+		}
 	}
-	db.aofFile = aofFile
+	return nil
 }
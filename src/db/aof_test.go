@@ -0,0 +1,360 @@
+package db
+
+import (
+	"myGodis/src/config"
+	"myGodis/src/datastruct/dict"
+	"myGodis/src/datastruct/lock"
+	"myGodis/src/lib/rdb"
+	"myGodis/src/redis/reply"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useAof enables aof in a tmp dir and returns the dir
+func useAof(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "appendonlydir")
+	config.Properties.AppendOnly = true
+	config.Properties.AppendDirname = dir
+	config.Properties.AppendFilename = "appendonly.aof"
+	t.Cleanup(func() {
+		config.Properties.AppendOnly = false
+		config.Properties.AppendDirname = "appendonlydir"
+	})
+	return dir
+}
+
+// aofContent returns content of all files listed by manifest
+func aofContent(t *testing.T, dir string) string {
+	t.Helper()
+	files, err := ReadAofManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content []byte
+	for _, filename := range files {
+		data, _ := os.ReadFile(filename)
+		content = append(content, data...)
+	}
+	return string(content)
+}
+
+func TestLoadAofEmptyBulk(t *testing.T) {
+	// the single aof file of older version is moved into aof dir
+	useAof(t)
+	legacy := filepath.Join(t.TempDir(), "appendonly.aof")
+	content := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n" +
+		"*3\r\n$5\r\nRPUSH\r\n$1\r\nl\r\n$0\r\n\r\n"
+	if err := os.WriteFile(legacy, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.Properties.AppendFilename = legacy
+
+	db := MakeDB()
+	defer db.Close()
+	result := db.Exec(nil, toArgs("get", "k"))
+	if string(result.ToBytes()) != "$0\r\n\r\n" {
+		t.Errorf("expected empty bulk, actual %q", result.ToBytes())
+	}
+	result = db.Exec(nil, toArgs("llen", "l"))
+	if string(result.ToBytes()) != ":1\r\n" {
+		t.Errorf("expected 1, actual %q", result.ToBytes())
+	}
+}
+
+// waitAof waits until aof files contain s
+func waitAof(t *testing.T, dir string, s string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if strings.Contains(aofContent(t, dir), s) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q is not written into aof", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRewriteWithRdbPreamble(t *testing.T) {
+	dir := useAof(t)
+	config.Properties.AofUseRdbPreamble = true
+	defer func() {
+		config.Properties.AofUseRdbPreamble = false
+	}()
+
+	db := MakeDB()
+	db.Exec(nil, toArgs("set", "str", "v"))
+	db.Exec(nil, toArgs("rpush", "list", "a", "b"))
+	db.Exec(nil, toArgs("hset", "hash", "f", "v"))
+	db.Exec(nil, toArgs("sadd", "set", "m"))
+	db.Exec(nil, toArgs("pexpire", "hash", "100000"))
+	waitAof(t, dir, "PEXPIREAT")
+	if err := db.aofRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(nil, toArgs("rpush", "list", "c"))
+	waitAof(t, dir, "rpush")
+	db.Close()
+
+	manifest, err := os.ReadFile(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("expected manifest %q, actual %q", expected, manifest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "appendonly.aof.1.incr.aof")); !os.IsNotExist(err) {
+		t.Error("rewritten incr file should be removed")
+	}
+	if content := aofContent(t, dir); !strings.HasPrefix(content, "REDIS") {
+		t.Fatalf("aof should start with rdb preamble: %q", content)
+	}
+
+	loaded := MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"get", "str"}, "$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"lrange", "list", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	assertReply(t, loaded, []string{"hget", "hash", "f"}, "$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"sismember", "set", "m"}, ":1\r\n")
+	if ttl := loaded.Exec(nil, toArgs("ttl", "hash")).ToBytes(); string(ttl) == ":-1\r\n" {
+		t.Error("ttl of hash is lost")
+	}
+}
+
+func TestAppendFsyncAlways(t *testing.T) {
+	dir := useAof(t)
+	config.Properties.AppendFsync = "always"
+	defer func() {
+		config.Properties.AppendFsync = "everysec"
+	}()
+
+	db := MakeDB()
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Exec(nil, toArgs("set", "k"+strconv.Itoa(i), "v"))
+		// the command is on disk once replied
+		if !strings.Contains(aofContent(t, dir), "k"+strconv.Itoa(i)) {
+			t.Fatalf("k%d is not written before reply", i)
+		}
+	}
+	info := string(db.Exec(nil, toArgs("info", "persistence")).ToBytes())
+	if !strings.Contains(info, "aof_fsync_policy:always") || strings.Contains(info, "aof_fsync_count:0\r\n") {
+		t.Errorf("wrong fsync info: %s", info)
+	}
+	if strings.Contains(info, "# Server") {
+		t.Errorf("only persistence section is expected: %s", info)
+	}
+	if policy := parseFsyncPolicy("sometimes"); policy != fsyncEverySec {
+		t.Errorf("expected everysec, actual %s", policy)
+	}
+}
+
+func TestLoadTruncatedAof(t *testing.T) {
+	dir := t.TempDir()
+	valid := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n"
+	truncated := valid + "*2\r\n$3\r\nDEL\r\n$1"
+	baseFilename := filepath.Join(dir, "appendonly.aof.1.base.aof")
+	incrFilename := filepath.Join(dir, "appendonly.aof.1.incr.aof")
+	_ = os.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"),
+		[]byte("file appendonly.aof.1.base.aof seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"), 0644)
+	makeTmpDB := func() *DB {
+		return &DB{
+			Data:        dict.MakeSimple(),
+			TTLMap:      dict.MakeSimple(),
+			Locker:      lock.Make(lockerSize),
+			aofDir:      dir,
+			aofFilename: "appendonly.aof",
+		}
+	}
+	defer func() {
+		config.Properties.AofLoadTruncated = true
+	}()
+
+	// refuse to load
+	_ = os.WriteFile(baseFilename, []byte(valid), 0644)
+	_ = os.WriteFile(incrFilename, []byte(truncated), 0644)
+	config.Properties.AofLoadTruncated = false
+	if err := makeTmpDB().loadAof(); err == nil {
+		t.Error("expected error of truncated aof")
+	}
+
+	// truncate the last command of the last file
+	config.Properties.AofLoadTruncated = true
+	db := makeTmpDB()
+	if err := db.loadAof(); err != nil {
+		t.Fatal(err)
+	}
+	assertReply(t, db, []string{"get", "k"}, "$1\r\nv\r\n")
+	content, _ := os.ReadFile(incrFilename)
+	if string(content) != valid {
+		t.Errorf("aof should be truncated to %q, actual %q", valid, content)
+	}
+
+	// only the last file could be truncated
+	_ = os.WriteFile(baseFilename, []byte(truncated), 0644)
+	if err := makeTmpDB().loadAof(); err == nil {
+		t.Error("expected error of truncated base")
+	}
+
+	// bad format in the middle is never loaded
+	_ = os.WriteFile(baseFilename, []byte(valid), 0644)
+	_ = os.WriteFile(incrFilename, []byte("*1\r\n+OK\r\n"+valid), 0644)
+	if err := makeTmpDB().loadAof(); err == nil {
+		t.Error("expected error of bad format")
+	}
+	size, ok, err := CheckAof(incrFilename)
+	if err == nil || ok != 0 || size != int64(len(valid)+9) {
+		t.Errorf("wrong check result: size %d, valid %d, err %v", size, ok, err)
+	}
+
+	// missing file
+	_ = os.Remove(baseFilename)
+	if err := makeTmpDB().loadAof(); err == nil {
+		t.Error("expected error of missing base")
+	}
+}
+
+func TestRewriteDuringWrites(t *testing.T) {
+	dir := useAof(t)
+	db := MakeDB()
+	db.Exec(nil, toArgs("set", "k0", "v"))
+	assertReply(t, db, []string{"bgrewriteaof"}, "+Background append only file rewriting started\r\n")
+	for i := 1; i < 100; i++ {
+		db.Exec(nil, toArgs("set", "k"+strconv.Itoa(i), "v"))
+	}
+	for {
+		db.pausingAof.RLock()
+		rewriting := db.aofRewriting
+		db.pausingAof.RUnlock()
+		if !rewriting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	db.Close()
+
+	manifest, err := readManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.base == nil || manifest.base.name != "appendonly.aof.1.base.aof" || len(manifest.incrs) != 1 {
+		t.Fatalf("wrong manifest %q", manifest.encode())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("expected base, incr and manifest in aof dir, actual %d files", len(entries))
+	}
+
+	loaded := MakeDB()
+	defer loaded.Close()
+	for i := 0; i < 100; i++ {
+		assertReply(t, loaded, []string{"get", "k" + strconv.Itoa(i)}, "$1\r\nv\r\n")
+	}
+}
+
+// dataset returns all keys as rdb objects, members of sets and sorted sets are sorted for comparison
+func dataset(db *DB) map[string]*rdb.Object {
+	snap := db.takeSnapshot(nil)
+	defer db.releaseSnapshot(snap)
+	objects := make(map[string]*rdb.Object)
+	now := time.Now()
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if !expireAt.IsZero() && now.After(expireAt) {
+			return true
+		}
+		obj := entityToObject(key, entity, expireAt)
+		if obj == nil {
+			return true
+		}
+		if obj.Type == rdb.TypeSet {
+			sort.Slice(obj.Members, func(i, j int) bool {
+				return string(obj.Members[i]) < string(obj.Members[j])
+			})
+		}
+		sort.Slice(obj.ZSet, func(i, j int) bool {
+			return obj.ZSet[i].Member < obj.ZSet[j].Member
+		})
+		objects[key] = obj
+		return true
+	})
+	return objects
+}
+
+func TestAofRoundTrip(t *testing.T) {
+	writes := [][]string{
+		{"set", "str", "v"}, {"set", "px", "v", "px", "100000"}, {"setex", "ex", "100", "v"},
+		{"set", "counter", "1"}, {"incrby", "counter", "10"}, {"incrbyfloat", "counter", "0.5"},
+		{"rpush", "list", "a", "b", "c", "d"}, {"lpush", "list", "z"}, {"lpop", "list"},
+		{"lset", "list", "0", "x"}, {"lrem", "list", "1", "c"}, {"rpoplpush", "list", "list2"},
+		{"hset", "hash", "f1", "v1"}, {"hsetnx", "hash", "f1", "other"}, {"hmset", "hash", "f2", "1", "f3", "v3"},
+		{"hincrby", "hash", "f2", "5"}, {"hincrbyfloat", "hash", "f4", "1.5"}, {"hdel", "hash", "f3"},
+		{"sadd", "s1", "a", "b", "c"}, {"sadd", "s2", "b", "c", "d"}, {"srem", "s1", "a"},
+		{"sinterstore", "inter", "s1", "s2"}, {"sunionstore", "union", "s1", "s2"}, {"sdiffstore", "diff", "s2", "s1"},
+		{"zadd", "zset", "1", "a", "2", "b", "3", "c"}, {"zadd", "zset", "0.5", "c", "-inf", "d"},
+		{"set", "renamed", "v"}, {"expire", "renamed", "1000"}, {"rename", "renamed", "dest"},
+		{"set", "persisted", "v"}, {"pexpire", "persisted", "100"}, {"persist", "persisted"},
+		{"set", "deleted", "v"}, {"del", "deleted"},
+		// expires before restart, but the command after ttl must not be replayed on nothing
+		{"set", "short", "1", "px", "100"}, {"incr", "short"},
+		{"set", "retyped", "v", "px", "1"},
+	}
+	cases := []struct {
+		name        string
+		rewrite     bool
+		rdbPreamble bool
+	}{
+		{"append", false, false},
+		{"rewrite", true, false},
+		{"rdb-preamble", true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useAof(t)
+			config.Properties.AppendFsync = "always"
+			config.Properties.AofUseRdbPreamble = c.rdbPreamble
+			defer func() {
+				config.Properties.AppendFsync = "everysec"
+				config.Properties.AofUseRdbPreamble = false
+			}()
+
+			db := MakeDB()
+			for _, cmdLine := range writes {
+				if result, ok := db.Exec(nil, toArgs(cmdLine...)).(reply.ErrorReply); ok {
+					t.Fatalf("%v: %s", cmdLine, result.ToBytes())
+				}
+			}
+			if c.rewrite {
+				if err := db.aofRewrite(); err != nil {
+					t.Fatal(err)
+				}
+				db.Exec(nil, toArgs("zadd", "zset", "7", "e"))
+			}
+			time.Sleep(150 * time.Millisecond)
+			// retyped is expired, then overwritten by another type
+			assertReply(t, db, []string{"lpush", "retyped", "x"}, ":1\r\n")
+			expected := dataset(db)
+			db.Close()
+
+			loaded := MakeDB()
+			defer loaded.Close()
+			actual := dataset(loaded)
+			if len(expected) != len(actual) {
+				t.Errorf("expected %d keys, actual %d", len(expected), len(actual))
+			}
+			for key, obj := range expected {
+				if !reflect.DeepEqual(obj, actual[key]) {
+					t.Errorf("%s: expected %+v, actual %+v", key, obj, actual[key])
+				}
+			}
+			assertReply(t, loaded, []string{"zrank", "zset", "a"}, ":2\r\n")
+		})
+	}
+}
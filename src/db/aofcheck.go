@@ -0,0 +1,108 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"myGodis/src/lib/rdb"
+	"myGodis/src/redis/parser"
+	"os"
+	"strings"
+)
+
+/*
+ * AOF is read strictly command by command with offsets by parser.ReadCommand, so that a command truncated by crash
+ * could be cut off at the end of the last complete command.
+ * Commands between MULTI and EXEC are a transaction, an unfinished one is cut off as a whole.
+ */
+
+var errAofFormat = errors.New("bad file format")
+
+// countingReader counts bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// scanAof reads rdb preamble by loadPreamble if exists, then passes each command line to consumer,
+// commands of a transaction are passed after its EXEC without MULTI and EXEC themselves.
+// returns length of the valid prefix, the error is io.ErrUnexpectedEOF if the last command or transaction is truncated
+func scanAof(reader io.Reader, loadPreamble func(reader io.Reader) error, consumer func(cmdLine [][]byte)) (int64, error) {
+	counter := &countingReader{r: reader}
+	bufReader := bufio.NewReader(counter)
+	var valid int64
+	if header, _ := bufReader.Peek(len(rdbMagic)); string(header) == rdbMagic {
+		if err := loadPreamble(bufReader); err != nil {
+			return 0, errors.New("bad rdb preamble: " + err.Error())
+		}
+		valid = counter.n - int64(bufReader.Buffered())
+	}
+	var tx [][][]byte // commands of the unfinished transaction, nil if not in transaction
+	var txSize int64
+	for {
+		cmdLine, size, err := parser.ReadCommand(bufReader)
+		if err == io.EOF {
+			if tx != nil {
+				return valid, io.ErrUnexpectedEOF
+			}
+			return valid, nil
+		} else if err != nil {
+			return valid, err
+		}
+		switch {
+		case isCommand(cmdLine, "multi"):
+			if tx != nil {
+				return valid, errAofFormat
+			}
+			tx = make([][][]byte, 0)
+			txSize = size
+		case isCommand(cmdLine, "exec"):
+			if tx == nil {
+				return valid, errAofFormat
+			}
+			valid += txSize + size
+			for _, line := range tx {
+				consumer(line)
+			}
+			tx = nil
+		case tx != nil:
+			tx = append(tx, cmdLine)
+			txSize += size
+		default:
+			valid += size
+			consumer(cmdLine)
+		}
+	}
+}
+
+func isCommand(cmdLine [][]byte, name string) bool {
+	return len(cmdLine) == 1 && strings.EqualFold(string(cmdLine[0]), name)
+}
+
+// CheckAof validates format of aof file, returns size of file, length of the valid prefix and the error found
+func CheckAof(filename string) (size int64, valid int64, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	skipPreamble := func(reader io.Reader) error {
+		return rdb.NewDecoder(reader).Parse(func(obj *rdb.Object) bool {
+			return true
+		})
+	}
+	valid, err = scanAof(file, skipPreamble, func(cmdLine [][]byte) {})
+	return info.Size(), valid, err
+}
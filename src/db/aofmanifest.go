@@ -0,0 +1,209 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Multi part aof, all files are kept in appenddirname:
+ *   <appendfilename>.<seq>.base.rdb or .base.aof: snapshot written by rewrite, at most one
+ *   <appendfilename>.<seq>.incr.aof: commands after base, new commands are appended to the last one
+ *   <appendfilename>.manifest: lists files above in loading order, replaced atomically by rename
+ * Rewrite opens a new incr file when it starts, so files being rewritten are never written again,
+ * and they are replaced by the new base in one manifest update once the base is on disk.
+ */
+
+const (
+	aofBaseType = "b"
+	aofIncrType = "i"
+
+	manifestSuffix = ".manifest"
+)
+
+type aofFileInfo struct {
+	name     string
+	seq      int64
+	fileType string
+}
+
+type aofManifest struct {
+	base  *aofFileInfo
+	incrs []*aofFileInfo
+}
+
+// files returns files in loading order
+func (manifest *aofManifest) files() []*aofFileInfo {
+	files := make([]*aofFileInfo, 0, len(manifest.incrs)+1)
+	if manifest.base != nil {
+		files = append(files, manifest.base)
+	}
+	return append(files, manifest.incrs...)
+}
+
+func (manifest *aofManifest) clone() *aofManifest {
+	return &aofManifest{
+		base:  manifest.base,
+		incrs: append([]*aofFileInfo(nil), manifest.incrs...),
+	}
+}
+
+// nextIncr returns info of the next incr file
+func (manifest *aofManifest) nextIncr(prefix string) *aofFileInfo {
+	seq := int64(1)
+	if n := len(manifest.incrs); n > 0 {
+		seq = manifest.incrs[n-1].seq + 1
+	}
+	return &aofFileInfo{
+		name:     prefix + "." + strconv.FormatInt(seq, 10) + ".incr.aof",
+		seq:      seq,
+		fileType: aofIncrType,
+	}
+}
+
+// nextBase returns info of the base file written by the next rewrite
+func (manifest *aofManifest) nextBase(prefix string, rdbPreamble bool) *aofFileInfo {
+	seq := int64(1)
+	if manifest.base != nil {
+		seq = manifest.base.seq + 1
+	}
+	suffix := ".base.aof"
+	if rdbPreamble {
+		suffix = ".base.rdb"
+	}
+	return &aofFileInfo{
+		name:     prefix + "." + strconv.FormatInt(seq, 10) + suffix,
+		seq:      seq,
+		fileType: aofBaseType,
+	}
+}
+
+// encode writes a line for each file like: file appendonly.aof.1.base.rdb seq 1 type b
+func (manifest *aofManifest) encode() []byte {
+	var buf bytes.Buffer
+	for _, info := range manifest.files() {
+		buf.WriteString("file " + info.name + " seq " + strconv.FormatInt(info.seq, 10) +
+			" type " + info.fileType + "\n")
+	}
+	return buf.Bytes()
+}
+
+func parseManifest(data []byte) (*aofManifest, error) {
+	manifest := &aofManifest{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, errors.New("invalid aof manifest line: " + line)
+		}
+		info := &aofFileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+				if err != nil {
+					return nil, errors.New("invalid aof manifest line: " + line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1]
+			}
+			// unknown fields are ignored for compatibility
+		}
+		if info.name == "" || strings.ContainsAny(info.name, "/\\") {
+			return nil, errors.New("invalid aof manifest line: " + line)
+		}
+		switch info.fileType {
+		case aofBaseType:
+			if manifest.base != nil {
+				return nil, errors.New("found duplicate base file in aof manifest")
+			}
+			manifest.base = info
+		case aofIncrType:
+			if n := len(manifest.incrs); n > 0 && manifest.incrs[n-1].seq >= info.seq {
+				return nil, errors.New("incr files in aof manifest are out of order")
+			}
+			manifest.incrs = append(manifest.incrs, info)
+		default:
+			// history files are left by rewrite and could be ignored
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// readManifest returns error satisfying os.IsNotExist if the manifest doesn't exist
+func readManifest(filename string) (*aofManifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// writeManifest replaces the manifest atomically by writing a tmp file then renaming it
+func writeManifest(filename string, manifest *aofManifest) (err error) {
+	dir := filepath.Dir(filename)
+	file, err := os.CreateTemp(dir, "temp-*"+manifestSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if _, err = file.Write(manifest.encode()); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(file.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes renaming and creating of files in dir durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return file.Sync()
+}
+
+// ReadAofManifest returns paths of aof files listed by the manifest in loading order
+func ReadAofManifest(filename string) ([]string, error) {
+	manifest, err := readManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	var paths []string
+	for _, info := range manifest.files() {
+		paths = append(paths, filepath.Join(dir, info.name))
+	}
+	return paths, nil
+}
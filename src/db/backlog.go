@@ -0,0 +1,74 @@
+package db
+
+// backlog keeps the latest commands sent to replicas in a circular buffer,
+// so that a reconnected replica could continue from its offset by PSYNC
+type backlog struct {
+	buf     []byte // nil until the first replica is attached
+	idx     int    // next write position in buf
+	histlen int64  // valid bytes in buf
+	offset  int64  // replication offset of the last byte written, master_repl_offset
+}
+
+func (b *backlog) enabled() bool {
+	return b.buf != nil
+}
+
+// enable allocates buffer, data written before are not kept
+func (b *backlog) enable(size int) {
+	if size <= 0 {
+		size = 1024 * 1024
+	}
+	b.buf = make([]byte, size)
+	b.idx = 0
+	b.histlen = 0
+}
+
+// reset drops history and starts from offset, used when data set is replaced by full sync
+func (b *backlog) reset(offset int64) {
+	b.idx = 0
+	b.histlen = 0
+	b.offset = offset
+}
+
+// first returns offset of the first byte in backlog
+func (b *backlog) first() int64 {
+	return b.offset - b.histlen + 1
+}
+
+func (b *backlog) write(p []byte) {
+	if b.buf == nil {
+		return
+	}
+	b.offset += int64(len(p))
+	size := len(b.buf)
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		p = p[n:]
+		b.idx = (b.idx + n) % size
+		b.histlen += int64(n)
+	}
+	if b.histlen > int64(size) {
+		b.histlen = int64(size)
+	}
+}
+
+// readFrom copies at most max bytes starting at offset, returns false if offset is out of backlog
+func (b *backlog) readFrom(offset int64, max int) ([]byte, bool) {
+	if b.buf == nil || offset < b.first() || offset > b.offset+1 {
+		return nil, false
+	}
+	n := b.offset + 1 - offset
+	if n > int64(max) {
+		n = int64(max)
+	}
+	size := int64(len(b.buf))
+	// position of offset in buf
+	start := (int64(b.idx) - (b.offset + 1 - offset) + size) % size
+	data := make([]byte, n)
+	copied := copy(data, b.buf[start:])
+	copy(data[copied:], b.buf)
+	return data, true
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"math"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * BLPOP, BRPOP, BRPOPLPUSH and BLMOVE wait if all their lists are empty, in transactions and scripts they reply nil instead.
+ * A blocked client is queued on each of its keys, a write to the key wakes the first client of the queue,
+ * which retries the command and wakes the next client when it leaves the queue, so clients are served in FIFO order.
+ * A client only tries keys it is the first one waiting for, so new clients never take elements
+ * signalled to the clients queued before them.
+ * Blocked clients are released by timeout or when their connections are closed.
+ */
+
+type blockedClient struct {
+	keys  []string
+	ready chan struct{} // buffered, some key may be ready
+}
+
+func (b *blockedClient) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// IsBlocking returns true if the command line is a valid blocking command
+func IsBlocking(cmdLine [][]byte) bool {
+	cmd, ok := router[strings.ToLower(string(cmdLine[0]))]
+	return ok && cmd.flags&flagBlocking > 0 && cmd.validateArity(cmdLine)
+}
+
+// TryBlocking executes a blocking command line once without waiting
+func (db *DB) TryBlocking(args [][]byte) redis.Reply {
+	return db.tryBlocking(router[strings.ToLower(string(args[0]))], args)
+}
+
+// ExecBlocking executes a blocking command by try, it waits until some key is ready if try gets nothing.
+// try is called again after waiting, so invokers may hold their locks in try but not while the client is waiting.
+// try is called with args whose source keys are limited to the keys the client is the first one waiting for
+func (db *DB) ExecBlocking(c redis.Client, args [][]byte, try func(args [][]byte) redis.Reply) redis.Reply {
+	timeout, errReply := parseBlockingTimeout(args[len(args)-1])
+	if errReply != nil {
+		return errReply
+	}
+	// the client is queued before trying, so writes after the try always wake it
+	b := db.block(blockingKeys(args))
+	defer db.unblock(b)
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	var closed <-chan struct{}
+	if c != nil {
+		closed = c.Closed()
+	}
+	var empty redis.Reply
+	for {
+		var result redis.Reply
+		if headArgs := db.headArgs(b, args); headArgs != nil {
+			result = try(headArgs)
+		} else {
+			// all keys are waited by clients queued before
+			result = emptyBlockingReply(args)
+		}
+		if !isEmptyReply(result) {
+			// a key replaced by another type doesn't fail the blocked client
+			if _, wrongType := result.(*reply.WrongTypeErrReply); !wrongType || empty == nil {
+				return result
+			}
+		} else {
+			empty = result
+		}
+		select {
+		case <-b.ready:
+		case <-timer:
+			return empty
+		case <-closed:
+			return empty
+		case <-db.closeCh:
+			return empty
+		}
+	}
+}
+
+// tryBlocking executes the command if some of keys exists. Otherwise the executor only checks arguments,
+// it runs under read locks so that a failed try is not counted as a change or copied by snapshots
+func (db *DB) tryBlocking(cmdSpec *command, args [][]byte) redis.Reply {
+	keys := blockingKeys(args)
+	db.RLocks(keys...)
+	for _, key := range keys {
+		if _, ok := db.Get(key); ok {
+			db.RUnlocks(keys...)
+			return db.execNormalCommand(cmdSpec, args)
+		}
+	}
+	defer db.RUnlocks(keys...)
+	return cmdSpec.executor(db, args[1:])
+}
+
+// emptyBlockingReply replies nil like a failed try, or an error if args are illegal
+func emptyBlockingReply(args [][]byte) redis.Reply {
+	switch strings.ToLower(string(args[0])) {
+	case "blpop", "brpop":
+		return &reply.NullMultiBulkReply{}
+	case "blmove":
+		if _, _, errReply := parseMoveDirections(args[3], args[4]); errReply != nil {
+			return errReply
+		}
+	}
+	return &reply.NullBulkReply{}
+}
+
+func isEmptyReply(result redis.Reply) bool {
+	switch result.(type) {
+	case *reply.NullBulkReply, *reply.NullMultiBulkReply:
+		return true
+	}
+	return false
+}
+
+// blockingKeys returns keys a blocking command waits for, destinations of BRPOPLPUSH and BLMOVE are excluded
+func blockingKeys(args [][]byte) []string {
+	cmd := strings.ToLower(string(args[0]))
+	sources := args[1:2]
+	if cmd == "blpop" || cmd == "brpop" {
+		sources = args[1 : len(args)-1]
+	}
+	keys := make([]string, 0, len(sources))
+	seen := make(map[string]struct{}, len(sources))
+	for _, source := range sources {
+		key := string(source)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// parseBlockingTimeout parses timeout in seconds, 0 means no timeout
+func parseBlockingTimeout(arg []byte) (time.Duration, redis.Reply) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds > math.MaxInt64/float64(time.Second) {
+		return 0, reply.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, reply.MakeErrReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// block queues a client at the end of queues of keys
+func (db *DB) block(keys []string) *blockedClient {
+	b := &blockedClient{
+		keys:  keys,
+		ready: make(chan struct{}, 1),
+	}
+	db.blockingMu.Lock()
+	defer db.blockingMu.Unlock()
+	for _, key := range keys {
+		db.blocked[key] = append(db.blocked[key], b)
+	}
+	atomic.AddInt32(&db.blockedCount, 1)
+	return b
+}
+
+// unblock removes a client from queues, the next client is woken if it was the first one
+// since the client may have been woken without taking the element
+func (db *DB) unblock(b *blockedClient) {
+	db.blockingMu.Lock()
+	defer db.blockingMu.Unlock()
+	for _, key := range b.keys {
+		queue := db.blocked[key]
+		for i, other := range queue {
+			if other != b {
+				continue
+			}
+			queue = append(queue[:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(db.blocked, key)
+			} else {
+				db.blocked[key] = queue
+				if i == 0 {
+					queue[0].signal()
+				}
+			}
+			break
+		}
+	}
+	atomic.AddInt32(&db.blockedCount, -1)
+}
+
+// headArgs returns args without source keys that other clients are queued before b for, nil if no key is left
+func (db *DB) headArgs(b *blockedClient, args [][]byte) [][]byte {
+	db.blockingMu.Lock()
+	defer db.blockingMu.Unlock()
+	isHead := func(key []byte) bool {
+		return db.blocked[string(key)][0] == b
+	}
+	cmd := strings.ToLower(string(args[0]))
+	if cmd != "blpop" && cmd != "brpop" {
+		if !isHead(args[1]) {
+			return nil
+		}
+		return args
+	}
+	headArgs := make([][]byte, 0, len(args))
+	headArgs = append(headArgs, args[0])
+	for _, key := range args[1 : len(args)-1] {
+		if isHead(key) {
+			headArgs = append(headArgs, key)
+		}
+	}
+	if len(headArgs) == 1 {
+		return nil
+	}
+	return append(headArgs, args[len(args)-1])
+}
+
+// signalBlocked wakes the first client blocked on each key
+func (db *DB) signalBlocked(keys ...string) {
+	if atomic.LoadInt32(&db.blockedCount) == 0 {
+		return
+	}
+	db.blockingMu.Lock()
+	defer db.blockingMu.Unlock()
+	for _, key := range keys {
+		if queue, ok := db.blocked[key]; ok {
+			queue[0].signal()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// execAsync executes a command in background and returns its reply through the channel
+func execAsync(db *DB, c *testClient, cmdLine ...string) <-chan string {
+	result := make(chan string, 1)
+	go func() {
+		if c == nil {
+			result <- string(db.Exec(nil, toArgs(cmdLine...)).ToBytes())
+		} else {
+			result <- string(db.Exec(c, toArgs(cmdLine...)).ToBytes())
+		}
+	}()
+	return result
+}
+
+// waitBlocked waits until n clients are blocked
+func waitBlocked(t *testing.T, db *DB, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		count := atomic.LoadInt32(&db.blockedCount)
+		if int(count) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d blocked clients, actual %d", n, count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectResult(t *testing.T, result <-chan string, expected string) {
+	t.Helper()
+	select {
+	case actual := <-result:
+		if actual != expected {
+			t.Errorf("expected %q, actual %q", expected, actual)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("expected %q, but the client is still blocked", expected)
+	}
+}
+
+func TestBlockingPop(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+
+	// not blocked
+	db.Exec(nil, toArgs("rpush", "l2", "a", "b"))
+	assertReply(t, db, []string{"blpop", "l1", "l2", "0"}, "*2\r\n$2\r\nl2\r\n$1\r\na\r\n")
+	assertReply(t, db, []string{"brpop", "l1", "l2", "0"}, "*2\r\n$2\r\nl2\r\n$1\r\nb\r\n")
+	assertReply(t, db, []string{"blpop", "l1", "0.01"}, "*-1\r\n")
+	assertReply(t, db, []string{"blpop", "l1", "-1"}, "-ERR timeout is negative\r\n")
+	assertReply(t, db, []string{"blpop", "l1", "x"}, "-ERR timeout is not a float or out of range\r\n")
+	db.Exec(nil, toArgs("set", "str", "v"))
+	assertReply(t, db, []string{"blpop", "str", "0"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+
+	// clients are served in FIFO order
+	first := execAsync(db, nil, "blpop", "l1", "0")
+	waitBlocked(t, db, 1)
+	second := execAsync(db, nil, "brpop", "other", "l1", "0")
+	waitBlocked(t, db, 2)
+	db.Exec(nil, toArgs("rpush", "l1", "a", "b"))
+	expectResult(t, first, "*2\r\n$2\r\nl1\r\n$1\r\na\r\n")
+	expectResult(t, second, "*2\r\n$2\r\nl1\r\n$1\r\nb\r\n")
+	waitBlocked(t, db, 0)
+
+	// new clients queue behind a woken client which has not taken its element yet
+	ahead := db.block([]string{"l1"})
+	db.Exec(nil, toArgs("rpush", "l1", "x"))
+	expectResult(t, execAsync(db, nil, "blmove", "l1", "l2", "up", "left", "0"), "-ERR syntax error\r\n")
+	late := execAsync(db, nil, "blpop", "l1", "0")
+	waitBlocked(t, db, 2)
+	assertReply(t, db, []string{"lrange", "l1", "0", "-1"}, "*1\r\n$1\r\nx\r\n")
+	db.unblock(ahead)
+	expectResult(t, late, "*2\r\n$2\r\nl1\r\n$1\r\nx\r\n")
+	waitBlocked(t, db, 0)
+
+	// waiting clients don't retry or change anything until their keys are written
+	dirty := atomic.LoadInt64(&db.dirty)
+	blocked := execAsync(db, nil, "blpop", "l1", "0")
+	waitBlocked(t, db, 1)
+	db.Exec(nil, toArgs("rpush", "other", "a"))
+	time.Sleep(20 * time.Millisecond)
+	if changes := atomic.LoadInt64(&db.dirty) - dirty; changes != 1 {
+		t.Errorf("expected 1 change while blocked, actual %d", changes)
+	}
+	db.blockingMu.Lock()
+	woken := len(db.blocked["l1"][0].ready)
+	db.blockingMu.Unlock()
+	if woken != 0 {
+		t.Error("blocked client should not be woken by other keys")
+	}
+	db.Exec(nil, toArgs("rpush", "l1", "a"))
+	expectResult(t, blocked, "*2\r\n$2\r\nl1\r\n$1\r\na\r\n")
+
+	// woken by a transaction after it finishes
+	blocked = execAsync(db, nil, "blpop", "l1", "0")
+	waitBlocked(t, db, 1)
+	c := &testClient{}
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"lpush", "l1", "a"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"lpop", "l1"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"lpush", "l1", "b"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*3\r\n:1\r\n$1\r\na\r\n:1\r\n")
+	expectResult(t, blocked, "*2\r\n$2\r\nl1\r\n$1\r\nb\r\n")
+
+	// no blocking in transactions
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"blpop", "l1", "0"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*1\r\n*-1\r\n")
+
+	// timeout
+	start := time.Now()
+	assertReply(t, db, []string{"brpop", "l1", "0.05"}, "*-1\r\n")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned before timeout: %s", elapsed)
+	}
+	waitBlocked(t, db, 0)
+
+	// closed clients are released and don't take elements
+	closing := &testClient{closed: make(chan struct{})}
+	blocked = execAsync(db, closing, "blpop", "l1", "0")
+	waitBlocked(t, db, 1)
+	close(closing.closed)
+	expectResult(t, blocked, "*-1\r\n")
+	waitBlocked(t, db, 0)
+	db.Exec(nil, toArgs("rpush", "l1", "a"))
+	assertReply(t, db, []string{"llen", "l1"}, ":1\r\n")
+}
+
+func TestBlockingMove(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+
+	db.Exec(nil, toArgs("rpush", "src", "a", "b", "c"))
+	assertReply(t, db, []string{"lmove", "src", "dst", "left", "right"}, "$1\r\na\r\n")
+	assertReply(t, db, []string{"lmove", "src", "src", "right", "left"}, "$1\r\nc\r\n")
+	assertReply(t, db, []string{"lrange", "src", "0", "-1"}, "*2\r\n$1\r\nc\r\n$1\r\nb\r\n")
+	assertReply(t, db, []string{"lmove", "src", "dst", "up", "right"}, "-ERR syntax error\r\n")
+	assertReply(t, db, []string{"lmove", "nothing", "dst", "left", "right"}, "$-1\r\n")
+	db.Exec(nil, toArgs("set", "str", "v"))
+	assertReply(t, db, []string{"lmove", "src", "str", "left", "right"}, "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+	assertReply(t, db, []string{"llen", "src"}, ":2\r\n")
+
+	// blocked on source only, the destination may be written meanwhile
+	moved := execAsync(db, nil, "blmove", "queue", "dst", "right", "left", "0")
+	waitBlocked(t, db, 1)
+	popped := execAsync(db, nil, "brpoplpush", "dst", "queue", "0")
+	expectResult(t, popped, "$1\r\na\r\n")
+	expectResult(t, moved, "$1\r\na\r\n")
+	assertReply(t, db, []string{"lrange", "dst", "0", "-1"}, "*1\r\n$1\r\na\r\n")
+	assertReply(t, db, []string{"brpoplpush", "nothing", "dst", "0.01"}, "$-1\r\n")
+	assertReply(t, db, []string{"command", "info", "blmove"}, "*1\r\n*7\r\n$6\r\nblmove\r\n:6\r\n"+
+		"*2\r\n+write\r\n+blocking\r\n:1\r\n:2\r\n:1\r\n*2\r\n+@write\r\n+@blocking\r\n")
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"sort"
+	"strings"
+)
+
+/*
+ * COMMAND introspection, replies are generated from the command table in router.go
+ */
+
+func (cmd *command) flagNames() [][]byte {
+	var flags [][]byte
+	if cmd.flags&flagWrite > 0 {
+		flags = append(flags, []byte("write"))
+	}
+	if cmd.flags&flagReadOnly > 0 {
+		flags = append(flags, []byte("readonly"))
+	}
+	if cmd.flags&flagPubSub > 0 {
+		flags = append(flags, []byte("pubsub"))
+	}
+	if cmd.flags&flagNoMulti > 0 {
+		flags = append(flags, []byte("no-multi"))
+	}
+	if cmd.flags&flagNoScript > 0 {
+		flags = append(flags, []byte("noscript"))
+	}
+	if cmd.flags&flagScript > 0 {
+		flags = append(flags, []byte("may-replicate"))
+	}
+	if cmd.flags&flagBlocking > 0 {
+		flags = append(flags, []byte("blocking"))
+	}
+	if cmd.keysFunc != nil {
+		flags = append(flags, []byte("movablekeys"))
+	}
+	return flags
+}
+
+func (cmd *command) aclCategories() [][]byte {
+	var categories [][]byte
+	if cmd.flags&flagWrite > 0 {
+		categories = append(categories, []byte("@write"))
+	}
+	if cmd.flags&flagReadOnly > 0 {
+		categories = append(categories, []byte("@read"))
+	}
+	if cmd.flags&flagPubSub > 0 {
+		categories = append(categories, []byte("@pubsub"))
+	}
+	if cmd.flags&flagScript > 0 {
+		categories = append(categories, []byte("@scripting"))
+	}
+	if cmd.flags&flagBlocking > 0 {
+		categories = append(categories, []byte("@blocking"))
+	}
+	return categories
+}
+
+// toDescReply formats cmd as one element of COMMAND reply:
+// name, arity, flags, first key, last key, step, acl categories
+func (cmd *command) toDescReply() redis.Reply {
+	return reply.MakeMultiRawReply([]redis.Reply{
+		reply.MakeBulkReply([]byte(cmd.name)),
+		reply.MakeIntReply(int64(cmd.arity)),
+		reply.MakeMultiRawReply(toStatusReplies(cmd.flagNames())),
+		reply.MakeIntReply(int64(cmd.firstKey)),
+		reply.MakeIntReply(int64(cmd.lastKey)),
+		reply.MakeIntReply(int64(cmd.keyStep)),
+		reply.MakeMultiRawReply(toStatusReplies(cmd.aclCategories())),
+	})
+}
+
+func toStatusReplies(names [][]byte) []redis.Reply {
+	replies := make([]redis.Reply, len(names))
+	for i, name := range names {
+		replies[i] = reply.MakeStatusReply(string(name))
+	}
+	return replies
+}
+
+// COMMAND [COUNT | INFO [command ...] | GETKEYS command [arg ...] | DOCS [command ...]]
+func Command(db *DB, args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return commandAll()
+	}
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "count":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "command|count"}
+		}
+		return reply.MakeIntReply(int64(len(router)))
+	case "info":
+		return commandInfo(args[1:])
+	case "getkeys":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: "command|getkeys"}
+		}
+		return commandGetKeys(args[1:])
+	case "docs":
+		// docs are not maintained, reply empty array so that clients fallback to COMMAND
+		return &reply.EmptyMultiBulkReply{}
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try COMMAND HELP.")
+	}
+}
+
+func commandAll() redis.Reply {
+	names := make([]string, 0, len(router))
+	for name := range router {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	replies := make([]redis.Reply, len(names))
+	for i, name := range names {
+		replies[i] = router[name].toDescReply()
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func commandInfo(names [][]byte) redis.Reply {
+	if len(names) == 0 {
+		return commandAll()
+	}
+	replies := make([]redis.Reply, len(names))
+	for i, name := range names {
+		cmd, ok := router[strings.ToLower(string(name))]
+		if !ok {
+			replies[i] = &reply.NullMultiBulkReply{}
+			continue
+		}
+		replies[i] = cmd.toDescReply()
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+// commandGetKeys extracts keys of a full command line, eg. COMMAND GETKEYS MSET a 1 b 2
+func commandGetKeys(cmdLine [][]byte) redis.Reply {
+	cmd, ok := router[strings.ToLower(string(cmdLine[0]))]
+	if !ok {
+		return reply.MakeErrReply("ERR Invalid command specified")
+	}
+	if !cmd.validateArity(cmdLine) {
+		return reply.MakeErrReply("ERR Invalid number of arguments specified for command")
+	}
+	keys := cmd.getKeys(cmdLine)
+	if len(keys) == 0 {
+		return reply.MakeErrReply("ERR The command has no key arguments")
+	}
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i] = []byte(key)
+	}
+	return reply.MakeMultiBulkReply(result)
+}
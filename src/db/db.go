@@ -11,12 +11,25 @@ import (
 	"myGodis/src/pubsub"
 	"myGodis/src/redis/reply"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// fsyncStats records fsync latency of aof
+type fsyncStats struct {
+	mu      sync.Mutex
+	count   int64
+	total   time.Duration
+	last    time.Duration
+	max     time.Duration
+	lastErr error
+}
+
 type DataEntity struct {
 	Data interface{}
 }
@@ -46,20 +59,63 @@ type DB struct {
 	// TimerTask interval
 	interval time.Duration
 
-	stopWorld sync.WaitGroup
-
 	hub *pubsub.Hub
 
 	// main goroutine send commands to aof goroutine through aofChan
-	aofChan     chan *reply.MultiBulkReply
-	aofFile     *os.File
-	aofFilename string
-
-	aofRewriteChan chan *reply.MultiBulkReply
-	pausingAof     sync.RWMutex
+	aofChan     chan *aofPayload
+	aofFile     *os.File // the last incr file
+	aofDir      string
+	aofFilename string // prefix of files in aofDir
+	aofManifest *aofManifest
+	fsyncPolicy string
+	aofUnsynced int32 // 1 if some commands are written but not fsynced, accessed atomically
+	fsyncStats  fsyncStats
+
+	aofRewriting bool // protected by pausingAof
+	loading      bool // replaying aof, keys are not expired
+	pausingAof   sync.RWMutex
+
+	// rdb
+	dirty       int64 // changes since last save, accessed atomically
+	saveMu      sync.Mutex
+	saving      bool
+	lastSave    time.Time // time of last successful save
+	lastSaveTry time.Time
+	lastSaveOK  bool
+
+	// replication
+	repl        *replication
+	replicaMode int32 // 1 if this server is a replica, accessed atomically
+	// write commands hold the read lock, snapshots are taken with the write lock, see snapshot.go
+	snapshotMu    sync.RWMutex
+	snapshotsMu   sync.Mutex // guards snapshots
+	snapshots     []*snapshot
+	snapshotCount int32 // len(snapshots), accessed atomically
+	// commands recorded by running write transactions, see multi.go
+	txAofMu  sync.Mutex
+	txAofs   map[string]*txAof // write key -> buffer of the transaction locking it
+	txAofAll *txAof            // buffer of the transaction holding snapshotMu exclusively, it records all commands
+	// versions of keys watched by clients
+	watchMu      sync.Mutex
+	watched      map[string]*watchedKey
+	watchedCount int32 // len(watched), accessed atomically
+	// lua scripts and their cache
+	scripts *scripting
+	// clients waiting for lists, see blocking.go
+	blockingMu   sync.Mutex
+	blocked      map[string][]*blockedClient
+	blockedCount int32 // clients in blocked, accessed atomically
+
+	startTime time.Time
+	closeCh   chan struct{}
 }
 
-var router = MakeRouter()
+var router map[string]*command
+
+func init() {
+	// initialized in init() since some executors refer to router (eg. loadAof)
+	router = MakeRouter()
+}
 
 func MakeDB() *DB {
 	db := &DB{
@@ -68,24 +124,69 @@ func MakeDB() *DB {
 		Locker:   lock.Make(lockerSize),
 		interval: 5 * time.Second,
 
-		hub: pubsub.MakeHub(),
+		hub:     pubsub.MakeHub(),
+		watched: make(map[string]*watchedKey),
+		blocked: make(map[string][]*blockedClient),
+		txAofs:  make(map[string]*txAof),
+
+		startTime:  time.Now(),
+		lastSave:   time.Now(),
+		lastSaveOK: true,
+		closeCh:    make(chan struct{}),
+		repl:       makeReplication(),
 	}
+	db.scripts = makeScripting(db)
 
 	// aof
 	if config.Properties.AppendOnly {
-		db.aofFilename = config.Properties.AppendFilename
-		db.loadAof()
-		aofFile, err := os.OpenFile(db.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		db.aofDir = config.Properties.AppendDirname
+		db.aofFilename = filepath.Base(config.Properties.AppendFilename)
+		db.fsyncPolicy = parseFsyncPolicy(config.Properties.AppendFsync)
+		if err := db.loadAof(); err != nil {
+			logger.Fatal(err.Error())
+		}
+		aofFile, err := db.openAof()
 		if err != nil {
 			logger.Warn(err)
 		} else {
 			db.aofFile = aofFile
-			db.aofChan = make(chan *reply.MultiBulkReply, aofQueueSize)
+			db.aofChan = make(chan *aofPayload, aofQueueSize)
 		}
 
 		go func() {
 			db.handleAof()
 		}()
+		if db.fsyncPolicy == fsyncEverySec {
+			go db.fsyncEverySec()
+		}
+	} else if _, err := os.Stat(config.Properties.DBFilename); err == nil {
+		// aof has higher priority since it is more complete
+		if err := db.loadRDB(config.Properties.DBFilename); err != nil {
+			logger.Error("load " + config.Properties.DBFilename + " failed: " + err.Error())
+		}
+	}
+
+	// rdb
+	saveParams, err := parseSaveParams(config.Properties.Save)
+	if err != nil {
+		logger.Warn(err.Error())
+	} else if len(saveParams) > 0 {
+		go db.saveCron(saveParams)
+	}
+
+	// replication
+	go db.replicationCron()
+	if config.Properties.ReplicaOf != "" {
+		fields := strings.Fields(config.Properties.ReplicaOf)
+		port := 0
+		if len(fields) == 2 {
+			port, _ = strconv.Atoi(fields[1])
+		}
+		if port <= 0 {
+			logger.Warn("invalid replicaof " + config.Properties.ReplicaOf)
+		} else {
+			db.replicaOf(fields[0], port)
+		}
 	}
 
 	// start timer
@@ -94,7 +195,18 @@ func MakeDB() *DB {
 }
 
 func (db *DB) Close() {
+	if db.closeCh != nil {
+		close(db.closeCh)
+	}
+	if db.repl != nil {
+		db.stopReplication()
+	}
 	if db.aofFile != nil {
+		db.pausingAof.Lock()
+		defer db.pausingAof.Unlock()
+		if db.fsyncPolicy != fsyncNo {
+			db.fsyncAof()
+		}
 		err := db.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
@@ -111,41 +223,115 @@ func (db *DB) Exec(c redis.Client, args [][]byte) (result redis.Reply) {
 	}()
 
 	cmd := strings.ToLower(string(args[0]))
+	cmdSpec, ok := router[cmd]
+	if !ok {
+		return rejectInMulti(c, reply.MakeErrReply("ERR unknown command '"+cmd+"'"))
+	}
+	if !cmdSpec.validateArity(args) {
+		return rejectInMulti(c, &reply.ArgNumErrReply{Cmd: cmd})
+	}
+
+	// transaction
+	if cmd == "multi" {
+		return StartMulti(c)
+	} else if cmd == "exec" {
+		return db.ExecMulti(c)
+	} else if cmd == "discard" {
+		return DiscardMulti(db, c)
+	} else if cmd == "watch" {
+		return Watch(db, c, args[1:])
+	}
+	if c != nil && c.InMultiState() {
+		return enqueueCmd(c, cmdSpec, args)
+	}
 
 	//special commands
 	if cmd == "subscribe" {
-		if len(args) < 2 {
-			return reply.MakeErrReply("ERR wrong number of arguments for 'subscribe' command")
-		}
 		return pubsub.Subscribe(db.hub, c, args[1:])
 	} else if cmd == "publish" {
 		return pubsub.Publish(db.hub, args[1:])
 	} else if cmd == "unsubscribe" {
 		return pubsub.UnSubscribe(db.hub, c, args[1:])
-	} else if cmd == "bgrewriteaof" {
-		reply := BGRewriteAOF(db, args[1:])
-		return reply
+	} else if cmd == "hello" {
+		return Hello(db, c, args[1:])
+	} else if cmd == "psync" || cmd == "sync" {
+		return PSync(db, c, args[1:], cmd == "sync")
+	} else if cmd == "replconf" {
+		return ReplConf(db, c, args[1:])
+	} else if cmd == "unwatch" {
+		return UnWatch(db, c)
 	}
 
-	// normal commands
-	cmdFunc, ok := router[cmd]
-	if !ok {
+	if cmdSpec.flags&flagScript > 0 {
+		return db.execScript(args)
+	} else if cmdSpec.flags&flagBlocking > 0 {
+		return db.ExecBlocking(c, args, func(args [][]byte) redis.Reply {
+			return db.tryBlocking(cmdSpec, args)
+		})
+	}
+	return db.execNormalCommand(cmdSpec, args)
+}
+
+// ExecLocked executes a command with the bookkeeping of Exec except locking,
+// invoker should hold its keys by LocksForWrite, eg. commands committed by cluster transactions
+func (db *DB) ExecLocked(cmdLine [][]byte) redis.Reply {
+	cmd := strings.ToLower(string(cmdLine[0]))
+	cmdSpec, ok := router[cmd]
+	if !ok || cmdSpec.executor == nil {
 		return reply.MakeErrReply("ERR unknown command '" + cmd + "'")
 	}
-	if len(args) > 1 {
-		result = cmdFunc(db, args[1:])
+	if !cmdSpec.validateArity(cmdLine) {
+		return &reply.ArgNumErrReply{Cmd: cmd}
+	}
+	if cmdSpec.isWrite(cmdLine) {
+		if errReply := db.checkWritable(); errReply != nil {
+			return errReply
+		}
+		db.beforeWrite(true, cmdSpec.getKeys(cmdLine)...)
+	}
+	return db.execCommand(cmdSpec, cmdLine)
+}
+
+// execNormalCommand executes a command out of transactions
+func (db *DB) execNormalCommand(cmdSpec *command, args [][]byte) redis.Reply {
+	if cmdSpec.isWrite(args) {
+		if errReply := db.checkWritable(); errReply != nil {
+			return errReply
+		}
+		db.snapshotMu.RLock()
+		defer db.snapshotMu.RUnlock()
+	}
+	return db.execWithLock(cmdSpec, args)
+}
+
+// execWithLock executes a command holding locks of its keys, write commands should hold snapshotMu
+func (db *DB) execWithLock(cmdSpec *command, args [][]byte) redis.Reply {
+	keys := cmdSpec.getKeys(args)
+	if cmdSpec.isWrite(args) {
+		// entities may be modified in place
+		db.beforeWrite(true, keys...)
+		db.Locks(keys...)
+		defer db.UnLocks(keys...)
 	} else {
-		result = cmdFunc(db, [][]byte{})
+		db.RLocks(keys...)
+		defer db.RUnlocks(keys...)
 	}
+	return db.execCommand(cmdSpec, args)
+}
 
-	// aof
-	return
+// execCommand executes a command and counts changes, invoker should hold locks of its keys
+func (db *DB) execCommand(cmdSpec *command, args [][]byte) redis.Reply {
+	result := cmdSpec.executor(db, args[1:])
+	if cmdSpec.isWrite(args) {
+		if _, ok := result.(reply.ErrorReply); !ok {
+			atomic.AddInt64(&db.dirty, 1)
+		}
+	}
+	return result
 }
 
 /* ---- Data Access ---- */
 func (db *DB) Get(key string) (*DataEntity, bool) {
-	db.stopWorld.Wait()
-
 	raw, ok := db.Data.Get(key)
 	if !ok {
 		return nil, false
@@ -158,48 +344,58 @@ func (db *DB) Get(key string) (*DataEntity, bool) {
 }
 
 func (db *DB) Put(key string, entity *DataEntity) int {
-	db.stopWorld.Wait()
-
+	db.beforeWrite(false, key)
+	defer db.touchKeys(key)
 	return db.Data.Put(key, entity)
 }
 
 func (db *DB) PutIfExists(key string, entity *DataEntity) int {
-	db.stopWorld.Wait()
-	return db.Data.PutIfExists(key, entity)
+	db.beforeWrite(false, key)
+	result := db.Data.PutIfExists(key, entity)
+	if result > 0 {
+		db.touchKeys(key)
+	}
+	return result
 }
 
 func (db *DB) PutIfAbsent(key string, entity *DataEntity) int {
-	db.stopWorld.Wait()
-	return db.Data.PutIfAbsent(key, entity)
+	db.beforeWrite(false, key)
+	result := db.Data.PutIfAbsent(key, entity)
+	if result > 0 {
+		db.touchKeys(key)
+	}
+	return result
 }
 
 func (db *DB) Remove(key string) {
-	db.stopWorld.Wait()
-	db.Data.Remove(key)
+	db.beforeWrite(false, key)
+	removed := db.Data.Remove(key)
 	db.TTLMap.Remove(key)
+	if removed > 0 {
+		db.touchKeys(key)
+	}
 }
 
 func (db *DB) Removes(keys ...string) (deleted int) {
-	db.stopWorld.Wait()
 	deleted = 0
 	for _, key := range keys {
 		_, exists := db.Data.Get(key)
 		if exists {
-			db.Data.Remove(key)
-			db.TTLMap.Remove(key)
+			db.Remove(key)
 			deleted++
 		}
 	}
 	return deleted
 }
 
+// Flush removes all keys, snapshots still see them
 func (db *DB) Flush() {
-	db.stopWorld.Add(1)
-	defer db.stopWorld.Done()
-
-	db.Data = dict.MakeConcurrent(dataDictSize)
-	db.TTLMap = dict.MakeConcurrent(ttlDictSize)
-	db.Locker = lock.Make(lockerSize)
+	var keys []string
+	db.Data.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	db.Removes(keys...)
 }
 
 /* ---- Lock Function ---------------*/
@@ -236,17 +432,40 @@ func (db *DB) RUnlocks(keys ...string) {
 	db.Locker.RUnlocks(keys...)
 }
 
+// LocksForWrite locks keys for commands executed later by ExecLocked,
+// it holds snapshotMu before keys like Exec, so that snapshots are taken between the commands
+func (db *DB) LocksForWrite(keys ...string) {
+	db.snapshotMu.RLock()
+	db.Locks(keys...)
+}
+
+func (db *DB) UnLocksForWrite(keys ...string) {
+	db.UnLocks(keys...)
+	db.snapshotMu.RUnlock()
+}
+
+func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	db.Locker.RWLocks(writeKeys, readKeys)
+}
+
+func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
+	db.Locker.RWUnLocks(writeKeys, readKeys)
+}
+
 /* ----- TTL Funtions -------*/
 // 为key设置过期时间
 func (db *DB) Expire(key string, expireTime time.Time) {
-	db.stopWorld.Wait()
+	db.beforeWrite(false, key)
 	db.TTLMap.Put(key, expireTime)
+	db.touchKeys(key)
 }
 
 // 持久化保存
 func (db *DB) Persist(key string) {
-	db.stopWorld.Wait()
-	db.TTLMap.Remove(key)
+	db.beforeWrite(false, key)
+	if db.TTLMap.Remove(key) > 0 {
+		db.touchKeys(key)
+	}
 }
 
 // 判断key是否过期
@@ -255,15 +474,23 @@ func (db *DB) IsExpired(key string) bool {
 	if !ok {
 		return false
 	}
+	if db.loading {
+		return false
+	}
 	expireTime, _ := rawExpireTime.(time.Time)
 	expired := time.Now().After(expireTime)
-	if expired {
+	// replicas wait for DEL from master
+	if expired && !db.isReplica() {
 		db.Remove(key)
+		db.addAof(makeAofCmd("del", [][]byte{[]byte(key)}))
 	}
 	return expired
 }
 
 func (db *DB) CleanExpired() {
+	if db.isReplica() {
+		return
+	}
 	now := time.Now()
 	toRemove := &List.LinkedList{}
 	db.TTLMap.ForEach(func(key string, val interface{}) bool {
@@ -271,13 +498,13 @@ func (db *DB) CleanExpired() {
 		if now.After(expireTime) {
 			// expired
 			toRemove.Add(key)
-			db.Data.Remove(key)
 		}
 		return true
 	})
 	toRemove.ForEach(func(i int, val interface{}) bool {
 		key, _ := val.(string)
-		db.TTLMap.Remove(key)
+		db.Remove(key)
+		db.addAof(makeAofCmd("del", [][]byte{[]byte(key)}))
 		return true
 	})
 }
@@ -294,4 +521,5 @@ func (db *DB) TimerTask() {
 /* ----- Subscribe Functions ----- */
 func (db *DB) AfterClientClose(c redis.Client) {
 	pubsub.UnsubscribeAll(db.hub, c)
+	db.unwatchAll(c)
 }
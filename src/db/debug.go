@@ -0,0 +1,135 @@
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"myGodis/src/datastruct/dict"
+	List "myGodis/src/datastruct/list"
+	"myGodis/src/datastruct/set"
+	SortedSet "myGodis/src/datastruct/sortedset"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * DEBUG DIGEST returns a digest of the whole data set, used to check whether replicas or reloaded dbs are the same.
+ * Digests of keys, set members and hash fields are xor-ed, so they don't depend on iteration order.
+ */
+
+type digest [sha1.Size]byte
+
+// mix replaces d by sha1(d + data), so the order of mixed data matters
+func (d *digest) mix(data []byte) {
+	h := sha1.New()
+	h.Write(d[:])
+	h.Write(data)
+	copy(d[:], h.Sum(nil))
+}
+
+// xor adds data into d regardless of order
+func (d *digest) xor(data []byte) {
+	sum := sha1.Sum(data)
+	for i := range d {
+		d[i] ^= sum[i]
+	}
+}
+
+func (d *digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// entityDigest returns digest of value and ttl, the key is not included
+func entityDigest(entity *DataEntity, expireAt time.Time) digest {
+	var d digest
+	switch val := entity.Data.(type) {
+	case []byte:
+		d.mix([]byte("string"))
+		d.mix(val)
+	case *List.LinkedList:
+		d.mix([]byte("list"))
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			d.mix(bytes)
+			return true
+		})
+	case *set.Set:
+		var members digest
+		val.ForEach(func(member string) bool {
+			members.xor([]byte(member))
+			return true
+		})
+		d.mix([]byte("set"))
+		d.mix(members[:])
+	case dict.Dict:
+		var fields digest
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			var fd digest
+			fd.mix([]byte(field))
+			fd.mix(bytes)
+			fields.xor(fd[:])
+			return true
+		})
+		d.mix([]byte("hash"))
+		d.mix(fields[:])
+	case *SortedSet.SortedSet:
+		d.mix([]byte("zset"))
+		val.ForEach(func(element *SortedSet.Element) bool {
+			d.mix([]byte(element.Member))
+			d.mix([]byte(strconv.FormatFloat(element.Score, 'g', 17, 64)))
+			return true
+		})
+	}
+	if !expireAt.IsZero() {
+		d.mix([]byte("!!expire!!"))
+		d.mix([]byte(strconv.FormatInt(expireAt.UnixNano()/1e6, 10)))
+	}
+	return d
+}
+
+// Digest returns digest of the data set at a point in time, 40 zeros if db is empty
+func (db *DB) Digest() string {
+	snap := db.takeSnapshot(nil)
+	defer db.releaseSnapshot(snap)
+	var result digest
+	now := time.Now()
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if !expireAt.IsZero() && now.After(expireAt) {
+			return true
+		}
+		var d digest
+		d.mix([]byte(key))
+		value := entityDigest(entity, expireAt)
+		d.mix(value[:])
+		result.xor(d[:])
+		return true
+	})
+	return result.String()
+}
+
+// DEBUG DIGEST | DIGEST-VALUE key [key ...]
+func Debug(db *DB, args [][]byte) redis.Reply {
+	sub := strings.ToLower(string(args[0]))
+	switch sub {
+	case "digest":
+		if len(args) != 1 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'debug|digest' command")
+		}
+		return reply.MakeStatusReply(db.Digest())
+	case "digest-value":
+		result := make([][]byte, 0, len(args)-1)
+		for _, arg := range args[1:] {
+			var d digest
+			// ttl is not included, the same as redis
+			if entity, ok := db.Get(string(arg)); ok {
+				d = entityDigest(entity, time.Time{})
+			}
+			result = append(result, []byte(d.String()))
+		}
+		return reply.MakeMultiBulkReply(result)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try DEBUG HELP.")
+}
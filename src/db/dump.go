@@ -0,0 +1,85 @@
+package db
+
+import (
+	"errors"
+	"myGodis/src/datastruct/dict"
+	"myGodis/src/datastruct/lock"
+	"myGodis/src/redis/reply"
+	"strings"
+	"time"
+)
+
+/*
+ * Dump and restore a key as command lines, used to move keys between nodes.
+ * Command lines are the same as aof rewrite, so they can be replayed by any node.
+ */
+
+var errUnsupportedType = errors.New("ERR unsupported type")
+
+// DumpKey returns command lines which rebuild key with its ttl, returns nil if key not exists
+func (db *DB) DumpKey(key string) ([][][]byte, error) {
+	return db.DumpKeyAs(key, key)
+}
+
+// DumpKeyAs is similar to DumpKey, but the command lines rebuild the value as newKey
+func (db *DB) DumpKeyAs(key string, newKey string) ([][][]byte, error) {
+	entity, ok := db.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	cmd := entityToCmd(newKey, entity)
+	if cmd == nil {
+		return nil, errUnsupportedType
+	}
+	cmdLines := [][][]byte{cmd.Args}
+	if raw, ok := db.TTLMap.Get(key); ok {
+		expireTime, _ := raw.(time.Time)
+		cmdLines = append(cmdLines, makeExpireCmd(newKey, expireTime).Args)
+	}
+	return cmdLines, nil
+}
+
+// RestoreKey replaces key by the value built from cmdLines, removes key if cmdLines is empty.
+// cmdLines should only write key, invoker should hold the lock of key
+func (db *DB) RestoreKey(key string, cmdLines [][][]byte) error {
+	tmpDB := &DB{
+		Data:   dict.MakeSimple(),
+		TTLMap: dict.MakeSimple(),
+		Locker: lock.Make(1),
+	}
+	for _, cmdLine := range cmdLines {
+		if len(cmdLine) < 2 || string(cmdLine[1]) != key {
+			return errors.New("ERR illegal command line for key " + key)
+		}
+		cmd := strings.ToLower(string(cmdLine[0]))
+		cmdSpec, ok := router[cmd]
+		if !ok || cmdSpec.executor == nil || !cmdSpec.validateArity(cmdLine) {
+			return errors.New("ERR illegal command " + cmd)
+		}
+		result := cmdSpec.executor(tmpDB, cmdLine[1:])
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			return errReply
+		}
+	}
+
+	db.Remove(key)
+	db.addAof(makeAofCmd("del", [][]byte{[]byte(key)}))
+	entity, ok := tmpDB.Get(key)
+	if !ok {
+		return nil
+	}
+	db.Put(key, entity)
+	if raw, ok := tmpDB.TTLMap.Get(key); ok {
+		expireTime, _ := raw.(time.Time)
+		db.Expire(key, expireTime)
+	}
+	for _, cmdLine := range cmdLines {
+		db.addAof(reply.MakeMultiBulkReply(cmdLine))
+	}
+	return nil
+}
+
+// AddAof sends a command line executed outside of Exec to aof, eg. commands committed by cluster transactions
+func (db *DB) AddAof(cmdLine [][]byte) {
+	db.addAof(reply.MakeMultiBulkReply(cmdLine))
+}
@@ -0,0 +1,512 @@
+package db
+
+import (
+	"context"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/rdb"
+	"myGodis/src/redis/reply"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/*
+ * Functions are named scripts grouped in libraries, a library is the lua code starting with "#!lua name=<library>"
+ * which registers functions by redis.register_function when it is loaded.
+ * Libraries are a part of the dataset: changes are sent to aof and replicas as FUNCTION commands,
+ * snapshots keep the libraries at the time they are taken and save them in rdb and aof rewrite,
+ * FLUSHALL does not remove them.
+ */
+
+const libraryLoadTimeout = 500 * time.Millisecond
+
+type library struct {
+	name      string
+	code      string
+	functions []*luaFunction // sorted by name
+}
+
+type luaFunction struct {
+	name        string
+	library     string
+	description string
+	flags       []string
+	noWrites    bool
+	callback    *lua.LFunction
+}
+
+var functionFlags = map[string]bool{
+	"no-writes":             true,
+	"allow-oom":             true,
+	"allow-stale":           true,
+	"no-cluster":            true,
+	"allow-cross-slot-keys": true,
+}
+
+func isValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMeta parses the first line of library code, eg. #!lua name=mylib.
+// The line is removed from body and line numbers are kept
+func parseLibraryMeta(code string) (name string, body string, errReply redis.Reply) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", reply.MakeErrReply("ERR Missing library metadata")
+	}
+	line := code
+	if i := strings.IndexByte(code, '\n'); i >= 0 {
+		line, body = code[:i], code[i:]
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 || strings.ToLower(fields[0]) != "lua" {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", "", reply.MakeErrReply("ERR Engine '" + engine + "' not found")
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "name=") {
+			return "", "", reply.MakeErrReply("ERR Invalid metadata value given: " + field)
+		}
+		name = field[len("name="):]
+	}
+	if name == "" {
+		return "", "", reply.MakeErrReply("ERR Library name was not given")
+	}
+	if !isValidFunctionName(name) {
+		return "", "", reply.MakeErrReply("ERR Library names can only contain letters, numbers, or underscores(_) " +
+			"and must be at least one character long")
+	}
+	return name, body, nil
+}
+
+// registerFunction implements redis.register_function(name, callback)
+// and redis.register_function{function_name=name, callback=callback, flags={...}, description=description}
+func (s *scripting) registerFunction(L *lua.LState) int {
+	if s.registering == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+	}
+	f := &luaFunction{}
+	if table, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+		table.ForEach(func(key lua.LValue, value lua.LValue) {
+			switch key.String() {
+			case "function_name":
+				f.name = lua.LVAsString(value)
+			case "callback":
+				f.callback, _ = value.(*lua.LFunction)
+			case "description":
+				f.description = lua.LVAsString(value)
+			case "flags":
+				flags, ok := value.(*lua.LTable)
+				if !ok {
+					L.RaiseError("flags argument to redis.register_function must be a table representing function flags")
+				}
+				flags.ForEach(func(_ lua.LValue, flag lua.LValue) {
+					if !functionFlags[flag.String()] {
+						L.RaiseError("unknown flag given")
+					}
+					f.flags = append(f.flags, flag.String())
+					f.noWrites = f.noWrites || flag.String() == "no-writes"
+				})
+			default:
+				L.RaiseError("unknown argument given to redis.register_function")
+			}
+		})
+	} else {
+		if L.GetTop() != 2 {
+			L.RaiseError("wrong number of arguments to redis.register_function")
+		}
+		f.name = lua.LVAsString(L.Get(1))
+		f.callback, _ = L.Get(2).(*lua.LFunction)
+	}
+	if !isValidFunctionName(f.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if f.callback == nil {
+		L.RaiseError("callback argument given to redis.register_function must be a function")
+	}
+	if _, ok := s.registering[f.name]; ok {
+		L.RaiseError("Function already exists in the library")
+	}
+	s.registering[f.name] = f
+	return 0
+}
+
+// compileLibrary runs code of a library to get its functions, invoker should hold mu
+func (s *scripting) compileLibrary(code string) (*library, redis.Reply) {
+	name, body, errReply := parseLibraryMeta(code)
+	if errReply != nil {
+		return nil, errReply
+	}
+	proto, err := compileLua(body, "@user_function")
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling function: " + err.Error())
+	}
+	L := s.getLuaState()
+	s.registering = make(map[string]*luaFunction)
+	ctx, cancel := context.WithTimeout(context.Background(), libraryLoadTimeout)
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+	timeout := ctx.Err() != nil
+	L.RemoveContext()
+	L.SetTop(0)
+	cancel()
+	registered := s.registering
+	s.registering = nil
+	if err != nil {
+		if timeout {
+			return nil, reply.MakeErrReply("ERR FUNCTION LOAD timeout")
+		}
+		return nil, reply.MakeErrReply("ERR Error registering functions: " + luaErrorMessage(err))
+	}
+	if len(registered) == 0 {
+		return nil, reply.MakeErrReply("ERR No functions registered")
+	}
+	lib := &library{name: name, code: code}
+	for _, f := range registered {
+		f.library = name
+		lib.functions = append(lib.functions, f)
+	}
+	sort.Slice(lib.functions, func(i, j int) bool {
+		return lib.functions[i].name < lib.functions[j].name
+	})
+	return lib, nil
+}
+
+// addLibraries adds compiled libraries, libraries with the same names are replaced if replace is true.
+// Nothing is changed if there is any conflict
+func (s *scripting) addLibraries(libs []*library, replace bool) redis.Reply {
+	s.libMu.Lock()
+	defer s.libMu.Unlock()
+	replaced := make(map[string]bool)
+	functionNames := make(map[string]bool)
+	for _, lib := range libs {
+		if _, ok := s.libraries[lib.name]; (ok && !replace) || replaced[lib.name] {
+			return reply.MakeErrReply("ERR Library '" + lib.name + "' already exists")
+		}
+		replaced[lib.name] = true
+	}
+	for _, lib := range libs {
+		for _, f := range lib.functions {
+			existed, ok := s.functions[f.name]
+			if (ok && !replaced[existed.library]) || functionNames[f.name] {
+				return reply.MakeErrReply("ERR Function " + f.name + " already exists")
+			}
+			functionNames[f.name] = true
+		}
+	}
+	for _, lib := range libs {
+		s.removeLibrary(lib.name)
+		s.libraries[lib.name] = lib
+		for _, f := range lib.functions {
+			s.functions[f.name] = f
+		}
+	}
+	return nil
+}
+
+// removeLibrary removes a library and its functions, invoker should hold libMu
+func (s *scripting) removeLibrary(name string) bool {
+	lib, ok := s.libraries[name]
+	if !ok {
+		return false
+	}
+	for _, f := range lib.functions {
+		delete(s.functions, f.name)
+	}
+	delete(s.libraries, name)
+	return true
+}
+
+// loadLibrary compiles and adds a library, returns its name
+func (s *scripting) loadLibrary(code string, replace bool) (string, redis.Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lib, errReply := s.compileLibrary(code)
+	if errReply != nil {
+		return "", errReply
+	}
+	if errReply := s.addLibraries([]*library{lib}, replace); errReply != nil {
+		return "", errReply
+	}
+	return lib.name, nil
+}
+
+func (s *scripting) flushLibraries() {
+	s.libMu.Lock()
+	defer s.libMu.Unlock()
+	s.libraries = make(map[string]*library)
+	s.functions = make(map[string]*luaFunction)
+}
+
+// libraryCodes returns codes of all libraries sorted by name
+func (s *scripting) libraryCodes() [][]byte {
+	s.libMu.RLock()
+	defer s.libMu.RUnlock()
+	names := make([]string, 0, len(s.libraries))
+	for name := range s.libraries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	codes := make([][]byte, len(names))
+	for i, name := range names {
+		codes[i] = []byte(s.libraries[name].code)
+	}
+	return codes
+}
+
+// FCall calls a function, FCALL function numkeys key [key ...] arg [arg ...]
+func FCall(db *DB, args [][]byte) redis.Reply {
+	return fCall(db, args, false)
+}
+
+// FCallRO calls a function with no-writes flag, FCALL_RO function numkeys key [key ...] arg [arg ...]
+func FCallRO(db *DB, args [][]byte) redis.Reply {
+	return fCall(db, args, true)
+}
+
+func fCall(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	keys, argv, errReply := parseScriptArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	name := string(args[0])
+	db.scripts.libMu.RLock()
+	f, ok := db.scripts.functions[name]
+	db.scripts.libMu.RUnlock()
+	if !ok {
+		return reply.MakeErrReply("ERR Function not found")
+	}
+	if readOnly && !f.noWrites {
+		return reply.MakeErrReply("ERR Can not execute a script with write flag using *_ro command.")
+	}
+	return db.scripts.run(&scriptRun{
+		name:     name,
+		function: true,
+		readOnly: f.noWrites,
+		keys:     keys,
+		argv:     argv,
+		push: func(L *lua.LState) int {
+			L.Push(f.callback)
+			L.Push(makeLuaStringTable(L, keys))
+			L.Push(makeLuaStringTable(L, argv))
+			return 2
+		},
+	})
+}
+
+// Function manages function libraries, FUNCTION LOAD | DELETE | FLUSH | LIST | DUMP | RESTORE | STATS | KILL
+func Function(db *DB, args [][]byte) redis.Reply {
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "load":
+		return functionLoad(db, args)
+	case "delete":
+		if len(args) != 2 {
+			return &reply.ArgNumErrReply{Cmd: "function|delete"}
+		}
+		db.scripts.libMu.Lock()
+		removed := db.scripts.removeLibrary(string(args[1]))
+		db.scripts.libMu.Unlock()
+		if !removed {
+			return reply.MakeErrReply("ERR Library not found")
+		}
+		db.addAof(makeAofCmd("function", args))
+		return &reply.OkReply{}
+	case "flush":
+		if len(args) > 2 {
+			return &reply.ArgNumErrReply{Cmd: "function|flush"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "async" && mode != "sync" {
+				return reply.MakeErrReply("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+			}
+		}
+		db.scripts.flushLibraries()
+		db.addAof(makeAofCmd("function", args))
+		return &reply.OkReply{}
+	case "list":
+		return functionList(db, args[1:])
+	case "dump":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "function|dump"}
+		}
+		return reply.MakeBulkReply(rdb.EncodeFunctions(db.scripts.libraryCodes()))
+	case "restore":
+		return functionRestore(db, args)
+	case "stats":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "function|stats"}
+		}
+		return db.scripts.stats()
+	case "kill":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "function|kill"}
+		}
+		return db.scripts.kill(true)
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try FUNCTION HELP.")
+	}
+}
+
+// FUNCTION LOAD [REPLACE] code
+func functionLoad(db *DB, args [][]byte) redis.Reply {
+	replace := false
+	if len(args) == 3 && strings.ToLower(string(args[1])) == "replace" {
+		replace = true
+	} else if len(args) != 2 {
+		return &reply.ArgNumErrReply{Cmd: "function|load"}
+	}
+	name, errReply := db.scripts.loadLibrary(string(args[len(args)-1]), replace)
+	if errReply != nil {
+		return errReply
+	}
+	db.addAof(makeAofCmd("function", args))
+	return reply.MakeBulkReply([]byte(name))
+}
+
+// FUNCTION RESTORE payload [FLUSH | APPEND | REPLACE]
+func functionRestore(db *DB, args [][]byte) redis.Reply {
+	policy := "append"
+	if len(args) == 3 {
+		policy = strings.ToLower(string(args[2]))
+		if policy != "flush" && policy != "append" && policy != "replace" {
+			return reply.MakeErrReply("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+	} else if len(args) != 2 {
+		return &reply.ArgNumErrReply{Cmd: "function|restore"}
+	}
+	codes, err := rdb.DecodeFunctions(args[1])
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+
+	s := db.scripts
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	libs := make([]*library, len(codes))
+	for i, code := range codes {
+		lib, errReply := s.compileLibrary(string(code))
+		if errReply != nil {
+			return errReply
+		}
+		libs[i] = lib
+	}
+	if policy == "flush" {
+		s.flushLibraries()
+	}
+	if errReply := s.addLibraries(libs, policy != "append"); errReply != nil {
+		return errReply
+	}
+	db.addAof(makeAofCmd("function", args))
+	return &reply.OkReply{}
+}
+
+// FUNCTION LIST [LIBRARYNAME pattern] [WITHCODE]
+func functionList(db *DB, args [][]byte) redis.Reply {
+	pattern := ""
+	withCode := false
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if option == "withcode" && !withCode {
+			withCode = true
+		} else if option == "libraryname" && pattern == "" && i+1 < len(args) {
+			pattern = string(args[i+1])
+			i++
+		} else {
+			return reply.MakeErrReply("ERR Unknown argument " + string(args[i]))
+		}
+	}
+
+	s := db.scripts
+	s.libMu.RLock()
+	defer s.libMu.RUnlock()
+	names := make([]string, 0, len(s.libraries))
+	for name := range s.libraries {
+		if matched, _ := path.Match(pattern, name); pattern == "" || matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	result := make([]redis.Reply, len(names))
+	for i, name := range names {
+		result[i] = s.libraries[name].toReply(withCode)
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+func (lib *library) toReply(withCode bool) redis.Reply {
+	functions := make([]redis.Reply, len(lib.functions))
+	for i, f := range lib.functions {
+		var description redis.Reply = &reply.NullBulkReply{}
+		if f.description != "" {
+			description = reply.MakeBulkReply([]byte(f.description))
+		}
+		flags := make([][]byte, len(f.flags))
+		for j, flag := range f.flags {
+			flags[j] = []byte(flag)
+		}
+		functions[i] = reply.MakeMapReply(bulkReplies("name", "description", "flags"), []redis.Reply{
+			reply.MakeBulkReply([]byte(f.name)),
+			description,
+			reply.MakeBulkSetReply(flags),
+		})
+	}
+	keys := bulkReplies("library_name", "engine", "functions")
+	values := []redis.Reply{
+		reply.MakeBulkReply([]byte(lib.name)),
+		reply.MakeBulkReply([]byte("LUA")),
+		reply.MakeMultiRawReply(functions),
+	}
+	if withCode {
+		keys = append(keys, reply.MakeBulkReply([]byte("library_code")))
+		values = append(values, reply.MakeBulkReply([]byte(lib.code)))
+	}
+	return reply.MakeMapReply(keys, values)
+}
+
+// stats replies the running function and counts of libraries, FUNCTION STATS
+func (s *scripting) stats() redis.Reply {
+	var running redis.Reply = &reply.NullBulkReply{}
+	s.runningMu.Lock()
+	if s.running != nil && s.running.function {
+		running = reply.MakeMapReply(bulkReplies("name", "duration_ms"), []redis.Reply{
+			reply.MakeBulkReply([]byte(s.running.name)),
+			reply.MakeIntReply(time.Since(s.runningSince).Milliseconds()),
+		})
+	}
+	s.runningMu.Unlock()
+
+	s.libMu.RLock()
+	engine := reply.MakeMapReply(bulkReplies("libraries_count", "functions_count"), []redis.Reply{
+		reply.MakeIntReply(int64(len(s.libraries))),
+		reply.MakeIntReply(int64(len(s.functions))),
+	})
+	s.libMu.RUnlock()
+	return reply.MakeMapReply(bulkReplies("running_script", "engines"), []redis.Reply{
+		running,
+		reply.MakeMapReply(bulkReplies("LUA"), []redis.Reply{engine}),
+	})
+}
+
+func bulkReplies(values ...string) []redis.Reply {
+	replies := make([]redis.Reply, len(values))
+	for i, value := range values {
+		replies[i] = reply.MakeBulkReply([]byte(value))
+	}
+	return replies
+}
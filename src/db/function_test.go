@@ -0,0 +1,99 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+const testLibrary = "#!lua name=mylib\n" +
+	"redis.register_function('myset', function(keys, args) return redis.call('set', keys[1], args[1]) end)\n" +
+	"redis.register_function{function_name='myget', callback=function(keys) return redis.call('get', keys[1]) end, " +
+	"flags={'no-writes'}, description='get a key'}\n"
+
+func TestFunction(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+
+	assertReply(t, db, []string{"function", "load", testLibrary}, "$5\r\nmylib\r\n")
+	assertReply(t, db, []string{"fcall", "myset", "1", "k", "v"}, "+OK\r\n")
+	assertReply(t, db, []string{"fcall", "myget", "1", "k"}, "$1\r\nv\r\n")
+	assertReply(t, db, []string{"fcall_ro", "myget", "1", "k"}, "$1\r\nv\r\n")
+	assertReply(t, db, []string{"fcall_ro", "myset", "1", "k", "v"},
+		"-ERR Can not execute a script with write flag using *_ro command.\r\n")
+	assertReply(t, db, []string{"fcall", "nothing", "0"}, "-ERR Function not found\r\n")
+	assertReply(t, db, []string{"function", "stats"},
+		"*4\r\n$14\r\nrunning_script\r\n$-1\r\n$7\r\nengines\r\n"+
+			"*2\r\n$3\r\nLUA\r\n*4\r\n$15\r\nlibraries_count\r\n:1\r\n$15\r\nfunctions_count\r\n:2\r\n")
+
+	// load errors
+	assertReply(t, db, []string{"function", "load", testLibrary}, "-ERR Library 'mylib' already exists\r\n")
+	assertReply(t, db, []string{"function", "load", "return 1"}, "-ERR Missing library metadata\r\n")
+	assertReply(t, db, []string{"function", "load", "#!js name=x\n"}, "-ERR Engine 'js' not found\r\n")
+	assertReply(t, db, []string{"function", "load", "#!lua name=x\nreturn 1"}, "-ERR No functions registered\r\n")
+	assertReply(t, db, []string{"function", "load", "#!lua name=other\n" +
+		"redis.register_function('myset', function() return 1 end)"}, "-ERR Function myset already exists\r\n")
+	if result := string(db.Exec(nil, toArgs("function", "load", "#!lua name=x\n"+
+		"redis.call('set', 'k', 'v')")).ToBytes()); !strings.HasPrefix(result, "-ERR Error registering functions") {
+		t.Errorf("commands should be refused while loading, actual %q", result)
+	}
+	if result := string(db.Exec(nil, toArgs("eval", "redis.register_function('f', function() end)", "0")).ToBytes()); !strings.Contains(result, "can only be called on FUNCTION LOAD") {
+		t.Errorf("register_function should be refused by scripts, actual %q", result)
+	}
+
+	// replace
+	assertReply(t, db, []string{"function", "load", "replace", "#!lua name=mylib\n" +
+		"redis.register_function('myget', function(keys) return 'replaced' end)"}, "$5\r\nmylib\r\n")
+	assertReply(t, db, []string{"fcall", "myget", "1", "k"}, "$8\r\nreplaced\r\n")
+	assertReply(t, db, []string{"fcall", "myset", "1", "k", "v"}, "-ERR Function not found\r\n")
+	assertReply(t, db, []string{"function", "load", "replace", testLibrary}, "$5\r\nmylib\r\n")
+
+	assertReply(t, db, []string{"function", "list", "libraryname", "my*"},
+		"*1\r\n*6\r\n$12\r\nlibrary_name\r\n$5\r\nmylib\r\n$6\r\nengine\r\n$3\r\nLUA\r\n$9\r\nfunctions\r\n*2\r\n"+
+			"*6\r\n$4\r\nname\r\n$5\r\nmyget\r\n$11\r\ndescription\r\n$9\r\nget a key\r\n$5\r\nflags\r\n*1\r\n$9\r\nno-writes\r\n"+
+			"*6\r\n$4\r\nname\r\n$5\r\nmyset\r\n$11\r\ndescription\r\n$-1\r\n$5\r\nflags\r\n*0\r\n")
+	assertReply(t, db, []string{"function", "list", "libraryname", "other*"}, "*0\r\n")
+
+	// dump and restore
+	payload := string(db.Exec(nil, toArgs("function", "dump")).ToBytes())
+	payload = payload[strings.Index(payload, "\r\n")+2 : len(payload)-2]
+	assertReply(t, db, []string{"function", "restore", payload}, "-ERR Library 'mylib' already exists\r\n")
+	assertReply(t, db, []string{"function", "delete", "mylib"}, "+OK\r\n")
+	assertReply(t, db, []string{"function", "delete", "mylib"}, "-ERR Library not found\r\n")
+	assertReply(t, db, []string{"function", "restore", payload}, "+OK\r\n")
+	assertReply(t, db, []string{"function", "restore", payload, "replace"}, "+OK\r\n")
+	assertReply(t, db, []string{"function", "restore", payload[:len(payload)-1] + "x"},
+		"-ERR DUMP payload version or checksum are wrong\r\n")
+	assertReply(t, db, []string{"fcall", "myget", "1", "k"}, "$1\r\nv\r\n")
+
+	assertReply(t, db, []string{"function", "flush"}, "+OK\r\n")
+	assertReply(t, db, []string{"function", "list"}, "*0\r\n")
+	assertReply(t, db, []string{"function", "kill"}, "-NOTBUSY No scripts in execution right now.\r\n")
+}
+
+func TestFunctionPersistence(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	db.Exec(nil, toArgs("function", "load", testLibrary))
+	assertReply(t, db, []string{"save"}, "+OK\r\n")
+	db.Close()
+	loaded := MakeDB()
+	assertReply(t, loaded, []string{"fcall", "myset", "1", "k", "v"}, "+OK\r\n")
+	loaded.Close()
+
+	dir := useAof(t)
+	db = MakeDB()
+	db.Exec(nil, toArgs("function", "load", testLibrary))
+	waitAof(t, dir, "$8\r\nfunction\r\n$4\r\nload\r\n")
+	db.Close()
+	loaded = MakeDB()
+	assertReply(t, loaded, []string{"fcall", "myset", "1", "k", "v"}, "+OK\r\n")
+	// libraries are kept by rewrite
+	if err := loaded.aofRewrite(); err != nil {
+		t.Fatal(err)
+	}
+	loaded.Close()
+	loaded = MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"fcall_ro", "myget", "1", "k"}, "$1\r\nv\r\n")
+}
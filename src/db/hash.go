@@ -36,41 +36,26 @@ func (db *DB) getOrInitDict(key string) (dict Dict.Dict, inited bool, errReply r
 }
 
 func HSet(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hset' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 	value := args[2]
 
-	// lock
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get or init entity
 	dict, _, errReply := db.getOrInitDict(key)
 	if errReply != nil {
 		return errReply
 	}
 	result := dict.Put(field, value)
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("hset", args))
 	return reply.MakeIntReply(int64(result))
 }
 
 func HSetNX(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hsetnx' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 	value := args[2]
 
-	// lock
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get or init entity
 	dict, _, errReply := db.getOrInitDict(key)
 	if errReply != nil {
@@ -78,15 +63,14 @@ func HSetNX(db *DB, args [][]byte) redis.Reply {
 	}
 
 	result := dict.PutIfAbsent(field, value)
-	db.addAof(makeAofCmd("hset", args))
+	if result > 0 {
+		db.touchKeys(key)
+		db.addAof(makeAofCmd("hset", args))
+	}
 	return reply.MakeIntReply(int64(result))
 }
 
 func HGet(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hget' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 
@@ -107,10 +91,6 @@ func HGet(db *DB, args [][]byte) redis.Reply {
 }
 
 func HExists(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hexists' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 
@@ -130,10 +110,6 @@ func HExists(db *DB, args [][]byte) redis.Reply {
 }
 
 func HDel(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hdel' command")
-	}
 	key := string(args[0])
 	fields := make([]string, len(args)-1)
 	fieldArgs := args[1:]
@@ -141,9 +117,6 @@ func HDel(db *DB, args [][]byte) redis.Reply {
 		fields[i] = string(v)
 	}
 
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get entity
 	dict, errReply := db.getAsDict(key)
 	if errReply != nil {
@@ -161,16 +134,13 @@ func HDel(db *DB, args [][]byte) redis.Reply {
 		db.Remove(key)
 	}
 	if deleted > 0 {
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("hdel", args))
 	}
 	return reply.MakeIntReply(int64(deleted))
 }
 
 func HLen(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hlen' command")
-	}
 	key := string(args[0])
 
 	// get entity
@@ -186,7 +156,7 @@ func HLen(db *DB, args [][]byte) redis.Reply {
 
 func HMSet(db *DB, args [][]byte) redis.Reply {
 	// parse args
-	if len(args) < 3 || len(args)%2 != 1 {
+	if len(args)%2 != 1 {
 		return reply.MakeErrReply("ERR wrong number of arguments for 'hmset' command")
 	}
 	key := string(args[0])
@@ -198,10 +168,6 @@ func HMSet(db *DB, args [][]byte) redis.Reply {
 		values[i] = args[2*i+2]
 	}
 
-	// lock key
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get or init entity
 	dict, _, errReply := db.getOrInitDict(key)
 	if errReply != nil {
@@ -213,14 +179,12 @@ func HMSet(db *DB, args [][]byte) redis.Reply {
 		value := values[i]
 		dict.Put(field, value)
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("hmset", args))
 	return &reply.OkReply{}
 }
 
 func HMGet(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hmget' command")
-	}
 	key := string(args[0])
 	size := len(args) - 1
 	fields := make([]string, size)
@@ -228,9 +192,6 @@ func HMGet(db *DB, args [][]byte) redis.Reply {
 		fields[i] = string(args[i+1])
 	}
 
-	db.RLock(key)
-	defer db.RUnlock(key)
-
 	// get entity
 	result := make([][]byte, size)
 	dict, errReply := db.getAsDict(key)
@@ -254,14 +215,8 @@ func HMGet(db *DB, args [][]byte) redis.Reply {
 }
 
 func HKeys(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hkeys' command")
-	}
 	key := string(args[0])
 
-	db.RLock(key)
-	defer db.RUnlock(key)
-
 	// get entity
 	dict, errReply := db.getAsDict(key)
 	if errReply != nil {
@@ -281,14 +236,8 @@ func HKeys(db *DB, args [][]byte) redis.Reply {
 }
 
 func HVals(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hvals' command")
-	}
 	key := string(args[0])
 
-	db.RLock(key)
-	defer db.RUnlock(key)
-
 	// get entity
 	dict, errReply := db.getAsDict(key)
 	if errReply != nil {
@@ -308,41 +257,30 @@ func HVals(db *DB, args [][]byte) redis.Reply {
 }
 
 func HGetAll(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hgetall' command")
-	}
 	key := string(args[0])
 
-	db.RLock(key)
-	defer db.RUnlock(key)
-
 	// get entity
 	dict, errReply := db.getAsDict(key)
 	if errReply != nil {
 		return errReply
 	}
 	if dict == nil {
-		return &reply.EmptyMultiBulkReply{}
+		return reply.MakeMapReply(nil, nil)
 	}
 
 	size := dict.Len()
-	result := make([][]byte, size*2)
-	i := 0
+	fields := make([]redis.Reply, 0, size)
+	values := make([]redis.Reply, 0, size)
 	dict.ForEach(func(key string, val interface{}) bool {
-		result[i] = []byte(key)
-		i++
-		result[i], _ = val.([]byte)
-		i++
+		bytes, _ := val.([]byte)
+		fields = append(fields, reply.MakeBulkReply([]byte(key)))
+		values = append(values, reply.MakeBulkReply(bytes))
 		return true
 	})
-	return reply.MakeMultiBulkReply(result[:i])
+	return reply.MakeMapReply(fields, values)
 }
 
 func HIncrBy(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hincrby' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 	rawDelta := string(args[2])
@@ -351,9 +289,6 @@ func HIncrBy(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get or init entity
 	dict, _, errReply := db.getOrInitDict(key)
 	if errReply != nil {
@@ -362,6 +297,7 @@ func HIncrBy(db *DB, args [][]byte) redis.Reply {
 	value, exists := dict.Get(field)
 	if !exists {
 		dict.Put(field, args[2])
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("hincrby", args))
 		return reply.MakeBulkReply(args[2])
 	} else {
@@ -372,16 +308,13 @@ func HIncrBy(db *DB, args [][]byte) redis.Reply {
 		val += delta
 		bytes := []byte(strconv.FormatInt(val, 10))
 		dict.Put(field, bytes)
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("hincrby", args))
 		return reply.MakeBulkReply(bytes)
 	}
 }
 
 func HIncrByFloat(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'hincrbyfloat' command")
-	}
 	key := string(args[0])
 	field := string(args[1])
 	rawDelta := string(args[2])
@@ -390,17 +323,16 @@ func HIncrByFloat(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR value is not a valid float")
 	}
 
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get or init entity
-	dict, errReply := db.getAsDict(key)
+	dict, _, errReply := db.getOrInitDict(key)
 	if errReply != nil {
 		return errReply
 	}
 	value, exists := dict.Get(field)
 	if !exists {
 		dict.Put(field, args[2])
+		db.touchKeys(key)
+		db.addAof(makeAofCmd("hincrbyfloat", args))
 		return reply.MakeBulkReply(args[2])
 	} else {
 		val, err := decimal.NewFromString(string(value.([]byte)))
@@ -410,6 +342,7 @@ func HIncrByFloat(db *DB, args [][]byte) redis.Reply {
 		result := val.Add(delta)
 		resultBytes := []byte(result.String())
 		dict.Put(field, resultBytes)
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("hincrbyfloat", args))
 		return reply.MakeBulkReply(resultBytes)
 	}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"myGodis/src/config"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type infoSection struct {
+	name   string
+	render func(db *DB) [][2]string
+}
+
+// sections of INFO in order, the name is used as title
+var infoSections = []*infoSection{
+	{name: "Server", render: serverInfo},
+	{name: "Persistence", render: persistenceInfo},
+	{name: "Stats", render: statsInfo},
+	{name: "Replication", render: replicationInfo},
+	{name: "Keyspace", render: keyspaceInfo},
+}
+
+// Info returns information of server, INFO [section ...]
+func Info(db *DB, args [][]byte) redis.Reply {
+	selected := make(map[string]bool)
+	for _, arg := range args {
+		selected[strings.ToLower(string(arg))] = true
+	}
+	all := len(args) == 0 || selected["all"] || selected["everything"] || selected["default"]
+	var builder strings.Builder
+	for _, section := range infoSections {
+		if !all && !selected[strings.ToLower(section.name)] {
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteString("\r\n")
+		}
+		builder.WriteString("# " + section.name + "\r\n")
+		for _, field := range section.render(db) {
+			builder.WriteString(field[0] + ":" + field[1] + "\r\n")
+		}
+	}
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
+
+func serverInfo(db *DB) [][2]string {
+	return [][2]string{
+		{"redis_version", "6.0.0"},
+		{"redis_mode", "standalone"},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", strconv.Itoa(config.Properties.Port)},
+		{"uptime_in_seconds", strconv.FormatInt(int64(time.Since(db.startTime)/time.Second), 10)},
+	}
+}
+
+func boolInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func statusInfo(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "err"
+}
+
+func persistenceInfo(db *DB) [][2]string {
+	db.saveMu.Lock()
+	saving, lastSave, lastSaveOK := db.saving, db.lastSave, db.lastSaveOK
+	db.saveMu.Unlock()
+	db.pausingAof.RLock()
+	rewriting := db.aofRewriting
+	db.pausingAof.RUnlock()
+	fields := [][2]string{
+		{"loading", "0"},
+		{"rdb_changes_since_last_save", strconv.FormatInt(atomic.LoadInt64(&db.dirty), 10)},
+		{"rdb_bgsave_in_progress", boolInfo(saving)},
+		{"rdb_last_save_time", strconv.FormatInt(lastSave.Unix(), 10)},
+		{"rdb_last_bgsave_status", statusInfo(lastSaveOK)},
+		{"aof_enabled", boolInfo(db.aofFile != nil)},
+		{"aof_rewrite_in_progress", boolInfo(rewriting)},
+	}
+	if db.aofFile == nil {
+		return fields
+	}
+	db.fsyncStats.mu.Lock()
+	defer db.fsyncStats.mu.Unlock()
+	stats := &db.fsyncStats
+	var avg time.Duration
+	if stats.count > 0 {
+		avg = stats.total / time.Duration(stats.count)
+	}
+	return append(fields, [][2]string{
+		{"aof_fsync_policy", db.fsyncPolicy},
+		{"aof_fsync_count", strconv.FormatInt(stats.count, 10)},
+		{"aof_last_fsync_latency_usec", strconv.FormatInt(stats.last.Microseconds(), 10)},
+		{"aof_avg_fsync_latency_usec", strconv.FormatInt(avg.Microseconds(), 10)},
+		{"aof_max_fsync_latency_usec", strconv.FormatInt(stats.max.Microseconds(), 10)},
+		{"aof_last_fsync_status", statusInfo(stats.lastErr == nil)},
+	}...)
+}
+
+func keyspaceInfo(db *DB) [][2]string {
+	keys := db.Data.Len()
+	if keys == 0 {
+		return nil
+	}
+	return [][2]string{
+		{"db0", "keys=" + strconv.Itoa(keys) + ",expires=" + strconv.Itoa(db.TTLMap.Len()) + ",avg_ttl=0"},
+	}
+}
@@ -12,19 +12,11 @@ import (
 )
 
 func Del(db *DB, args [][]byte) redis.Reply {
-	if len(args) == 0 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'del' command")
-	}
 	keys := make([]string, len(args))
 	for i, v := range args {
 		keys[i] = string(v)
 	}
 
-	db.Locker.Locks(keys...)
-	defer func() {
-		db.Locker.UnLocks(keys...)
-	}()
-
 	deleted := db.Removes(keys...)
 	if deleted > 0 {
 		db.addAof(makeAofCmd("del", args))
@@ -32,41 +24,30 @@ func Del(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeIntReply(int64(deleted))
 }
 
+// Exists counts existing keys, a key given several times is counted several times, EXISTS key [key ...]
 func Exists(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `exists` command")
-	}
-	key := string(args[0])
-	_, exists := db.Get(key)
-	if exists {
-		return reply.MakeIntReply(1)
-	} else {
-		return reply.MakeIntReply(0)
+	result := int64(0)
+	for _, arg := range args {
+		if _, exists := db.Get(string(arg)); exists {
+			result++
+		}
 	}
+	return reply.MakeIntReply(result)
 }
 
 func FlushDB(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 0 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `flushdb` command")
-	}
 	db.Flush()
 	db.addAof(makeAofCmd("flushdb", args))
 	return &reply.OkReply{}
 }
 
 func FlushAll(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 0 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `flushall` command")
-	}
 	db.Flush()
 	db.addAof(makeAofCmd("flushall", args))
 	return &reply.OkReply{}
 }
 
 func Type(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `type` command")
-	}
 	key := string(args[0])
 	entity, exists := db.Get(key)
 	if !exists {
@@ -77,7 +58,7 @@ func Type(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeStatusReply("string")
 	case *list.LinkedList:
 		return reply.MakeStatusReply("list")
-	case *dict.Dict:
+	case dict.Dict:
 		return reply.MakeStatusReply("hash")
 	case *set.Set:
 		return reply.MakeStatusReply("set")
@@ -88,15 +69,9 @@ func Type(db *DB, args [][]byte) redis.Reply {
 }
 
 func Rename(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `rename` command")
-	}
 	src := string(args[0])
 	dest := string(args[1])
 
-	db.Locks(src, dest)
-	defer db.UnLocks(src, dest)
-
 	entity, ok := db.Get(src)
 	if !ok {
 		return reply.MakeErrReply("no such key")
@@ -114,15 +89,9 @@ func Rename(db *DB, args [][]byte) redis.Reply {
 }
 
 func RenameNx(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `renamenx` command")
-	}
 	src := string(args[0])
 	dest := string(args[1])
 
-	db.Locks(src, dest)
-	defer db.UnLocks(src, dest)
-
 	_, ok := db.Get(dest)
 	if ok {
 		return reply.MakeIntReply(0)
@@ -144,9 +113,6 @@ func RenameNx(db *DB, args [][]byte) redis.Reply {
 }
 
 func Expire(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `expire` command")
-	}
 	key := string(args[0])
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -165,9 +131,6 @@ func Expire(db *DB, args [][]byte) redis.Reply {
 }
 
 func ExpireAt(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `expireat` command")
-	}
 	key := string(args[0])
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -184,9 +147,6 @@ func ExpireAt(db *DB, args [][]byte) redis.Reply {
 }
 
 func PExpire(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `pexpire` command")
-	}
 	key := string(args[0])
 
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
@@ -207,9 +167,6 @@ func PExpire(db *DB, args [][]byte) redis.Reply {
 }
 
 func PExpireAt(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `pexpireat` command")
-	}
 	key := string(args[0])
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -226,9 +183,6 @@ func PExpireAt(db *DB, args [][]byte) redis.Reply {
 }
 
 func TTL(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `ttl` command")
-	}
 	key := string(args[0])
 	_, exists := db.Get(key)
 	if !exists {
@@ -244,9 +198,6 @@ func TTL(db *DB, args [][]byte) redis.Reply {
 }
 
 func PTTL(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `pttl` command")
-	}
 	key := string(args[0])
 	_, exists := db.Get(key)
 	if !exists {
@@ -262,9 +213,6 @@ func PTTL(db *DB, args [][]byte) redis.Reply {
 }
 
 func Persist(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `persist` command")
-	}
 	key := string(args[0])
 	_, exists := db.Get(key)
 	if !exists {
@@ -274,16 +222,18 @@ func Persist(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return reply.MakeIntReply(0)
 	}
-	db.TTLMap.Remove(key)
+	db.Persist(key)
 	db.addAof(makeAofCmd("persist", args))
 	return reply.MakeIntReply(1)
 }
 
 func BGRewriteAOF(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 0 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'bgrewriteaof' command")
+	rewritten, snap, err := db.startRewrite()
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
 	}
-
-	go db.aofRewrite()
+	go func() {
+		_ = db.doRewrite(rewritten, snap)
+	}()
 	return reply.MakeStatusReply("Background append only file rewriting started")
 }
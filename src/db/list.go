@@ -5,6 +5,7 @@ import (
 	"myGodis/src/interface/redis"
 	"myGodis/src/redis/reply"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsList(key string) (*List.LinkedList, reply.ErrorReply) {
@@ -36,10 +37,6 @@ func (db *DB) getOrInitList(key string) (list *List.LinkedList, inited bool, err
 }
 
 func LIndex(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of args for 'lindex' command")
-	}
 	key := string(args[0])
 	index64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -68,10 +65,6 @@ func LIndex(db *DB, args [][]byte) redis.Reply {
 }
 
 func LLen(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'llen' command")
-	}
 	key := string(args[0])
 
 	list, errReply := db.getAsList(key)
@@ -86,17 +79,9 @@ func LLen(db *DB, args [][]byte) redis.Reply {
 }
 
 func LPop(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'lpop' command")
-	}
 
 	key := string(args[0])
 
-	// lock key
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get data
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
@@ -107,23 +92,17 @@ func LPop(db *DB, args [][]byte) redis.Reply {
 	}
 	val, _ := list.Remove(0).([]byte)
 	if list.Len() == 0 {
-		db.Data.Remove(key)
+		db.Remove(key)
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("lpop", args))
 	return reply.MakeBulkReply(val)
 }
 
 func LPush(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR number of args for'lpush' command")
-	}
 	key := string(args[0])
 	values := args[1:]
 
-	// lock key
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get or init entity
 	list, _, errReply := db.getOrInitList(key)
 	if errReply != nil {
@@ -133,22 +112,16 @@ func LPush(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Insert(0, value)
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("lpush", args))
 	return reply.MakeIntReply(int64(list.Len()))
 }
 
 // 只有在key存在的情况下才执行插入，否则不执行插入操作
 func LPushX(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR number of args for'lpushx' command")
-	}
 	key := string(args[0])
 	values := args[1:]
 
-	// lock key
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
 		return errReply
@@ -159,15 +132,12 @@ func LPushX(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Insert(0, value)
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("lpushx", args))
 	return reply.MakeIntReply(int64(list.Len()))
 }
 
 func LRange(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'lrange' command")
-	}
 	key := string(args[0])
 	start64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -180,9 +150,6 @@ func LRange(db *DB, args [][]byte) redis.Reply {
 	}
 	stop := int(stop64)
 
-	db.RLock(key)
-	defer db.RUnlock(key)
-
 	// get data
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
@@ -225,10 +192,6 @@ func LRange(db *DB, args [][]byte) redis.Reply {
 }
 
 func LRem(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply(("ERR wrong number of arguments for 'lrem' command"))
-	}
 	key := string(args[0])
 	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -237,10 +200,6 @@ func LRem(db *DB, args [][]byte) redis.Reply {
 	count := int(count64)
 	value := args[2]
 
-	// lock key
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get data entity
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
@@ -259,19 +218,16 @@ func LRem(db *DB, args [][]byte) redis.Reply {
 	}
 
 	if list.Len() == 0 {
-		db.Data.Remove(key)
+		db.Remove(key)
 	}
 	if removed > 0 {
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("lrem", args))
 	}
 	return reply.MakeIntReply(int64(removed))
 }
 
 func LSet(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'lset' command")
-	}
 	key := string(args[0])
 	index64, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -280,10 +236,6 @@ func LSet(db *DB, args [][]byte) redis.Reply {
 	index := int(index64)
 	value := args[2]
 
-	// lock key
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get entity
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
@@ -302,21 +254,14 @@ func LSet(db *DB, args [][]byte) redis.Reply {
 	}
 
 	list.Set(index, value)
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("lset", args))
 	return &reply.OkReply{}
 }
 
 func RPop(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'rpop' command")
-	}
 	key := string(args[0])
 
-	// lock key
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get entity
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
@@ -327,23 +272,17 @@ func RPop(db *DB, args [][]byte) redis.Reply {
 	}
 	val, _ := list.RemoveLast().([]byte)
 	if list.Len() == 0 {
-		db.Data.Remove(key)
+		db.Remove(key)
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("rpop", args))
 	return reply.MakeBulkReply(val)
 }
 
 func RPopLPush(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'rpoplpush' command")
-	}
 	sourceKey := string(args[0])
 	destKey := string(args[1])
 
-	// locks keys
-	db.Locker.Locks(sourceKey, destKey)
-	defer db.Locker.UnLocks(sourceKey, destKey)
-
 	// get source entity
 	sourceList, errReply := db.getAsList(sourceKey)
 	if errReply != nil {
@@ -366,20 +305,15 @@ func RPopLPush(db *DB, args [][]byte) redis.Reply {
 	if sourceList.Len() == 0 {
 		db.Remove(sourceKey)
 	}
+	db.touchKeys(sourceKey, destKey)
 	db.addAof(makeAofCmd("rpoplpush", args))
 	return reply.MakeBulkReply(val)
 }
 
 func RPush(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'rpush' command")
-	}
 	key := string(args[0])
 	values := args[1:]
 
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	// get or init entity
 	list, _, errReply := db.getOrInitList(key)
 	if errReply != nil {
@@ -390,6 +324,120 @@ func RPush(db *DB, args [][]byte) redis.Reply {
 	for _, value := range values {
 		list.Add(value)
 	}
-	db.addAof(makeAofCmd("rpushx", args))
+	db.touchKeys(key)
+	db.addAof(makeAofCmd("rpush", args))
 	return reply.MakeIntReply(int64(list.Len()))
 }
+
+// LMove pops an element from source and pushes it to destination, LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func LMove(db *DB, args [][]byte) redis.Reply {
+	from, to, errReply := parseMoveDirections(args[2], args[3])
+	if errReply != nil {
+		return errReply
+	}
+	return moveElement(db, args[0], args[1], from, to)
+}
+
+// BLPop pops from the first non-empty list, BLPOP key [key ...] timeout
+func BLPop(db *DB, args [][]byte) redis.Reply {
+	return blockingPop(db, args, "lpop")
+}
+
+// BRPop pops from the tail of the first non-empty list, BRPOP key [key ...] timeout
+func BRPop(db *DB, args [][]byte) redis.Reply {
+	return blockingPop(db, args, "rpop")
+}
+
+// BRPopLPush is the blocking RPOPLPUSH, BRPOPLPUSH source destination timeout
+func BRPopLPush(db *DB, args [][]byte) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[2]); errReply != nil {
+		return errReply
+	}
+	return moveElement(db, args[0], args[1], "right", "left")
+}
+
+// BLMove is the blocking LMOVE, BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout
+func BLMove(db *DB, args [][]byte) redis.Reply {
+	from, to, errReply := parseMoveDirections(args[2], args[3])
+	if errReply != nil {
+		return errReply
+	}
+	if _, errReply := parseBlockingTimeout(args[4]); errReply != nil {
+		return errReply
+	}
+	return moveElement(db, args[0], args[1], from, to)
+}
+
+// blockingPop replies nil if all lists are empty, the client is blocked by ExecBlocking
+func blockingPop(db *DB, args [][]byte, popCmd string) redis.Reply {
+	if _, errReply := parseBlockingTimeout(args[len(args)-1]); errReply != nil {
+		return errReply
+	}
+	for _, arg := range args[:len(args)-1] {
+		key := string(arg)
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			continue
+		}
+		var val []byte
+		if popCmd == "lpop" {
+			val, _ = list.Remove(0).([]byte)
+		} else {
+			val, _ = list.RemoveLast().([]byte)
+		}
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		db.touchKeys(key)
+		db.addAof(makeAofCmd(popCmd, [][]byte{arg}))
+		return reply.MakeMultiBulkReply([][]byte{arg, val})
+	}
+	return &reply.NullMultiBulkReply{}
+}
+
+func parseMoveDirections(fromArg []byte, toArg []byte) (from string, to string, errReply redis.Reply) {
+	from = strings.ToLower(string(fromArg))
+	to = strings.ToLower(string(toArg))
+	if (from != "left" && from != "right") || (to != "left" && to != "right") {
+		return "", "", reply.MakeErrReply("ERR syntax error")
+	}
+	return from, to, nil
+}
+
+// moveElement replies nil if source doesn't exist, source may be the same as destination
+func moveElement(db *DB, source []byte, dest []byte, from string, to string) redis.Reply {
+	sourceKey := string(source)
+	destKey := string(dest)
+	sourceList, errReply := db.getAsList(sourceKey)
+	if errReply != nil {
+		return errReply
+	}
+	if sourceList == nil {
+		return &reply.NullBulkReply{}
+	}
+	if _, errReply := db.getAsList(destKey); errReply != nil {
+		return errReply
+	}
+
+	var val []byte
+	if from == "left" {
+		val, _ = sourceList.Remove(0).([]byte)
+	} else {
+		val, _ = sourceList.RemoveLast().([]byte)
+	}
+	if sourceList.Len() == 0 {
+		db.Remove(sourceKey)
+	}
+	destList, _, _ := db.getOrInitList(destKey)
+	if to == "left" {
+		destList.Insert(0, val)
+	} else {
+		destList.Add(val)
+	}
+	db.touchKeys(sourceKey, destKey)
+	db.addAof(makeAofCmd("lmove", [][]byte{source, dest, []byte(from), []byte(to)}))
+	return reply.MakeBulkReply(val)
+}
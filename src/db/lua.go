@@ -0,0 +1,270 @@
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+/*
+ * Lua vm shared by scripts, only base, table, string and math libraries are loaded.
+ * Conversion between lua values and replies follows redis:
+ *   integer -> number, bulk -> string, nil bulk/multi bulk -> false, array -> table,
+ *   status -> {ok=status}, error -> {err=message}
+ * numbers are truncated to integers when converted back, true -> 1, false/nil -> nil bulk
+ */
+
+const (
+	luaLogDebug = iota
+	luaLogVerbose
+	luaLogNotice
+	luaLogWarning
+)
+
+// newLuaState creates a sandboxed lua vm with redis api
+func (s *scripting) newLuaState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// no file access
+	for _, name := range []string{"dofile", "loadfile", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	redisTable := L.NewTable()
+	L.SetFuncs(redisTable, map[string]lua.LGFunction{
+		"call": func(L *lua.LState) int {
+			return s.call(L, true)
+		},
+		"pcall": func(L *lua.LState) int {
+			return s.call(L, false)
+		},
+		"register_function": s.registerFunction,
+		"error_reply": func(L *lua.LState) int {
+			L.Push(makeLuaStatusTable(L, "err", L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			L.Push(makeLuaStatusTable(L, "ok", L.CheckString(1)))
+			return 1
+		},
+		"sha1hex": func(L *lua.LState) int {
+			L.Push(lua.LString(sha1Hex(L.CheckString(1))))
+			return 1
+		},
+		"log": luaLog,
+	})
+	redisTable.RawSetString("LOG_DEBUG", lua.LNumber(luaLogDebug))
+	redisTable.RawSetString("LOG_VERBOSE", lua.LNumber(luaLogVerbose))
+	redisTable.RawSetString("LOG_NOTICE", lua.LNumber(luaLogNotice))
+	redisTable.RawSetString("LOG_WARNING", lua.LNumber(luaLogWarning))
+	L.SetGlobal("redis", redisTable)
+
+	// scripts should use local variables, globals are kept between scripts
+	globalMeta := L.NewTable()
+	L.SetFuncs(globalMeta, map[string]lua.LGFunction{
+		"__newindex": func(L *lua.LState) int {
+			L.RaiseError("Script attempted to create global variable '%s'", L.CheckAny(2).String())
+			return 0
+		},
+		"__index": func(L *lua.LState) int {
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.CheckAny(2).String())
+			return 0
+		},
+	})
+	L.SetMetatable(L.G.Global, globalMeta)
+	return L
+}
+
+func luaLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	if L.GetTop() < 2 {
+		L.RaiseError("redis.log() requires two arguments or more.")
+	}
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.Get(i).String())
+	}
+	msg := strings.Join(parts, " ")
+	switch level {
+	case luaLogDebug, luaLogVerbose:
+		logger.Debug(msg)
+	case luaLogNotice:
+		logger.Info(msg)
+	case luaLogWarning:
+		logger.Warn(msg)
+	default:
+		L.RaiseError("Invalid debug level.")
+	}
+	return 0
+}
+
+func sha1Hex(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// compileLua compiles a chunk, functions are created from the proto by every call
+func compileLua(body string, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+func makeLuaStatusTable(L *lua.LState, field string, msg string) *lua.LTable {
+	table := L.NewTable()
+	table.RawSetString(field, lua.LString(msg))
+	return table
+}
+
+// luaArgsToCmdLine converts arguments of redis.call, only strings and numbers are accepted
+func luaArgsToCmdLine(L *lua.LState) ([][]byte, bool) {
+	top := L.GetTop()
+	if top == 0 {
+		return nil, false
+	}
+	cmdLine := make([][]byte, top)
+	for i := 1; i <= top; i++ {
+		switch value := L.Get(i).(type) {
+		case lua.LString:
+			cmdLine[i-1] = []byte(value)
+		case lua.LNumber:
+			cmdLine[i-1] = []byte(value.String())
+		default:
+			return nil, false
+		}
+	}
+	return cmdLine, true
+}
+
+func makeLuaStringTable(L *lua.LState, args [][]byte) *lua.LTable {
+	table := L.CreateTable(len(args), 0)
+	for _, arg := range args {
+		table.Append(lua.LString(arg))
+	}
+	return table
+}
+
+// replyToLua converts reply of commands called by scripts
+func replyToLua(L *lua.LState, r redis.Reply) lua.LValue {
+	if value, ok := knownReplyToLua(L, r); ok {
+		return value
+	}
+	// other replies, eg. +OK, are converted from their RESP2 bytes
+	parsed, err := parser.ParseOne(r.ToBytes())
+	if err != nil {
+		return makeLuaStatusTable(L, "err", "ERR "+err.Error())
+	}
+	if value, ok := knownReplyToLua(L, parsed); ok {
+		return value
+	}
+	return lua.LFalse
+}
+
+func knownReplyToLua(L *lua.LState, r redis.Reply) (lua.LValue, bool) {
+	switch r := r.(type) {
+	case *reply.IntReply:
+		return lua.LNumber(r.Code), true
+	case *reply.BulkReply:
+		if r.Arg == nil {
+			return lua.LFalse, true
+		}
+		return lua.LString(r.Arg), true
+	case *reply.NullBulkReply, *reply.NullMultiBulkReply, *reply.NullReply:
+		return lua.LFalse, true
+	case *reply.EmptyMultiBulkReply:
+		return L.NewTable(), true
+	case *reply.MultiBulkReply:
+		table := L.CreateTable(len(r.Args), 0)
+		for _, arg := range r.Args {
+			if arg == nil {
+				table.Append(lua.LFalse)
+			} else {
+				table.Append(lua.LString(arg))
+			}
+		}
+		return table, true
+	case *reply.MultiRawReply:
+		table := L.CreateTable(len(r.Replies), 0)
+		for _, element := range r.Replies {
+			table.Append(replyToLua(L, element))
+		}
+		return table, true
+	case *reply.StatusReply:
+		return makeLuaStatusTable(L, "ok", r.Status), true
+	case reply.ErrorReply:
+		return makeLuaStatusTable(L, "err", r.Error()), true
+	}
+	return nil, false
+}
+
+// luaToReply converts the value returned by scripts, arrays end at the first nil
+func luaToReply(value lua.LValue) redis.Reply {
+	switch value := value.(type) {
+	case lua.LNumber:
+		return reply.MakeIntReply(int64(value))
+	case lua.LString:
+		return reply.MakeBulkReply([]byte(value))
+	case lua.LBool:
+		if value {
+			return reply.MakeIntReply(1)
+		}
+		return &reply.NullBulkReply{}
+	case *lua.LTable:
+		if errMsg, ok := value.RawGetString("err").(lua.LString); ok {
+			return reply.MakeErrReply(string(errMsg))
+		}
+		if status, ok := value.RawGetString("ok").(lua.LString); ok {
+			return reply.MakeStatusReply(string(status))
+		}
+		var replies []redis.Reply
+		for i := 1; ; i++ {
+			element := value.RawGetInt(i)
+			if element == lua.LNil {
+				break
+			}
+			replies = append(replies, luaToReply(element))
+		}
+		return reply.MakeMultiRawReply(replies)
+	}
+	return &reply.NullBulkReply{}
+}
+
+// luaErrorToReply converts errors raised by scripts, errors raised by redis.call keep their messages
+func luaErrorToReply(err error, name string) redis.Reply {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		if table, ok := apiErr.Object.(*lua.LTable); ok {
+			if errMsg, ok := table.RawGetString("err").(lua.LString); ok {
+				return reply.MakeErrReply(string(errMsg))
+			}
+		}
+	}
+	return reply.MakeErrReply("ERR Error running script (call to " + name + "): " + luaErrorMessage(err))
+}
+
+func luaErrorMessage(err error) string {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		return apiErr.Object.String()
+	}
+	return err.Error()
+}
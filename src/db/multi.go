@@ -0,0 +1,216 @@
+package db
+
+import (
+	"bytes"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strings"
+)
+
+/*
+ * MULTI queues commands of the client until EXEC, commands are checked while queueing
+ * and EXEC discards the transaction if any of them is wrong, or replies nil if any watched key has changed.
+ * EXEC executes queued commands holding locks of all their keys. Like a single write command, a transaction with
+ * write commands holds snapshotMu.RLock, or holds it exclusively if some of them have no keys, eg. FLUSHDB.
+ * Scripts are executed as transactions too, read-only scripts only hold read locks of their keys.
+ * Commands recorded for its write keys are buffered and sent to aof and replicas as one unit wrapped by MULTI and EXEC
+ * before the keys are unlocked, so that a partial transaction is never replayed.
+ */
+
+var (
+	multiCmd = reply.MakeMultiBulkReply([][]byte{[]byte("MULTI")})
+	execCmd  = reply.MakeMultiBulkReply([][]byte{[]byte("EXEC")})
+)
+
+// StartMulti starts queueing commands of the client, MULTI
+func StartMulti(c redis.Client) redis.Reply {
+	if c == nil {
+		return reply.MakeErrReply("ERR MULTI is not supported here")
+	}
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR MULTI calls can not be nested")
+	}
+	c.SetMultiState(true)
+	return &reply.OkReply{}
+}
+
+// DiscardMulti drops queued commands and watched keys, DISCARD
+func DiscardMulti(db *DB, c redis.Client) redis.Reply {
+	if c == nil || !c.InMultiState() {
+		return reply.MakeErrReply("ERR DISCARD without MULTI")
+	}
+	c.SetMultiState(false)
+	db.unwatchAll(c)
+	return &reply.OkReply{}
+}
+
+// rejectInMulti returns errReply, and marks the transaction of client as failed if it is queueing
+func rejectInMulti(c redis.Client, errReply reply.ErrorReply) redis.Reply {
+	if c != nil && c.InMultiState() {
+		c.AddTxError(errReply)
+	}
+	return errReply
+}
+
+// enqueueCmd queues a checked command line
+func enqueueCmd(c redis.Client, cmdSpec *command, args [][]byte) redis.Reply {
+	if cmdSpec.flags&flagNoMulti > 0 {
+		return rejectInMulti(c, reply.MakeErrReply("ERR Command not allowed inside a transaction"))
+	}
+	c.EnqueueCmd(args)
+	return reply.MakeStatusReply("QUEUED")
+}
+
+// ExecMulti executes queued commands atomically, EXEC
+func (db *DB) ExecMulti(c redis.Client) redis.Reply {
+	if c == nil || !c.InMultiState() {
+		return reply.MakeErrReply("ERR EXEC without MULTI")
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	failed := len(c.GetTxErrors()) > 0
+	c.SetMultiState(false)
+	defer db.unwatchAll(c)
+	if failed {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if isWriteTx(cmdLines) {
+		if errReply := db.checkWritable(); errReply != nil {
+			return errReply
+		}
+	}
+	results := db.execTx(cmdLines, c.GetWatching())
+	if results == nil {
+		return &reply.NullMultiBulkReply{}
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+func isWriteTx(cmdLines [][][]byte) bool {
+	for _, cmdLine := range cmdLines {
+		if router[strings.ToLower(string(cmdLine[0]))].isWrite(cmdLine) {
+			return true
+		}
+	}
+	return false
+}
+
+// execTx executes checked command lines atomically if keys of watching are not changed, returns nil if they have changed.
+// Commands after a failed one are still executed, there is no rollback
+func (db *DB) execTx(cmdLines [][][]byte, watching map[string]uint32) []redis.Reply {
+	var writeKeys, readKeys []string
+	for key := range watching {
+		readKeys = append(readKeys, key)
+	}
+	write, exclusive := false, false
+	for _, cmdLine := range cmdLines {
+		cmdSpec := router[strings.ToLower(string(cmdLine[0]))]
+		keys := cmdSpec.getKeys(cmdLine)
+		if cmdSpec.flags&flagScript > 0 && cmdSpec.flags&flagReadOnly == 0 {
+			write = true
+			writeKeys = append(writeKeys, keys...)
+		} else if cmdSpec.isWrite(cmdLine) {
+			write = true
+			exclusive = exclusive || len(keys) == 0
+			writeKeys = append(writeKeys, keys...)
+		} else {
+			readKeys = append(readKeys, keys...)
+		}
+	}
+	if exclusive {
+		// no other writes until the transaction is recorded
+		db.snapshotMu.Lock()
+		defer db.snapshotMu.Unlock()
+	} else if write {
+		db.snapshotMu.RLock()
+		defer db.snapshotMu.RUnlock()
+	}
+	if write {
+		db.beforeWrite(true, writeKeys...)
+	}
+	db.RWLocks(writeKeys, readKeys)
+	defer db.RWUnLocks(writeKeys, readKeys)
+	if db.isWatchChanged(watching) {
+		return nil
+	}
+	if write {
+		// recorded before keys are unlocked
+		tx := db.startTxAof(writeKeys, exclusive)
+		defer db.finishTxAof(tx)
+	}
+
+	results := make([]redis.Reply, len(cmdLines))
+	for i, cmdLine := range cmdLines {
+		results[i] = db.execCommand(router[strings.ToLower(string(cmdLine[0]))], cmdLine)
+	}
+	return results
+}
+
+// txAof buffers commands recorded by a write transaction
+type txAof struct {
+	keys     []string // write keys, nil if the transaction holds snapshotMu exclusively
+	cmdLines []*reply.MultiBulkReply
+}
+
+// startTxAof starts buffering commands of keys, or all commands if exclusive.
+// Invoker should hold snapshotMu and locks of keys, so that commands of the keys are recorded by itself
+func (db *DB) startTxAof(keys []string, exclusive bool) *txAof {
+	db.txAofMu.Lock()
+	defer db.txAofMu.Unlock()
+	tx := &txAof{}
+	if exclusive {
+		db.txAofAll = tx
+		return tx
+	}
+	tx.keys = keys
+	for _, key := range keys {
+		db.txAofs[key] = tx
+	}
+	return tx
+}
+
+// bufferTxAof buffers args if a transaction is writing its keys, expiration of the keys is buffered too
+func (db *DB) bufferTxAof(args *reply.MultiBulkReply) bool {
+	db.txAofMu.Lock()
+	defer db.txAofMu.Unlock()
+	if db.txAofAll != nil {
+		db.txAofAll.cmdLines = append(db.txAofAll.cmdLines, args)
+		return true
+	}
+	if len(db.txAofs) == 0 {
+		return false
+	}
+	cmdSpec, ok := router[strings.ToLower(string(args.Args[0]))]
+	if !ok {
+		return false
+	}
+	for _, key := range cmdSpec.getKeys(args.Args) {
+		if tx, ok := db.txAofs[key]; ok {
+			tx.cmdLines = append(tx.cmdLines, args)
+			return true
+		}
+	}
+	return false
+}
+
+// finishTxAof sends buffered commands wrapped by MULTI and EXEC
+func (db *DB) finishTxAof(tx *txAof) {
+	db.txAofMu.Lock()
+	if tx.keys == nil {
+		db.txAofAll = nil
+	}
+	for _, key := range tx.keys {
+		delete(db.txAofs, key)
+	}
+	cmdLines := tx.cmdLines
+	db.txAofMu.Unlock()
+	if len(cmdLines) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	buf.Write(multiCmd.ToBytes())
+	for _, cmdLine := range cmdLines {
+		buf.Write(cmdLine.ToBytes())
+	}
+	buf.Write(execCmd.ToBytes())
+	db.appendAof(buf.Bytes())
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func assertClientReply(t *testing.T, db *DB, c *testClient, cmdLine []string, expected string) {
+	t.Helper()
+	result := db.Exec(c, toArgs(cmdLine...))
+	if string(result.ToBytes()) != expected {
+		t.Errorf("%v: expected %q, actual %q", cmdLine, expected, result.ToBytes())
+	}
+}
+
+func TestMulti(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	c := &testClient{}
+
+	assertClientReply(t, db, c, []string{"exec"}, "-ERR EXEC without MULTI\r\n")
+	assertClientReply(t, db, c, []string{"discard"}, "-ERR DISCARD without MULTI\r\n")
+
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"multi"}, "-ERR MULTI calls can not be nested\r\n")
+	assertClientReply(t, db, c, []string{"set", "k", "v"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"incr", "k"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"rpush", "l", "a"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"get", "k"}, "+QUEUED\r\n")
+	assertReply(t, db, []string{"get", "k"}, "$-1\r\n")
+	// commands after the failed one are executed
+	assertClientReply(t, db, c, []string{"exec"},
+		"*4\r\n+OK\r\n-ERR value is not an integer or out of range\r\n:1\r\n$1\r\nv\r\n")
+	assertReply(t, db, []string{"lrange", "l", "0", "-1"}, "*1\r\n$1\r\na\r\n")
+
+	// errors found while queueing abort the transaction
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"set", "k", "v2"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"set", "k"}, "-ERR wrong number of arguments for 'set' command\r\n")
+	assertClientReply(t, db, c, []string{"nothing"}, "-ERR unknown command 'nothing'\r\n")
+	assertClientReply(t, db, c, []string{"save"}, "-ERR Command not allowed inside a transaction\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+	assertReply(t, db, []string{"get", "k"}, "$1\r\nv\r\n")
+
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"set", "k", "v2"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"discard"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "-ERR EXEC without MULTI\r\n")
+	assertReply(t, db, []string{"get", "k"}, "$1\r\nv\r\n")
+}
+
+func TestMultiAof(t *testing.T) {
+	dir := useAof(t)
+	db := MakeDB()
+	c := &testClient{}
+	db.Exec(nil, toArgs("set", "before", "v"))
+	db.Exec(c, toArgs("multi"))
+	db.Exec(c, toArgs("set", "k1", "v"))
+	db.Exec(c, toArgs("set", "k2", "v"))
+	db.Exec(c, toArgs("exec"))
+	tx := "*1\r\n$5\r\nMULTI\r\n" +
+		"*3\r\n$3\r\nset\r\n$2\r\nk1\r\n$1\r\nv\r\n" +
+		"*3\r\n$3\r\nset\r\n$2\r\nk2\r\n$1\r\nv\r\n" +
+		"*1\r\n$4\r\nEXEC\r\n"
+	waitAof(t, dir, tx)
+	db.Close()
+
+	loaded := MakeDB()
+	assertReply(t, loaded, []string{"mget", "k1", "k2"}, "*2\r\n$1\r\nv\r\n$1\r\nv\r\n")
+	loaded.Close()
+
+	// a transaction without EXEC is cut off as a whole
+	files, err := ReadAofManifest(filepath.Join(dir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	incr := files[len(files)-1]
+	content, _ := os.ReadFile(incr)
+	_ = os.WriteFile(incr, content[:len(content)-len("*1\r\n$4\r\nEXEC\r\n")], 0644)
+	loaded = MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"get", "before"}, "$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"exists", "k1"}, ":0\r\n")
+	truncated, _ := os.ReadFile(incr)
+	if len(truncated) != len(content)-len(tx) {
+		t.Errorf("aof should be truncated to %d bytes, actual %d", len(content)-len(tx), len(truncated))
+	}
+}
+
+func TestTxAofByKeys(t *testing.T) {
+	dir := useAof(t)
+	db := MakeDB()
+	defer db.Close()
+	// a running transaction writing k1 doesn't stall or buffer writes of other keys
+	db.snapshotMu.RLock()
+	db.Locks("k1")
+	tx := db.startTxAof([]string{"k1"}, false)
+	db.execCommand(router["set"], toArgs("set", "k1", "v"))
+	assertReply(t, db, []string{"set", "other", "v"}, "+OK\r\n")
+	db.finishTxAof(tx)
+	db.UnLocks("k1")
+	db.snapshotMu.RUnlock()
+
+	waitAof(t, dir, "*3\r\n$3\r\nset\r\n$5\r\nother\r\n$1\r\nv\r\n"+
+		"*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nset\r\n$2\r\nk1\r\n$1\r\nv\r\n*1\r\n$4\r\nEXEC\r\n")
+	if len(db.txAofs) != 0 || db.txAofAll != nil {
+		t.Error("transaction buffer is not removed")
+	}
+}
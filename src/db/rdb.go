@@ -0,0 +1,343 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"myGodis/src/config"
+	"myGodis/src/datastruct/dict"
+	List "myGodis/src/datastruct/list"
+	"myGodis/src/datastruct/set"
+	SortedSet "myGodis/src/datastruct/sortedset"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/lib/rdb"
+	"myGodis/src/redis/reply"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * RDB snapshot, saved by SAVE, BGSAVE or save rules and loaded by MakeDB if appendonly is off.
+ * There is no fork, the data set is read from a copy-on-write snapshot, see snapshot.go
+ */
+
+// retry failed BGSAVE triggered by save rules after the delay
+const bgSaveRetryDelay = 5 * time.Second
+
+type saveParam struct {
+	seconds int64
+	changes int64
+}
+
+// parseSaveParams parses config like "3600 1 300 100", empty string or "" disables saving
+func parseSaveParams(value string) ([]*saveParam, error) {
+	fields := strings.Fields(strings.Trim(value, "\""))
+	if len(fields)%2 != 0 {
+		return nil, errors.New("invalid save params: " + value)
+	}
+	params := make([]*saveParam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, errors.New("invalid save params: " + value)
+		}
+		params = append(params, &saveParam{seconds: seconds, changes: changes})
+	}
+	return params, nil
+}
+
+// saveCron starts BGSAVE once any save rule is satisfied
+func (db *DB) saveCron(params []*saveParam) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.closeCh:
+			return
+		}
+		db.saveMu.Lock()
+		saving, lastSave, lastTry, lastOK := db.saving, db.lastSave, db.lastSaveTry, db.lastSaveOK
+		db.saveMu.Unlock()
+		if saving || (!lastOK && time.Since(lastTry) < bgSaveRetryDelay) {
+			continue
+		}
+		dirty := atomic.LoadInt64(&db.dirty)
+		for _, param := range params {
+			if dirty >= param.changes && time.Since(lastSave) > time.Duration(param.seconds)*time.Second {
+				logger.Info(strconv.FormatInt(param.changes, 10) + " changes in " +
+					strconv.FormatInt(param.seconds, 10) + " seconds. Saving...")
+				_ = db.bgSave()
+				break
+			}
+		}
+	}
+}
+
+// bgSave starts saving in background, returns error if a saving is in progress
+func (db *DB) bgSave() error {
+	if !db.startSave() {
+		return errors.New("Background save already in progress")
+	}
+	go func() {
+		if err := db.saveRDB(); err != nil {
+			logger.Warn("background saving error: " + err.Error())
+			return
+		}
+		logger.Info("background saving terminated with success")
+	}()
+	return nil
+}
+
+// startSave marks saving is in progress, returns false if another saving is in progress
+func (db *DB) startSave() bool {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	if db.saving {
+		return false
+	}
+	db.saving = true
+	db.lastSaveTry = time.Now()
+	return true
+}
+
+// saveRDB writes snapshot into dbfilename, invoker should call startSave before
+func (db *DB) saveRDB() (err error) {
+	var dirty int64
+	snap := db.takeSnapshot(func() {
+		dirty = atomic.LoadInt64(&db.dirty)
+	})
+	defer db.releaseSnapshot(snap)
+	defer func() {
+		db.saveMu.Lock()
+		defer db.saveMu.Unlock()
+		db.saving = false
+		db.lastSaveOK = err == nil
+		if err == nil {
+			db.lastSave = time.Now()
+			atomic.AddInt64(&db.dirty, -dirty)
+		}
+	}()
+
+	filename := config.Properties.DBFilename
+	file, err := os.CreateTemp(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+	if err = db.writeRDB(file, snap); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+// writeRDB writes data set of snap
+func (db *DB) writeRDB(writer io.Writer, snap *snapshot) error {
+	enc := rdb.NewEncoder(writer)
+	aux := map[string]string{
+		"redis-ver":  "6.0.0",
+		"redis-bits": "64",
+		"ctime":      strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if err := enc.WriteHeader(aux); err != nil {
+		return err
+	}
+	for _, code := range snap.libraries {
+		if err := enc.WriteFunction(code); err != nil {
+			return err
+		}
+	}
+	// sizes are hints for loading
+	if err := enc.WriteDBHeader(0, db.Data.Len(), db.TTLMap.Len()); err != nil {
+		return err
+	}
+	now := time.Now()
+	var err error
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if !expireAt.IsZero() && now.After(expireAt) {
+			return true
+		}
+		obj := entityToObject(key, entity, expireAt)
+		if obj == nil {
+			return true
+		}
+		err = enc.WriteObject(obj)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return enc.WriteEnd()
+}
+
+// entityToObject converts entity into rdb object, returns nil if the type is not supported
+func entityToObject(key string, entity *DataEntity, expireAt time.Time) *rdb.Object {
+	obj := &rdb.Object{Key: key}
+	if !expireAt.IsZero() {
+		obj.ExpireAt = expireAt.UnixNano() / 1e6
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		obj.Type = rdb.TypeString
+		obj.String = val
+	case *List.LinkedList:
+		obj.Type = rdb.TypeList
+		obj.Members = make([][]byte, 0, val.Len())
+		val.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			obj.Members = append(obj.Members, bytes)
+			return true
+		})
+	case *set.Set:
+		obj.Type = rdb.TypeSet
+		obj.Members = make([][]byte, 0, val.Len())
+		val.ForEach(func(member string) bool {
+			obj.Members = append(obj.Members, []byte(member))
+			return true
+		})
+	case dict.Dict:
+		obj.Type = rdb.TypeHash
+		obj.Hash = make(map[string][]byte, val.Len())
+		val.ForEach(func(field string, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			obj.Hash[field] = bytes
+			return true
+		})
+	case *SortedSet.SortedSet:
+		obj.Type = rdb.TypeZSet
+		obj.ZSet = make([]*rdb.ZSetEntry, 0, val.Len())
+		val.ForEach(func(element *SortedSet.Element) bool {
+			obj.ZSet = append(obj.ZSet, &rdb.ZSetEntry{Member: element.Member, Score: element.Score})
+			return true
+		})
+	default:
+		return nil
+	}
+	return obj
+}
+
+// loadRDB loads snapshot from filename
+func (db *DB) loadRDB(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return db.readRDB(file)
+}
+
+// readRDB loads snapshot from reader, only keys of db 0 are loaded.
+// Expired keys are kept for rdb preamble of aof, since commands after it may be executed before expiration,
+// and for replicas, since keys are expired by DEL from master
+func (db *DB) readRDB(reader io.Reader) error {
+	now := time.Now()
+	skipped := 0
+	err := rdb.NewDecoder(reader).Parse(func(obj *rdb.Object) bool {
+		if obj.Type == rdb.TypeFunction {
+			if _, errReply := db.scripts.loadLibrary(string(obj.String), true); errReply != nil {
+				logger.Warn("load function library failed: " + errReply.(reply.ErrorReply).Error())
+			}
+			return true
+		}
+		if obj.DB != 0 {
+			skipped++
+			return true
+		}
+		var expireTime time.Time
+		if obj.ExpireAt > 0 {
+			expireTime = time.Unix(0, obj.ExpireAt*1e6)
+			if now.After(expireTime) && !db.loading && !db.isReplica() {
+				return true
+			}
+		}
+		entity := objectToEntity(obj)
+		if entity == nil {
+			return true
+		}
+		db.Put(obj.Key, entity)
+		if obj.ExpireAt > 0 {
+			db.Expire(obj.Key, expireTime)
+		}
+		return true
+	})
+	if skipped > 0 {
+		logger.Warn(strconv.Itoa(skipped) + " keys of other databases are not loaded")
+	}
+	return err
+}
+
+func objectToEntity(obj *rdb.Object) *DataEntity {
+	switch obj.Type {
+	case rdb.TypeString:
+		return &DataEntity{Data: obj.String}
+	case rdb.TypeList:
+		return &DataEntity{Data: List.MakeBytesList(obj.Members...)}
+	case rdb.TypeSet:
+		members := set.Make()
+		for _, member := range obj.Members {
+			members.Add(string(member))
+		}
+		return &DataEntity{Data: members}
+	case rdb.TypeHash:
+		hash := dict.MakeSimple()
+		for field, value := range obj.Hash {
+			hash.Put(field, value)
+		}
+		return &DataEntity{Data: hash}
+	case rdb.TypeZSet:
+		zset := SortedSet.Make()
+		for _, entry := range obj.ZSet {
+			zset.Add(entry.Member, entry.Score)
+		}
+		return &DataEntity{Data: zset}
+	}
+	return nil
+}
+
+// Save saves snapshot synchronously, SAVE
+func Save(db *DB, args [][]byte) redis.Reply {
+	if !db.startSave() {
+		return reply.MakeErrReply("ERR Background save already in progress")
+	}
+	if err := db.saveRDB(); err != nil {
+		logger.Warn("saving error: " + err.Error())
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return &reply.OkReply{}
+}
+
+// BGSave saves snapshot in background, BGSAVE [SCHEDULE]
+func BGSave(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 1 || (len(args) == 1 && strings.ToLower(string(args[0])) != "schedule") {
+		return reply.MakeErrReply("ERR syntax error")
+	}
+	if err := db.bgSave(); err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeStatusReply("Background saving started")
+}
+
+// LastSave returns unix time of the last successful save, LASTSAVE
+func LastSave(db *DB, args [][]byte) redis.Reply {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	return reply.MakeIntReply(db.lastSave.Unix())
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"myGodis/src/config"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func useRDB(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "dump.rdb")
+	dbFilename, save := config.Properties.DBFilename, config.Properties.Save
+	config.Properties.DBFilename = filename
+	t.Cleanup(func() {
+		config.Properties.DBFilename, config.Properties.Save = dbFilename, save
+	})
+	return filename
+}
+
+func assertReply(t *testing.T, db *DB, cmdLine []string, expected string) {
+	t.Helper()
+	result := db.Exec(nil, toArgs(cmdLine...))
+	if string(result.ToBytes()) != expected {
+		t.Errorf("%v: expected %q, actual %q", cmdLine, expected, result.ToBytes())
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	filename := useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	db.Exec(nil, toArgs("set", "str", "v"))
+	db.Exec(nil, toArgs("pexpire", "str", "100000"))
+	db.Exec(nil, toArgs("set", "expired", "v"))
+	db.Exec(nil, toArgs("pexpire", "expired", "1"))
+	db.Exec(nil, toArgs("rpush", "list", "a", "b", "c"))
+	db.Exec(nil, toArgs("sadd", "set", "m"))
+	db.Exec(nil, toArgs("hset", "hash", "f", "v"))
+	db.Exec(nil, toArgs("zadd", "zset", "1.5", "m1", "-2", "m2"))
+	time.Sleep(2 * time.Millisecond)
+
+	before := db.Exec(nil, toArgs("lastsave")).ToBytes()
+	assertReply(t, db, []string{"save"}, "+OK\r\n")
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	}
+	after := db.Exec(nil, toArgs("lastsave")).ToBytes()
+	if string(after) < string(before) {
+		t.Errorf("lastsave should increase, before %q, after %q", before, after)
+	}
+
+	loaded := MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"get", "str"}, "$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"exists", "expired"}, ":0\r\n")
+	assertReply(t, loaded, []string{"lrange", "list", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	assertReply(t, loaded, []string{"smembers", "set"}, "*1\r\n$1\r\nm\r\n")
+	assertReply(t, loaded, []string{"hget", "hash", "f"}, "$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"zscore", "zset", "m2"}, "$2\r\n-2\r\n")
+	ttl := loaded.Exec(nil, toArgs("pttl", "str")).ToBytes()
+	pttl, _ := strconv.Atoi(string(ttl[1 : len(ttl)-2]))
+	if pttl <= 0 || pttl > 100000 {
+		t.Errorf("wrong ttl %q", ttl)
+	}
+}
+
+func TestBGSaveAndRules(t *testing.T) {
+	filename := useRDB(t)
+	config.Properties.Save = "1 2"
+	db := MakeDB()
+	defer db.Close()
+	assertReply(t, db, []string{"bgsave", "now"}, "-ERR syntax error\r\n")
+
+	// 2 changes trigger saving after 1 second
+	db.Exec(nil, toArgs("set", "k1", "v"))
+	db.Exec(nil, toArgs("set", "k2", "v"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filename); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("save rule is not triggered")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	db.Exec(nil, toArgs("set", "k3", "v"))
+	assertReply(t, db, []string{"bgsave"}, "+Background saving started\r\n")
+	for {
+		db.saveMu.Lock()
+		saving := db.saving
+		db.saveMu.Unlock()
+		if !saving {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	config.Properties.Save = ""
+	loaded := MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"get", "k3"}, "$1\r\nv\r\n")
+
+	if _, err := parseSaveParams("1 2 3"); err == nil {
+		t.Error("expected error of odd params")
+	}
+	if params, err := parseSaveParams(`""`); err != nil || len(params) != 0 {
+		t.Error("empty string should disable saving")
+	}
+}
@@ -0,0 +1,426 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"myGodis/src/config"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Replication, replica side.
+ * The replica connects master in background: PING, REPLCONF listening-port, REPLCONF capa, then PSYNC.
+ * Commands from master are executed and fed into backlog as they are, so that replicas of this replica
+ * share the same offsets and replid with the master.
+ */
+
+// states of master link shown by ROLE
+const (
+	linkConnect    = "connect"    // waiting to connect
+	linkConnecting = "connecting" // handshake
+	linkSync       = "sync"       // receiving snapshot
+	linkConnected  = "connected"
+)
+
+type masterLink struct {
+	host   string
+	port   int
+	state  string
+	conn   net.Conn
+	lastIO time.Time
+	closed chan struct{} // closed by REPLICAOF or db closing
+}
+
+func (link *masterLink) addr() string {
+	return net.JoinHostPort(link.host, strconv.Itoa(link.port))
+}
+
+// status returns master_link_status of INFO
+func (link *masterLink) status() string {
+	if link.state == linkConnected {
+		return "up"
+	}
+	return "down"
+}
+
+// close stops the link, invoker should hold repl.mu
+func (link *masterLink) close() {
+	select {
+	case <-link.closed:
+		return
+	default:
+	}
+	close(link.closed)
+	if link.conn != nil {
+		_ = link.conn.Close()
+	}
+}
+
+func (link *masterLink) isClosed() bool {
+	select {
+	case <-link.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// isReplica could be checked without lock in the key access path
+func (db *DB) isReplica() bool {
+	return atomic.LoadInt32(&db.replicaMode) == 1
+}
+
+// ReplicaOf makes this server a replica of another one or turns it into a master, REPLICAOF host port | NO ONE
+func ReplicaOf(db *DB, args [][]byte) redis.Reply {
+	if strings.EqualFold(string(args[0]), "no") && strings.EqualFold(string(args[1]), "one") {
+		db.replicaOfNoOne()
+		return &reply.OkReply{}
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid master port")
+	}
+	if !db.replicaOf(string(args[0]), port) {
+		return reply.MakeStatusReply("OK Already connected to specified master")
+	}
+	return &reply.OkReply{}
+}
+
+// replicaOf starts syncing with master in background, returns false if it is the current master
+func (db *DB) replicaOf(host string, port int) bool {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if link := repl.master; link != nil {
+		if link.host == host && link.port == port {
+			return false
+		}
+		link.close()
+	}
+	// replicas should sync again with the history of new master
+	repl.closeReplicas()
+	link := &masterLink{
+		host:   host,
+		port:   port,
+		state:  linkConnect,
+		closed: make(chan struct{}),
+	}
+	repl.master = link
+	atomic.StoreInt32(&db.replicaMode, 1)
+	logger.Info("connecting to master " + link.addr())
+	go db.syncWithMaster(link)
+	return true
+}
+
+// replicaOfNoOne promotes this replica to master, replicas could continue by the old replid
+func (db *DB) replicaOfNoOne() {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master == nil {
+		return
+	}
+	repl.master.close()
+	repl.master = nil
+	atomic.StoreInt32(&db.replicaMode, 0)
+	repl.shiftReplid(genReplid())
+	logger.Info("master mode enabled, new replid " + repl.replid)
+}
+
+// shiftReplid keeps the current replid as replid2, invoker should hold repl.mu
+func (repl *replication) shiftReplid(replid string) {
+	repl.replid2 = repl.replid
+	repl.secondOffset = repl.backlog.offset + 1
+	repl.replid = replid
+}
+
+// syncWithMaster keeps reconnecting master until the link is closed
+func (db *DB) syncWithMaster(link *masterLink) {
+	for {
+		err := db.connectMaster(link)
+		if link.isClosed() {
+			return
+		}
+		logger.Warn("connection with master " + link.addr() + " lost: " + err.Error())
+		db.repl.mu.Lock()
+		link.state = linkConnect
+		db.repl.mu.Unlock()
+		select {
+		case <-link.closed:
+			return
+		case <-time.After(replCronInterval):
+		}
+	}
+}
+
+// timeoutReader fails reading if nothing is received from master in repl-timeout
+type timeoutReader struct {
+	conn net.Conn
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	timeout := time.Duration(config.Properties.ReplTimeout) * time.Second
+	_ = r.conn.SetReadDeadline(time.Now().Add(timeout))
+	return r.conn.Read(p)
+}
+
+// readReplLine reads a line of reply from master
+func readReplLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if strings.HasPrefix(line, "-") {
+		return "", errors.New(line[1:])
+	}
+	return line, nil
+}
+
+// sendReplCommand sends a command to master and returns the status line of reply
+func sendReplCommand(conn net.Conn, reader *bufio.Reader, args ...string) (string, error) {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	if _, err := conn.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		return "", err
+	}
+	return readReplLine(reader)
+}
+
+// connectMaster syncs with master and applies commands from it, returns after the connection is broken
+func (db *DB) connectMaster(link *masterLink) error {
+	timeout := time.Duration(config.Properties.ReplTimeout) * time.Second
+	conn, err := net.DialTimeout("tcp", link.addr(), timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	repl := db.repl
+	repl.mu.Lock()
+	if link.isClosed() {
+		repl.mu.Unlock()
+		return errors.New("replication is cancelled")
+	}
+	link.conn = conn
+	link.state = linkConnecting
+	if !repl.backlog.enabled() {
+		repl.backlog.enable(config.Properties.ReplBacklogSize)
+	}
+	replid, psyncOffset := repl.replid, repl.backlog.offset+1
+	repl.mu.Unlock()
+
+	reader := bufio.NewReader(&timeoutReader{conn: conn})
+	if _, err := sendReplCommand(conn, reader, "PING"); err != nil {
+		return errors.New("error reply to PING: " + err.Error())
+	}
+	// errors of REPLCONF are ignored like redis, master may not support them
+	if _, err := sendReplCommand(conn, reader, "REPLCONF", "listening-port", strconv.Itoa(config.Properties.Port)); err != nil {
+		logger.Warn("REPLCONF listening-port failed: " + err.Error())
+	}
+	if _, err := sendReplCommand(conn, reader, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		logger.Warn("REPLCONF capa failed: " + err.Error())
+	}
+	line, err := sendReplCommand(conn, reader, "PSYNC", replid, strconv.FormatInt(psyncOffset, 10))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("bad FULLRESYNC reply: " + line)
+		}
+		if err := db.loadFromMaster(link, reader, fields[1], offset); err != nil {
+			return err
+		}
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		logger.Info("partial resynchronization with master succeeded")
+		repl.mu.Lock()
+		if len(fields) == 2 && fields[1] != repl.replid {
+			// master is a promoted replica
+			repl.shiftReplid(fields[1])
+		}
+		repl.mu.Unlock()
+	default:
+		return errors.New("unexpected reply to PSYNC: " + line)
+	}
+
+	repl.mu.Lock()
+	link.state = linkConnected
+	link.lastIO = time.Now()
+	repl.mu.Unlock()
+	return db.applyStream(link, reader)
+}
+
+// loadFromMaster receives snapshot into a file then replaces data set by it
+func (db *DB) loadFromMaster(link *masterLink, reader *bufio.Reader, replid string, offset int64) error {
+	repl := db.repl
+	repl.mu.Lock()
+	link.state = linkSync
+	repl.mu.Unlock()
+
+	line, err := readReplLine(reader)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(line, "$"), 10, 64)
+	if !strings.HasPrefix(line, "$") || err != nil || size < 0 {
+		return errors.New("bad snapshot size: " + line)
+	}
+	// the snapshot is saved as dbfilename, or the base of aof if appendonly
+	dir := filepath.Dir(config.Properties.DBFilename)
+	if db.aofFile != nil {
+		dir = db.aofDir
+	}
+	file, err := os.CreateTemp(dir, "temp-repl-*.rdb")
+	if err != nil {
+		return err
+	}
+	tmpFilename := file.Name()
+	defer func() {
+		_ = os.Remove(tmpFilename) // no-op if it is renamed
+	}()
+	_, err = io.CopyN(file, reader, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	logger.Info("received " + strconv.FormatInt(size, 10) + " bytes from master, loading")
+
+	db.Flush()
+	db.scripts.flushLibraries()
+	if err := db.loadRDB(tmpFilename); err != nil {
+		return errors.New("load snapshot from master failed: " + err.Error())
+	}
+	if db.aofFile != nil {
+		// the snapshot replaces all aof files as the new base
+		rewritten, err := db.rotateAof()
+		if err == nil {
+			err = db.finishRewrite(tmpFilename, rewritten, true)
+		}
+		if err != nil {
+			logger.Warn("replace aof by snapshot from master failed: " + err.Error())
+		}
+	} else if err := os.Rename(tmpFilename, config.Properties.DBFilename); err != nil {
+		logger.Warn(err)
+	}
+
+	repl.mu.Lock()
+	repl.replid = replid
+	repl.replid2 = ""
+	repl.secondOffset = -1
+	repl.backlog.reset(offset)
+	// replicas of this replica have the old data set
+	repl.closeReplicas()
+	repl.mu.Unlock()
+	logger.Info("synchronization with master succeeded")
+	return nil
+}
+
+// applyStream executes commands from master until the connection is broken.
+// A transaction is executed and counted in offset after its EXEC arrives, so a partial one is sent again by PSYNC
+func (db *DB) applyStream(link *masterLink, reader *bufio.Reader) error {
+	repl := db.repl
+	var tx [][][]byte // nil if not in transaction
+	var txData []byte
+	for {
+		cmdLine, _, err := parser.ReadCommand(reader)
+		if err != nil {
+			return err
+		}
+		data := reply.MakeMultiBulkReply(cmdLine).ToBytes()
+		getAck := isGetAck(cmdLine)
+		if isCommand(cmdLine, "multi") {
+			tx, txData = make([][][]byte, 0), data
+			continue
+		} else if tx != nil && !isCommand(cmdLine, "exec") {
+			tx = append(tx, cmdLine)
+			txData = append(txData, data...)
+			continue
+		} else if tx != nil {
+			db.execMasterTx(tx)
+			data = append(txData, data...)
+			tx, txData = nil, nil
+		} else if !getAck {
+			db.execMasterCommand(cmdLine)
+		}
+		repl.mu.Lock()
+		link.lastIO = time.Now()
+		repl.backlog.write(data)
+		repl.cond.Broadcast()
+		if getAck {
+			// offset of GETACK itself is acknowledged
+			repl.sendAck(link)
+		}
+		repl.mu.Unlock()
+	}
+}
+
+func isGetAck(cmdLine [][]byte) bool {
+	return len(cmdLine) == 3 && strings.EqualFold(string(cmdLine[0]), "replconf") &&
+		strings.EqualFold(string(cmdLine[1]), "getack")
+}
+
+// ackMaster sends REPLCONF ACK every replCronInterval, so that master knows the lag of replica
+func (db *DB) ackMaster() {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil {
+		repl.sendAck(repl.master)
+	}
+}
+
+// sendAck sends REPLCONF ACK <offset> to master, errors are found by reading. invoker should hold repl.mu
+func (repl *replication) sendAck(link *masterLink) {
+	if link.state != linkConnected || link.conn == nil {
+		return
+	}
+	ack := reply.MakeMultiBulkReply([][]byte{
+		[]byte("REPLCONF"), []byte("ACK"), []byte(strconv.FormatInt(repl.backlog.offset, 10)),
+	})
+	_ = link.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.Properties.ReplTimeout) * time.Second))
+	_, _ = link.conn.Write(ack.ToBytes())
+}
+
+func (db *DB) execMasterCommand(cmdLine [][]byte) {
+	cmd := strings.ToLower(string(cmdLine[0]))
+	cmdSpec, ok := router[cmd]
+	if !ok || cmdSpec.executor == nil || !cmdSpec.validateArity(cmdLine) {
+		logger.Warn("illegal command from master: " + cmd)
+		return
+	}
+	db.snapshotMu.RLock()
+	defer db.snapshotMu.RUnlock()
+	db.execWithLock(cmdSpec, cmdLine)
+}
+
+func (db *DB) execMasterTx(cmdLines [][][]byte) {
+	for _, cmdLine := range cmdLines {
+		cmdSpec, ok := router[strings.ToLower(string(cmdLine[0]))]
+		if !ok || cmdSpec.executor == nil || !cmdSpec.validateArity(cmdLine) {
+			logger.Warn("illegal command in transaction from master: " + string(cmdLine[0]))
+			return
+		}
+	}
+	db.execTx(cmdLines, nil)
+}
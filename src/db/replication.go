@@ -0,0 +1,588 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"myGodis/src/config"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Replication, master side.
+ * Write commands are fed into backlog at addAof, every replica has a goroutine streaming backlog from its offset.
+ * A replica syncs by PSYNC <replid> <offset>:
+ *   +CONTINUE <replid>: replid matches and offset is still in backlog, the stream after offset is sent
+ *   +FULLRESYNC <replid> <offset>: followed by a rdb snapshot as $<len>\r\n<rdb> and the stream after offset
+ * replid2 is the replid of the former master of a promoted replica, so that other replicas could still PSYNC.
+ */
+
+var (
+	// master pings replicas through the stream, so that replicas could find the master is down
+	replPingPeriod = 10 * time.Second
+	// interval of replicationCron
+	replCronInterval = time.Second
+)
+
+// max bytes sent to a replica by one write
+const replStreamChunk = 16 * 1024
+
+// states of replicas shown by INFO
+const (
+	replicaHandshake  = "handshake"
+	replicaWaitBgsave = "wait_bgsave"
+	replicaOnline     = "online"
+)
+
+type replicaState struct {
+	client     redis.Client
+	listenPort int
+	state      string
+	offset     int64 // acknowledged by REPLCONF ACK
+	ackTime    time.Time
+	closed     bool
+}
+
+type replStats struct {
+	syncFull       int64
+	syncPartialOK  int64
+	syncPartialErr int64
+}
+
+type replication struct {
+	mu sync.Mutex
+	// broadcast when backlog is written or a replica is closed
+	cond *sync.Cond
+
+	replid       string
+	replid2      string
+	secondOffset int64 // replid2 is valid for offsets before it, -1 if there is no replid2
+	backlog      backlog
+	replicas     map[redis.Client]*replicaState
+	lastPing     time.Time
+	stats        replStats
+	stopped      bool // db is closing, WAIT returns at once
+
+	// not nil if this server is a replica
+	master *masterLink
+}
+
+func makeReplication() *replication {
+	repl := &replication{
+		replid:       genReplid(),
+		secondOffset: -1,
+		replicas:     make(map[redis.Client]*replicaState),
+	}
+	repl.cond = sync.NewCond(&repl.mu)
+	return repl
+}
+
+// genReplid returns 40 random hex characters
+func genReplid() string {
+	buf := make([]byte, 20)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// feedReplicas appends serialized commands into backlog, commands of a replica are fed by applyStream instead
+func (db *DB) feedReplicas(data []byte) {
+	repl := db.repl
+	if repl == nil {
+		return
+	}
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil || !repl.backlog.enabled() {
+		return
+	}
+	repl.backlog.write(data)
+	repl.cond.Broadcast()
+}
+
+// replicationCron runs periodical jobs of replication
+func (db *DB) replicationCron() {
+	ticker := time.NewTicker(replCronInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.closeCh:
+			return
+		}
+		db.pingReplicas()
+		db.ackMaster()
+	}
+}
+
+var pingCmd = [][]byte{[]byte("PING")}
+
+// pingReplicas sends PING through the stream every replPingPeriod
+func (db *DB) pingReplicas() {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil || len(repl.replicas) == 0 || time.Since(repl.lastPing) < replPingPeriod {
+		return
+	}
+	repl.lastPing = time.Now()
+	repl.backlog.write(reply.MakeMultiBulkReply(pingCmd).ToBytes())
+	repl.cond.Broadcast()
+}
+
+// getReplica returns state of replica c, creates one in handshake state if absent. invoker should hold repl.mu
+func (repl *replication) getReplica(c redis.Client) *replicaState {
+	state, ok := repl.replicas[c]
+	if !ok {
+		state = &replicaState{client: c, state: replicaHandshake}
+		repl.replicas[c] = state
+	}
+	return state
+}
+
+// closeReplica stops streaming and closes connection of replica. invoker should hold repl.mu
+func (repl *replication) closeReplica(state *replicaState) {
+	if state.closed {
+		return
+	}
+	state.closed = true
+	delete(repl.replicas, state.client)
+	repl.cond.Broadcast()
+	go func() {
+		_ = state.client.Close()
+	}()
+}
+
+// closeReplicas disconnects all replicas, so they would sync again with the new history. invoker should hold repl.mu
+func (repl *replication) closeReplicas() {
+	for _, state := range repl.replicas {
+		repl.closeReplica(state)
+	}
+}
+
+// removeReplica is called after connection c is closed
+func (db *DB) removeReplica(c redis.Client) {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if state, ok := repl.replicas[c]; ok {
+		state.closed = true
+		delete(repl.replicas, c)
+		repl.cond.Broadcast()
+	}
+}
+
+// ReplConf handles REPLCONF <option> <value> [<option> <value> ...] from replica c
+func ReplConf(db *DB, c redis.Client, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeErrReply("ERR syntax error")
+	}
+	if c == nil {
+		return reply.MakeErrReply("ERR REPLCONF is only available on connections")
+	}
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToLower(string(args[i]))
+		value := string(args[i+1])
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 0 || port > 65535 {
+				return reply.MakeErrReply("ERR invalid listening-port " + value)
+			}
+			repl.getReplica(c).listenPort = port
+		case "capa", "ip-address":
+			// eof and psync2 are always supported
+		case "ack":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return &reply.NoReply{}
+			}
+			if state, ok := repl.replicas[c]; ok {
+				if offset > state.offset {
+					state.offset = offset
+				}
+				state.ackTime = time.Now()
+				// wake up WAIT
+				repl.cond.Broadcast()
+			}
+			// replicas expect no reply for ACK
+			return &reply.NoReply{}
+		default:
+			return reply.MakeErrReply("ERR Unrecognized REPLCONF option: " + option)
+		}
+	}
+	return &reply.OkReply{}
+}
+
+// PSync handles PSYNC replid offset, or SYNC if isSync, from replica c
+func PSync(db *DB, c redis.Client, args [][]byte, isSync bool) redis.Reply {
+	if c == nil {
+		return reply.MakeErrReply("ERR PSYNC is only available on connections")
+	}
+	replid, psyncOffset := "?", int64(-1)
+	if !isSync {
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'psync' command")
+		}
+		offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		replid, psyncOffset = string(args[0]), offset
+	}
+
+	repl := db.repl
+	repl.mu.Lock()
+	if repl.master != nil && repl.master.state != linkConnected {
+		repl.mu.Unlock()
+		return reply.MakeErrReply("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	state := repl.getReplica(c)
+	if state.state != replicaHandshake {
+		repl.mu.Unlock()
+		return &reply.NoReply{}
+	}
+	if !repl.backlog.enabled() {
+		repl.backlog.enable(config.Properties.ReplBacklogSize)
+	}
+	if !isSync && repl.canPartialSync(replid, psyncOffset) {
+		repl.stats.syncPartialOK++
+		state.state = replicaOnline
+		state.offset = psyncOffset - 1
+		state.ackTime = time.Now()
+		replid := repl.replid
+		repl.mu.Unlock()
+		logger.Info("partial resynchronization accepted, sending backlog from " + strconv.FormatInt(psyncOffset, 10))
+		// stream is sent after +CONTINUE
+		go func() {
+			if err := c.Write([]byte("+CONTINUE " + replid + "\r\n")); err != nil {
+				return
+			}
+			db.streamToReplica(state, psyncOffset)
+		}()
+		return &reply.NoReply{}
+	}
+	if replid != "?" {
+		repl.stats.syncPartialErr++
+	}
+	repl.stats.syncFull++
+	state.state = replicaWaitBgsave
+	repl.mu.Unlock()
+
+	go db.fullSync(state, isSync)
+	return &reply.NoReply{}
+}
+
+// canPartialSync returns true if replica could continue from psyncOffset. invoker should hold repl.mu
+func (repl *replication) canPartialSync(replid string, psyncOffset int64) bool {
+	if replid != repl.replid && (replid != repl.replid2 || psyncOffset > repl.secondOffset) {
+		return false
+	}
+	return psyncOffset >= repl.backlog.first() && psyncOffset <= repl.backlog.offset+1
+}
+
+// fullSync sends a snapshot then streams commands after it
+func (db *DB) fullSync(state *replicaState, isSync bool) {
+	repl := db.repl
+	// the snapshot is exactly the data set at offset
+	var buf bytes.Buffer
+	var replid string
+	var offset int64
+	snap := db.takeSnapshot(func() {
+		repl.mu.Lock()
+		replid, offset = repl.replid, repl.backlog.offset
+		repl.mu.Unlock()
+	})
+	err := db.writeRDB(&buf, snap)
+	db.releaseSnapshot(snap)
+	if err != nil {
+		logger.Warn("write snapshot for replica failed: " + err.Error())
+		repl.mu.Lock()
+		repl.closeReplica(state)
+		repl.mu.Unlock()
+		return
+	}
+
+	var header string
+	if !isSync {
+		header = "+FULLRESYNC " + replid + " " + strconv.FormatInt(offset, 10) + "\r\n"
+	}
+	header += "$" + strconv.Itoa(buf.Len()) + "\r\n"
+	if err := state.client.Write(append([]byte(header), buf.Bytes()...)); err != nil {
+		repl.mu.Lock()
+		repl.closeReplica(state)
+		repl.mu.Unlock()
+		return
+	}
+	repl.mu.Lock()
+	state.state = replicaOnline
+	state.offset = offset
+	state.ackTime = time.Now()
+	repl.mu.Unlock()
+	logger.Info("synchronization with replica succeeded")
+	db.streamToReplica(state, offset+1)
+}
+
+// streamToReplica sends backlog from offset to replica until it is closed
+func (db *DB) streamToReplica(state *replicaState, offset int64) {
+	repl := db.repl
+	for {
+		repl.mu.Lock()
+		for !state.closed && repl.backlog.offset < offset {
+			repl.cond.Wait()
+		}
+		if state.closed {
+			repl.mu.Unlock()
+			return
+		}
+		data, ok := repl.backlog.readFrom(offset, replStreamChunk)
+		if !ok {
+			logger.Warn("replica is too slow to keep up with backlog, disconnecting it")
+			repl.closeReplica(state)
+			repl.mu.Unlock()
+			return
+		}
+		repl.mu.Unlock()
+		if err := state.client.Write(data); err != nil {
+			repl.mu.Lock()
+			repl.closeReplica(state)
+			repl.mu.Unlock()
+			return
+		}
+		offset += int64(len(data))
+	}
+}
+
+// stopReplication closes master link and replicas when db is closing
+func (db *DB) stopReplication() {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil {
+		repl.master.close()
+	}
+	repl.closeReplicas()
+	repl.stopped = true
+	repl.cond.Broadcast()
+}
+
+// goodReplicas counts online replicas acknowledged in min-replicas-max-lag. invoker should hold repl.mu
+func (repl *replication) goodReplicas() int {
+	maxLag := time.Duration(config.Properties.MinReplicasMaxLag) * time.Second
+	count := 0
+	for _, state := range repl.replicas {
+		if state.state == replicaOnline && time.Since(state.ackTime) <= maxLag {
+			count++
+		}
+	}
+	return count
+}
+
+// ackedReplicas counts replicas acknowledged offset. invoker should hold repl.mu
+func (repl *replication) ackedReplicas(offset int64) int {
+	count := 0
+	for _, state := range repl.replicas {
+		if state.state == replicaOnline && state.offset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// checkWritable returns error reply if writes from clients should be refused
+func (db *DB) checkWritable() redis.Reply {
+	if db.isReplica() {
+		if config.Properties.ReplicaReadOnly {
+			return reply.MakeErrReply("READONLY You can't write against a read only replica.")
+		}
+		return nil
+	}
+	if config.Properties.MinReplicasToWrite <= 0 || db.repl == nil {
+		return nil
+	}
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.goodReplicas() < config.Properties.MinReplicasToWrite {
+		return reply.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+	}
+	return nil
+}
+
+var getAckCmd = [][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")}
+
+// Wait blocks until numreplicas replicas acknowledge writes before it, WAIT numreplicas timeout
+// returns the number of replicas acknowledged, timeout is in milliseconds and 0 means forever
+func Wait(db *DB, args [][]byte) redis.Reply {
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return reply.MakeErrReply("ERR timeout is negative")
+	}
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil {
+		return reply.MakeErrReply("ERR WAIT cannot be used with replica instances.")
+	}
+	offset := repl.backlog.offset
+	acked := repl.ackedReplicas(offset)
+	if acked >= numReplicas {
+		return reply.MakeIntReply(int64(acked))
+	}
+	// ask replicas to ack at once instead of waiting for their periodical ack
+	repl.backlog.write(reply.MakeMultiBulkReply(getAckCmd).ToBytes())
+	repl.cond.Broadcast()
+
+	timedOut := false
+	if timeout > 0 {
+		timer := time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			repl.mu.Lock()
+			timedOut = true
+			repl.cond.Broadcast()
+			repl.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for acked < numReplicas && !timedOut && !repl.stopped {
+		repl.cond.Wait()
+		acked = repl.ackedReplicas(offset)
+	}
+	return reply.MakeIntReply(int64(acked))
+}
+
+// replicaAddr returns ip and listening port of replica
+func replicaAddr(state *replicaState) (string, string) {
+	host, _, err := net.SplitHostPort(state.client.RemoteAddr())
+	if err != nil {
+		host = state.client.RemoteAddr()
+	}
+	return host, strconv.Itoa(state.listenPort)
+}
+
+// Role returns role of the server, ROLE
+func Role(db *DB, args [][]byte) redis.Reply {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if link := repl.master; link != nil {
+		return reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeBulkReply([]byte("slave")),
+			reply.MakeBulkReply([]byte(link.host)),
+			reply.MakeIntReply(int64(link.port)),
+			reply.MakeBulkReply([]byte(link.state)),
+			reply.MakeIntReply(repl.backlog.offset),
+		})
+	}
+	var replicas []redis.Reply
+	for _, state := range repl.replicas {
+		if state.state != replicaOnline {
+			continue
+		}
+		host, port := replicaAddr(state)
+		replicas = append(replicas, reply.MakeMultiBulkReply([][]byte{
+			[]byte(host), []byte(port), []byte(strconv.FormatInt(state.offset, 10)),
+		}))
+	}
+	return reply.MakeMultiRawReply([]redis.Reply{
+		reply.MakeBulkReply([]byte("master")),
+		reply.MakeIntReply(repl.backlog.offset),
+		reply.MakeMultiRawReply(replicas),
+	})
+}
+
+// role returns master or slave
+func (db *DB) role() string {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.master != nil {
+		return "slave"
+	}
+	return "master"
+}
+
+func replicationInfo(db *DB) [][2]string {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	var fields [][2]string
+	if link := repl.master; link != nil {
+		lastIO := int64(-1)
+		if !link.lastIO.IsZero() {
+			lastIO = int64(time.Since(link.lastIO) / time.Second)
+		}
+		fields = append(fields, [][2]string{
+			{"role", "slave"},
+			{"master_host", link.host},
+			{"master_port", strconv.Itoa(link.port)},
+			{"master_link_status", link.status()},
+			{"master_last_io_seconds_ago", strconv.FormatInt(lastIO, 10)},
+			{"master_sync_in_progress", boolInfo(link.state == linkSync)},
+			{"slave_repl_offset", strconv.FormatInt(repl.backlog.offset, 10)},
+		}...)
+	} else {
+		fields = append(fields, [2]string{"role", "master"})
+		if config.Properties.MinReplicasToWrite > 0 {
+			fields = append(fields, [2]string{"min_slaves_good_slaves", strconv.Itoa(repl.goodReplicas())})
+		}
+	}
+	var replicas [][2]string
+	for _, state := range repl.replicas {
+		if state.state == replicaHandshake {
+			continue
+		}
+		host, port := replicaAddr(state)
+		lag := int64(time.Since(state.ackTime) / time.Second)
+		replicas = append(replicas, [2]string{
+			"slave" + strconv.Itoa(len(replicas)),
+			"ip=" + host + ",port=" + port + ",state=" + state.state +
+				",offset=" + strconv.FormatInt(state.offset, 10) + ",lag=" + strconv.FormatInt(lag, 10),
+		})
+	}
+	fields = append(fields, [2]string{"connected_slaves", strconv.Itoa(len(replicas))})
+	fields = append(fields, replicas...)
+	return append(fields, [][2]string{
+		{"master_replid", repl.replid},
+		{"master_replid2", replid2Info(repl.replid2)},
+		{"master_repl_offset", strconv.FormatInt(repl.backlog.offset, 10)},
+		{"second_repl_offset", strconv.FormatInt(repl.secondOffset, 10)},
+		{"repl_backlog_active", boolInfo(repl.backlog.enabled())},
+		{"repl_backlog_size", strconv.Itoa(len(repl.backlog.buf))},
+		{"repl_backlog_first_byte_offset", strconv.FormatInt(repl.backlog.first(), 10)},
+		{"repl_backlog_histlen", strconv.FormatInt(repl.backlog.histlen, 10)},
+	}...)
+}
+
+func replid2Info(replid2 string) string {
+	if replid2 == "" {
+		return strings.Repeat("0", 40)
+	}
+	return replid2
+}
+
+func statsInfo(db *DB) [][2]string {
+	repl := db.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	return [][2]string{
+		{"sync_full", strconv.FormatInt(repl.stats.syncFull, 10)},
+		{"sync_partial_ok", strconv.FormatInt(repl.stats.syncPartialOK, 10)},
+		{"sync_partial_err", strconv.FormatInt(repl.stats.syncPartialErr, 10)},
+	}
+}
@@ -0,0 +1,295 @@
+package db
+
+import (
+	"myGodis/src/config"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient is a minimal redis.Client serving one connection
+type testClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+
+	multiState bool
+	queue      [][][]byte
+	txErrors   []error
+	watching   map[string]uint32
+	closed     chan struct{}
+}
+
+func (c *testClient) Write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *testClient) Close() error                 { return c.conn.Close() }
+func (c *testClient) RemoteAddr() string           { return c.conn.RemoteAddr().String() }
+func (c *testClient) SubsChannel(channel string)   {}
+func (c *testClient) UnSubsChannel(channel string) {}
+func (c *testClient) SubsCount() int               { return 0 }
+func (c *testClient) GetChannels() []string        { return nil }
+func (c *testClient) GetProtocol() int             { return reply.RESP2 }
+func (c *testClient) SetProtocol(protocol int)     {}
+func (c *testClient) InMultiState() bool           { return c.multiState }
+func (c *testClient) GetQueuedCmdLine() [][][]byte { return c.queue }
+func (c *testClient) EnqueueCmd(cmdLine [][]byte)  { c.queue = append(c.queue, cmdLine) }
+func (c *testClient) AddTxError(err error)         { c.txErrors = append(c.txErrors, err) }
+func (c *testClient) GetTxErrors() []error         { return c.txErrors }
+func (c *testClient) Closed() <-chan struct{}      { return c.closed }
+
+func (c *testClient) GetWatching() map[string]uint32 {
+	if c.watching == nil {
+		c.watching = make(map[string]uint32)
+	}
+	return c.watching
+}
+
+func (c *testClient) SetMultiState(state bool) {
+	c.multiState = state
+	c.queue = nil
+	c.txErrors = nil
+}
+
+// serveDB serves db on a random port and returns the port
+func serveDB(t *testing.T, db *DB) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := &testClient{conn: conn}
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						_ = conn.Close()
+						continue
+					}
+					cmdLine, ok := payload.Data.(*reply.MultiBulkReply)
+					if !ok {
+						continue
+					}
+					_ = c.Write(db.Exec(c, cmdLine.Args).ToBytes())
+				}
+				db.AfterClientClose(c)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// waitReply waits until the reply of cmdLine is expected
+func waitReply(t *testing.T, db *DB, cmdLine []string, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result := string(db.Exec(nil, toArgs(cmdLine...)).ToBytes())
+		if result == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: expected %q, actual %q", cmdLine, expected, result)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitLinkUp waits until the replica finishes syncing with master
+func waitLinkUp(t *testing.T, db *DB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.repl.mu.Lock()
+		up := db.repl.master != nil && db.repl.master.state == linkConnected
+		db.repl.mu.Unlock()
+		if up {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replica is not connected with master")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func replOffset(db *DB) int64 {
+	db.repl.mu.Lock()
+	defer db.repl.mu.Unlock()
+	return db.repl.backlog.offset
+}
+
+func TestReplication(t *testing.T) {
+	useRDB(t)
+	master := MakeDB()
+	defer master.Close()
+	port := serveDB(t, master)
+	master.Exec(nil, toArgs("set", "k0", "v"))
+	master.Exec(nil, toArgs("rpush", "list", "a", "b"))
+	master.Exec(nil, toArgs("set", "ttl", "v", "ex", "100"))
+
+	replica := MakeDB()
+	defer replica.Close()
+	assertReply(t, replica, []string{"replicaof", "127.0.0.1", strconv.Itoa(port)}, "+OK\r\n")
+	assertReply(t, replica, []string{"replicaof", "127.0.0.1", strconv.Itoa(port)},
+		"+OK Already connected to specified master\r\n")
+
+	// full sync then the stream
+	waitLinkUp(t, replica)
+	waitReply(t, replica, []string{"get", "k0"}, "$1\r\nv\r\n")
+	master.Exec(nil, toArgs("incr", "counter"))
+	master.Exec(nil, toArgs("rpush", "list", "c"))
+	waitReply(t, replica, []string{"get", "counter"}, "$1\r\n1\r\n")
+	assertReply(t, replica, []string{"lrange", "list", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n")
+	if ttl := replica.Exec(nil, toArgs("ttl", "ttl")).ToBytes(); string(ttl) == ":-1\r\n" {
+		t.Error("ttl is lost")
+	}
+
+	role := string(replica.Exec(nil, toArgs("role")).ToBytes())
+	if !strings.HasPrefix(role, "*5\r\n$5\r\nslave\r\n$9\r\n127.0.0.1\r\n:"+strconv.Itoa(port)+"\r\n$9\r\nconnected\r\n") {
+		t.Errorf("wrong role of replica %q", role)
+	}
+	role = string(master.Exec(nil, toArgs("role")).ToBytes())
+	if !strings.HasPrefix(role, "*3\r\n$6\r\nmaster\r\n") || !strings.Contains(role, "$9\r\n127.0.0.1\r\n") {
+		t.Errorf("wrong role of master %q", role)
+	}
+
+	// reconnect by partial resync
+	replica.repl.mu.Lock()
+	_ = replica.repl.master.conn.Close()
+	replica.repl.mu.Unlock()
+	master.Exec(nil, toArgs("set", "k1", "v"))
+	waitReply(t, replica, []string{"get", "k1"}, "$1\r\nv\r\n")
+
+	// transactions are replicated as a unit
+	c := &testClient{}
+	master.Exec(c, toArgs("multi"))
+	master.Exec(c, toArgs("incr", "counter"))
+	master.Exec(c, toArgs("set", "k3", "v"))
+	master.Exec(c, toArgs("exec"))
+	waitReply(t, replica, []string{"get", "k3"}, "$1\r\nv\r\n")
+	assertReply(t, replica, []string{"get", "counter"}, "$1\r\n2\r\n")
+
+	// effects of scripts are replicated, read-only scripts are allowed on replica
+	master.Exec(nil, toArgs("eval", "redis.call('incr', KEYS[1]) return redis.call('set', KEYS[2], 'v')", "2", "counter", "k4"))
+	waitReply(t, replica, []string{"get", "k4"}, "$1\r\nv\r\n")
+	assertReply(t, replica, []string{"eval", "return redis.call('get', KEYS[1])", "1", "counter"}, "$1\r\n3\r\n")
+	assertReply(t, replica, []string{"eval", "return redis.call('incr', KEYS[1])", "1", "counter"},
+		"-READONLY You can't write against a read only replica.\r\n")
+	stats := string(master.Exec(nil, toArgs("info", "stats")).ToBytes())
+	if !strings.Contains(stats, "sync_full:1\r\n") || !strings.Contains(stats, "sync_partial_ok:1\r\n") {
+		t.Errorf("expected 1 full sync and 1 partial sync: %s", stats)
+	}
+	if replOffset(master) != replOffset(replica) {
+		t.Errorf("offset of master %d, replica %d", replOffset(master), replOffset(replica))
+	}
+	info := string(master.Exec(nil, toArgs("info", "replication")).ToBytes())
+	if !strings.Contains(info, "connected_slaves:1\r\n") || !strings.Contains(info, "state=online") {
+		t.Errorf("wrong replication info: %s", info)
+	}
+
+	// promote replica, the old replid is kept as replid2
+	masterReplid := master.repl.replid
+	assertReply(t, replica, []string{"replicaof", "no", "one"}, "+OK\r\n")
+	assertReply(t, replica, []string{"set", "k2", "v"}, "+OK\r\n")
+	info = string(replica.Exec(nil, toArgs("info", "replication")).ToBytes())
+	if !strings.Contains(info, "role:master\r\n") || !strings.Contains(info, "master_replid2:"+masterReplid) {
+		t.Errorf("wrong replication info after promoted: %s", info)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	b := &backlog{}
+	b.write([]byte("ignored"))
+	if b.offset != 0 {
+		t.Error("disabled backlog should not be written")
+	}
+	b.enable(8)
+	b.write([]byte("abcde"))
+	b.write([]byte("fghij"))
+	if b.offset != 10 || b.histlen != 8 || b.first() != 3 {
+		t.Fatalf("wrong backlog offset %d, histlen %d", b.offset, b.histlen)
+	}
+	if _, ok := b.readFrom(2, 100); ok {
+		t.Error("offset 2 is overwritten")
+	}
+	if data, ok := b.readFrom(3, 100); !ok || string(data) != "cdefghij" {
+		t.Errorf("expected cdefghij, actual %q", data)
+	}
+	if data, ok := b.readFrom(9, 1); !ok || string(data) != "i" {
+		t.Errorf("expected i, actual %q", data)
+	}
+	if data, ok := b.readFrom(11, 100); !ok || len(data) != 0 {
+		t.Errorf("expected nothing, actual %q", data)
+	}
+	b.write([]byte("0123456789"))
+	if data, _ := b.readFrom(13, 100); string(data) != "23456789" {
+		t.Errorf("expected 23456789, actual %q", data)
+	}
+}
+
+func TestWaitAndWriteSafety(t *testing.T) {
+	useRDB(t)
+	master := MakeDB()
+	defer master.Close()
+	// waits until timeout even if there is no replica
+	start := time.Now()
+	assertReply(t, master, []string{"wait", "1", "100"}, ":0\r\n")
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WAIT returns before timeout without replicas")
+	}
+	port := serveDB(t, master)
+	replica := MakeDB()
+	defer replica.Close()
+	assertReply(t, replica, []string{"replicaof", "127.0.0.1", strconv.Itoa(port)}, "+OK\r\n")
+	waitLinkUp(t, replica)
+
+	assertReply(t, master, []string{"wait", "0", "0"}, ":1\r\n")
+	assertReply(t, master, []string{"set", "k", "v"}, "+OK\r\n")
+	assertReply(t, master, []string{"wait", "1", "5000"}, ":1\r\n")
+	assertReply(t, replica, []string{"get", "k"}, "$1\r\nv\r\n")
+	start = time.Now()
+	assertReply(t, master, []string{"wait", "2", "100"}, ":1\r\n")
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WAIT returns before timeout")
+	}
+	if replOffset(master) != replOffset(replica) {
+		t.Errorf("offset of master %d, replica %d", replOffset(master), replOffset(replica))
+	}
+
+	// replica is read only
+	assertReply(t, replica, []string{"set", "k", "v2"}, "-READONLY You can't write against a read only replica.\r\n")
+	assertReply(t, replica, []string{"wait", "0", "0"}, "-ERR WAIT cannot be used with replica instances.\r\n")
+	config.Properties.ReplicaReadOnly = false
+	assertReply(t, replica, []string{"set", "local", "v"}, "+OK\r\n")
+	config.Properties.ReplicaReadOnly = true
+
+	// min-replicas-to-write
+	defer func() {
+		config.Properties.MinReplicasToWrite = 0
+	}()
+	config.Properties.MinReplicasToWrite = 2
+	assertReply(t, master, []string{"set", "k", "v3"}, "-NOREPLICAS Not enough good replicas to write.\r\n")
+	assertReply(t, master, []string{"get", "k"}, "$1\r\nv\r\n")
+	config.Properties.MinReplicasToWrite = 1
+	assertReply(t, master, []string{"set", "k", "v3"}, "+OK\r\n")
+	info := string(master.Exec(nil, toArgs("info", "replication")).ToBytes())
+	if !strings.Contains(info, "min_slaves_good_slaves:1\r\n") {
+		t.Errorf("wrong replication info: %s", info)
+	}
+}
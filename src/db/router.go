@@ -1,14 +1,246 @@
 package db
 
-func MakeRouter() map[string]CmdFunc {
-	routerMap := make(map[string]CmdFunc)
+import (
+	"strings"
+)
 
-	routerMap["del"] = Del
-	routerMap["expire"] = Expire
-	routerMap["expireat"] = ExpireAt
+const (
+	flagWrite    = 1 << iota // command may modify the dataset
+	flagReadOnly             // command never modifies the dataset
+	flagPubSub               // pub/sub command
+	flagNoMulti              // command could not be queued in transaction
+	flagNoScript             // command could not be called by scripts
+	flagScript               // command runs a script atomically, writes are flagged by commands it calls unless it is flagReadOnly
+	flagBlocking             // command may wait for keys, it doesn't block in transactions and scripts
+)
 
-	routerMap["flushdb"] = FlushDB
-	routerMap["flushall"] = FlushAll
+type command struct {
+	name     string
+	executor CmdFunc
+	// arity counts the command name itself, arity < 0 means len(args) >= -arity
+	arity int
+	flags int
+	// 1-based positions of keys in args (args[0] is command name), 0 means no key
+	firstKey int
+	// lastKey < 0 counts from the end of args, -1 means the last arg
+	lastKey int
+	keyStep int
+	// keysFunc finds keys not at fixed positions, eg. EVAL, positions above are ignored if it is set
+	keysFunc func(args [][]byte) []string
+	// subcommands never modify the dataset, eg. FUNCTION LIST
+	readOnlySubcommands []string
+}
+
+func registerCommand(routerMap map[string]*command, name string, executor CmdFunc, arity int, flags int,
+	firstKey int, lastKey int, keyStep int) {
+	name = strings.ToLower(name)
+	routerMap[name] = &command{
+		name:     name,
+		executor: executor,
+		arity:    arity,
+		flags:    flags,
+		firstKey: firstKey,
+		lastKey:  lastKey,
+		keyStep:  keyStep,
+	}
+}
+
+func MakeRouter() map[string]*command {
+	routerMap := make(map[string]*command)
+
+	// commands handled by DB.Exec itself since they need the client, executor is nil
+	registerCommand(routerMap, "subscribe", nil, -2, flagPubSub|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "unsubscribe", nil, -1, flagPubSub|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "publish", nil, 3, flagPubSub|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "hello", nil, -1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "multi", nil, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "exec", nil, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "discard", nil, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "watch", nil, -2, flagReadOnly|flagNoMulti, 1, -1, 1)
+	registerCommand(routerMap, "unwatch", nil, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+
+	// server
+	registerCommand(routerMap, "ping", Ping, -1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "command", Command, -1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "bgrewriteaof", BGRewriteAOF, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "save", Save, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "bgsave", BGSave, -1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "lastsave", LastSave, 1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "info", Info, -1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "debug", Debug, -2, flagReadOnly|flagNoMulti, 0, 0, 0)
+
+	// replication
+	registerCommand(routerMap, "replicaof", ReplicaOf, 3, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "slaveof", ReplicaOf, 3, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "role", Role, 1, flagReadOnly, 0, 0, 0)
+	registerCommand(routerMap, "wait", Wait, 3, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "psync", nil, 3, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "sync", nil, 1, flagReadOnly|flagNoMulti, 0, 0, 0)
+	registerCommand(routerMap, "replconf", nil, -1, flagReadOnly|flagNoMulti, 0, 0, 0)
+
+	// scripting
+	registerCommand(routerMap, "eval", Eval, -3, flagScript|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "evalsha", EvalSha, -3, flagScript|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "eval_ro", EvalRO, -3, flagScript|flagReadOnly|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "evalsha_ro", EvalShaRO, -3, flagScript|flagReadOnly|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "script", Script, -2, flagReadOnly|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "fcall", FCall, -3, flagScript|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "fcall_ro", FCallRO, -3, flagScript|flagReadOnly|flagNoScript, 0, 0, 0)
+	registerCommand(routerMap, "function", Function, -2, flagWrite|flagNoScript, 0, 0, 0)
+	routerMap["eval"].keysFunc = scriptKeys
+	routerMap["evalsha"].keysFunc = scriptKeys
+	routerMap["eval_ro"].keysFunc = scriptKeys
+	routerMap["evalsha_ro"].keysFunc = scriptKeys
+	routerMap["fcall"].keysFunc = scriptKeys
+	routerMap["fcall_ro"].keysFunc = scriptKeys
+	routerMap["function"].readOnlySubcommands = []string{"list", "dump", "stats", "kill"}
+
+	// keys
+	registerCommand(routerMap, "del", Del, -2, flagWrite, 1, -1, 1)
+	registerCommand(routerMap, "exists", Exists, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "type", Type, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "rename", Rename, 3, flagWrite, 1, 2, 1)
+	registerCommand(routerMap, "renamenx", RenameNx, 3, flagWrite, 1, 2, 1)
+	registerCommand(routerMap, "expire", Expire, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "expireat", ExpireAt, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "pexpire", PExpire, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "pexpireat", PExpireAt, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "ttl", TTL, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "pttl", PTTL, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "persist", Persist, 2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "flushdb", FlushDB, 1, flagWrite, 0, 0, 0)
+	registerCommand(routerMap, "flushall", FlushAll, 1, flagWrite, 0, 0, 0)
+
+	// string
+	registerCommand(routerMap, "get", Get, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "set", Set, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "setnx", SetNX, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "setex", SetEX, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "psetex", PSetEX, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "mset", MSet, -3, flagWrite, 1, -1, 2)
+	registerCommand(routerMap, "msetnx", MSetNX, -3, flagWrite, 1, -1, 2)
+	registerCommand(routerMap, "mget", MGet, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "getset", GetSet, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "incr", Incr, 2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "incrby", IncrBy, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "incrbyfloat", IncrByFloat, 3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "decr", Decr, 2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "decrby", DecrBy, 3, flagWrite, 1, 1, 1)
+
+	// list
+	registerCommand(routerMap, "lindex", LIndex, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "llen", LLen, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "lmove", LMove, 5, flagWrite, 1, 2, 1)
+	registerCommand(routerMap, "lpop", LPop, 2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "lpush", LPush, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "lpushx", LPushX, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "lrange", LRange, 4, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "lrem", LRem, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "lset", LSet, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "rpop", RPop, 2, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "rpoplpush", RPopLPush, 3, flagWrite, 1, 2, 1)
+	registerCommand(routerMap, "rpush", RPush, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "blpop", BLPop, -3, flagWrite|flagBlocking, 1, -2, 1)
+	registerCommand(routerMap, "brpop", BRPop, -3, flagWrite|flagBlocking, 1, -2, 1)
+	registerCommand(routerMap, "brpoplpush", BRPopLPush, 4, flagWrite|flagBlocking, 1, 2, 1)
+	registerCommand(routerMap, "blmove", BLMove, 6, flagWrite|flagBlocking, 1, 2, 1)
+
+	// hash
+	registerCommand(routerMap, "hset", HSet, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hsetnx", HSetNX, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hget", HGet, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hexists", HExists, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hdel", HDel, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hlen", HLen, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hmset", HMSet, -4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hmget", HMGet, -3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hkeys", HKeys, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hvals", HVals, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hgetall", HGetAll, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "hincrby", HIncrBy, 4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "hincrbyfloat", HIncrByFloat, 4, flagWrite, 1, 1, 1)
+
+	// set
+	registerCommand(routerMap, "sadd", SAdd, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "sismember", SIsMember, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "srem", SRem, -3, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "scard", SCard, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "smembers", SMembers, 2, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "sinter", SInter, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "sinterstore", SInterStore, -3, flagWrite, 1, -1, 1)
+	registerCommand(routerMap, "sunion", SUnion, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "sunionstore", SUnionStore, -3, flagWrite, 1, -1, 1)
+	registerCommand(routerMap, "sdiff", SDiff, -2, flagReadOnly, 1, -1, 1)
+	registerCommand(routerMap, "sdiffstore", SDiffStore, -3, flagWrite, 1, -1, 1)
+
+	// sorted set
+	registerCommand(routerMap, "zadd", ZAdd, -4, flagWrite, 1, 1, 1)
+	registerCommand(routerMap, "zscore", ZScore, 3, flagReadOnly, 1, 1, 1)
+	registerCommand(routerMap, "zrank", ZRank, 3, flagReadOnly, 1, 1, 1)
 
 	return routerMap
 }
+
+// validateArity checks args (including command name) against the declared arity
+func (cmd *command) validateArity(args [][]byte) bool {
+	argNum := len(args)
+	if cmd.arity >= 0 {
+		return argNum == cmd.arity
+	}
+	return argNum >= -cmd.arity
+}
+
+// isWrite returns true if the command line (including command name) may modify the dataset
+func (cmd *command) isWrite(args [][]byte) bool {
+	if cmd.flags&flagWrite == 0 {
+		return false
+	}
+	if len(args) > 1 {
+		subCommand := strings.ToLower(string(args[1]))
+		for _, name := range cmd.readOnlySubcommands {
+			if subCommand == name {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// getKeys extracts keys from args (including command name) by the declared key positions
+func (cmd *command) getKeys(args [][]byte) []string {
+	if cmd.keysFunc != nil {
+		return cmd.keysFunc(args)
+	}
+	if cmd.firstKey <= 0 || cmd.firstKey >= len(args) {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	if last < cmd.firstKey {
+		return nil
+	}
+	step := cmd.keyStep
+	if step <= 0 {
+		step = 1
+	}
+	keys := make([]string, 0, (last-cmd.firstKey)/step+1)
+	for i := cmd.firstKey; i <= last; i += step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// GetRelatedKeys returns keys declared in command table of the command line,
+// ok is false if the command is unknown or arity mismatches
+func GetRelatedKeys(cmdLine [][]byte) (keys []string, ok bool) {
+	cmd, ok := router[strings.ToLower(string(cmdLine[0]))]
+	if !ok || !cmd.validateArity(cmdLine) {
+		return nil, false
+	}
+	return cmd.getKeys(cmdLine), true
+}
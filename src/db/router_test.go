@@ -0,0 +1,82 @@
+package db
+
+import (
+	"myGodis/src/redis/reply"
+	"testing"
+)
+
+func toArgs(cmd ...string) [][]byte {
+	args := make([][]byte, len(cmd))
+	for i, s := range cmd {
+		args[i] = []byte(s)
+	}
+	return args
+}
+
+func TestExecArity(t *testing.T) {
+	db := MakeDB()
+	result := db.Exec(nil, toArgs("get"))
+	if string(result.ToBytes()) != string((&reply.ArgNumErrReply{Cmd: "get"}).ToBytes()) {
+		t.Errorf("expected arity error, actual: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("set", "a", "1"))
+	if _, ok := result.(*reply.OkReply); !ok {
+		t.Errorf("expected ok, actual: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("GET", "a"))
+	if string(result.ToBytes()) != "$1\r\n1\r\n" {
+		t.Errorf("expected bulk 1, actual: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("mset", "a", "1", "b"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("exists", "a", "b", "a"))
+	if string(result.ToBytes()) != ":2\r\n" {
+		t.Errorf("expected 2, actual: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("notacommand"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual: %s", string(result.ToBytes()))
+	}
+}
+
+func TestGetKeys(t *testing.T) {
+	keys := router["mset"].getKeys(toArgs("mset", "a", "1", "b", "2"))
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("wrong keys: %v", keys)
+	}
+	keys = router["del"].getKeys(toArgs("del", "a", "b", "c"))
+	if len(keys) != 3 {
+		t.Errorf("wrong keys: %v", keys)
+	}
+	keys = router["exists"].getKeys(toArgs("exists", "a", "b"))
+	if len(keys) != 2 || keys[1] != "b" {
+		t.Errorf("wrong keys: %v", keys)
+	}
+	keys = router["ping"].getKeys(toArgs("ping"))
+	if len(keys) != 0 {
+		t.Errorf("wrong keys: %v", keys)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	db := MakeDB()
+	result := db.Exec(nil, toArgs("command", "count"))
+	if intReply, ok := result.(*reply.IntReply); !ok || intReply.Code != int64(len(router)) {
+		t.Errorf("wrong command count: %s", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("command", "info", "get", "nosuchcmd"))
+	expected := "*2\r\n*7\r\n$3\r\nget\r\n:2\r\n*1\r\n+readonly\r\n:1\r\n:1\r\n:1\r\n*1\r\n+@read\r\n*-1\r\n"
+	if string(result.ToBytes()) != expected {
+		t.Errorf("wrong command info: %q", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("command", "getkeys", "mset", "a", "1", "b", "2"))
+	if string(result.ToBytes()) != "*2\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Errorf("wrong command getkeys: %q", string(result.ToBytes()))
+	}
+	result = db.Exec(nil, toArgs("command", "getkeys", "ping"))
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual: %q", string(result.ToBytes()))
+	}
+}
@@ -0,0 +1,352 @@
+package db
+
+import (
+	"context"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/*
+ * EVAL runs scripts atomically: like a transaction, it holds snapshotMu.RLock and locks all keys declared in KEYS,
+ * so scripts may only access declared keys and can't call write commands without keys, eg. FLUSHDB.
+ * EVAL_RO, EVALSHA_RO and FCALL_RO refuse write commands, they only hold read locks of keys.
+ * Write commands called by the script are sent to aof and replicas as a transaction, scripts themselves are never replicated.
+ * Scripts and functions are executed one by one in a shared lua vm, a running script may be killed by SCRIPT KILL
+ * before it writes.
+ */
+
+type scripting struct {
+	db *DB
+	// serializes scripts, L is not thread safe
+	mu sync.Mutex
+	L  *lua.LState
+	// keys declared by the running script
+	keys     map[string]struct{}
+	readOnly bool
+	// functions registered by the library being loaded, nil if no library is loading
+	registering map[string]*luaFunction
+
+	// function libraries, they are changed holding mu since loading runs lua code
+	libMu     sync.RWMutex
+	libraries map[string]*library
+	functions map[string]*luaFunction // name -> function of all libraries
+
+	cacheMu sync.RWMutex
+	cache   map[string]*lua.FunctionProto // sha1 -> compiled script
+
+	runningMu    sync.Mutex
+	running      *scriptRun
+	runningSince time.Time
+	written      bool // the running script has called write commands
+	cancel       context.CancelFunc
+}
+
+func makeScripting(db *DB) *scripting {
+	return &scripting{
+		db:        db,
+		cache:     make(map[string]*lua.FunctionProto),
+		libraries: make(map[string]*library),
+		functions: make(map[string]*luaFunction),
+	}
+}
+
+// scriptKeys returns KEYS of EVAL script numkeys key [key ...] arg [arg ...], also used by FCALL
+func scriptKeys(args [][]byte) []string {
+	if len(args) < 3 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(string(args[2]))
+	if err != nil || numKeys < 0 || 3+numKeys > len(args) {
+		return nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[3+i])
+	}
+	return keys
+}
+
+// execScript executes a script command atomically, eg. EVAL, EVALSHA_RO and FCALL
+func (db *DB) execScript(args [][]byte) redis.Reply {
+	return db.execTx([][][]byte{args}, nil)[0]
+}
+
+// parseScriptArgs splits numkeys key [key ...] arg [arg ...]
+func parseScriptArgs(args [][]byte) (keys [][]byte, argv [][]byte, errReply redis.Reply) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, nil, reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, reply.MakeErrReply("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, reply.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// Eval runs a script and caches it, EVAL script numkeys key [key ...] arg [arg ...]
+func Eval(db *DB, args [][]byte) redis.Reply {
+	return eval(db, args, false)
+}
+
+// EvalRO runs a script refusing write commands, EVAL_RO script numkeys key [key ...] arg [arg ...]
+func EvalRO(db *DB, args [][]byte) redis.Reply {
+	return eval(db, args, true)
+}
+
+func eval(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	keys, argv, errReply := parseScriptArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	body := string(args[0])
+	sha := sha1Hex(body)
+	proto, errReply := db.scripts.load(sha, body)
+	if errReply != nil {
+		return errReply
+	}
+	return db.scripts.runScript(sha, proto, keys, argv, readOnly)
+}
+
+// EvalSha runs a cached script, EVALSHA sha1 numkeys key [key ...] arg [arg ...]
+func EvalSha(db *DB, args [][]byte) redis.Reply {
+	return evalSha(db, args, false)
+}
+
+// EvalShaRO runs a cached script refusing write commands, EVALSHA_RO sha1 numkeys key [key ...] arg [arg ...]
+func EvalShaRO(db *DB, args [][]byte) redis.Reply {
+	return evalSha(db, args, true)
+}
+
+func evalSha(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	keys, argv, errReply := parseScriptArgs(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	sha := strings.ToLower(string(args[0]))
+	db.scripts.cacheMu.RLock()
+	proto, ok := db.scripts.cache[sha]
+	db.scripts.cacheMu.RUnlock()
+	if !ok {
+		return reply.MakeErrReply("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return db.scripts.runScript(sha, proto, keys, argv, readOnly)
+}
+
+// Script manages the script cache, SCRIPT LOAD | EXISTS | FLUSH | KILL
+func Script(db *DB, args [][]byte) redis.Reply {
+	subCommand := strings.ToLower(string(args[0]))
+	switch subCommand {
+	case "load":
+		if len(args) != 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|load"}
+		}
+		body := string(args[1])
+		sha := sha1Hex(body)
+		if _, errReply := db.scripts.load(sha, body); errReply != nil {
+			return errReply
+		}
+		return reply.MakeBulkReply([]byte(sha))
+	case "exists":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|exists"}
+		}
+		db.scripts.cacheMu.RLock()
+		defer db.scripts.cacheMu.RUnlock()
+		result := make([]redis.Reply, len(args)-1)
+		for i, sha := range args[1:] {
+			exists := int64(0)
+			if _, ok := db.scripts.cache[strings.ToLower(string(sha))]; ok {
+				exists = 1
+			}
+			result[i] = reply.MakeIntReply(exists)
+		}
+		return reply.MakeMultiRawReply(result)
+	case "flush":
+		if len(args) > 2 {
+			return &reply.ArgNumErrReply{Cmd: "script|flush"}
+		}
+		if len(args) == 2 {
+			mode := strings.ToLower(string(args[1]))
+			if mode != "async" && mode != "sync" {
+				return reply.MakeErrReply("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		db.scripts.cacheMu.Lock()
+		db.scripts.cache = make(map[string]*lua.FunctionProto)
+		db.scripts.cacheMu.Unlock()
+		return &reply.OkReply{}
+	case "kill":
+		if len(args) != 1 {
+			return &reply.ArgNumErrReply{Cmd: "script|kill"}
+		}
+		return db.scripts.kill(false)
+	default:
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(args[0]) + "'. Try SCRIPT HELP.")
+	}
+}
+
+// load compiles and caches a script if it is not cached
+func (s *scripting) load(sha string, body string) (*lua.FunctionProto, redis.Reply) {
+	s.cacheMu.RLock()
+	proto, ok := s.cache[sha]
+	s.cacheMu.RUnlock()
+	if ok {
+		return proto, nil
+	}
+	proto, err := compileLua(body, "@user_script")
+	if err != nil {
+		return nil, reply.MakeErrReply("ERR Error compiling script (new function): " + err.Error())
+	}
+	s.cacheMu.Lock()
+	s.cache[sha] = proto
+	s.cacheMu.Unlock()
+	return proto, nil
+}
+
+// scriptRun is a running script or function
+type scriptRun struct {
+	name     string // f_<sha1> of scripts or name of functions
+	function bool
+	readOnly bool // write commands are refused
+	keys     [][]byte
+	argv     [][]byte
+	// push pushes the lua function and its arguments, returns the number of arguments
+	push func(L *lua.LState) int
+}
+
+// runScript executes a compiled script, invoker should hold snapshotMu and locks of keys
+func (s *scripting) runScript(sha string, proto *lua.FunctionProto, keys [][]byte, argv [][]byte, readOnly bool) redis.Reply {
+	return s.run(&scriptRun{
+		name:     "f_" + sha,
+		readOnly: readOnly,
+		keys:     keys,
+		argv:     argv,
+		push: func(L *lua.LState) int {
+			L.G.Global.RawSetString("KEYS", makeLuaStringTable(L, keys))
+			L.G.Global.RawSetString("ARGV", makeLuaStringTable(L, argv))
+			L.Push(L.NewFunctionFromProto(proto))
+			return 0
+		},
+	})
+}
+
+func (s *scripting) run(r *scriptRun) redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	L := s.getLuaState()
+	s.keys = make(map[string]struct{}, len(r.keys))
+	for _, key := range r.keys {
+		s.keys[string(key)] = struct{}{}
+	}
+	s.readOnly = r.readOnly
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.runningMu.Lock()
+	s.running, s.written, s.cancel = r, false, cancel
+	s.runningSince = time.Now()
+	s.runningMu.Unlock()
+	L.SetContext(ctx)
+	defer func() {
+		L.RemoveContext()
+		L.SetTop(0)
+		s.runningMu.Lock()
+		s.running, s.cancel = nil, nil
+		s.runningMu.Unlock()
+		cancel()
+	}()
+
+	nargs := r.push(L)
+	if err := L.PCall(nargs, 1, nil); err != nil {
+		if ctx.Err() != nil {
+			return reply.MakeErrReply("ERR Script killed by user with SCRIPT KILL...")
+		}
+		return luaErrorToReply(err, r.name)
+	}
+	return luaToReply(L.Get(-1))
+}
+
+func (s *scripting) getLuaState() *lua.LState {
+	if s.L == nil {
+		s.L = s.newLuaState()
+	}
+	return s.L
+}
+
+// call implements redis.call and redis.pcall, errors are raised by redis.call and returned by redis.pcall
+func (s *scripting) call(L *lua.LState, raise bool) int {
+	result := s.execCommand(L)
+	if errReply, ok := result.(reply.ErrorReply); ok && raise {
+		L.Error(makeLuaStatusTable(L, "err", errReply.Error()), 1)
+		return 0
+	}
+	L.Push(replyToLua(L, result))
+	return 1
+}
+
+func (s *scripting) execCommand(L *lua.LState) redis.Reply {
+	if s.registering != nil {
+		return reply.MakeErrReply("ERR Redis commands are not allowed while loading libraries")
+	}
+	cmdLine, ok := luaArgsToCmdLine(L)
+	if !ok {
+		return reply.MakeErrReply("ERR Lua redis() command arguments must be strings or integers")
+	}
+	cmd := strings.ToLower(string(cmdLine[0]))
+	cmdSpec, ok := router[cmd]
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown Redis command called from Lua script")
+	}
+	if !cmdSpec.validateArity(cmdLine) {
+		return &reply.ArgNumErrReply{Cmd: cmd}
+	}
+	if cmdSpec.executor == nil || cmdSpec.flags&(flagNoMulti|flagNoScript) > 0 {
+		return reply.MakeErrReply("ERR This Redis command is not allowed from scripts")
+	}
+	keys := cmdSpec.getKeys(cmdLine)
+	for _, key := range keys {
+		if _, ok := s.keys[key]; !ok {
+			return reply.MakeErrReply("ERR Script attempted to access key '" + key + "' which is not declared in KEYS")
+		}
+	}
+	if cmdSpec.isWrite(cmdLine) {
+		if len(keys) == 0 {
+			// it may change keys not locked by the script
+			return reply.MakeErrReply("ERR This Redis command is not allowed from scripts")
+		}
+		if s.readOnly {
+			return reply.MakeErrReply("ERR Write commands are not allowed from read-only scripts.")
+		}
+		if errReply := s.db.checkWritable(); errReply != nil {
+			return errReply
+		}
+		s.runningMu.Lock()
+		s.written = true
+		s.runningMu.Unlock()
+	}
+	return s.db.execCommand(cmdSpec, cmdLine)
+}
+
+// kill stops the running script or function if it has not written, SCRIPT KILL only kills scripts
+// and FUNCTION KILL only kills functions
+func (s *scripting) kill(function bool) redis.Reply {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	if s.running == nil || s.running.function != function {
+		return reply.MakeErrReply("NOTBUSY No scripts in execution right now.")
+	}
+	if s.written {
+		return reply.MakeErrReply("UNKILLABLE Sorry the script already executed write commands against the dataset. " +
+			"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	s.cancel()
+	return &reply.OkReply{}
+}
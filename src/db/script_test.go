@@ -0,0 +1,146 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEval(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+
+	assertReply(t, db, []string{"eval", "return redis.call('set', KEYS[1], ARGV[1])", "1", "k", "v"}, "+OK\r\n")
+	assertReply(t, db, []string{"eval", "return redis.call('get', KEYS[1])", "1", "k"}, "$1\r\nv\r\n")
+	assertReply(t, db, []string{"eval", "return {1, 'a', {2}, false, nil, 3}", "0"},
+		"*4\r\n:1\r\n$1\r\na\r\n*1\r\n:2\r\n$-1\r\n")
+	assertReply(t, db, []string{"eval", "return 3.9", "0"}, ":3\r\n")
+	assertReply(t, db, []string{"eval", "return redis.call('get', KEYS[1])", "1", "nothing"}, "$-1\r\n")
+	assertReply(t, db, []string{"eval", "return redis.status_reply('FINE')", "0"}, "+FINE\r\n")
+	assertReply(t, db, []string{"eval", "return redis.error_reply('MY error')", "0"}, "-MY error\r\n")
+	assertReply(t, db, []string{"eval", "return redis.sha1hex('')", "0"},
+		"$40\r\nda39a3ee5e6b4b0d3255bfef95601890afd80709\r\n")
+	assertReply(t, db, []string{"eval", "return ARGV", "0", "a", "b"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+
+	// errors
+	assertReply(t, db, []string{"eval", "return redis.call('incr', KEYS[1])", "1", "k"},
+		"-ERR value is not an integer or out of range\r\n")
+	assertReply(t, db, []string{"eval", "local r = redis.pcall('incr', KEYS[1]); return r.err", "1", "k"},
+		"$43\r\nERR value is not an integer or out of range\r\n")
+	assertReply(t, db, []string{"eval", "return redis.call('get', 'other')", "0"},
+		"-ERR Script attempted to access key 'other' which is not declared in KEYS\r\n")
+	assertReply(t, db, []string{"eval", "return redis.call('multi')", "0"},
+		"-ERR This Redis command is not allowed from scripts\r\n")
+	assertReply(t, db, []string{"eval", "return redis.call('eval', 'return 1', '0')", "0"},
+		"-ERR This Redis command is not allowed from scripts\r\n")
+	assertReply(t, db, []string{"eval", "return 1", "2", "k"}, "-ERR Number of keys can't be greater than number of args\r\n")
+	assertReply(t, db, []string{"eval", "return 1", "-1"}, "-ERR Number of keys can't be negative\r\n")
+	if result := string(db.Exec(nil, toArgs("eval", "a = 1", "0")).ToBytes()); !strings.Contains(result, "create global variable 'a'") {
+		t.Errorf("global variable should be rejected, actual %q", result)
+	}
+	if result := string(db.Exec(nil, toArgs("eval", "return (", "0")).ToBytes()); !strings.HasPrefix(result, "-ERR Error compiling script") {
+		t.Errorf("expected compile error, actual %q", result)
+	}
+	if result := string(db.Exec(nil, toArgs("eval", "return io.open('x')", "0")).ToBytes()); !strings.HasPrefix(result, "-ERR Error running script") {
+		t.Errorf("io should not be loaded, actual %q", result)
+	}
+
+	// cache
+	sha := sha1Hex("return 'hello'")
+	assertReply(t, db, []string{"evalsha", sha, "0"}, "-NOSCRIPT No matching script. Please use EVAL.\r\n")
+	assertReply(t, db, []string{"script", "load", "return 'hello'"}, "$40\r\n"+sha+"\r\n")
+	assertReply(t, db, []string{"script", "exists", sha, strings.ToUpper(sha), "nothing"}, "*3\r\n:1\r\n:1\r\n:0\r\n")
+	assertReply(t, db, []string{"evalsha", sha, "0"}, "$5\r\nhello\r\n")
+	assertReply(t, db, []string{"script", "flush"}, "+OK\r\n")
+	assertReply(t, db, []string{"script", "exists", sha}, "*1\r\n:0\r\n")
+
+	// in transaction
+	c := &testClient{}
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"eval", "return redis.call('incrby', KEYS[1], ARGV[1])", "1", "counter", "2"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*1\r\n:2\r\n")
+
+	assertReply(t, db, []string{"command", "getkeys", "eval", "return 1", "2", "a", "b", "c"}, "*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+}
+
+func TestScriptLocks(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	db.Exec(nil, toArgs("set", "k", "v"))
+	assertReply(t, db, []string{"eval", "return redis.call('flushdb')", "0"},
+		"-ERR This Redis command is not allowed from scripts\r\n")
+	assertReply(t, db, []string{"eval_ro", "return redis.call('set', KEYS[1], 'x')", "1", "k"},
+		"-ERR Write commands are not allowed from read-only scripts.\r\n")
+
+	// read-only scripts share locks with readers and don't hold snapshotMu
+	db.snapshotMu.Lock()
+	db.RLocks("k")
+	expectResult(t, execAsync(db, nil, "eval_ro", "return redis.call('get', KEYS[1])", "1", "k"), "$1\r\nv\r\n")
+	db.RUnlocks("k")
+	db.snapshotMu.Unlock()
+
+	// write scripts don't hold snapshotMu exclusively
+	db.snapshotMu.RLock()
+	expectResult(t, execAsync(db, nil, "eval", "return redis.call('set', KEYS[1], 'x')", "1", "k"), "+OK\r\n")
+	db.snapshotMu.RUnlock()
+}
+
+func TestScriptKill(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	assertReply(t, db, []string{"script", "kill"}, "-NOTBUSY No scripts in execution right now.\r\n")
+
+	done := make(chan string)
+	go func() {
+		done <- string(db.Exec(nil, toArgs("eval", "while true do end", "0")).ToBytes())
+	}()
+	waitReply(t, db, []string{"script", "kill"}, "+OK\r\n")
+	if result := <-done; result != "-ERR Script killed by user with SCRIPT KILL...\r\n" {
+		t.Errorf("unexpected reply of killed script: %q", result)
+	}
+
+	go func() {
+		done <- string(db.Exec(nil, toArgs("eval", "redis.call('set', KEYS[1], 'v') while true do end", "1", "k")).ToBytes())
+	}()
+	for written := false; !written; {
+		time.Sleep(10 * time.Millisecond)
+		db.scripts.runningMu.Lock()
+		written = db.scripts.running != nil && db.scripts.written
+		db.scripts.runningMu.Unlock()
+	}
+	assertReply(t, db, []string{"script", "kill"}, "-UNKILLABLE Sorry the script already executed write commands against the dataset. "+
+		"You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n")
+	// the script can't be killed, stop it without checking
+	db.scripts.runningMu.Lock()
+	db.scripts.cancel()
+	db.scripts.runningMu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("script is not stopped")
+	}
+	assertReply(t, db, []string{"eval", "return 1", "0"}, ":1\r\n")
+}
+
+func TestScriptAof(t *testing.T) {
+	dir := useAof(t)
+	db := MakeDB()
+	db.Exec(nil, toArgs("eval", "redis.call('set', KEYS[1], ARGV[1]) redis.call('rpush', KEYS[2], ARGV[1])", "2", "k", "l", "v"))
+	// read-only scripts are not recorded
+	db.Exec(nil, toArgs("eval", "return redis.call('get', KEYS[1])", "1", "k"))
+	db.Exec(nil, toArgs("set", "after", "v"))
+	waitAof(t, dir, "*1\r\n$5\r\nMULTI\r\n"+
+		"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n"+
+		"*3\r\n$5\r\nrpush\r\n$1\r\nl\r\n$1\r\nv\r\n"+
+		"*1\r\n$4\r\nEXEC\r\n"+
+		"*3\r\n$3\r\nset\r\n$5\r\nafter\r\n$1\r\nv\r\n")
+	db.Close()
+
+	loaded := MakeDB()
+	defer loaded.Close()
+	assertReply(t, loaded, []string{"lrange", "l", "0", "-1"}, "*1\r\n$1\r\nv\r\n")
+	assertReply(t, loaded, []string{"get", "k"}, "$1\r\nv\r\n")
+}
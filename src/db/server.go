@@ -3,6 +3,8 @@ package db
 import (
 	"myGodis/src/interface/redis"
 	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
 )
 
 func Ping(db *DB, args [][]byte) redis.Reply {
@@ -14,3 +16,45 @@ func Ping(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR wrong number of arguments for 'ping' command")
 	}
 }
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func Hello(db *DB, c redis.Client, args [][]byte) redis.Reply {
+	protocol := c.GetProtocol()
+	if len(args) > 0 {
+		version, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return reply.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if version != reply.RESP2 && version != reply.RESP3 {
+			return reply.MakeErrReply("NOPROTO sorry, this protocol version is not supported")
+		}
+		protocol = int(version)
+		// authentication and client name are not supported yet, only validate their syntax
+		for i := 1; i < len(args); i++ {
+			option := strings.ToLower(string(args[i]))
+			if option == "auth" && i+2 < len(args) {
+				i += 2
+			} else if option == "setname" && i+1 < len(args) {
+				i++
+			} else {
+				return reply.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+			}
+		}
+	}
+	c.SetProtocol(protocol)
+
+	keys := []string{"server", "version", "proto", "mode", "role", "modules"}
+	values := []redis.Reply{
+		reply.MakeBulkReply([]byte("redis")),
+		reply.MakeBulkReply([]byte("6.0.0")),
+		reply.MakeIntReply(int64(protocol)),
+		reply.MakeBulkReply([]byte("standalone")),
+		reply.MakeBulkReply([]byte(db.role())),
+		&reply.EmptyMultiBulkReply{},
+	}
+	keyReplies := make([]redis.Reply, len(keys))
+	for i, key := range keys {
+		keyReplies[i] = reply.MakeBulkReply([]byte(key))
+	}
+	return reply.MakeMapReply(keyReplies, values)
+}
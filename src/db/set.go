@@ -35,16 +35,9 @@ func (db *DB) GetOrInitSet(key string) (set *HashSet.Set, inited bool, errReply
 }
 
 func SAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'sadd' command")
-	}
 	key := string(args[0])
 	members := args[1:]
 
-	// lock
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get or init entity
 	set, _, errReply := db.GetOrInitSet(key)
 	if errReply != nil {
@@ -55,14 +48,14 @@ func SAdd(db *DB, args [][]byte) redis.Reply {
 	for _, member := range members {
 		counter += set.Add(string(member))
 	}
+	if counter > 0 {
+		db.touchKeys(key)
+	}
 	db.addAof(makeAofCmd("sadd", args))
 	return reply.MakeIntReply(int64(counter))
 }
 
 func SIsMember(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sismember` command")
-	}
 	key := string(args[0])
 	member := string(args[1])
 
@@ -83,16 +76,9 @@ func SIsMember(db *DB, args [][]byte) redis.Reply {
 }
 
 func SRem(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'srem' command")
-	}
 	key := string(args[0])
 	members := args[1:]
 
-	// lock
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	set, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return errReply
@@ -109,15 +95,13 @@ func SRem(db *DB, args [][]byte) redis.Reply {
 		db.Remove(key)
 	}
 	if counter > 0 {
+		db.touchKeys(key)
 		db.addAof(makeAofCmd("srem", args))
 	}
 	return reply.MakeIntReply(int64(counter))
 }
 
 func SCard(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `scard` command")
-	}
 	key := string(args[0])
 
 	set, errReply := db.getAsSet(key)
@@ -131,21 +115,14 @@ func SCard(db *DB, args [][]byte) redis.Reply {
 }
 
 func SMembers(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `smembers` command")
-	}
 	key := string(args[0])
 
-	// lock
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	set, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return errReply
 	}
 	if set == nil {
-		return &reply.EmptyMultiBulkReply{}
+		return reply.MakeSetReply(nil)
 	}
 	arr := make([][]byte, set.Len())
 	i := 0
@@ -154,13 +131,10 @@ func SMembers(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return reply.MakeMultiBulkReply(arr)
+	return reply.MakeBulkSetReply(arr)
 }
 
 func SInter(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sinter` command")
-	}
 
 	keys := make([]string, len(args))
 
@@ -168,10 +142,6 @@ func SInter(db *DB, args [][]byte) redis.Reply {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-
 	var result *HashSet.Set
 	for _, key := range keys {
 		set, errReply := db.getAsSet(key)
@@ -179,14 +149,14 @@ func SInter(db *DB, args [][]byte) redis.Reply {
 			return errReply
 		}
 		if set == nil {
-			return &reply.EmptyMultiBulkReply{}
+			return reply.MakeSetReply(nil)
 		}
 		if result == nil {
 			result = HashSet.MakeFromVals(set.ToSlice()...)
 		} else {
 			result = result.Intersect(set)
 			if result.Len() == 0 {
-				return &reply.EmptyMultiBulkReply{}
+				return reply.MakeSetReply(nil)
 			}
 		}
 	}
@@ -198,13 +168,10 @@ func SInter(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return reply.MakeMultiBulkReply(arr)
+	return reply.MakeBulkSetReply(arr)
 }
 
 func SInterStore(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sinterstore` command")
-	}
 	dest := string(args[0])
 	keys := make([]string, len(args)-1)
 
@@ -212,12 +179,6 @@ func SInterStore(db *DB, args [][]byte) redis.Reply {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-	db.Locker.Lock(dest)
-	defer db.Locker.UnLock(dest)
-
 	var result *HashSet.Set
 	for _, key := range keys {
 		set, errReply := db.getAsSet(key)
@@ -250,18 +211,11 @@ func SInterStore(db *DB, args [][]byte) redis.Reply {
 }
 
 func SUnion(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sunion` command")
-	}
 	keys := make([]string, len(args))
 	for i, arg := range args {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-
 	var result *HashSet.Set
 	for _, key := range keys {
 		set, errReply := db.getAsSet(key)
@@ -279,7 +233,7 @@ func SUnion(db *DB, args [][]byte) redis.Reply {
 	}
 
 	if result == nil {
-		return &reply.EmptyMultiBulkReply{}
+		return reply.MakeSetReply(nil)
 	}
 	arr := make([][]byte, result.Len())
 	i := 0
@@ -288,25 +242,16 @@ func SUnion(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return reply.MakeMultiBulkReply(arr)
+	return reply.MakeBulkSetReply(arr)
 }
 
 func SUnionStore(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sunionstore` command")
-	}
 	dest := string(args[0])
 	keys := make([]string, len(args)-1)
 	for i, arg := range args[1:] {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-	db.Locker.Lock(dest)
-	defer db.Locker.UnLock(dest)
-
 	var result *HashSet.Set
 	for _, key := range keys {
 		set, errReply := db.getAsSet(key)
@@ -338,9 +283,6 @@ func SUnionStore(db *DB, args [][]byte) redis.Reply {
 }
 
 func SDiff(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sdiff` command")
-	}
 
 	keys := make([]string, len(args))
 
@@ -348,10 +290,6 @@ func SDiff(db *DB, args [][]byte) redis.Reply {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-
 	var result *HashSet.Set
 	for i, key := range keys {
 		set, errReply := db.getAsSet(key)
@@ -360,7 +298,7 @@ func SDiff(db *DB, args [][]byte) redis.Reply {
 		}
 		if set == nil {
 			if i == 0 {
-				return &reply.EmptyMultiBulkReply{}
+				return reply.MakeSetReply(nil)
 			}
 			continue
 		}
@@ -370,14 +308,14 @@ func SDiff(db *DB, args [][]byte) redis.Reply {
 			result = result.Diff(set)
 			if result.Len() == 0 {
 				// early termination
-				return &reply.EmptyMultiBulkReply{}
+				return reply.MakeSetReply(nil)
 			}
 		}
 	}
 
 	if result == nil {
 		// all keys are nil
-		return &reply.EmptyMultiBulkReply{}
+		return reply.MakeSetReply(nil)
 	}
 
 	arr := make([][]byte, result.Len())
@@ -387,25 +325,16 @@ func SDiff(db *DB, args [][]byte) redis.Reply {
 		i++
 		return true
 	})
-	return reply.MakeMultiBulkReply(arr)
+	return reply.MakeBulkSetReply(arr)
 }
 
 func SDiffStore(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for `sdiffstore` command")
-	}
 	dest := string(args[0])
 	keys := make([]string, len(args)-1)
 	for i, arg := range args[1:] {
 		keys[i] = string(arg)
 	}
 
-	// lock
-	db.Locker.RLocks(keys...)
-	defer db.Locker.RUnlocks(keys...)
-	db.Locker.Lock(dest)
-	defer db.Locker.UnLock(dest)
-
 	var result *HashSet.Set
 	for i, key := range keys {
 		set, errReply := db.getAsSet(key)
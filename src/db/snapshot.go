@@ -0,0 +1,210 @@
+package db
+
+import (
+	"myGodis/src/datastruct/dict"
+	List "myGodis/src/datastruct/list"
+	"myGodis/src/datastruct/set"
+	SortedSet "myGodis/src/datastruct/sortedset"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * A snapshot is a point-in-time view of the data set, iterated by BGSAVE, aof rewrite, full sync and DEBUG DIGEST
+ * while writes continue. It is copy-on-write at key granularity:
+ *   - snapshot is taken between write commands, they hold snapshotMu.RLock and taking a snapshot holds the lock
+ *   - the first change to a key after that saves its entity and ttl into the snapshot, then the iterator uses the saved one.
+ *     Write commands save a deep copy since they may modify the entity in place, Put/Remove only replace the pointer.
+ *   - keys already iterated needn't be saved any more
+ */
+
+type savedKey struct {
+	entity   *DataEntity // nil if key didn't exist when snapshot was taken
+	expireAt time.Time   // zero if no ttl
+}
+
+type snapshot struct {
+	mu     sync.Mutex
+	saved  map[string]*savedKey
+	dumped map[string]struct{}
+	// code of function libraries, they are small and copied when the snapshot is taken
+	libraries [][]byte
+}
+
+// takeSnapshot takes a snapshot between write commands, fn is called at the same point, eg. to get replication offset.
+// The snapshot should be released after iterating
+func (db *DB) takeSnapshot(fn func()) *snapshot {
+	db.snapshotMu.Lock()
+	defer db.snapshotMu.Unlock()
+	if fn != nil {
+		fn()
+	}
+	return db.addSnapshot()
+}
+
+// addSnapshot starts a snapshot, invoker should hold snapshotMu
+func (db *DB) addSnapshot() *snapshot {
+	snap := &snapshot{
+		saved:  make(map[string]*savedKey),
+		dumped: make(map[string]struct{}),
+	}
+	if db.scripts != nil {
+		snap.libraries = db.scripts.libraryCodes()
+	}
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+	db.snapshots = append(db.snapshots, snap)
+	atomic.AddInt32(&db.snapshotCount, 1)
+	return snap
+}
+
+func (db *DB) releaseSnapshot(snap *snapshot) {
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+	for i, s := range db.snapshots {
+		if s == snap {
+			db.snapshots = append(db.snapshots[:i], db.snapshots[i+1:]...)
+			atomic.AddInt32(&db.snapshotCount, -1)
+			return
+		}
+	}
+}
+
+// beforeWrite saves keys into active snapshots before they are changed, deep is true if entities may be modified in place
+func (db *DB) beforeWrite(deep bool, keys ...string) {
+	if atomic.LoadInt32(&db.snapshotCount) == 0 {
+		return
+	}
+	db.snapshotsMu.Lock()
+	defer db.snapshotsMu.Unlock()
+	for _, snap := range db.snapshots {
+		for _, key := range keys {
+			snap.save(db, key, deep)
+		}
+	}
+}
+
+func (snap *snapshot) save(db *DB, key string, deep bool) {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if _, ok := snap.saved[key]; ok {
+		return
+	}
+	if _, ok := snap.dumped[key]; ok {
+		return
+	}
+	saved := &savedKey{}
+	if raw, ok := db.Data.Get(key); ok {
+		saved.entity, _ = raw.(*DataEntity)
+		if deep {
+			saved.entity = copyEntity(saved.entity)
+		}
+		if raw, ok := db.TTLMap.Get(key); ok {
+			saved.expireAt, _ = raw.(time.Time)
+		}
+	}
+	snap.saved[key] = saved
+}
+
+// forEach calls consumer with keys in the snapshot, expireAt is zero if key has no ttl. Expired keys are included
+func (snap *snapshot) forEach(db *DB, consumer func(key string, entity *DataEntity, expireAt time.Time) bool) {
+	var keys []string
+	db.Data.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		if !snap.visit(db, key, consumer) {
+			return
+		}
+	}
+
+	// keys removed after snapshot was taken
+	snap.mu.Lock()
+	removed := make(map[string]*savedKey)
+	for key, saved := range snap.saved {
+		if _, ok := snap.dumped[key]; !ok && saved.entity != nil {
+			removed[key] = saved
+		}
+	}
+	snap.mu.Unlock()
+	for key, saved := range removed {
+		if !consumer(key, saved.entity, saved.expireAt) {
+			return
+		}
+	}
+}
+
+// visit calls consumer with key in the snapshot if it exists
+func (snap *snapshot) visit(db *DB, key string, consumer func(key string, entity *DataEntity, expireAt time.Time) bool) bool {
+	saved := snap.take(db, key)
+	if saved.entity == nil {
+		return true
+	}
+	return consumer(key, saved.entity, saved.expireAt)
+}
+
+// take marks key as dumped and returns its entity in the snapshot. Entities still in the data set are copied,
+// since they may be modified in place once the lock is released, and consumers shouldn't hold locks while doing io
+func (snap *snapshot) take(db *DB, key string) *savedKey {
+	// writers save key before locking it, so the entity isn't modified while it is copied under the lock
+	db.RLock(key)
+	defer db.RUnlock(key)
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	saved, ok := snap.saved[key]
+	if !ok {
+		saved = &savedKey{}
+		if raw, exists := db.Data.Get(key); exists {
+			entity, _ := raw.(*DataEntity)
+			saved.entity = copyEntity(entity)
+			if raw, ok := db.TTLMap.Get(key); ok {
+				saved.expireAt, _ = raw.(time.Time)
+			}
+		}
+	}
+	delete(snap.saved, key)
+	snap.dumped[key] = struct{}{}
+	return saved
+}
+
+// copyEntity returns a deep copy of entity, members are shared since they are never modified in place
+func copyEntity(entity *DataEntity) *DataEntity {
+	if entity == nil {
+		return nil
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		return &DataEntity{Data: append([]byte(nil), val...)}
+	case *List.LinkedList:
+		list := &List.LinkedList{}
+		val.ForEach(func(i int, v interface{}) bool {
+			list.Add(v)
+			return true
+		})
+		return &DataEntity{Data: list}
+	case *set.Set:
+		members := set.Make()
+		val.ForEach(func(member string) bool {
+			members.Add(member)
+			return true
+		})
+		return &DataEntity{Data: members}
+	case dict.Dict:
+		hash := dict.MakeSimple()
+		val.ForEach(func(field string, v interface{}) bool {
+			hash.Put(field, v)
+			return true
+		})
+		return &DataEntity{Data: hash}
+	case *SortedSet.SortedSet:
+		zset := SortedSet.Make()
+		val.ForEach(func(element *SortedSet.Element) bool {
+			zset.Add(element.Member, element.Score)
+			return true
+		})
+		return &DataEntity{Data: zset}
+	}
+	return entity
+}
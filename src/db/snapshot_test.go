@@ -0,0 +1,120 @@
+package db
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	db.Exec(nil, toArgs("set", "str", "v"))
+	db.Exec(nil, toArgs("rpush", "list", "a", "b"))
+	db.Exec(nil, toArgs("sadd", "set", "a"))
+	db.Exec(nil, toArgs("hset", "hash", "f", "v"))
+	db.Exec(nil, toArgs("zadd", "zset", "1", "a"))
+	db.Exec(nil, toArgs("set", "removed", "v"))
+	db.Exec(nil, toArgs("set", "ttl", "v"))
+	expected := dataset(db)
+
+	snap := db.takeSnapshot(nil)
+	db.Exec(nil, toArgs("set", "str", "changed"))
+	db.Exec(nil, toArgs("rpush", "list", "c"))
+	db.Exec(nil, toArgs("sadd", "set", "b"))
+	db.Exec(nil, toArgs("hset", "hash", "f", "changed"))
+	db.Exec(nil, toArgs("zadd", "zset", "2", "a"))
+	db.Exec(nil, toArgs("del", "removed"))
+	db.Exec(nil, toArgs("expire", "ttl", "1000"))
+	db.Exec(nil, toArgs("set", "added", "v"))
+
+	actual := make(map[string]*DataEntity)
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if !expireAt.IsZero() {
+			t.Errorf("%s: ttl set after snapshot is visible", key)
+		}
+		actual[key] = entity
+		// changes after the key is iterated are not saved
+		db.Exec(nil, toArgs("set", "str", "again"))
+		return true
+	})
+	db.releaseSnapshot(snap)
+	if len(actual) != len(expected) {
+		t.Errorf("expected %d keys, actual %d", len(expected), len(actual))
+	}
+	for key, obj := range expected {
+		entity, ok := actual[key]
+		if !ok {
+			t.Errorf("%s is missing in snapshot", key)
+			continue
+		}
+		if got := entityToObject(key, entity, time.Time{}); !reflect.DeepEqual(got, obj) {
+			t.Errorf("%s: expected %+v, actual %+v", key, obj, got)
+		}
+	}
+	if len(db.snapshots) != 0 {
+		t.Error("snapshot is not released")
+	}
+}
+
+func TestDebugDigest(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	assertReply(t, db, []string{"debug", "digest"}, "+"+strings.Repeat("0", 40)+"\r\n")
+	for i := 0; i < 10; i++ {
+		db.Exec(nil, toArgs("sadd", "set", strconv.Itoa(i)))
+		db.Exec(nil, toArgs("hset", "hash", strconv.Itoa(i), "v"))
+	}
+	digest := string(db.Exec(nil, toArgs("debug", "digest")).ToBytes())
+
+	// the same data set inserted in another order
+	other := MakeDB()
+	defer other.Close()
+	for i := 9; i >= 0; i-- {
+		other.Exec(nil, toArgs("hset", "hash", strconv.Itoa(i), "v"))
+		other.Exec(nil, toArgs("sadd", "set", strconv.Itoa(i)))
+	}
+	assertReply(t, other, []string{"debug", "digest"}, digest)
+	if string(db.Exec(nil, toArgs("debug", "digest-value", "set")).ToBytes()) !=
+		string(other.Exec(nil, toArgs("debug", "digest-value", "set")).ToBytes()) {
+		t.Error("digest of the same set differs")
+	}
+
+	other.Exec(nil, toArgs("expire", "set", "1000"))
+	if string(other.Exec(nil, toArgs("debug", "digest")).ToBytes()) == digest {
+		t.Error("digest doesn't change with ttl")
+	}
+	assertReply(t, db, []string{"debug", "nothing"}, "-ERR unknown subcommand 'nothing'. Try DEBUG HELP.\r\n")
+}
+
+func TestExecLocked(t *testing.T) {
+	db := MakeDB()
+	defer db.Close()
+	db.Exec(nil, toArgs("rpush", "list", "a"))
+	expected := dataset(db)
+	snap := db.takeSnapshot(nil)
+	defer db.releaseSnapshot(snap)
+	dirty := atomic.LoadInt64(&db.dirty)
+
+	db.LocksForWrite("list")
+	result := db.ExecLocked(toArgs("rpush", "list", "b"))
+	db.UnLocksForWrite("list")
+	if string(result.ToBytes()) != ":2\r\n" {
+		t.Errorf("expected 2, actual %q", result.ToBytes())
+	}
+	if changes := atomic.LoadInt64(&db.dirty) - dirty; changes != 1 {
+		t.Errorf("expected 1 change, actual %d", changes)
+	}
+	// entity modified in place is saved into the snapshot
+	snap.forEach(db, func(key string, entity *DataEntity, expireAt time.Time) bool {
+		if obj := entityToObject(key, entity, expireAt); !reflect.DeepEqual(obj, expected[key]) {
+			t.Errorf("snapshot should not see changes, actual %+v", obj)
+		}
+		return true
+	})
+}
@@ -36,7 +36,7 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 }
 
 func ZAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 3 || len(args)%2 != 1 {
+	if len(args)%2 != 1 {
 		return reply.MakeErrReply("ERR wrong number of arguments for 'zadd' command")
 	}
 
@@ -56,10 +56,6 @@ func ZAdd(db *DB, args [][]byte) redis.Reply {
 		}
 	}
 
-	// lock
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	// get or init entity
 	sortedSet, _, errReply := db.getOrInitSortedSet(key)
 	if errReply != nil {
@@ -71,15 +67,12 @@ func ZAdd(db *DB, args [][]byte) redis.Reply {
 			i++
 		}
 	}
+	db.touchKeys(key)
 	db.addAof(makeAofCmd("zadd", args))
 	return reply.MakeIntReply(int64(i))
 }
 
 func ZScore(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'zscore' command")
-	}
 
 	key := string(args[0])
 	member := string(args[1])
@@ -96,16 +89,10 @@ func ZScore(db *DB, args [][]byte) redis.Reply {
 	if !exists {
 		return &reply.NullBulkReply{}
 	}
-	value := strconv.FormatFloat(element.Score, 'f', -1, 64)
-
-	return reply.MakeBulkReply([]byte(value))
+	return reply.MakeDoubleReply(element.Score)
 }
 
 func ZRank(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'zrank' command")
-	}
 
 	key := string(args[0])
 	member := string(args[1])
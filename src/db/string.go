@@ -23,9 +23,6 @@ func (db *DB) getAsString(key string) ([]byte, reply.ErrorReply) {
 }
 
 func Get(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'get' command")
-	}
 	key := string(args[0])
 	bytes, err := db.getAsString(key)
 	if err != nil {
@@ -47,9 +44,6 @@ const unlimitedTTL int64 = 0
 
 // SET key value [EX seconds] [PX milliseconds] [NX|XX]
 func Set(db *DB, args [][]byte) redis.Reply {
-	if len(args) < 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'set' command")
-	}
 	key := string(args[0])
 	value := args[1]
 	policy := upsertPolicy
@@ -73,7 +67,7 @@ func Set(db *DB, args [][]byte) redis.Reply {
 				if ttl != unlimitedTTL {
 					return &reply.SyntaxErrReply{}
 				}
-				if i+1 > len(args) {
+				if i+1 >= len(args) {
 					return &reply.SyntaxErrReply{}
 				}
 				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
@@ -89,7 +83,7 @@ func Set(db *DB, args [][]byte) redis.Reply {
 				if ttl != unlimitedTTL {
 					return &reply.SyntaxErrReply{}
 				}
-				if i+1 > len(args) {
+				if i+1 >= len(args) {
 					return &reply.SyntaxErrReply{}
 				}
 				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
@@ -111,7 +105,6 @@ func Set(db *DB, args [][]byte) redis.Reply {
 		Data: value,
 	}
 
-	db.Persist(key) // clean ttl
 	var result int
 	switch policy {
 	case upsertPolicy:
@@ -121,7 +114,8 @@ func Set(db *DB, args [][]byte) redis.Reply {
 	case updatePolicy:
 		result = db.PutIfExists(key, entity)
 	}
-	if result > 0 {
+	// Put replies 0 if key existed
+	if policy == upsertPolicy || result > 0 {
 		if ttl != unlimitedTTL {
 			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
 			db.Expire(key, expireTime)
@@ -147,9 +141,6 @@ func Set(db *DB, args [][]byte) redis.Reply {
 
 // 不存在则插入
 func SetNX(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'setnx' command")
-	}
 	key := string(args[0])
 	value := args[1]
 	entity := &DataEntity{
@@ -162,13 +153,10 @@ func SetNX(db *DB, args [][]byte) redis.Reply {
 	return reply.MakeIntReply(int64(result))
 }
 
-// 存在则更新，并更新TTL
+// 设置值并更新TTL
 func SetEX(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'setex' command")
-	}
 	key := string(args[0])
-	value := args[1]
+	value := args[2]
 
 	ttlArg, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -182,28 +170,18 @@ func SetEX(db *DB, args [][]byte) redis.Reply {
 		Data: value,
 	}
 
-	db.Lock(key)
-	defer db.UnLock(key)
-
-	result := db.Put(key, entity)
-
+	db.Put(key, entity)
 	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
 	db.Expire(key, expireTime)
-
-	if result > 0 {
-		db.addAof(makeAofCmd("setex", args))
-		db.addAof(makeExpireCmd(key, expireTime))
-	}
+	db.addAof(makeAofCmd("set", [][]byte{args[0], value}))
+	db.addAof(makeExpireCmd(key, expireTime))
 	return &reply.OkReply{}
 }
 
-// 存在则更新，不过ttl的单位为ms
+// 设置值并更新TTL，不过ttl的单位为ms
 func PSetEX(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 3 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'psetex' command")
-	}
 	key := string(args[0])
-	value := args[1]
+	value := args[2]
 
 	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
 	if err != nil {
@@ -215,20 +193,17 @@ func PSetEX(db *DB, args [][]byte) redis.Reply {
 	entity := &DataEntity{
 		Data: value,
 	}
-	result := db.PutIfExists(key, entity)
-	if result > 0 {
-		db.addAof(makeAofCmd("psetex", args))
-		if ttl != unlimitedTTL {
-			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
-			db.Expire(key, expireTime)
-			db.addAof(makeExpireCmd(key, expireTime))
-		}
-	}
+
+	db.Put(key, entity)
+	expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	db.Expire(key, expireTime)
+	db.addAof(makeAofCmd("set", [][]byte{args[0], value}))
+	db.addAof(makeExpireCmd(key, expireTime))
 	return &reply.OkReply{}
 }
 
 func MSet(db *DB, args [][]byte) redis.Reply {
-	if len(args)%2 != 0 || len(args) == 0 {
+	if len(args)%2 != 0 {
 		return reply.MakeErrReply("ERR wrong number of arguments for 'mset' command")
 	}
 	size := len(args) / 2
@@ -239,9 +214,6 @@ func MSet(db *DB, args [][]byte) redis.Reply {
 		values[i] = args[2*i+1]
 	}
 
-	db.Locks(keys...)
-	defer db.UnLocks(keys...)
-
 	for i, key := range keys {
 		value := values[i]
 		db.Put(key, &DataEntity{Data: value})
@@ -250,10 +222,34 @@ func MSet(db *DB, args [][]byte) redis.Reply {
 	return &reply.OkReply{}
 }
 
-func MGet(db *DB, args [][]byte) redis.Reply {
-	if len(args) == 0 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'mget' command ")
+// 只有在所有key都不存在的情况下才设置
+func MSetNX(db *DB, args [][]byte) redis.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'msetnx' command")
+	}
+	size := len(args) / 2
+	keys := make([]string, size)
+	values := make([][]byte, size)
+	for i := 0; i < size; i++ {
+		keys[i] = string(args[2*i])
+		values[i] = args[2*i+1]
+	}
+
+	for _, key := range keys {
+		_, exists := db.Get(key)
+		if exists {
+			return reply.MakeIntReply(0)
+		}
 	}
+	for i, key := range keys {
+		value := values[i]
+		db.Put(key, &DataEntity{Data: value})
+	}
+	db.addAof(makeAofCmd("msetnx", args))
+	return reply.MakeIntReply(1)
+}
+
+func MGet(db *DB, args [][]byte) redis.Reply {
 	keys := make([]string, len(args))
 	for i, v := range args {
 		keys[i] = string(v)
@@ -276,9 +272,6 @@ func MGet(db *DB, args [][]byte) redis.Reply {
 }
 
 func GetSet(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'getset' command")
-	}
 	key := string(args[0])
 	value := args[1]
 
@@ -293,14 +286,8 @@ func GetSet(db *DB, args [][]byte) redis.Reply {
 }
 
 func Incr(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'incr' command")
-	}
 	key := string(args[0])
 
-	db.Locker.Lock(key)
-	defer db.Locker.UnLock(key)
-
 	bytes, err := db.getAsString(key)
 	if err != nil {
 		return err
@@ -321,9 +308,6 @@ func Incr(db *DB, args [][]byte) redis.Reply {
 }
 
 func IncrBy(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'incrby' command")
-	}
 	key := string(args[0])
 	rawDelta := string(args[1])
 	delta, err := strconv.ParseInt(rawDelta, 10, 64)
@@ -331,9 +315,6 @@ func IncrBy(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	bytes, errReply := db.getAsString(key)
 	if errReply != nil {
 		return errReply
@@ -354,9 +335,6 @@ func IncrBy(db *DB, args [][]byte) redis.Reply {
 }
 
 func IncrByFloat(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'incrbyfloat' command")
-	}
 	key := string(args[0])
 	rawDelta := string(args[1])
 	delta, err := decimal.NewFromString(rawDelta)
@@ -364,9 +342,6 @@ func IncrByFloat(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR value is not a valid float")
 	}
 
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	bytes, errReply := db.getAsString(key)
 	if errReply != nil {
 		return errReply
@@ -388,14 +363,8 @@ func IncrByFloat(db *DB, args [][]byte) redis.Reply {
 }
 
 func Decr(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 1 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'decr' command")
-	}
 	key := string(args[0])
 
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	bytes, errReply := db.getAsString(key)
 	if errReply != nil {
 		return errReply
@@ -416,9 +385,6 @@ func Decr(db *DB, args [][]byte) redis.Reply {
 }
 
 func DecrBy(db *DB, args [][]byte) redis.Reply {
-	if len(args) != 2 {
-		return reply.MakeErrReply("ERR wrong number of arguments for 'decrby' command")
-	}
 	key := string(args[0])
 	rawDelta := string(args[1])
 	delta, err := strconv.ParseInt(rawDelta, 10, 64)
@@ -426,9 +392,6 @@ func DecrBy(db *DB, args [][]byte) redis.Reply {
 		return reply.MakeErrReply("ERR value is not an integer or out of range")
 	}
 
-	db.Lock(key)
-	defer db.UnLock(key)
-
 	bytes, errReply := db.getAsString(key)
 	if errReply != nil {
 		return errReply
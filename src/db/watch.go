@@ -0,0 +1,105 @@
+package db
+
+import (
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"sync/atomic"
+)
+
+/*
+ * WATCH records versions of keys, EXEC replies nil if any of them has changed since then.
+ * Versions are increased by Put, Remove, Expire, Persist and commands modifying entities in place,
+ * writes changing nothing keep versions.
+ * they are only kept while keys are watched by some client.
+ */
+
+type watchedKey struct {
+	version  uint32
+	watchers int
+}
+
+// touchKeys increases versions of watched keys and wakes clients blocked on keys
+func (db *DB) touchKeys(keys ...string) {
+	db.signalBlocked(keys...)
+	if atomic.LoadInt32(&db.watchedCount) == 0 {
+		return
+	}
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, key := range keys {
+		if w, ok := db.watched[key]; ok {
+			w.version++
+		}
+	}
+}
+
+// Watch records versions of keys for the client, WATCH key [key ...]
+func Watch(db *DB, c redis.Client, args [][]byte) redis.Reply {
+	if c == nil {
+		return reply.MakeErrReply("ERR WATCH is not supported here")
+	}
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR WATCH inside MULTI is not allowed")
+	}
+	watching := c.GetWatching()
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for _, arg := range args {
+		key := string(arg)
+		if _, ok := watching[key]; ok {
+			continue
+		}
+		w, ok := db.watched[key]
+		if !ok {
+			w = &watchedKey{}
+			db.watched[key] = w
+			atomic.AddInt32(&db.watchedCount, 1)
+		}
+		w.watchers++
+		watching[key] = w.version
+	}
+	return &reply.OkReply{}
+}
+
+// UnWatch forgets all keys watched by the client, UNWATCH
+func UnWatch(db *DB, c redis.Client) redis.Reply {
+	if c != nil {
+		db.unwatchAll(c)
+	}
+	return &reply.OkReply{}
+}
+
+func (db *DB) unwatchAll(c redis.Client) {
+	watching := c.GetWatching()
+	if len(watching) == 0 {
+		return
+	}
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for key := range watching {
+		if w, ok := db.watched[key]; ok {
+			w.watchers--
+			if w.watchers == 0 {
+				delete(db.watched, key)
+				atomic.AddInt32(&db.watchedCount, -1)
+			}
+		}
+		delete(watching, key)
+	}
+}
+
+// isWatchChanged returns true if any key of watching has changed, invoker should lock the keys
+func (db *DB) isWatchChanged(watching map[string]uint32) bool {
+	for key := range watching {
+		// an expired key is removed and touched here
+		db.IsExpired(key)
+	}
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for key, version := range watching {
+		if w, ok := db.watched[key]; !ok || w.version != version {
+			return true
+		}
+	}
+	return false
+}
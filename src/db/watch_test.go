@@ -0,0 +1,97 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	useRDB(t)
+	db := MakeDB()
+	defer db.Close()
+	c := &testClient{}
+	db.Exec(nil, toArgs("set", "k", "v"))
+	db.Exec(nil, toArgs("hset", "hash", "f", "v"))
+
+	// not changed
+	assertClientReply(t, db, c, []string{"watch", "k", "hash"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"watch", "k"}, "-ERR WATCH inside MULTI is not allowed\r\n")
+	assertClientReply(t, db, c, []string{"set", "k", "v1"}, "+QUEUED\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*1\r\n+OK\r\n")
+
+	writes := [][]string{
+		{"set", "k", "other"},
+		{"hset", "hash", "f", "other"}, // modified in place
+		{"hdel", "hash", "f"},
+		{"rpush", "list", "b"},
+		{"lpop", "list"},
+		{"lset", "list", "0", "x"},
+		{"sadd", "set", "b"},
+		{"srem", "set", "a"},
+		{"expire", "k", "100"},
+		{"persist", "k"},
+		{"del", "k"},
+		{"flushdb"},
+	}
+	for _, write := range writes {
+		db.Exec(nil, toArgs("set", "k", "v"))
+		db.Exec(nil, toArgs("pexpire", "k", "100000"))
+		db.Exec(nil, toArgs("hset", "hash", "f", "v"))
+		db.Exec(nil, toArgs("rpush", "list", "a"))
+		db.Exec(nil, toArgs("sadd", "set", "a"))
+		assertClientReply(t, db, c, []string{"watch", "k", "hash", "list", "set"}, "+OK\r\n")
+		db.Exec(nil, toArgs(write...))
+		assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+		assertClientReply(t, db, c, []string{"set", "result", "v"}, "+QUEUED\r\n")
+		assertClientReply(t, db, c, []string{"exec"}, "*-1\r\n")
+		assertReply(t, db, []string{"exists", "result"}, ":0\r\n")
+	}
+
+	// writes changing nothing
+	noops := [][]string{
+		{"del", "missing"},
+		{"setnx", "k", "other"},
+		{"set", "k", "other", "nx"},
+		{"persist", "k"},
+		{"lpop", "missing"},
+		{"hdel", "hash", "absent"},
+		{"srem", "set", "absent"},
+		{"blpop", "missing", "0.01"},
+	}
+	db.Exec(nil, toArgs("set", "k", "v"))
+	for _, write := range noops {
+		assertClientReply(t, db, c, []string{"watch", "k", "hash", "set", "missing"}, "+OK\r\n")
+		db.Exec(nil, toArgs(write...))
+		assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+		assertClientReply(t, db, c, []string{"ping"}, "+QUEUED\r\n")
+		assertClientReply(t, db, c, []string{"exec"}, "*1\r\n+PONG\r\n")
+	}
+
+	// expiration
+	db.Exec(nil, toArgs("set", "k", "v", "px", "10"))
+	assertClientReply(t, db, c, []string{"watch", "k"}, "+OK\r\n")
+	time.Sleep(20 * time.Millisecond)
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*-1\r\n")
+
+	// keys are unwatched by EXEC, DISCARD, UNWATCH and closing client
+	assertClientReply(t, db, c, []string{"watch", "k"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"discard"}, "+OK\r\n")
+	db.Exec(nil, toArgs("set", "k", "v"))
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*0\r\n")
+
+	assertClientReply(t, db, c, []string{"watch", "k"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"unwatch"}, "+OK\r\n")
+	db.Exec(nil, toArgs("set", "k", "v"))
+	assertClientReply(t, db, c, []string{"multi"}, "+OK\r\n")
+	assertClientReply(t, db, c, []string{"exec"}, "*0\r\n")
+
+	assertClientReply(t, db, c, []string{"watch", "k"}, "+OK\r\n")
+	db.AfterClientClose(c)
+	if len(db.watched) != 0 || db.watchedCount != 0 {
+		t.Errorf("watched keys are not released: %v", db.watched)
+	}
+}
@@ -2,10 +2,31 @@ package redis
 
 type Client interface {
 	Write([]byte) error
+	Close() error
+	// address of the peer, eg. 127.0.0.1:6380
+	RemoteAddr() string
 
 	// client should keep its subscribing channels
 	SubsChannel(channel string)
 	UnSubsChannel(channel string)
 	SubsCount() int
 	GetChannels() []string
+
+	// protocol version negotiated by HELLO, 2 or 3
+	GetProtocol() int
+	SetProtocol(protocol int)
+
+	// commands are queued after MULTI until EXEC or DISCARD,
+	// SetMultiState clears queued commands and errors
+	InMultiState() bool
+	SetMultiState(state bool)
+	GetQueuedCmdLine() [][][]byte
+	EnqueueCmd(cmdLine [][]byte)
+	// errors found while queueing, EXEC is aborted if there is any
+	AddTxError(err error)
+	GetTxErrors() []error
+	// watched keys -> their versions when WATCH, not cleared by SetMultiState
+	GetWatching() map[string]uint32
+	// closed once the connection is closed, blocking commands stop waiting then
+	Closed() <-chan struct{}
 }
@@ -0,0 +1,30 @@
+package crc16
+
+/*
+ * CRC16-CCITT (XModem), the variant used by redis cluster to compute hash slots
+ */
+
+var table [256]uint16
+
+func init() {
+	const poly = 0x1021
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+func Checksum(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ table[byte(crc>>8)^b]
+	}
+	return crc
+}
@@ -0,0 +1,13 @@
+package crc16
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	// check value of CRC16-CCITT (XModem)
+	if sum := Checksum([]byte("123456789")); sum != 0x31C3 {
+		t.Errorf("expected 0x31C3, actual 0x%X", sum)
+	}
+	if sum := Checksum(nil); sum != 0 {
+		t.Errorf("expected 0, actual 0x%X", sum)
+	}
+}
@@ -0,0 +1,35 @@
+package crc64
+
+/*
+ * CRC64 Jones (reflected, no final xor), the variant used by redis to check RDB files and DUMP payloads
+ */
+
+var table [256]uint64
+
+func init() {
+	// reversed representation of polynomial 0xad93d23594c935a9
+	const poly = 0x95ac9329ac4bc9b5
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+}
+
+// Update returns the checksum of data appended to the data of crc
+func Update(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+func Checksum(data []byte) uint64 {
+	return Update(0, data)
+}
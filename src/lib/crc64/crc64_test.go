@@ -0,0 +1,13 @@
+package crc64
+
+import "testing"
+
+func TestChecksum(t *testing.T) {
+	// check value from redis crc64.c
+	if sum := Checksum([]byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expected 0xe9c6d914c4b8d9ca, actual 0x%x", sum)
+	}
+	if sum := Update(Checksum([]byte("1234")), []byte("56789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Errorf("expected 0xe9c6d914c4b8d9ca, actual 0x%x", sum)
+	}
+}
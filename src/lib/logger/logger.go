@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -24,6 +25,7 @@ var (
 	DefaultCallerDepth = 2
 	logger             *log.Logger
 	logPrefix          = ""
+	mu                 sync.Mutex // prefix and message are written together
 	levelFlags         = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
 )
 
@@ -37,6 +39,11 @@ const (
 	FATAL
 )
 
+func init() {
+	// log to stdout until Setup is called
+	logger = log.New(os.Stdout, DefaultPrefix, log.LstdFlags)
+}
+
 func Setup(settings *Settings) {
 	var err error
 	dir := settings.Path
@@ -66,26 +73,36 @@ func setPrefix(level Level) {
 }
 
 func Debug(v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
 	setPrefix(DEBUG)
 	logger.Println(v...)
 }
 
 func Info(v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
 	setPrefix(INFO)
 	logger.Println(v...)
 }
 
 func Warn(v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
 	setPrefix(WARNING)
 	logger.Println(v...)
 }
 
 func Error(v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
 	setPrefix(ERROR)
 	logger.Println(v...)
 }
 
 func Fatal(v ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
 	setPrefix(FATAL)
 	logger.Fatalln(v...)
 }
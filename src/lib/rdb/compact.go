@@ -0,0 +1,249 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+ * compact encodings written by redis, they are only decoded
+ */
+
+// parseIntset decodes intset: encoding(4 bytes) length(4 bytes) then little endian integers
+func parseIntset(blob []byte) ([][]byte, error) {
+	if len(blob) < 8 {
+		return nil, errCorrupted
+	}
+	width := int(binary.LittleEndian.Uint32(blob[0:4]))
+	n := int(binary.LittleEndian.Uint32(blob[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(blob) != 8+width*n {
+		return nil, errCorrupted
+	}
+	members := make([][]byte, n)
+	for i := range members {
+		p := blob[8+i*width:]
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			value = int64(binary.LittleEndian.Uint64(p))
+		}
+		members[i] = []byte(strconv.FormatInt(value, 10))
+	}
+	return members, nil
+}
+
+// parseZiplist decodes ziplist: zlbytes(4) zltail(4) zllen(2) entries... 0xff
+func parseZiplist(blob []byte) ([][]byte, error) {
+	if len(blob) < 11 {
+		return nil, errCorrupted
+	}
+	var values [][]byte
+	p := 10
+	for {
+		if p >= len(blob) {
+			return nil, errCorrupted
+		}
+		if blob[p] == 0xff {
+			return values, nil
+		}
+		// skip previous entry length
+		if blob[p] == 0xfe {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(blob) {
+			return nil, errCorrupted
+		}
+		value, size, err := parseZiplistEntry(blob[p:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p += size
+	}
+}
+
+// parseZiplistEntry returns value and size of encoding and content
+func parseZiplistEntry(p []byte) ([]byte, int, error) {
+	b := p[0]
+	var header, n int
+	switch b >> 6 {
+	case 0:
+		header, n = 1, int(b&0x3f)
+	case 1:
+		if len(p) < 2 {
+			return nil, 0, errCorrupted
+		}
+		header, n = 2, int(b&0x3f)<<8|int(p[1])
+	case 2:
+		if len(p) < 5 {
+			return nil, 0, errCorrupted
+		}
+		header, n = 5, int(binary.BigEndian.Uint32(p[1:5]))
+	default:
+		var value int64
+		var size int
+		switch {
+		case b == 0xc0:
+			size = 2
+		case b == 0xd0:
+			size = 4
+		case b == 0xe0:
+			size = 8
+		case b == 0xf0:
+			size = 3
+		case b == 0xfe:
+			size = 1
+		case b >= 0xf1 && b <= 0xfd:
+			return []byte(strconv.Itoa(int(b&0x0f) - 1)), 1, nil
+		default:
+			return nil, 0, errCorrupted
+		}
+		if len(p) < 1+size {
+			return nil, 0, errCorrupted
+		}
+		value = readSigned(p[1:1+size], size)
+		return []byte(strconv.FormatInt(value, 10)), 1 + size, nil
+	}
+	if n < 0 || len(p) < header+n {
+		return nil, 0, errCorrupted
+	}
+	return p[header : header+n], header + n, nil
+}
+
+// readSigned reads a little endian signed integer of size bytes
+func readSigned(p []byte, size int) int64 {
+	var u uint64
+	for i := size - 1; i >= 0; i-- {
+		u = u<<8 | uint64(p[i])
+	}
+	shift := uint(64 - size*8)
+	return int64(u<<shift) >> shift
+}
+
+// parseListpack decodes listpack: total bytes(4) count(2) entries... 0xff, each entry ends with its backward length
+func parseListpack(blob []byte) ([][]byte, error) {
+	if len(blob) < 7 {
+		return nil, errCorrupted
+	}
+	var values [][]byte
+	p := 6
+	for {
+		if p >= len(blob) {
+			return nil, errCorrupted
+		}
+		if blob[p] == 0xff {
+			return values, nil
+		}
+		value, size, err := parseListpackEntry(blob[p:])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p += size + backlenSize(size)
+	}
+}
+
+func parseListpackEntry(p []byte) ([]byte, int, error) {
+	b := p[0]
+	var header, n int
+	switch {
+	case b&0x80 == 0: // 7 bit unsigned integer
+		return []byte(strconv.Itoa(int(b & 0x7f))), 1, nil
+	case b&0xc0 == 0x80: // 6 bit length string
+		header, n = 1, int(b&0x3f)
+	case b&0xe0 == 0xc0: // 13 bit signed integer
+		if len(p) < 2 {
+			return nil, 0, errCorrupted
+		}
+		u := uint64(b&0x1f)<<8 | uint64(p[1])
+		value := int64(u<<51) >> 51
+		return []byte(strconv.FormatInt(value, 10)), 2, nil
+	case b&0xf0 == 0xe0: // 12 bit length string
+		if len(p) < 2 {
+			return nil, 0, errCorrupted
+		}
+		header, n = 2, int(b&0x0f)<<8|int(p[1])
+	case b == 0xf0: // 32 bit length string
+		if len(p) < 5 {
+			return nil, 0, errCorrupted
+		}
+		header, n = 5, int(binary.LittleEndian.Uint32(p[1:5]))
+	case b >= 0xf1 && b <= 0xf4: // 16, 24, 32 and 64 bit signed integer
+		size := []int{2, 3, 4, 8}[b-0xf1]
+		if len(p) < 1+size {
+			return nil, 0, errCorrupted
+		}
+		return []byte(strconv.FormatInt(readSigned(p[1:1+size], size), 10)), 1 + size, nil
+	default:
+		return nil, 0, errCorrupted
+	}
+	if n < 0 || len(p) < header+n {
+		return nil, 0, errCorrupted
+	}
+	return p[header : header+n], header + n, nil
+}
+
+// backlenSize returns bytes used to save entry size backward
+func backlenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// lzfDecompress decompresses data compressed by liblzf
+func lzfDecompress(in []byte, rawLen int) ([]byte, error) {
+	out := make([]byte, 0, rawLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 1<<5 { // literal run
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errCorrupted
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errCorrupted
+			}
+			n += int(in[i])
+			i++
+		}
+		n += 2
+		if i >= len(in) {
+			return nil, errCorrupted
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupted
+		}
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != rawLen {
+		return nil, errCorrupted
+	}
+	return out, nil
+}
@@ -0,0 +1,429 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"myGodis/src/lib/crc64"
+	"strconv"
+)
+
+var errCorrupted = errors.New("rdb file is corrupted")
+
+// Decoder reads rdb file
+type Decoder struct {
+	r   *bufio.Reader
+	crc uint64
+	buf [8]byte
+}
+
+// NewDecoder makes a decoder, if r is a *bufio.Reader data after EOF of rdb is left in it
+func NewDecoder(r io.Reader) *Decoder {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Decoder{r: reader}
+}
+
+func (dec *Decoder) read(p []byte) error {
+	if _, err := io.ReadFull(dec.r, p); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec.crc = crc64.Update(dec.crc, p)
+	return nil
+}
+
+func (dec *Decoder) readByte() (byte, error) {
+	err := dec.read(dec.buf[:1])
+	return dec.buf[0], err
+}
+
+// readLength returns length or the encoding type of a special encoded string
+func (dec *Decoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := dec.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := dec.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 2:
+		if b == 0x80 {
+			err = dec.read(dec.buf[:4])
+			return uint64(binary.BigEndian.Uint32(dec.buf[:4])), false, err
+		} else if b == 0x81 {
+			err = dec.read(dec.buf[:8])
+			return binary.BigEndian.Uint64(dec.buf[:8]), false, err
+		}
+		return 0, false, errCorrupted
+	default:
+		return uint64(b & 0x3f), true, nil
+	}
+}
+
+func (dec *Decoder) readLen() (int, error) {
+	n, encoded, err := dec.readLength()
+	if err != nil {
+		return 0, err
+	} else if encoded || n > math.MaxInt32 {
+		return 0, errCorrupted
+	}
+	return int(n), nil
+}
+
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+func (dec *Decoder) readString() ([]byte, error) {
+	n, encoded, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		if n > math.MaxInt32 {
+			return nil, errCorrupted
+		}
+		s := make([]byte, n)
+		return s, dec.read(s)
+	}
+	switch n {
+	case encInt8:
+		b, err := dec.readByte()
+		return []byte(strconv.Itoa(int(int8(b)))), err
+	case encInt16:
+		err := dec.read(dec.buf[:2])
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(dec.buf[:2]))))), err
+	case encInt32:
+		err := dec.read(dec.buf[:4])
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(dec.buf[:4]))))), err
+	case encLZF:
+		compressedLen, err := dec.readLen()
+		if err != nil {
+			return nil, err
+		}
+		rawLen, err := dec.readLen()
+		if err != nil {
+			return nil, err
+		}
+		compressed := make([]byte, compressedLen)
+		if err := dec.read(compressed); err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, rawLen)
+	}
+	return nil, errCorrupted
+}
+
+// readScore reads score of TypeZSet which is saved as string
+func (dec *Decoder) readScore() (float64, error) {
+	n, err := dec.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	s := make([]byte, n)
+	if err := dec.read(s); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(s), 64)
+}
+
+// Parse reads the whole file, consumer is called for each key-value pair and function library,
+// it could stop parsing by returning false
+func (dec *Decoder) Parse(consumer func(obj *Object) bool) error {
+	header := make([]byte, 9)
+	if err := dec.read(header); err != nil {
+		return err
+	}
+	if string(header[:5]) != magic {
+		return errors.New("wrong signature trying to load rdb file")
+	}
+	fileVersion, err := strconv.Atoi(string(header[5:]))
+	if err != nil || fileVersion < 1 || fileVersion > 12 {
+		return errors.New("can't handle rdb format version " + string(header[5:]))
+	}
+	db := 0
+	var expireAt int64
+	for {
+		opcode, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case opEOF:
+			return dec.checkSum(fileVersion)
+		case opSelectDB:
+			if db, err = dec.readLen(); err != nil {
+				return err
+			}
+		case opResizeDB:
+			if _, err := dec.readLen(); err != nil {
+				return err
+			}
+			if _, err := dec.readLen(); err != nil {
+				return err
+			}
+		case opAux:
+			if _, err := dec.readString(); err != nil {
+				return err
+			}
+			if _, err := dec.readString(); err != nil {
+				return err
+			}
+		case opExpireTimeMs:
+			if err := dec.read(dec.buf[:8]); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(dec.buf[:8]))
+		case opExpireTime:
+			if err := dec.read(dec.buf[:4]); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(dec.buf[:4])) * 1000
+		case opIdle:
+			if _, _, err := dec.readLength(); err != nil {
+				return err
+			}
+		case opFreq:
+			if _, err := dec.readByte(); err != nil {
+				return err
+			}
+		case opFunction2:
+			code, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			if !consumer(&Object{DB: db, Type: TypeFunction, String: code}) {
+				return nil
+			}
+		case opModuleAux:
+			return errors.New("modules are not supported")
+		default:
+			key, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			obj := &Object{DB: db, Key: string(key), ExpireAt: expireAt}
+			if err := dec.readObject(int(opcode), obj); err != nil {
+				return err
+			}
+			expireAt = 0
+			if !consumer(obj) {
+				return nil
+			}
+		}
+	}
+}
+
+func (dec *Decoder) checkSum(fileVersion int) error {
+	if fileVersion < 5 {
+		return nil
+	}
+	expected := dec.crc
+	if _, err := io.ReadFull(dec.r, dec.buf[:8]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	sum := binary.LittleEndian.Uint64(dec.buf[:8])
+	// checksum is 0 if it is disabled by rdbchecksum no
+	if sum != 0 && sum != expected {
+		return errors.New("wrong rdb checksum")
+	}
+	return nil
+}
+
+func (dec *Decoder) readObject(valueType int, obj *Object) error {
+	var err error
+	switch valueType {
+	case TypeString:
+		obj.Type = TypeString
+		obj.String, err = dec.readString()
+	case TypeList, TypeSet:
+		obj.Type = valueType
+		obj.Members, err = dec.readStrings(1)
+	case TypeHash:
+		obj.Type = TypeHash
+		var values [][]byte
+		if values, err = dec.readStrings(2); err == nil {
+			obj.Hash = toHash(values)
+		}
+	case TypeZSet, TypeZSet2:
+		obj.Type = TypeZSet
+		obj.ZSet, err = dec.readZSet(valueType == TypeZSet2)
+	case typeSetIntset:
+		obj.Type = TypeSet
+		var blob []byte
+		if blob, err = dec.readString(); err == nil {
+			obj.Members, err = parseIntset(blob)
+		}
+	case typeListZiplist, typeHashZiplist, typeZSetZiplist:
+		var blob []byte
+		if blob, err = dec.readString(); err != nil {
+			return err
+		}
+		var values [][]byte
+		if values, err = parseZiplist(blob); err == nil {
+			err = fillCompact(obj, valueType, values)
+		}
+	case typeHashListpack, typeZSetListpack, typeSetListpack:
+		var blob []byte
+		if blob, err = dec.readString(); err != nil {
+			return err
+		}
+		var values [][]byte
+		if values, err = parseListpack(blob); err == nil {
+			err = fillCompact(obj, valueType, values)
+		}
+	case typeListQuicklist, typeListQuicklist2:
+		obj.Type = TypeList
+		obj.Members, err = dec.readQuicklist(valueType == typeListQuicklist2)
+	case typeHashZipmap, typeModule, typeModule2, typeStreamListpacks:
+		return errors.New("unsupported value type " + strconv.Itoa(valueType) + " of key " + obj.Key)
+	default:
+		return errors.New("unknown value type " + strconv.Itoa(valueType))
+	}
+	return err
+}
+
+// readStrings reads a length then length*width strings
+func (dec *Decoder) readStrings(width int) ([][]byte, error) {
+	n, err := dec.readLen()
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, n*width)
+	for i := 0; i < n*width; i++ {
+		value, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (dec *Decoder) readZSet(binaryScore bool) ([]*ZSetEntry, error) {
+	n, err := dec.readLen()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*ZSetEntry, 0, n)
+	for i := 0; i < n; i++ {
+		member, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if binaryScore {
+			if err := dec.read(dec.buf[:8]); err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(dec.buf[:8]))
+		} else if score, err = dec.readScore(); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &ZSetEntry{Member: string(member), Score: score})
+	}
+	return entries, nil
+}
+
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// readQuicklist reads a list of ziplist nodes, or listpack nodes and plain nodes if isV2
+func (dec *Decoder) readQuicklist(isV2 bool) ([][]byte, error) {
+	n, err := dec.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var members [][]byte
+	for i := 0; i < n; i++ {
+		container := quicklistNodePacked
+		if isV2 {
+			if container, err = dec.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		var values [][]byte
+		switch {
+		case container == quicklistNodePlain:
+			values = [][]byte{blob}
+		case container != quicklistNodePacked:
+			return nil, errCorrupted
+		case isV2:
+			values, err = parseListpack(blob)
+		default:
+			values, err = parseZiplist(blob)
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, values...)
+	}
+	return members, nil
+}
+
+// fillCompact fills obj by values of a ziplist or listpack
+func fillCompact(obj *Object, valueType int, values [][]byte) error {
+	switch valueType {
+	case typeListZiplist:
+		obj.Type = TypeList
+		obj.Members = values
+	case typeSetListpack:
+		obj.Type = TypeSet
+		obj.Members = values
+	case typeHashZiplist, typeHashListpack:
+		if len(values)%2 != 0 {
+			return errCorrupted
+		}
+		obj.Type = TypeHash
+		obj.Hash = toHash(values)
+	case typeZSetZiplist, typeZSetListpack:
+		if len(values)%2 != 0 {
+			return errCorrupted
+		}
+		obj.Type = TypeZSet
+		obj.ZSet = make([]*ZSetEntry, 0, len(values)/2)
+		for i := 0; i < len(values); i += 2 {
+			score, err := strconv.ParseFloat(string(values[i+1]), 64)
+			if err != nil {
+				return errCorrupted
+			}
+			obj.ZSet = append(obj.ZSet, &ZSetEntry{Member: string(values[i]), Score: score})
+		}
+	}
+	return nil
+}
+
+func toHash(values [][]byte) map[string][]byte {
+	hash := make(map[string][]byte, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		hash[string(values[i])] = values[i+1]
+	}
+	return hash
+}
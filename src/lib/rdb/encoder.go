@@ -0,0 +1,177 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"myGodis/src/lib/crc64"
+	"strconv"
+)
+
+// Encoder writes rdb file
+type Encoder struct {
+	w   *bufio.Writer
+	crc uint64
+	buf [9]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+func (enc *Encoder) write(p []byte) error {
+	enc.crc = crc64.Update(enc.crc, p)
+	_, err := enc.w.Write(p)
+	return err
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	enc.buf[0] = b
+	return enc.write(enc.buf[:1])
+}
+
+func (enc *Encoder) writeLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return enc.writeByte(byte(n))
+	case n < 1<<14:
+		enc.buf[0] = byte(n>>8) | 0x40
+		enc.buf[1] = byte(n)
+		return enc.write(enc.buf[:2])
+	case n <= math.MaxUint32:
+		enc.buf[0] = 0x80
+		binary.BigEndian.PutUint32(enc.buf[1:], uint32(n))
+		return enc.write(enc.buf[:5])
+	default:
+		enc.buf[0] = 0x81
+		binary.BigEndian.PutUint64(enc.buf[1:], n)
+		return enc.write(enc.buf[:9])
+	}
+}
+
+func (enc *Encoder) writeString(s []byte) error {
+	if err := enc.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return enc.write(s)
+}
+
+// WriteHeader writes magic, version and aux fields
+func (enc *Encoder) WriteHeader(aux map[string]string) error {
+	if err := enc.write([]byte(magic + "000" + strconv.Itoa(version))); err != nil {
+		return err
+	}
+	for key, value := range aux {
+		if err := enc.writeByte(opAux); err != nil {
+			return err
+		}
+		if err := enc.writeString([]byte(key)); err != nil {
+			return err
+		}
+		if err := enc.writeString([]byte(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFunction writes a function library, libraries should be written before databases
+func (enc *Encoder) WriteFunction(code []byte) error {
+	if err := enc.writeByte(opFunction2); err != nil {
+		return err
+	}
+	return enc.writeString(code)
+}
+
+// WriteDBHeader starts database of index, sizes are hints for loading
+func (enc *Encoder) WriteDBHeader(index int, keyCount int, ttlCount int) error {
+	if err := enc.writeByte(opSelectDB); err != nil {
+		return err
+	}
+	if err := enc.writeLength(uint64(index)); err != nil {
+		return err
+	}
+	if err := enc.writeByte(opResizeDB); err != nil {
+		return err
+	}
+	if err := enc.writeLength(uint64(keyCount)); err != nil {
+		return err
+	}
+	return enc.writeLength(uint64(ttlCount))
+}
+
+// WriteObject writes obj to current database, obj.DB is ignored
+func (enc *Encoder) WriteObject(obj *Object) error {
+	if obj.ExpireAt > 0 {
+		enc.buf[0] = opExpireTimeMs
+		binary.LittleEndian.PutUint64(enc.buf[1:], uint64(obj.ExpireAt))
+		if err := enc.write(enc.buf[:9]); err != nil {
+			return err
+		}
+	}
+	valueType := obj.Type
+	if valueType == TypeZSet {
+		valueType = TypeZSet2
+	}
+	if err := enc.writeByte(byte(valueType)); err != nil {
+		return err
+	}
+	if err := enc.writeString([]byte(obj.Key)); err != nil {
+		return err
+	}
+	switch obj.Type {
+	case TypeString:
+		return enc.writeString(obj.String)
+	case TypeList, TypeSet:
+		if err := enc.writeLength(uint64(len(obj.Members))); err != nil {
+			return err
+		}
+		for _, member := range obj.Members {
+			if err := enc.writeString(member); err != nil {
+				return err
+			}
+		}
+	case TypeHash:
+		if err := enc.writeLength(uint64(len(obj.Hash))); err != nil {
+			return err
+		}
+		for field, value := range obj.Hash {
+			if err := enc.writeString([]byte(field)); err != nil {
+				return err
+			}
+			if err := enc.writeString(value); err != nil {
+				return err
+			}
+		}
+	case TypeZSet:
+		if err := enc.writeLength(uint64(len(obj.ZSet))); err != nil {
+			return err
+		}
+		for _, entry := range obj.ZSet {
+			if err := enc.writeString([]byte(entry.Member)); err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint64(enc.buf[:], math.Float64bits(entry.Score))
+			if err := enc.write(enc.buf[:8]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown object type " + strconv.Itoa(obj.Type))
+	}
+	return nil
+}
+
+// WriteEnd writes EOF and checksum, then flushes buffer
+func (enc *Encoder) WriteEnd() error {
+	if err := enc.writeByte(opEOF); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(enc.buf[:], enc.crc)
+	if _, err := enc.w.Write(enc.buf[:8]); err != nil {
+		return err
+	}
+	return enc.w.Flush()
+}
@@ -0,0 +1,63 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"myGodis/src/lib/crc64"
+)
+
+/*
+ * Payload of FUNCTION DUMP is the same as redis: function libraries in rdb encoding,
+ * followed by 2 bytes rdb version and 8 bytes crc64 of all bytes before it, both are little endian
+ */
+
+var errBadPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// EncodeFunctions serializes function libraries into payload of FUNCTION DUMP
+func EncodeFunctions(codes [][]byte) []byte {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, code := range codes {
+		_ = enc.WriteFunction(code)
+	}
+	binary.LittleEndian.PutUint16(enc.buf[:2], version)
+	_ = enc.write(enc.buf[:2])
+	binary.LittleEndian.PutUint64(enc.buf[:8], enc.crc)
+	_, _ = enc.w.Write(enc.buf[:8])
+	_ = enc.w.Flush()
+	return buf.Bytes()
+}
+
+// DecodeFunctions returns codes of function libraries in payload of FUNCTION DUMP
+func DecodeFunctions(payload []byte) ([][]byte, error) {
+	if len(payload) < 10 {
+		return nil, errBadPayload
+	}
+	footer := payload[len(payload)-10:]
+	fileVersion := binary.LittleEndian.Uint16(footer[:2])
+	sum := binary.LittleEndian.Uint64(footer[2:])
+	if fileVersion > 12 || sum != crc64.Checksum(payload[:len(payload)-8]) {
+		return nil, errBadPayload
+	}
+	dec := NewDecoder(bytes.NewReader(payload[:len(payload)-10]))
+	var codes [][]byte
+	for {
+		if _, err := dec.r.Peek(1); err == io.EOF {
+			return codes, nil
+		}
+		opcode, err := dec.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if opcode != opFunction2 {
+			return nil, errors.New("ERR given type is not a function")
+		}
+		code, err := dec.readString()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+}
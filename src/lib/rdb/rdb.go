@@ -0,0 +1,73 @@
+package rdb
+
+/*
+ * RDB is the snapshot format of redis: a header "REDIS" + 4 digits version, aux fields, then key-value pairs
+ * of each database, an EOF opcode and a crc64 checksum of all bytes before it.
+ * Encoder writes version 9 files with plain encodings which every redis since 5.0 and RDB tools could read,
+ * except function libraries which are written by the opcode of redis 7.
+ * Decoder also reads compact encodings written by redis (intset, ziplist, listpack, quicklist and LZF strings)
+ */
+
+const (
+	version = 9
+	magic   = "REDIS"
+)
+
+// value types in file
+const (
+	TypeString          = 0
+	TypeList            = 1
+	TypeSet             = 2
+	TypeZSet            = 3
+	TypeHash            = 4
+	TypeZSet2           = 5
+	typeModule          = 6
+	typeModule2         = 7
+	typeHashZipmap      = 9
+	typeListZiplist     = 10
+	typeSetIntset       = 11
+	typeZSetZiplist     = 12
+	typeHashZiplist     = 13
+	typeListQuicklist   = 14
+	typeStreamListpacks = 15
+	typeHashListpack    = 16
+	typeZSetListpack    = 17
+	typeListQuicklist2  = 18
+	typeSetListpack     = 20
+
+	// TypeFunction is a function library, Object.String is its code and Key is empty
+	TypeFunction = opFunction2
+)
+
+// opcodes
+const (
+	opFunction2    = 245
+	opModuleAux    = 247
+	opIdle         = 248
+	opFreq         = 249
+	opAux          = 250
+	opResizeDB     = 251
+	opExpireTimeMs = 252
+	opExpireTime   = 253
+	opSelectDB     = 254
+	opEOF          = 255
+)
+
+// Object is a key-value pair in rdb file, Type is one of TypeString, TypeList, TypeSet, TypeHash and TypeZSet
+// whatever its encoding in file is, or TypeFunction for a function library
+type Object struct {
+	DB       int
+	Key      string
+	ExpireAt int64 // unix time in milliseconds, 0 means no ttl
+	Type     int
+
+	String  []byte
+	Members [][]byte // elements of list or members of set
+	Hash    map[string][]byte
+	ZSet    []*ZSetEntry
+}
+
+type ZSetEntry struct {
+	Member string
+	Score  float64
+}
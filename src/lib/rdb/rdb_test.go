@@ -0,0 +1,185 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func parseAll(t *testing.T, data []byte) map[string]*Object {
+	t.Helper()
+	objects := make(map[string]*Object)
+	err := NewDecoder(bytes.NewReader(data)).Parse(func(obj *Object) bool {
+		objects[obj.Key] = obj
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func TestRoundTrip(t *testing.T) {
+	objects := []*Object{
+		{Key: "str", Type: TypeString, String: []byte("hello"), ExpireAt: 1700000000123},
+		{Key: "empty", Type: TypeString, String: []byte{}},
+		{Key: "list", Type: TypeList, Members: [][]byte{[]byte("a"), []byte("b"), []byte("a")}},
+		{Key: "set", Type: TypeSet, Members: [][]byte{[]byte("x"), bytes.Repeat([]byte("y"), 20000)}},
+		{Key: "hash", Type: TypeHash, Hash: map[string][]byte{"f1": []byte("v1"), "f2": []byte("v2")}},
+		{Key: "zset", Type: TypeZSet, ZSet: []*ZSetEntry{{Member: "m1", Score: 1.5}, {Member: "m2", Score: math.Inf(-1)}}},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.WriteHeader(map[string]string{"redis-ver": "6.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteDBHeader(0, len(objects), 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objects {
+		if err := enc.WriteObject(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("REDIS0009")) {
+		t.Errorf("wrong header %q", buf.Bytes()[:9])
+	}
+
+	decoded := parseAll(t, buf.Bytes())
+	if len(decoded) != len(objects) {
+		t.Fatalf("expected %d objects, actual %d", len(objects), len(decoded))
+	}
+	for _, obj := range objects {
+		if !reflect.DeepEqual(obj, decoded[obj.Key]) {
+			t.Errorf("expected %+v, actual %+v", obj, decoded[obj.Key])
+		}
+	}
+
+	// corrupted checksum
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	err := NewDecoder(bytes.NewReader(data)).Parse(func(obj *Object) bool { return true })
+	if err == nil {
+		t.Error("expected checksum error")
+	}
+}
+
+func listpack(entries ...[]byte) []byte {
+	var body []byte
+	for _, entry := range entries {
+		body = append(body, entry...)
+		body = append(body, byte(len(entry))) // backlen of small entries
+	}
+	blob := make([]byte, 6, 7+len(body))
+	binary.LittleEndian.PutUint32(blob, uint32(7+len(body)))
+	binary.LittleEndian.PutUint16(blob[4:], uint16(len(entries)))
+	blob = append(blob, body...)
+	return append(blob, 0xff)
+}
+
+func ziplist(entries ...[]byte) []byte {
+	blob := make([]byte, 10)
+	binary.LittleEndian.PutUint16(blob[8:], uint16(len(entries)))
+	for _, entry := range entries {
+		blob = append(blob, 0) // previous entry length
+		blob = append(blob, entry...)
+	}
+	return append(blob, 0xff)
+}
+
+func TestCompactEncodings(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	_ = enc.WriteHeader(nil)
+	_ = enc.WriteDBHeader(0, 0, 0)
+	writeRaw := func(valueType byte, key string, blob []byte) {
+		_ = enc.writeByte(valueType)
+		_ = enc.writeString([]byte(key))
+		_ = enc.writeString(blob)
+	}
+	// int encoded strings
+	_ = enc.writeByte(TypeString)
+	_ = enc.writeString([]byte("int8"))
+	_ = enc.write([]byte{0xc0, 0xfe})
+	_ = enc.writeByte(TypeString)
+	_ = enc.writeString([]byte("int32"))
+	_ = enc.write([]byte{0xc2, 0x40, 0xe2, 0x01, 0x00})
+	// lzf string, literal 'a' then back reference of 9 bytes
+	_ = enc.writeByte(TypeString)
+	_ = enc.writeString([]byte("lzf"))
+	_ = enc.write([]byte{0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00})
+
+	intset := []byte{2, 0, 0, 0, 2, 0, 0, 0, 0xff, 0xff, 7, 0}
+	writeRaw(typeSetIntset, "intset", intset)
+	// string "ab", int16 300, immediate 5
+	writeRaw(typeListZiplist, "ziplist", ziplist([]byte{0x02, 'a', 'b'}, []byte{0xc0, 0x2c, 0x01}, []byte{0xf6}))
+	// field "f", 7 bit int 3
+	writeRaw(typeHashListpack, "hash", listpack([]byte{0x81, 'f'}, []byte{0x03}))
+	// member "m", 13 bit int -2
+	writeRaw(typeZSetListpack, "zset", listpack([]byte{0x81, 'm'}, []byte{0xdf, 0xfe}))
+	// quicklist2 with a plain node and a packed node
+	_ = enc.writeByte(typeListQuicklist2)
+	_ = enc.writeString([]byte("quicklist"))
+	_ = enc.writeLength(2)
+	_ = enc.writeLength(quicklistNodePlain)
+	_ = enc.writeString([]byte("plain"))
+	_ = enc.writeLength(quicklistNodePacked)
+	_ = enc.writeString(listpack([]byte{0x81, 'x'}))
+	_ = enc.WriteEnd()
+
+	objects := parseAll(t, buf.Bytes())
+	expected := map[string]*Object{
+		"int8":      {Key: "int8", Type: TypeString, String: []byte("-2")},
+		"int32":     {Key: "int32", Type: TypeString, String: []byte("123456")},
+		"lzf":       {Key: "lzf", Type: TypeString, String: []byte("aaaaaaaaaa")},
+		"intset":    {Key: "intset", Type: TypeSet, Members: [][]byte{[]byte("-1"), []byte("7")}},
+		"ziplist":   {Key: "ziplist", Type: TypeList, Members: [][]byte{[]byte("ab"), []byte("300"), []byte("5")}},
+		"hash":      {Key: "hash", Type: TypeHash, Hash: map[string][]byte{"f": []byte("3")}},
+		"zset":      {Key: "zset", Type: TypeZSet, ZSet: []*ZSetEntry{{Member: "m", Score: -2}}},
+		"quicklist": {Key: "quicklist", Type: TypeList, Members: [][]byte{[]byte("plain"), []byte("x")}},
+	}
+	for key, obj := range expected {
+		if !reflect.DeepEqual(obj, objects[key]) {
+			t.Errorf("expected %+v, actual %+v", obj, objects[key])
+		}
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	codes := [][]byte{[]byte("#!lua name=lib1\n"), bytes.Repeat([]byte("-"), 100)}
+	payload := EncodeFunctions(codes)
+	decoded, err := DecodeFunctions(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, codes) {
+		t.Errorf("expected %q, actual %q", codes, decoded)
+	}
+	payload[0] ^= 1
+	if _, err := DecodeFunctions(payload); err == nil {
+		t.Error("corrupted payload should be rejected")
+	}
+
+	// libraries in rdb file
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	_ = enc.WriteHeader(nil)
+	_ = enc.WriteFunction(codes[0])
+	_ = enc.WriteDBHeader(0, 1, 0)
+	_ = enc.WriteObject(&Object{Key: "k", Type: TypeString, String: []byte("v")})
+	if err := enc.WriteEnd(); err != nil {
+		t.Fatal(err)
+	}
+	objects := parseAll(t, buf.Bytes())
+	if lib := objects[""]; lib == nil || lib.Type != TypeFunction || string(lib.String) != string(codes[0]) {
+		t.Errorf("library is not decoded: %+v", lib)
+	}
+	if objects["k"] == nil {
+		t.Error("key after library is not decoded")
+	}
+}
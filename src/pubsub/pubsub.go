@@ -4,20 +4,30 @@ import (
 	"myGodis/src/datastruct/list"
 	"myGodis/src/interface/redis"
 	"myGodis/src/redis/reply"
-	"strconv"
 )
 
 var (
-	_subscribe         = "subscribe"
-	_unsubscribe       = "unsubscribe"
-	messageBytes       = []byte("message")
-	unSubscribeNothing = []byte("*3\r\n$11\r\nunsubscribe\r\n$-1\n:0\r\n")
+	_subscribe   = "subscribe"
+	_unsubscribe = "unsubscribe"
+	messageBytes = []byte("message")
 )
 
-func makeMsg(t string, channel string, code int64) []byte {
-	return []byte("*3\r\n$" + strconv.FormatInt(int64(len(t)), 10) + reply.CRLF + t + reply.CRLF +
-		"$" + strconv.FormatInt(int64(len(channel)), 10) + reply.CRLF + channel + reply.CRLF +
-		":" + strconv.FormatInt(code, 10) + reply.CRLF)
+// makeMsg makes subscribe/unsubscribe confirmation, channel is nil when unsubscribing nothing
+func makeMsg(t string, channel []byte, code int64) redis.Reply {
+	var channelReply redis.Reply = &reply.NullBulkReply{}
+	if channel != nil {
+		channelReply = reply.MakeBulkReply(channel)
+	}
+	return reply.MakePushReply([]redis.Reply{
+		reply.MakeBulkReply([]byte(t)),
+		channelReply,
+		reply.MakeIntReply(code),
+	})
+}
+
+// writePush sends a push message to client in the protocol it negotiated
+func writePush(c redis.Client, msg redis.Reply) {
+	_ = c.Write(reply.ToProtocolBytes(msg, c.GetProtocol()))
 }
 
 /*
@@ -75,7 +85,7 @@ func Subscribe(hub *Hub, c redis.Client, args [][]byte) redis.Reply {
 
 	for _, channel := range channels {
 		if subscribe0(hub, channel, c) {
-			_ = c.Write(makeMsg(_subscribe, channel, int64(c.SubsCount())))
+			writePush(c, makeMsg(_subscribe, []byte(channel), int64(c.SubsCount())))
 		}
 	}
 	return &reply.NoReply{}
@@ -107,13 +117,13 @@ func UnSubscribe(hub *Hub, c redis.Client, args [][]byte) redis.Reply {
 	defer hub.subsLocker.UnLocks(channels...)
 
 	if len(channels) == 0 {
-		_ = c.Write(unSubscribeNothing)
+		writePush(c, makeMsg(_unsubscribe, nil, 0))
 		return &reply.NoReply{}
 	}
 
 	for _, channel := range channels {
 		if unsubscribe0(hub, channel, c) {
-			_ = c.Write(makeMsg(_unsubscribe, channel, int64(c.SubsCount())))
+			writePush(c, makeMsg(_unsubscribe, []byte(channel), int64(c.SubsCount())))
 		}
 	}
 	return &reply.NoReply{}
@@ -136,11 +146,11 @@ func Publish(hub *Hub, args [][]byte) redis.Reply {
 	subscribers, _ := raw.(*list.LinkedList)
 	subscribers.ForEach(func(i int, c interface{}) bool {
 		client, _ := c.(redis.Client)
-		replyArgs := make([][]byte, 3)
-		replyArgs[0] = messageBytes
-		replyArgs[1] = []byte(channel)
-		replyArgs[2] = message
-		_ = client.Write(reply.MakeMultiBulkReply(replyArgs).ToBytes())
+		writePush(client, reply.MakePushReply([]redis.Reply{
+			reply.MakeBulkReply(messageBytes),
+			reply.MakeBulkReply([]byte(channel)),
+			reply.MakeBulkReply(message),
+		}))
 		return true
 	})
 	return reply.MakeIntReply(int64(subscribers.Len()))
@@ -2,33 +2,65 @@ package client
 
 import (
 	"context"
+	"errors"
+	"io"
 	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/lib/sync/wait"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	created = iota
+	running
+	closed
+)
+
+// Client is a pipelined redis client, requests are written in batches and replies are matched in order
 type Client struct {
 	conn        net.Conn
-	sendingReqs chan *Request
-	waitingReqs chan *Request
+	sendingReqs chan *Request // waiting to be sent
+	waitingReqs chan *Request // sent, waiting for reply
 	ticker      *time.Ticker
 	addr        string
 
 	ctx        context.Context
 	cancelFunc context.CancelFunc
-	writing    *sync.WaitGroup
+	writing    *sync.WaitGroup // unfinished Send calls, Close waits for them
+
+	status int32
+	// guards conn and waitingReqs while writing or reconnecting
+	mu sync.Mutex
+	// request whose replies are partially received, only accessed by handleRead
+	reading *Request
 }
 
 type Request struct {
-	args      [][]byte
-	reply     redis.Reply
+	cmdLines  [][][]byte // written at once, so commands of a pipeline are never interleaved with others
+	replies   []redis.Reply
 	heartbeat bool
-	waiting   *sync.WaitGroup
+	waiting   *wait.Wait
+	err       error
 }
 
 const (
-	chanSize = 256
+	chanSize     = 256
+	maxBatchSize = 64
+	maxWait      = 3 * time.Second
+
+	heartbeatInterval = 10 * time.Second
+	minBackoff        = 50 * time.Millisecond
+	maxBackoff        = 3 * time.Second
+)
+
+var (
+	errClosed      = errors.New("client closed")
+	errConnectLost = errors.New("connection lost")
 )
 
 func MakeClient(addr string) (*Client, error) {
@@ -45,9 +77,272 @@ func MakeClient(addr string) (*Client, error) {
 		ctx:         ctx,
 		cancelFunc:  cancel,
 		writing:     &sync.WaitGroup{},
+		status:      created,
 	}, nil
 }
 
+// Start starts the writing, reading and heartbeat goroutines
 func (client *Client) Start() {
+	client.ticker = time.NewTicker(heartbeatInterval)
+	atomic.StoreInt32(&client.status, running)
+	go client.handleWrite()
+	go client.handleRead()
+	go client.heartbeat()
+}
+
+// Close waits for unfinished requests then stops all goroutines and the connection
+func (client *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&client.status, running, closed) {
+		return
+	}
+	client.ticker.Stop()
+	waitWithTimeout(client.writing, maxWait)
+	client.cancelFunc()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	_ = client.conn.Close() // handleRead will fail waiting requests and exit
+}
+
+func waitWithTimeout(wg *sync.WaitGroup, timeout time.Duration) {
+	w := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(w)
+	}()
+	select {
+	case <-w:
+	case <-time.After(timeout):
+	}
+}
+
+// Send sends a command line to server and waits for its reply, errors are returned as error reply
+func (client *Client) Send(args [][]byte) redis.Reply {
+	return client.SendPipeline([][][]byte{args})[0]
+}
+
+// SendPipeline sends command lines in one write and waits for their replies,
+// no other command is sent between them. Errors are returned as error replies of all command lines
+func (client *Client) SendPipeline(cmdLines [][][]byte) []redis.Reply {
+	if len(cmdLines) == 0 {
+		return nil
+	}
+	if atomic.LoadInt32(&client.status) != running {
+		return failedReplies(len(cmdLines), reply.MakeErrReply("ERR "+errClosed.Error()))
+	}
+	client.writing.Add(1)
+	defer client.writing.Done()
+
+	request := &Request{
+		cmdLines: cmdLines,
+		replies:  make([]redis.Reply, 0, len(cmdLines)),
+		waiting:  &wait.Wait{},
+	}
+	request.waiting.Add(1)
+	select {
+	case client.sendingReqs <- request:
+	case <-client.ctx.Done():
+		return failedReplies(len(cmdLines), reply.MakeErrReply("ERR "+errClosed.Error()))
+	}
+	timeout := request.waiting.WaitWithTimeout(maxWait)
+	if timeout {
+		return failedReplies(len(cmdLines), reply.MakeErrReply("ERR server time out"))
+	}
+	if request.err != nil {
+		return failedReplies(len(cmdLines), reply.MakeErrReply("ERR request failed: "+request.err.Error()))
+	}
+	return request.replies
+}
+
+func failedReplies(n int, errReply redis.Reply) []redis.Reply {
+	replies := make([]redis.Reply, n)
+	for i := range replies {
+		replies[i] = errReply
+	}
+	return replies
+}
+
+func (client *Client) heartbeat() {
+	for {
+		select {
+		case <-client.ticker.C:
+			client.doHeartbeat()
+		case <-client.ctx.Done():
+			return
+		}
+	}
+}
+
+func (client *Client) doHeartbeat() {
+	request := &Request{
+		cmdLines:  [][][]byte{{[]byte("PING")}},
+		heartbeat: true,
+		waiting:   &wait.Wait{},
+	}
+	request.waiting.Add(1)
+	select {
+	case client.sendingReqs <- request:
+	case <-client.ctx.Done():
+		return
+	}
+	if request.waiting.WaitWithTimeout(maxWait) {
+		// server does not respond, close the connection to trigger reconnecting
+		logger.Warn("heartbeat timeout: " + client.addr)
+		client.mu.Lock()
+		_ = client.conn.Close()
+		client.mu.Unlock()
+	}
+}
+
+func (client *Client) handleWrite() {
+	batch := make([]*Request, 0, maxBatchSize)
+	for {
+		select {
+		case req := <-client.sendingReqs:
+			batch = append(batch[:0], req)
+			// collect requests already queued into one write
+		collect:
+			for len(batch) < maxBatchSize {
+				select {
+				case req := <-client.sendingReqs:
+					batch = append(batch, req)
+				default:
+					break collect
+				}
+			}
+			client.doWrite(batch)
+		case <-client.ctx.Done():
+			return
+		}
+	}
+}
+
+func (client *Client) doWrite(batch []*Request) {
+	buf := make([]byte, 0)
+	for _, req := range batch {
+		for _, cmdLine := range req.cmdLines {
+			buf = append(buf, reply.MakeMultiBulkReply(cmdLine).ToBytes()...)
+		}
+	}
 
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// enqueue before writing so that handleRead always finds the request of a reply
+	for _, req := range batch {
+		client.waitingReqs <- req
+	}
+	_, err := client.conn.Write(buf)
+	if err != nil {
+		// handleRead will get an error too, then fail waiting requests and reconnect
+		logger.Warn("write failed: " + err.Error())
+		_ = client.conn.Close()
+	}
+}
+
+func (client *Client) handleRead() {
+	for {
+		client.mu.Lock()
+		conn := client.conn
+		client.mu.Unlock()
+
+		err := client.readReplies(conn)
+		if atomic.LoadInt32(&client.status) == closed {
+			client.failWaitingReqs(errClosed)
+			return
+		}
+		logger.Warn("read failed: " + err.Error())
+		if !client.reconnect() {
+			client.failWaitingReqs(errClosed)
+			return
+		}
+	}
+}
+
+// readReplies parses replies from conn and finishes waiting requests in order until an error occurs
+func (client *Client) readReplies(conn net.Conn) error {
+	ch := parser.ParseStream(conn)
+	for payload := range ch {
+		if payload.Err != nil {
+			if _, ok := payload.Err.(*reply.ProtocolErrReply); ok {
+				// broken stream, cannot match further replies
+				_ = conn.Close()
+				for range ch {
+					// wait parser exits
+				}
+			}
+			return payload.Err
+		}
+		client.finishRequest(payload.Data)
+	}
+	return io.EOF
+}
+
+// finishRequest adds result to the first waiting request, which is finished after all its replies arrived
+func (client *Client) finishRequest(result redis.Reply) {
+	if client.reading == nil {
+		select {
+		case client.reading = <-client.waitingReqs:
+		default:
+			logger.Warn("received reply without request")
+			return
+		}
+	}
+	request := client.reading
+	request.replies = append(request.replies, result)
+	if len(request.replies) == len(request.cmdLines) {
+		client.reading = nil
+		request.waiting.Done()
+	}
+}
+
+func (client *Client) failWaitingReqs(err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.drainWaitingReqs(err)
+}
+
+// drainWaitingReqs fails all sent requests, invoker should hold client.mu
+func (client *Client) drainWaitingReqs(err error) {
+	if client.reading != nil {
+		client.reading.err = err
+		client.reading.waiting.Done()
+		client.reading = nil
+	}
+	for {
+		select {
+		case request := <-client.waitingReqs:
+			request.err = err
+			request.waiting.Done()
+		default:
+			return
+		}
+	}
+}
+
+// reconnect dials addr with exponential backoff until success or client closed
+func (client *Client) reconnect() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// replies of requests sent through the old connection will never arrive
+	_ = client.conn.Close()
+	client.drainWaitingReqs(errConnectLost)
+
+	backoff := minBackoff
+	for {
+		logger.Info("reconnect with: " + client.addr)
+		conn, err := net.Dial("tcp", client.addr)
+		if err == nil {
+			client.conn = conn
+			return true
+		}
+		select {
+		case <-time.After(backoff):
+		case <-client.ctx.Done():
+			return false
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
 }
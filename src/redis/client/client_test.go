@@ -0,0 +1,118 @@
+package client_test
+
+import (
+	"context"
+	"myGodis/src/redis/client"
+	"myGodis/src/redis/reply"
+	"myGodis/src/redis/server"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer serves a redis handler on a random port
+func startServer(t *testing.T, addr string) (net.Listener, *server.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := server.MakeHandler()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler.Handle(context.Background(), conn)
+		}
+	}()
+	return listener, handler
+}
+
+func TestClient(t *testing.T) {
+	listener, _ := startServer(t, "127.0.0.1:0")
+	defer listener.Close()
+	c, err := client.MakeClient(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+
+	result := c.Send([][]byte{[]byte("PING")})
+	if status, ok := result.(*reply.StatusReply); !ok || status.Status != "PONG" {
+		t.Errorf("expected PONG, actual: %q", string(result.ToBytes()))
+	}
+
+	// concurrent requests are pipelined
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "k" + strconv.Itoa(i)
+			value := strconv.Itoa(i)
+			c.Send([][]byte{[]byte("SET"), []byte(key), []byte(value)})
+			result := c.Send([][]byte{[]byte("GET"), []byte(key)})
+			if bulk, ok := result.(*reply.BulkReply); !ok || string(bulk.Arg) != value {
+				t.Errorf("expected %s, actual: %q", value, string(result.ToBytes()))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Send([][]byte{[]byte("RPUSH"), []byte("list"), []byte("a"), []byte("b")})
+	result = c.Send([][]byte{[]byte("LRANGE"), []byte("list"), []byte("0"), []byte("-1")})
+	if multi, ok := result.(*reply.MultiBulkReply); !ok || len(multi.Args) != 2 || string(multi.Args[1]) != "b" {
+		t.Errorf("unexpected lrange reply: %q", string(result.ToBytes()))
+	}
+	result = c.Send([][]byte{[]byte("GET"), []byte("nosuchkey")})
+	if _, ok := result.(*reply.NullBulkReply); !ok {
+		t.Errorf("expected null bulk, actual: %q", string(result.ToBytes()))
+	}
+	result = c.Send([][]byte{[]byte("nosuchcommand")})
+	if _, ok := result.(reply.ErrorReply); !ok {
+		t.Errorf("expected error, actual: %q", string(result.ToBytes()))
+	}
+
+	// a transaction is sent at once
+	results := c.SendPipeline([][][]byte{
+		{[]byte("MULTI")},
+		{[]byte("SET"), []byte("tx"), []byte("1")},
+		{[]byte("INCR"), []byte("tx")},
+		{[]byte("EXEC")},
+	})
+	if len(results) != 4 || string(results[3].ToBytes()) != "*2\r\n+OK\r\n:2\r\n" {
+		t.Errorf("unexpected pipeline replies: %d", len(results))
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	listener, handler := startServer(t, "127.0.0.1:0")
+	addr := listener.Addr().String()
+	c, err := client.MakeClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+
+	// shutdown server then restart it on the same address
+	_ = listener.Close()
+	_ = handler.Close()
+	time.Sleep(100 * time.Millisecond)
+	listener, _ = startServer(t, addr)
+	defer listener.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		result := c.Send([][]byte{[]byte("PING")})
+		if status, ok := result.(*reply.StatusReply); ok && status.Status == "PONG" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("client did not reconnect")
+}
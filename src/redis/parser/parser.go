@@ -0,0 +1,394 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"math/big"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A streaming RESP2/RESP3 parser shared by server, aof loader and client.
+ * Requests and replies have the same format except that a request may be an inline command.
+ */
+
+// Payload stores a parsed reply or the error occurred while parsing
+type Payload struct {
+	Data redis.Reply
+	Err  error
+}
+
+const (
+	// same as proto-max-bulk-len and the multibulk limit of redis
+	maxBulkLen  = 512 * 1024 * 1024
+	maxArrayLen = 1024 * 1024
+
+	// preallocated capacity limit, larger bodies grow while being read
+	maxPrealloc = 64 * 1024
+)
+
+// ParseStream reads data from reader and sends payloads through the returned channel.
+// The channel is closed after any error is sent, including io.EOF and protocol errors,
+// since the rest of the stream can not be framed after a protocol error.
+// Consumers must drain the channel until it is closed, or close reader to stop the parser.
+func ParseStream(reader io.Reader) <-chan *Payload {
+	ch := make(chan *Payload)
+	go parse0(reader, ch)
+	return ch
+}
+
+// ParseOne parses the first payload in data
+func ParseOne(data []byte) (redis.Reply, error) {
+	ch := make(chan *Payload)
+	reader := bytes.NewReader(data)
+	go parse0(reader, ch)
+	payload := <-ch // parse0 will close the channel
+	go func() {
+		for range ch {
+		}
+	}()
+	if payload == nil {
+		return nil, io.EOF
+	}
+	return payload.Data, payload.Err
+}
+
+// ReadCommand reads a multi bulk of bulk strings in strict mode for aof and replication stream,
+// where inline commands, other types and lines not ending with \r\n are protocol errors.
+// It returns the command line and its size in bytes, io.EOF if reader ends before the command
+// or io.ErrUnexpectedEOF if the command is truncated
+func ReadCommand(reader *bufio.Reader) ([][]byte, int64, error) {
+	line, err := readStrictLine(reader, '*')
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(len(line)) + 2
+	count, err := parseLength(line, maxArrayLen)
+	if err != nil || count <= 0 {
+		return nil, 0, protocolError("illegal length " + strconv.Quote(string(line)))
+	}
+	args := make([][]byte, count)
+	for i := range args {
+		line, err := readStrictLine(reader, '$')
+		if err != nil {
+			return nil, 0, toUnexpectedEOF(err)
+		}
+		bulkLen, err := parseLength(line, maxBulkLen)
+		if err != nil || bulkLen < 0 {
+			return nil, 0, protocolError("illegal length " + strconv.Quote(string(line)))
+		}
+		args[i], err = readBody(reader, bulkLen)
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(line)) + 2 + bulkLen + 2
+	}
+	return args, size, nil
+}
+
+// readStrictLine reads a line ending with \r\n and starting with prefix, the returned line excludes \r\n
+func readStrictLine(reader *bufio.Reader, prefix byte) ([]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-1] != '\r' {
+		return nil, protocolError("line should end with \\r\\n")
+	}
+	if line[0] != prefix {
+		return nil, protocolError("expected " + strconv.Quote(string(prefix)) + ", actual " + strconv.Quote(string(line[0])))
+	}
+	return line[:len(line)-1], nil
+}
+
+func parse0(rawReader io.Reader, ch chan<- *Payload) {
+	defer close(ch)
+	reader := bufio.NewReader(rawReader)
+	for {
+		result, err := parseValue(reader, true)
+		if err != nil {
+			ch <- &Payload{Err: err}
+			return
+		}
+		if result == nil {
+			// empty inline command
+			continue
+		}
+		ch <- &Payload{Data: result}
+	}
+}
+
+func protocolError(msg string) error {
+	return &reply.ProtocolErrReply{Msg: msg}
+}
+
+// readLine reads a line ending with \n, the returned line excludes the line ending
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return line[:len(line)-1], nil
+}
+
+// parseValue reads one value, topLevel values may be inline commands
+func parseValue(reader *bufio.Reader, topLevel bool) (redis.Reply, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		if topLevel {
+			return parseInline(line), nil
+		}
+		return nil, protocolError("line should end with \\r\\n")
+	}
+	line = line[:len(line)-1]
+	if len(line) == 0 {
+		if topLevel {
+			return nil, nil
+		}
+		return nil, protocolError("empty line")
+	}
+	switch line[0] {
+	case '+':
+		return reply.MakeStatusReply(string(line[1:])), nil
+	case '-':
+		return reply.MakeErrReply(string(line[1:])), nil
+	case ':':
+		code, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, protocolError("illegal number " + string(line[1:]))
+		}
+		return reply.MakeIntReply(code), nil
+	case '$':
+		body, err := parseBulk(reader, line)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return &reply.NullBulkReply{}, nil
+		}
+		return reply.MakeBulkReply(body), nil
+	case '*':
+		return parseArray(reader, line)
+	case '_':
+		return &reply.NullReply{}, nil
+	case ',':
+		value, err := parseDouble(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return reply.MakeDoubleReply(value), nil
+	case '#':
+		if len(line) != 2 || (line[1] != 't' && line[1] != 'f') {
+			return nil, protocolError("illegal boolean " + string(line[1:]))
+		}
+		return reply.MakeBooleanReply(line[1] == 't'), nil
+	case '(':
+		if _, ok := new(big.Int).SetString(string(line[1:]), 10); !ok {
+			return nil, protocolError("illegal big number " + string(line[1:]))
+		}
+		return reply.MakeBigNumberReply(string(line[1:])), nil
+	case '!':
+		body, err := parseBulk(reader, line)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			return nil, protocolError("illegal blob error length")
+		}
+		return reply.MakeErrReply(string(body)), nil
+	case '=':
+		body, err := parseBulk(reader, line)
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < 4 || body[3] != ':' {
+			return nil, protocolError("illegal verbatim string")
+		}
+		return reply.MakeVerbatimReply(string(body[:3]), body[4:]), nil
+	case '%', '|':
+		size, err := parseLength(line, maxArrayLen)
+		if err != nil || size < 0 {
+			return nil, protocolError("illegal length " + strconv.Quote(string(line)))
+		}
+		elements, err := parseElements(reader, size*2)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '|' {
+			// attributes are auxiliary data of the following value, drop them
+			return parseValue(reader, false)
+		}
+		keys := make([]redis.Reply, size)
+		values := make([]redis.Reply, size)
+		for i := int64(0); i < size; i++ {
+			keys[i] = elements[2*i]
+			values[i] = elements[2*i+1]
+		}
+		return reply.MakeMapReply(keys, values), nil
+	case '~', '>':
+		size, err := parseLength(line, maxArrayLen)
+		if err != nil || size < 0 {
+			return nil, protocolError("illegal length " + strconv.Quote(string(line)))
+		}
+		elements, err := parseElements(reader, size)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '~' {
+			return reply.MakeSetReply(elements), nil
+		}
+		return reply.MakePushReply(elements), nil
+	default:
+		if topLevel {
+			return parseInline(line), nil
+		}
+		return nil, protocolError("illegal type " + strconv.Quote(string(line[0])))
+	}
+}
+
+// parseInline splits an inline command like `SET key value` into a multi bulk
+func parseInline(line []byte) redis.Reply {
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r"))
+	if len(fields) == 0 {
+		return nil
+	}
+	args := make([][]byte, len(fields))
+	for i, field := range fields {
+		args[i] = []byte(field)
+	}
+	return reply.MakeMultiBulkReply(args)
+}
+
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, protocolError("illegal double " + s)
+	}
+	return value, nil
+}
+
+func parseLength(line []byte, max int64) (int64, error) {
+	length, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || length < -1 || length > max {
+		return 0, protocolError("illegal length " + strconv.Quote(string(line)))
+	}
+	return length, nil
+}
+
+// parseBulk reads body of a bulk string whose header is line, returns nil body for $-1
+func parseBulk(reader *bufio.Reader, line []byte) ([]byte, error) {
+	bulkLen, err := parseLength(line, maxBulkLen)
+	if err != nil {
+		return nil, err
+	}
+	if bulkLen == -1 {
+		return nil, nil
+	}
+	body, err := readBody(reader, bulkLen)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// readBody reads size bytes and the following \r\n
+func readBody(reader *bufio.Reader, size int64) ([]byte, error) {
+	var body []byte
+	if size+2 <= maxPrealloc {
+		body = make([]byte, size+2)
+		_, err := io.ReadFull(reader, body)
+		if err != nil {
+			return nil, toUnexpectedEOF(err)
+		}
+	} else {
+		buf := bytes.NewBuffer(make([]byte, 0, maxPrealloc))
+		_, err := io.CopyN(buf, reader, size+2)
+		if err != nil {
+			return nil, toUnexpectedEOF(err)
+		}
+		body = buf.Bytes()
+	}
+	if body[size] != '\r' || body[size+1] != '\n' {
+		return nil, protocolError("bulk should end with \\r\\n")
+	}
+	return body[:size], nil
+}
+
+func toUnexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseArray reads elements of an array whose header is line.
+// An array of bulk strings is returned as MultiBulkReply, otherwise as MultiRawReply
+func parseArray(reader *bufio.Reader, line []byte) (redis.Reply, error) {
+	size, err := parseLength(line, maxArrayLen)
+	if err != nil {
+		return nil, err
+	}
+	if size == -1 {
+		return &reply.NullMultiBulkReply{}, nil
+	}
+	if size == 0 {
+		return &reply.EmptyMultiBulkReply{}, nil
+	}
+	elements, err := parseElements(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	allBulk := true
+	for _, element := range elements {
+		switch element.(type) {
+		case *reply.BulkReply, *reply.NullBulkReply:
+		default:
+			allBulk = false
+		}
+	}
+	if !allBulk {
+		return reply.MakeMultiRawReply(elements), nil
+	}
+	args := make([][]byte, size)
+	for i, element := range elements {
+		if bulk, ok := element.(*reply.BulkReply); ok {
+			args[i] = bulk.Arg
+		}
+	}
+	return reply.MakeMultiBulkReply(args), nil
+}
+
+func parseElements(reader *bufio.Reader, size int64) ([]redis.Reply, error) {
+	capacity := size
+	if capacity > maxPrealloc {
+		capacity = maxPrealloc
+	}
+	elements := make([]redis.Reply, 0, capacity)
+	for i := int64(0); i < size; i++ {
+		element, err := parseValue(reader, false)
+		if err != nil {
+			return nil, toUnexpectedEOF(err)
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
@@ -0,0 +1,199 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"myGodis/src/interface/redis"
+	"myGodis/src/redis/reply"
+	"testing"
+)
+
+func TestParseStream(t *testing.T) {
+	replies := []redis.Reply{
+		reply.MakeIntReply(1),
+		reply.MakeStatusReply("OK"),
+		reply.MakeErrReply("ERR unknown"),
+		reply.MakeBulkReply([]byte("a\r\nb")), // test binary safe
+		reply.MakeBulkReply([]byte{}),         // empty bulk
+		&reply.NullBulkReply{},
+		reply.MakeMultiBulkReply([][]byte{
+			[]byte("a"),
+			nil,
+			[]byte("\r\n"),
+			{},
+		}),
+		&reply.EmptyMultiBulkReply{},
+		&reply.NullMultiBulkReply{},
+		reply.MakeMultiRawReply([]redis.Reply{
+			reply.MakeIntReply(1),
+			reply.MakeMultiBulkReply([][]byte{[]byte("nested")}),
+		}),
+	}
+	reqs := bytes.Buffer{}
+	for _, re := range replies {
+		reqs.Write(re.ToBytes())
+	}
+	reqs.Write([]byte("set a a" + reply.CRLF)) // test text protocol
+	expected := make([]redis.Reply, len(replies))
+	copy(expected, replies)
+	expected = append(expected, reply.MakeMultiBulkReply([][]byte{
+		[]byte("set"), []byte("a"), []byte("a"),
+	}))
+
+	ch := ParseStream(bytes.NewReader(reqs.Bytes()))
+	i := 0
+	for payload := range ch {
+		if payload.Err != nil {
+			if payload.Err == io.EOF {
+				break
+			}
+			t.Error(payload.Err)
+			return
+		}
+		if payload.Data == nil {
+			t.Error("empty data")
+			return
+		}
+		exp := expected[i]
+		i++
+		if !bytes.Equal(exp.ToBytes(), payload.Data.ToBytes()) {
+			t.Errorf("parse failed, expected %q, actual %q", exp.ToBytes(), payload.Data.ToBytes())
+		}
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d payloads, actual %d", len(expected), i)
+	}
+}
+
+func TestParseRESP3(t *testing.T) {
+	replies := []reply.RESP3Reply{
+		&reply.NullReply{},
+		reply.MakeDoubleReply(1.5),
+		reply.MakeDoubleReply(math.Inf(-1)),
+		reply.MakeBooleanReply(true),
+		reply.MakeBigNumberReply("3492890328409238509324850943850943825024385"),
+		reply.MakeVerbatimReply("txt", []byte("Some string")),
+		reply.MakeMapReply(
+			[]redis.Reply{reply.MakeBulkReply([]byte("a"))},
+			[]redis.Reply{reply.MakeSetReply([]redis.Reply{reply.MakeIntReply(1)})},
+		),
+		reply.MakePushReply([]redis.Reply{
+			reply.MakeBulkReply([]byte("message")),
+			reply.MakeBulkReply([]byte("ch")),
+			reply.MakeBulkReply([]byte("msg")),
+		}),
+	}
+	for _, re := range replies {
+		result, err := ParseOne(re.ToRESP3Bytes())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(reply.ToProtocolBytes(result, reply.RESP3), re.ToRESP3Bytes()) {
+			t.Errorf("parse failed, expected %q, actual %q", re.ToRESP3Bytes(), reply.ToProtocolBytes(result, reply.RESP3))
+		}
+	}
+
+	// attributes are dropped
+	result, err := ParseOne([]byte("|1\r\n+key-popularity\r\n:1\r\n:2039\r\n"))
+	if err != nil || string(result.ToBytes()) != ":2039\r\n" {
+		t.Errorf("parse attribute failed: %v %v", result, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	// truncated payload
+	_, err := ParseOne([]byte("*2\r\n$3\r\nSET\r\n"))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected eof, actual %v", err)
+	}
+	// illegal bulk length
+	_, err = ParseOne([]byte("*1\r\n$-2\r\n"))
+	if _, ok := err.(*reply.ProtocolErrReply); !ok {
+		t.Errorf("expected protocol error, actual %v", err)
+	}
+	// missing \r\n after bulk body
+	_, err = ParseOne([]byte("$1\r\nab\r\n"))
+	if _, ok := err.(*reply.ProtocolErrReply); !ok {
+		t.Errorf("expected protocol error, actual %v", err)
+	}
+
+	// parser stops after protocol error
+	ch := ParseStream(bytes.NewReader([]byte("*1\r\n:x\r\n+OK\r\n")))
+	payload := <-ch
+	if _, ok := payload.Err.(*reply.ProtocolErrReply); !ok {
+		t.Errorf("expected protocol error, actual %v", payload.Err)
+	}
+	if payload, ok := <-ch; ok {
+		t.Errorf("expected closed channel, actual %v", payload)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	first := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n"
+	second := "*1\r\n$4\r\nPING\r\n"
+	reader := bufio.NewReader(bytes.NewReader([]byte(first + second)))
+	for _, expected := range []string{first, second} {
+		cmdLine, size, err := ReadCommand(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.MakeMultiBulkReply(cmdLine).ToBytes()) != expected || size != int64(len(expected)) {
+			t.Errorf("expected %q of size %d, actual %q of size %d", expected, len(expected), cmdLine, size)
+		}
+	}
+	if _, _, err := ReadCommand(reader); err != io.EOF {
+		t.Errorf("expected eof, actual %v", err)
+	}
+
+	for _, data := range []string{"*2\r\n$3\r\nSET\r\n", "*1\r\n$4\r\nPI", "*1\r"} {
+		if _, _, err := ReadCommand(bufio.NewReader(bytes.NewReader([]byte(data)))); err != io.ErrUnexpectedEOF {
+			t.Errorf("%q: expected unexpected eof, actual %v", data, err)
+		}
+	}
+	// inline commands, other types and bare \n are illegal in strict mode
+	for _, data := range []string{"PING\r\n", "+OK\r\n", "*1\r\n:1\r\n", "*1\n$4\nPING\n", "*0\r\n", "*1\r\n$-1\r\n"} {
+		if _, _, err := ReadCommand(bufio.NewReader(bytes.NewReader([]byte(data)))); err == nil || err == io.ErrUnexpectedEOF {
+			t.Errorf("%q: expected protocol error, actual %v", data, err)
+		}
+	}
+}
+
+func FuzzParseStream(f *testing.F) {
+	f.Add([]byte("*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n"))
+	f.Add([]byte("+OK\r\n-ERR x\r\n:1\r\n$-1\r\n*-1\r\n*0\r\n"))
+	f.Add([]byte("*2\r\n*1\r\n:1\r\n$1\r\na\r\n"))
+	f.Add([]byte("ping\n"))
+	f.Add([]byte("%1\r\n~1\r\n,1.5\r\n>1\r\n#t\r\n=7\r\ntxt:abc\r\n(12\r\n_\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// parser must not panic or hang on any input
+		for payload := range ParseStream(bytes.NewReader(data)) {
+			if payload.Err == nil && payload.Data == nil {
+				t.Error("payload without data or error")
+			}
+		}
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte("SET"), []byte("key"), []byte(""))
+	f.Add([]byte("a\r\nb"), []byte("\r\n"), []byte("$-1"))
+	f.Fuzz(func(t *testing.T, a []byte, b []byte, c []byte) {
+		req := reply.MakeMultiBulkReply([][]byte{a, b, c})
+		result, err := ParseOne(req.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		multiBulk, ok := result.(*reply.MultiBulkReply)
+		if !ok || len(multiBulk.Args) != 3 {
+			t.Fatalf("expected multi bulk, actual %q", result.ToBytes())
+		}
+		for i, arg := range [][]byte{a, b, c} {
+			if !bytes.Equal(arg, multiBulk.Args[i]) {
+				t.Errorf("expected %q, actual %q", arg, multiBulk.Args[i])
+			}
+		}
+	})
+}
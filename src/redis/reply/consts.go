@@ -32,6 +32,14 @@ func (r *EmptyMultiBulkReply) ToBytes() []byte {
 	return emptyMultiBulkBytes
 }
 
+var nullMultiBulkBytes = []byte("*-1\r\n")
+
+type NullMultiBulkReply struct{}
+
+func (r *NullMultiBulkReply) ToBytes() []byte {
+	return nullMultiBulkBytes
+}
+
 // reply nothing, for commands like subscribe
 type NoReply struct{}
 
@@ -1,10 +1,13 @@
 package reply
 
-import "strconv"
+import (
+	"bytes"
+	"myGodis/src/interface/redis"
+	"strconv"
+)
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
-	CRLF               = "\r\n"
+	CRLF = "\r\n"
 )
 
 /* ---- Bulk Reply ---- */
@@ -17,8 +20,8 @@ func MakeBulkReply(arg []byte) *BulkReply {
 }
 
 func (r *BulkReply) ToBytes() []byte {
-	if len(r.Arg) == 0 {
-		return nullBulkReplyBytes
+	if r.Arg == nil {
+		return nullBulkBytes
 	}
 	return []byte("$" + strconv.Itoa(len(r.Arg)) + CRLF + string(r.Arg) + CRLF)
 }
@@ -96,3 +99,25 @@ func (r *StandardErrReply) ToBytes() []byte {
 func (r *StandardErrReply) Error() string {
 	return r.Status
 }
+
+/* ---- Multi Raw Reply ---- */
+// MultiRawReply stores complex multi bulk reply, eg. nested arrays
+type MultiRawReply struct {
+	Replies []redis.Reply
+}
+
+func MakeMultiRawReply(replies []redis.Reply) *MultiRawReply {
+	return &MultiRawReply{
+		Replies: replies,
+	}
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+	argLen := len(r.Replies)
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
+	for _, arg := range r.Replies {
+		buf.Write(arg.ToBytes())
+	}
+	return buf.Bytes()
+}
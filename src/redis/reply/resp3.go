@@ -0,0 +1,260 @@
+package reply
+
+import (
+	"bytes"
+	"math"
+	"myGodis/src/interface/redis"
+	"strconv"
+)
+
+/*
+ * RESP3 replies. ToBytes always encodes RESP2 form so that they work on any connection,
+ * ToRESP3Bytes encodes RESP3 form for connections negotiated protocol 3 by HELLO.
+ */
+
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// RESP3Reply is a reply which has a different form in RESP3
+type RESP3Reply interface {
+	redis.Reply
+	ToRESP3Bytes() []byte
+}
+
+// ToProtocolBytes encodes r in the given protocol version
+func ToProtocolBytes(r redis.Reply, protocol int) []byte {
+	if protocol == RESP3 {
+		if r3, ok := r.(RESP3Reply); ok {
+			return r3.ToRESP3Bytes()
+		}
+	}
+	return r.ToBytes()
+}
+
+var nullBytes = []byte("_\r\n")
+
+func (r *NullBulkReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+func (r *NullMultiBulkReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+func (r *MultiBulkReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Args)) + CRLF)
+	for _, arg := range r.Args {
+		if arg == nil {
+			buf.Write(nullBytes)
+		} else {
+			buf.Write(MakeBulkReply(arg).ToBytes())
+		}
+	}
+	return buf.Bytes()
+}
+
+func (r *MultiRawReply) ToRESP3Bytes() []byte {
+	return aggregateToBytes('*', r.Replies, RESP3)
+}
+
+func aggregateToBytes(prefix byte, elements []redis.Reply, protocol int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(prefix)
+	buf.WriteString(strconv.Itoa(len(elements)) + CRLF)
+	for _, element := range elements {
+		buf.Write(ToProtocolBytes(element, protocol))
+	}
+	return buf.Bytes()
+}
+
+/* ---- Null Reply ---- */
+type NullReply struct{}
+
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+/* ---- Map Reply ---- */
+// MapReply is a list of key-value pairs, encoded as flat array in RESP2
+type MapReply struct {
+	Keys   []redis.Reply
+	Values []redis.Reply
+}
+
+func MakeMapReply(keys []redis.Reply, values []redis.Reply) *MapReply {
+	return &MapReply{
+		Keys:   keys,
+		Values: values,
+	}
+}
+
+func (r *MapReply) flatten() []redis.Reply {
+	elements := make([]redis.Reply, 0, len(r.Keys)*2)
+	for i, key := range r.Keys {
+		elements = append(elements, key, r.Values[i])
+	}
+	return elements
+}
+
+func (r *MapReply) ToBytes() []byte {
+	return aggregateToBytes('*', r.flatten(), RESP2)
+}
+
+func (r *MapReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%" + strconv.Itoa(len(r.Keys)) + CRLF)
+	for i, key := range r.Keys {
+		buf.Write(ToProtocolBytes(key, RESP3))
+		buf.Write(ToProtocolBytes(r.Values[i], RESP3))
+	}
+	return buf.Bytes()
+}
+
+/* ---- Set Reply ---- */
+// SetReply is an unordered collection of distinct elements, encoded as array in RESP2
+type SetReply struct {
+	Members []redis.Reply
+}
+
+func MakeSetReply(members []redis.Reply) *SetReply {
+	return &SetReply{Members: members}
+}
+
+// MakeBulkSetReply makes a set reply of bulk strings
+func MakeBulkSetReply(members [][]byte) *SetReply {
+	replies := make([]redis.Reply, len(members))
+	for i, member := range members {
+		replies[i] = MakeBulkReply(member)
+	}
+	return &SetReply{Members: replies}
+}
+
+func (r *SetReply) ToBytes() []byte {
+	return aggregateToBytes('*', r.Members, RESP2)
+}
+
+func (r *SetReply) ToRESP3Bytes() []byte {
+	return aggregateToBytes('~', r.Members, RESP3)
+}
+
+/* ---- Push Reply ---- */
+// PushReply is an out of band message such as pub/sub messages, encoded as array in RESP2
+type PushReply struct {
+	Elements []redis.Reply
+}
+
+func MakePushReply(elements []redis.Reply) *PushReply {
+	return &PushReply{Elements: elements}
+}
+
+func (r *PushReply) ToBytes() []byte {
+	return aggregateToBytes('*', r.Elements, RESP2)
+}
+
+func (r *PushReply) ToRESP3Bytes() []byte {
+	return aggregateToBytes('>', r.Elements, RESP3)
+}
+
+/* ---- Double Reply ---- */
+// DoubleReply is a floating point number, encoded as bulk string in RESP2
+type DoubleReply struct {
+	Value float64
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{Value: value}
+}
+
+func formatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func (r *DoubleReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(formatDouble(r.Value))).ToBytes()
+}
+
+func (r *DoubleReply) ToRESP3Bytes() []byte {
+	return []byte("," + formatDouble(r.Value) + CRLF)
+}
+
+/* ---- Boolean Reply ---- */
+// BooleanReply is encoded as integer 1 or 0 in RESP2
+type BooleanReply struct {
+	Value bool
+}
+
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{Value: value}
+}
+
+var (
+	trueBytes  = []byte("#t\r\n")
+	falseBytes = []byte("#f\r\n")
+)
+
+func (r *BooleanReply) ToBytes() []byte {
+	if r.Value {
+		return MakeIntReply(1).ToBytes()
+	}
+	return MakeIntReply(0).ToBytes()
+}
+
+func (r *BooleanReply) ToRESP3Bytes() []byte {
+	if r.Value {
+		return trueBytes
+	}
+	return falseBytes
+}
+
+/* ---- Big Number Reply ---- */
+// BigNumberReply is an integer out of int64 range, encoded as bulk string in RESP2
+type BigNumberReply struct {
+	Value string
+}
+
+func MakeBigNumberReply(value string) *BigNumberReply {
+	return &BigNumberReply{Value: value}
+}
+
+func (r *BigNumberReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.Value)).ToBytes()
+}
+
+func (r *BigNumberReply) ToRESP3Bytes() []byte {
+	return []byte("(" + r.Value + CRLF)
+}
+
+/* ---- Verbatim String Reply ---- */
+// VerbatimReply is a string with a 3 bytes format such as txt or mkd, encoded as bulk string in RESP2
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{Format: format, Text: text}
+}
+
+func (r *VerbatimReply) ToBytes() []byte {
+	return MakeBulkReply(r.Text).ToBytes()
+}
+
+func (r *VerbatimReply) ToRESP3Bytes() []byte {
+	body := r.Format + ":" + string(r.Text)
+	return []byte("=" + strconv.Itoa(len(body)) + CRLF + body + CRLF)
+}
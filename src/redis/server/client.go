@@ -1,8 +1,8 @@
 package server
 
 import (
-	"myGodis/src/lib/sync/atomic"
 	"myGodis/src/lib/sync/wait"
+	"myGodis/src/redis/reply"
 	"net"
 	"sync"
 	"time"
@@ -14,23 +14,28 @@ type Client struct {
 	//waiting until reply finished
 	waitingReply wait.Wait
 
-	// is sending request in progress
-	uploading atomic.AtomicBool
-	// must bulk msg lineCount - 1 (first line)
-	expectedArgsCount uint32
-	// sent line count, exclude first line
-	receivedCount uint32
-	// sent lines, exclude first line
-	args [][]byte
-
 	// lock while server sending response
 	mu sync.Mutex
 
 	// subscribing channels
 	subs map[string]bool
+
+	// RESP version, 2 by default
+	protocol int
+
+	// transaction
+	multiState bool
+	queue      [][][]byte
+	txErrors   []error
+	watching   map[string]uint32
+
+	// closed by Close or a read error, releases blocking commands
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func (c *Client) Close() error {
+	c.markClosed()
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
 	return nil
@@ -38,8 +43,30 @@ func (c *Client) Close() error {
 
 func MakeClient(conn net.Conn) *Client {
 	return &Client{
-		conn: conn,
+		conn:     conn,
+		protocol: reply.RESP2,
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *Client) markClosed() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+func (c *Client) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Read reads requests from the connection, a blocked command is released by a read error
+// since the handler can't receive the error until the command returns
+func (c *Client) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if err != nil {
+		c.markClosed()
 	}
+	return n, err
 }
 
 func (c *Client) Write(b []byte) error {
@@ -83,11 +110,57 @@ func (c *Client) GetChannels() []string {
 	if c.subs == nil {
 		return make([]string, 0)
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	channels := make([]string, 0, len(c.subs))
-	i := 0
 	for channel := range c.subs {
-		channels[i] = channel
-		i++
+		channels = append(channels, channel)
 	}
 	return channels
 }
+
+func (c *Client) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *Client) GetProtocol() int {
+	return c.protocol
+}
+
+func (c *Client) SetProtocol(protocol int) {
+	c.protocol = protocol
+}
+
+func (c *Client) InMultiState() bool {
+	return c.multiState
+}
+
+func (c *Client) SetMultiState(state bool) {
+	c.multiState = state
+	c.queue = nil
+	c.txErrors = nil
+}
+
+func (c *Client) GetQueuedCmdLine() [][][]byte {
+	return c.queue
+}
+
+func (c *Client) EnqueueCmd(cmdLine [][]byte) {
+	c.queue = append(c.queue, cmdLine)
+}
+
+func (c *Client) AddTxError(err error) {
+	c.txErrors = append(c.txErrors, err)
+}
+
+func (c *Client) GetTxErrors() []error {
+	return c.txErrors
+}
+
+func (c *Client) GetWatching() map[string]uint32 {
+	if c.watching == nil {
+		c.watching = make(map[string]uint32)
+	}
+	return c.watching
+}
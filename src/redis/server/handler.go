@@ -1,16 +1,17 @@
 package server
 
 import (
-	"bufio"
 	"context"
 	"io"
+	"myGodis/src/cluster"
+	"myGodis/src/config"
 	DBImpl "myGodis/src/db"
 	"myGodis/src/interface/db"
 	"myGodis/src/lib/logger"
 	"myGodis/src/lib/sync/atomic"
+	"myGodis/src/redis/parser"
 	"myGodis/src/redis/reply"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 )
@@ -23,6 +24,9 @@ var (
 	UnknownErrReplyBytes = []byte("-ERR unknown\r\n")
 )
 
+// maxPendingRequests limits requests read ahead while a command is executing, eg. a blocked BLPOP
+const maxPendingRequests = 64 * 1024
+
 type Handler struct {
 	activeConn sync.Map // *client -> placeholder
 	db         db.DB
@@ -30,8 +34,21 @@ type Handler struct {
 }
 
 func MakeHandler() *Handler {
+	var db db.DB
+	if config.Properties.Self != "" {
+		db = cluster.MakeCluster()
+	} else {
+		db = DBImpl.MakeDB()
+	}
 	return &Handler{
-		db: DBImpl.MakeDB(),
+		db: db,
+	}
+}
+
+// MakeHandlerWithDB serves db instead of a database, eg. sentinel
+func MakeHandlerWithDB(db db.DB) *Handler {
+	return &Handler{
+		db: db,
 	}
 }
 
@@ -45,128 +62,99 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	if h.closing.Get() {
 		// closing handler refuse new connection
 		_ = conn.Close()
+		return
 	}
 	client := MakeClient(conn)
 	h.activeConn.Store(client, 1)
 
-	reader := bufio.NewReader(conn)
-	var fixedLen int64 = 0
-	var err error
-	var msg []byte
-	for {
-		// may occurs: client EOF, client timeout, server early close
-		if fixedLen == 0 {
-			msg, err = reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF || err == io.ErrUnexpectedEOF ||
-					strings.Contains(err.Error(), "use of closed network connection") {
-					logger.Info("connection close")
-				} else {
-					logger.Warn(err)
-				}
+	done := make(chan struct{})
+	defer close(done)
+	ch := readAhead(client, parser.ParseStream(client), done)
+	for payload := range ch {
+		if payload.Err != nil {
+			// may occurs: client EOF, client timeout, server early close
+			if payload.Err == io.EOF ||
+				payload.Err == io.ErrUnexpectedEOF ||
+				strings.Contains(payload.Err.Error(), "use of closed network connection") {
+				logger.Info("connection close")
 				// after client close
 				h.closeClient(client)
 				return // io error, disconnect with client
 			}
-			if len(msg) == 0 || msg[len(msg)-2] != '\r' {
-				errReply := &reply.ProtocolErrReply{Msg: "invalid multibulk length"}
-				_, _ = client.conn.Write(errReply.ToBytes())
-			}
-		} else {
-			msg = make([]byte, fixedLen+2)
-			_, err = io.ReadFull(reader, msg)
-			if err != nil {
-				if err == io.EOF || err == io.ErrUnexpectedEOF ||
-					strings.Contains(err.Error(), "use of closed network connection") {
-					logger.Info("connection close")
-				} else {
-					logger.Warn(err)
-				}
-				// after client close
+			if _, ok := payload.Err.(*reply.ProtocolErrReply); !ok {
+				logger.Warn(payload.Err)
 				h.closeClient(client)
-				return // io error, disconnect with client
-			}
-			if len(msg) == 0 ||
-				msg[len(msg)-2] != '\r' ||
-				msg[len(msg)-1] != '\n' {
-				errReply := &reply.ProtocolErrReply{Msg: "invalid multibulk length"}
-				_, _ = client.conn.Write(errReply.ToBytes())
+				return
 			}
-
-			fixedLen = 0
+			// protocol error, the rest of the stream can not be framed
+			errReply := reply.MakeErrReply(payload.Err.Error())
+			_ = client.Write(errReply.ToBytes())
+			h.closeClient(client)
+			return
+		}
+		args, ok := payload.Data.(*reply.MultiBulkReply)
+		if !ok {
+			// eg. empty multi bulk
+			continue
 		}
 
-		if !client.uploading.Get() {
-			// new request
-			if msg[0] == '*' {
-				// bulk multi msg
-				expectedLine, err := strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
-				if err != nil {
-					_, _ = client.conn.Write(UnknownErrReplyBytes)
-					continue
-				}
-				client.waitingReply.Add(1)
-				client.uploading.Set(true)
-				client.expectedArgsCount = uint32(expectedLine)
-				client.receivedCount = 0
-				client.args = make([][]byte, expectedLine)
-			} else {
-				// TODO: text protocol
-				// remove \r or \n or \r\n in the end of line
-				str := strings.TrimSuffix(string(msg), "\n")
-				str = strings.TrimSuffix(str, "\r")
-				strs := strings.Split(str, " ")
-				args := make([][]byte, len(strs))
-				for i, s := range strs {
-					args[i] = []byte(s)
-				}
+		// send reply
+		client.waitingReply.Add(1)
+		result := h.db.Exec(client, args.Args)
+		if result != nil {
+			_ = client.Write(reply.ToProtocolBytes(result, client.GetProtocol()))
+		} else {
+			_ = client.Write(UnknownErrReplyBytes)
+		}
+		client.waitingReply.Done()
+	}
+	// closed by readAhead
+	h.closeClient(client)
+}
 
-				// send reply
-				result := h.db.Exec(client, args)
-				if result != nil {
-					_ = client.Write(result.ToBytes())
-				} else {
-					_ = client.Write(UnknownErrReplyBytes)
-				}
+// readAhead keeps reading requests of client while a command is executing, so that a blocked command
+// is released as soon as the connection is closed. The client is closed if too many requests are pending.
+// It stops after the parser exits or the handler is done
+func readAhead(client *Client, payloads <-chan *parser.Payload, done <-chan struct{}) <-chan *parser.Payload {
+	out := make(chan *parser.Payload)
+	go func() {
+		defer close(out)
+		defer func() {
+			if payloads == nil {
+				return
 			}
-		} else {
-			// receive following part of a request
-			line := msg[0 : len(msg)-2]
-			if line[0] == '$' {
-				fixedLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
-				if err != nil {
-					errReply := &reply.ProtocolErrReply{Msg: err.Error()}
-					_, _ = client.conn.Write(errReply.ToBytes())
-				}
-				if fixedLen <= 0 {
-					errReply := &reply.ProtocolErrReply{Msg: "invalid multibulk length"}
-					_, _ = client.conn.Write(errReply.ToBytes())
-				}
-			} else {
-				client.args[client.receivedCount] = line
-				client.receivedCount++
+			// wait parser exits
+			for range payloads {
 			}
-
-			// if sending finished
-			if client.receivedCount == client.expectedArgsCount {
-				client.uploading.Set(false) // finish sending progress
-
-				// send reply
-				result := h.db.Exec(client, client.args)
-				if result != nil {
-					_ = client.Write(result.ToBytes())
-				} else {
-					_ = client.Write(UnknownErrReplyBytes)
+		}()
+		var pending []*parser.Payload
+		for payloads != nil || len(pending) > 0 {
+			var send chan<- *parser.Payload
+			var next *parser.Payload
+			if len(pending) > 0 {
+				send, next = out, pending[0]
+			}
+			select {
+			case payload, ok := <-payloads:
+				if !ok {
+					payloads = nil
+					continue
 				}
-
-				// finish reply
-				client.expectedArgsCount = 0
-				client.receivedCount = 0
-				client.args = nil
-				client.waitingReply.Done()
+				if len(pending) >= maxPendingRequests {
+					logger.Warn("too many pending requests, close client " + client.conn.RemoteAddr().String())
+					_ = client.conn.Close()
+					return
+				}
+				pending = append(pending, payload)
+			case send <- next:
+				pending[0] = nil
+				pending = pending[1:]
+			case <-done:
+				return
 			}
 		}
-	}
+	}()
+	return out
 }
 
 func (h *Handler) Close() error {
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"myGodis/src/redis/reply"
+	"net"
+	"testing"
+	"time"
+)
+
+func toCmdLine(cmd ...string) []byte {
+	args := make([][]byte, len(cmd))
+	for i, s := range cmd {
+		args[i] = []byte(s)
+	}
+	return reply.MakeMultiBulkReply(args).ToBytes()
+}
+
+// expectReply reads len(expected) bytes from reader and compares with expected
+func expectReply(t *testing.T, conn net.Conn, reader *bufio.Reader, expected string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != expected {
+		t.Errorf("expected %q, actual %q", expected, string(buf))
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	handler := MakeHandler()
+	server, conn := net.Pipe()
+	go handler.Handle(context.Background(), server)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(cmd ...string) {
+		_, err := conn.Write(toCmdLine(cmd...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("HSET", "h", "f", "v")
+	expectReply(t, conn, reader, ":1\r\n")
+	send("HGETALL", "h")
+	expectReply(t, conn, reader, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n")
+
+	send("HELLO", "4")
+	expectReply(t, conn, reader, "-NOPROTO sorry, this protocol version is not supported\r\n")
+	send("HELLO", "3")
+	expectReply(t, conn, reader, "%6\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n$5\r\n6.0.0\r\n"+
+		"$5\r\nproto\r\n:3\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n")
+
+	send("HGETALL", "h")
+	expectReply(t, conn, reader, "%1\r\n$1\r\nf\r\n$1\r\nv\r\n")
+	send("SADD", "s", "a")
+	expectReply(t, conn, reader, ":1\r\n")
+	send("SMEMBERS", "s")
+	expectReply(t, conn, reader, "~1\r\n$1\r\na\r\n")
+	send("ZADD", "z", "1.5", "a")
+	expectReply(t, conn, reader, ":1\r\n")
+	send("ZSCORE", "z", "a")
+	expectReply(t, conn, reader, ",1.5\r\n")
+	send("GET", "nosuchkey")
+	expectReply(t, conn, reader, "_\r\n")
+
+	// commands and subscriptions share one connection
+	send("SUBSCRIBE", "ch")
+	expectReply(t, conn, reader, ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n")
+	send("PUBLISH", "ch", "msg")
+	expectReply(t, conn, reader, ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$3\r\nmsg\r\n")
+	expectReply(t, conn, reader, ":1\r\n")
+	send("GET", "nosuchkey")
+	expectReply(t, conn, reader, "_\r\n")
+}
+
+func TestProtocolError(t *testing.T) {
+	handler := MakeHandler()
+	server, conn := net.Pipe()
+	go handler.Handle(context.Background(), server)
+	defer conn.Close()
+	go func() {
+		// PING after the broken frame must not be executed
+		_, _ = conn.Write([]byte("*2\r\n$3\r\nGET\r\n:x\r\n*1\r\n$4\r\nPING\r\n"))
+	}()
+	reader := bufio.NewReader(conn)
+	expectReply(t, conn, reader, "-ERR Protocol error: ")
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("expected connection closed, actual %q %v", line, err)
+	}
+}
+
+func TestCloseBlockedClient(t *testing.T) {
+	handler := MakeHandler()
+	server, conn := net.Pipe()
+	go handler.Handle(context.Background(), server)
+	// the pipelined PING waits for BLPOP, closing is still noticed
+	if _, err := conn.Write(append(toCmdLine("BLPOP", "blocked", "0"), toCmdLine("PING")...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// the client is removed after its command is released
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		active := 0
+		handler.activeConn.Range(func(key, value any) bool {
+			active++
+			return true
+		})
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blocked client is not released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	handler.db.Exec(nil, [][]byte{[]byte("RPUSH"), []byte("blocked"), []byte("v")})
+	if result := string(handler.db.Exec(nil, [][]byte{[]byte("LPOP"), []byte("blocked")}).ToBytes()); result != "$1\r\nv\r\n" {
+		t.Errorf("element is taken by the closed client: %q", result)
+	}
+}
@@ -0,0 +1,267 @@
+package sentinel
+
+import (
+	"fmt"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/reply"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exec executes commands of sentinel
+func (s *Sentinel) Exec(c redis.Client, args [][]byte) (result redis.Reply) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("error occurs: %v\n%s", err, string(debug.Stack())))
+			result = &reply.UnknownErrReply{}
+		}
+	}()
+
+	cmd := strings.ToLower(string(args[0]))
+	switch cmd {
+	case "ping":
+		return &reply.PongReply{}
+	case "sentinel":
+		if len(args) < 2 {
+			return &reply.ArgNumErrReply{Cmd: cmd}
+		}
+		return s.execSentinel(args[1:])
+	case "role":
+		return s.role()
+	case "info":
+		return s.info()
+	}
+	return reply.MakeErrReply("ERR unknown command '" + cmd + "'")
+}
+
+func (s *Sentinel) execSentinel(args [][]byte) redis.Reply {
+	sub := strings.ToLower(string(args[0]))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch sub {
+	case "myid":
+		return reply.MakeBulkReply([]byte(s.myid))
+	case "masters":
+		var masters []redis.Reply
+		for _, m := range s.sortedMasters() {
+			masters = append(masters, reply.MakeMultiBulkReply(toBytes(s.masterFields(m))))
+		}
+		return reply.MakeMultiRawReply(masters)
+	case "is-master-down-by-addr":
+		if len(args) != 5 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel|is-master-down-by-addr' command")
+		}
+		return s.isMasterDownByAddr(args[1:])
+	}
+
+	// subcommands of a master
+	if len(args) != 2 {
+		return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel|" + sub + "' command")
+	}
+	m := s.masters[string(args[1])]
+	if m == nil {
+		if sub == "get-master-addr-by-name" {
+			return &reply.NullMultiBulkReply{}
+		}
+		return reply.MakeErrReply("ERR No such master with that name")
+	}
+	switch sub {
+	case "get-master-addr-by-name":
+		return reply.MakeMultiBulkReply(toBytes([]string{m.inst.host, strconv.Itoa(m.inst.port)}))
+	case "master":
+		return reply.MakeMultiBulkReply(toBytes(s.masterFields(m)))
+	case "replicas", "slaves":
+		var replicas []redis.Reply
+		for _, inst := range sortedInstances(m.replicas) {
+			replicas = append(replicas, reply.MakeMultiBulkReply(toBytes(replicaFields(inst))))
+		}
+		return reply.MakeMultiRawReply(replicas)
+	case "sentinels":
+		var sentinels []redis.Reply
+		for _, inst := range sortedInstances(m.sentinels) {
+			sentinels = append(sentinels, reply.MakeMultiBulkReply(toBytes(sentinelFields(inst))))
+		}
+		return reply.MakeMultiRawReply(sentinels)
+	case "failover":
+		if m.failoverState != failoverNone {
+			return reply.MakeErrReply("INPROG Failover already in progress")
+		}
+		if s.selectReplica(m) == nil {
+			return reply.MakeErrReply("NOGOODSLAVE No suitable replica to promote")
+		}
+		s.startFailover(m, time.Now())
+		m.forced = true
+		return &reply.OkReply{}
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + sub + "'. Try SENTINEL HELP.")
+}
+
+// isMasterDownByAddr replies <down_state> <leader_runid> <leader_epoch>,
+// it votes for runid unless runid is *. invoker should hold s.mu
+func (s *Sentinel) isMasterDownByAddr(args [][]byte) redis.Reply {
+	port, ok := parsePort(string(args[1]))
+	epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if !ok || err != nil {
+		return reply.MakeErrReply("ERR invalid port or epoch")
+	}
+	addr := net.JoinHostPort(string(args[0]), strconv.Itoa(port))
+	runid := string(args[3])
+
+	down := int64(0)
+	leader, leaderEpoch := "*", int64(0)
+	for _, m := range s.masters {
+		if m.inst.addr() != addr {
+			continue
+		}
+		if m.inst.sdown {
+			down = 1
+		}
+		if runid != "*" {
+			leader, leaderEpoch = s.voteLeader(m, epoch, runid)
+			if leader == "" {
+				leader = "*"
+			}
+		}
+		break
+	}
+	return reply.MakeMultiRawReply([]redis.Reply{
+		reply.MakeIntReply(down),
+		reply.MakeBulkReply([]byte(leader)),
+		reply.MakeIntReply(leaderEpoch),
+	})
+}
+
+func (s *Sentinel) masterFields(m *monitoredMaster) []string {
+	flags := "master"
+	if m.inst.sdown {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != failoverNone {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name,
+		"ip", m.inst.host,
+		"port", strconv.Itoa(m.inst.port),
+		"flags", flags,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.FormatInt(m.configEpoch, 10),
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"failover-state", failoverStateNames[m.failoverState],
+	}
+}
+
+func replicaFields(inst *instance) []string {
+	flags := "slave"
+	if inst.sdown {
+		flags += ",s_down"
+	}
+	linkStatus := "err"
+	if inst.linkUp {
+		linkStatus = "ok"
+	}
+	return []string{
+		"name", inst.addr(),
+		"ip", inst.host,
+		"port", strconv.Itoa(inst.port),
+		"flags", flags,
+		"role-reported", inst.role,
+		"master-host", inst.masterHost,
+		"master-port", strconv.Itoa(inst.masterPort),
+		"master-link-status", linkStatus,
+		"slave-repl-offset", strconv.FormatInt(inst.offset, 10),
+	}
+}
+
+func sentinelFields(inst *instance) []string {
+	flags := "sentinel"
+	if inst.sdown {
+		flags += ",s_down"
+	}
+	return []string{
+		"name", inst.runid,
+		"ip", inst.host,
+		"port", strconv.Itoa(inst.port),
+		"runid", inst.runid,
+		"flags", flags,
+		"last-hello-message", strconv.FormatInt(time.Since(inst.lastHello).Milliseconds(), 10),
+		"leader", inst.leader,
+		"leader-epoch", strconv.FormatInt(inst.leaderEpoch, 10),
+	}
+}
+
+func toBytes(fields []string) [][]byte {
+	result := make([][]byte, len(fields))
+	for i, field := range fields {
+		result[i] = []byte(field)
+	}
+	return result
+}
+
+func (s *Sentinel) sortedMasters() []*monitoredMaster {
+	masters := make([]*monitoredMaster, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].name < masters[j].name
+	})
+	return masters
+}
+
+func sortedInstances(instances map[string]*instance) []*instance {
+	result := make([]*instance, 0, len(instances))
+	for _, inst := range instances {
+		result = append(result, inst)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].addr() < result[j].addr()
+	})
+	return result
+}
+
+// role replies sentinel and names of masters, ROLE
+func (s *Sentinel) role() redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names [][]byte
+	for _, m := range s.sortedMasters() {
+		names = append(names, []byte(m.name))
+	}
+	return reply.MakeMultiRawReply([]redis.Reply{
+		reply.MakeBulkReply([]byte("sentinel")),
+		reply.MakeMultiBulkReply(names),
+	})
+}
+
+func (s *Sentinel) info() redis.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var builder strings.Builder
+	builder.WriteString("# Sentinel\r\n")
+	builder.WriteString("sentinel_masters:" + strconv.Itoa(len(s.masters)) + "\r\n")
+	builder.WriteString("sentinel_current_epoch:" + strconv.FormatInt(s.currentEpoch, 10) + "\r\n")
+	for i, m := range s.sortedMasters() {
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.inst.sdown {
+			status = "sdown"
+		}
+		builder.WriteString("master" + strconv.Itoa(i) + ":name=" + m.name + ",status=" + status +
+			",address=" + m.inst.addr() + ",slaves=" + strconv.Itoa(len(m.replicas)) +
+			",sentinels=" + strconv.Itoa(len(m.sentinels)+1) + "\r\n")
+	}
+	return reply.MakeVerbatimReply("txt", []byte(builder.String()))
+}
@@ -0,0 +1,163 @@
+package sentinel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Sentinel reads lines starting with "sentinel" from its config file, other lines like port are read by config package.
+ *   sentinel monitor <name> <ip> <port> <quorum>
+ *   sentinel down-after-milliseconds <name> <ms>
+ *   sentinel failover-timeout <name> <ms>
+ *   sentinel known-replica <name> <ip> <port>
+ *   sentinel known-sentinel <name> <ip> <port> <runid>
+ *   sentinel myid <runid>
+ *   sentinel announce-ip <ip>
+ *   sentinel announce-port <port>
+ */
+
+const (
+	defaultDownAfter       = 30 * time.Second
+	defaultFailoverTimeout = 3 * time.Minute
+)
+
+type masterConfig struct {
+	name            string
+	host            string
+	port            int
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	knownReplicas   []string // host:port
+	knownSentinels  []knownSentinel
+}
+
+type knownSentinel struct {
+	host  string
+	port  int
+	runid string
+}
+
+type sentinelConfig struct {
+	myid         string
+	announceIP   string
+	announcePort int
+	masters      []*masterConfig
+}
+
+func (cfg *sentinelConfig) getMaster(name string) *masterConfig {
+	for _, m := range cfg.masters {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func parsePort(s string) (int, bool) {
+	port, err := strconv.Atoi(s)
+	return port, err == nil && port > 0 && port <= 65535
+}
+
+func parseConfig(reader io.Reader) (*sentinelConfig, error) {
+	cfg := &sentinelConfig{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.EqualFold(fields[0], "sentinel") {
+			continue
+		}
+		invalid := errors.New("invalid sentinel config line: " + line)
+		option := strings.ToLower(fields[1])
+		switch option {
+		case "myid":
+			cfg.myid = fields[2]
+			continue
+		case "announce-ip":
+			cfg.announceIP = fields[2]
+			continue
+		case "announce-port":
+			port, ok := parsePort(fields[2])
+			if !ok {
+				return nil, invalid
+			}
+			cfg.announcePort = port
+			continue
+		case "monitor":
+			if len(fields) != 6 {
+				return nil, invalid
+			}
+			port, ok := parsePort(fields[4])
+			quorum, err := strconv.Atoi(fields[5])
+			if !ok || err != nil || quorum <= 0 {
+				return nil, invalid
+			}
+			if cfg.getMaster(fields[2]) != nil {
+				return nil, errors.New("duplicated master name: " + fields[2])
+			}
+			cfg.masters = append(cfg.masters, &masterConfig{
+				name:            fields[2],
+				host:            fields[3],
+				port:            port,
+				quorum:          quorum,
+				downAfter:       defaultDownAfter,
+				failoverTimeout: defaultFailoverTimeout,
+			})
+			continue
+		}
+
+		// options of a monitored master
+		m := cfg.getMaster(fields[2])
+		if m == nil {
+			return nil, errors.New("no such master with specified name: " + line)
+		}
+		switch option {
+		case "down-after-milliseconds", "failover-timeout":
+			if len(fields) != 4 {
+				return nil, invalid
+			}
+			ms, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil || ms <= 0 {
+				return nil, invalid
+			}
+			if option == "down-after-milliseconds" {
+				m.downAfter = time.Duration(ms) * time.Millisecond
+			} else {
+				m.failoverTimeout = time.Duration(ms) * time.Millisecond
+			}
+		case "known-replica", "known-slave":
+			if len(fields) != 5 {
+				return nil, invalid
+			}
+			if _, ok := parsePort(fields[4]); !ok {
+				return nil, invalid
+			}
+			m.knownReplicas = append(m.knownReplicas, net.JoinHostPort(fields[3], fields[4]))
+		case "known-sentinel":
+			if len(fields) != 6 {
+				return nil, invalid
+			}
+			port, ok := parsePort(fields[4])
+			if !ok {
+				return nil, invalid
+			}
+			m.knownSentinels = append(m.knownSentinels, knownSentinel{host: fields[3], port: port, runid: fields[5]})
+		default:
+			return nil, errors.New("unknown sentinel option: " + line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.masters) == 0 {
+		return nil, errors.New("no master is monitored, add sentinel monitor <name> <ip> <port> <quorum>")
+	}
+	return cfg, nil
+}
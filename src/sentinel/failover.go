@@ -0,0 +1,258 @@
+package sentinel
+
+import (
+	"math/rand"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/reply"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// checkMaster updates SDOWN and ODOWN of m and drives its failover. invoker should hold s.mu
+func (s *Sentinel) checkMaster(m *monitoredMaster) {
+	now := time.Now()
+	s.checkSdown(m, m.inst, now)
+	for _, inst := range m.replicas {
+		s.checkSdown(m, inst, now)
+	}
+	for _, inst := range m.sentinels {
+		s.checkSdown(m, inst, now)
+	}
+
+	if !m.inst.sdown {
+		if m.odown {
+			logger.Info("-odown master " + m.name + " " + m.inst.addr())
+		}
+		m.odown = false
+		for _, inst := range m.sentinels {
+			inst.masterDown = false
+		}
+	} else {
+		if now.Sub(m.lastAsk) >= askPeriod {
+			m.lastAsk = now
+			s.askSentinels(m)
+		}
+		agreed := 1
+		for _, inst := range m.sentinels {
+			if inst.masterDown && now.Sub(inst.askTime) < 5*askPeriod {
+				agreed++
+			}
+		}
+		odown := agreed >= m.quorum
+		if odown && !m.odown {
+			logger.Info("+odown master " + m.name + " " + m.inst.addr() + " #quorum " +
+				strconv.Itoa(agreed) + "/" + strconv.Itoa(m.quorum))
+			desync := now.Add(time.Duration(rand.Int63n(int64(maxDesync))))
+			if desync.After(m.nextFailover) {
+				m.nextFailover = desync
+			}
+		} else if !odown && m.odown {
+			logger.Info("-odown master " + m.name + " " + m.inst.addr())
+		}
+		m.odown = odown
+	}
+	s.failoverStep(m, now)
+}
+
+// checkSdown marks inst as SDOWN if it doesn't reply PING in down-after-milliseconds. invoker should hold s.mu
+func (s *Sentinel) checkSdown(m *monitoredMaster, inst *instance, now time.Time) {
+	sdown := now.Sub(inst.lastOK) > m.downAfter
+	if sdown != inst.sdown {
+		if sdown {
+			logger.Info("+sdown " + inst.addr() + " of " + m.name)
+		} else {
+			logger.Info("-sdown " + inst.addr() + " of " + m.name)
+		}
+	}
+	inst.sdown = sdown
+}
+
+// askSentinels asks other sentinels whether master is down, and for their votes while electing. invoker should hold s.mu
+func (s *Sentinel) askSentinels(m *monitoredMaster) {
+	runid := "*"
+	if m.failoverState == failoverWaitStart {
+		runid = s.myid
+	}
+	args := []string{
+		"SENTINEL", "is-master-down-by-addr", m.inst.host, strconv.Itoa(m.inst.port),
+		strconv.FormatInt(s.currentEpoch, 10), runid,
+	}
+	for _, inst := range m.sentinels {
+		inst := inst
+		go func() {
+			result, ok := s.send(inst, args...).(*reply.MultiRawReply)
+			if !ok || len(result.Replies) != 3 {
+				return
+			}
+			down, ok1 := result.Replies[0].(*reply.IntReply)
+			leader, ok2 := result.Replies[1].(*reply.BulkReply)
+			leaderEpoch, ok3 := result.Replies[2].(*reply.IntReply)
+			if !ok1 || !ok2 || !ok3 {
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			inst.masterDown = down.Code == 1
+			inst.askTime = time.Now()
+			if string(leader.Arg) != "*" {
+				inst.leader = string(leader.Arg)
+				inst.leaderEpoch = leaderEpoch.Code
+			}
+		}()
+	}
+}
+
+// voteLeader votes for runid as the leader of epoch if this sentinel hasn't voted in it,
+// returns the leader voted and its epoch. invoker should hold s.mu
+func (s *Sentinel) voteLeader(m *monitoredMaster, epoch int64, runid string) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = runid
+		m.leaderEpoch = s.currentEpoch
+		logger.Info("+vote-for-leader " + runid + " " + strconv.FormatInt(epoch, 10))
+		if runid != s.myid {
+			// give the leader time to finish the failover
+			m.nextFailover = time.Now().Add(2 * m.failoverTimeout)
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// electedLeader returns the runid voted by majority of sentinels and at least quorum, or empty string
+// invoker should hold s.mu
+func (s *Sentinel) electedLeader(m *monitoredMaster) string {
+	votes := make(map[string]int)
+	if m.leaderEpoch == m.failoverEpoch && m.leader != "" {
+		votes[m.leader]++
+	}
+	for _, inst := range m.sentinels {
+		if inst.leaderEpoch == m.failoverEpoch && inst.leader != "" {
+			votes[inst.leader]++
+		}
+	}
+	var winner string
+	for runid, count := range votes {
+		if count > votes[winner] {
+			winner = runid
+		}
+	}
+	needed := (len(m.sentinels)+1)/2 + 1
+	if m.quorum > needed {
+		needed = m.quorum
+	}
+	if winner == "" || votes[winner] < needed {
+		return ""
+	}
+	return winner
+}
+
+// startFailover starts election in a new epoch. invoker should hold s.mu
+func (s *Sentinel) startFailover(m *monitoredMaster, now time.Time) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverState = failoverWaitStart
+	m.failoverStart = now
+	m.nextFailover = now.Add(2 * m.failoverTimeout)
+	logger.Info("+try-failover master " + m.name + " " + m.inst.addr() + " epoch " + strconv.FormatInt(s.currentEpoch, 10))
+	s.voteLeader(m, s.currentEpoch, s.myid)
+	// ask for votes at once
+	m.lastAsk = time.Time{}
+}
+
+// failoverStep moves failover of m to next state if possible. invoker should hold s.mu
+func (s *Sentinel) failoverStep(m *monitoredMaster, now time.Time) {
+	switch m.failoverState {
+	case failoverNone:
+		if m.odown && !now.Before(m.nextFailover) {
+			s.startFailover(m, now)
+		}
+	case failoverWaitStart:
+		if m.forced || s.electedLeader(m) == s.myid {
+			logger.Info("+elected-leader master " + m.name + " epoch " + strconv.FormatInt(m.failoverEpoch, 10))
+			m.failoverState = failoverSelectReplica
+			s.failoverStep(m, now)
+			return
+		}
+		election := m.failoverTimeout
+		if election > maxElection {
+			election = maxElection
+		}
+		if now.Sub(m.failoverStart) > election {
+			s.abortFailover(m, "not elected")
+		}
+	case failoverSelectReplica:
+		promoted := s.selectReplica(m)
+		if promoted == nil {
+			s.abortFailover(m, "no good slave")
+			return
+		}
+		logger.Info("+selected-slave " + promoted.addr() + " of " + m.name)
+		m.promoted = promoted
+		m.failoverState = failoverWaitPromotion
+		go s.send(promoted, "REPLICAOF", "NO", "ONE")
+	case failoverWaitPromotion:
+		promoted := m.promoted
+		if promoted.role == "master" && promoted.roleTime.After(m.failoverStart) {
+			s.finishFailover(m)
+			return
+		}
+		if now.Sub(m.failoverStart) > m.failoverTimeout {
+			s.abortFailover(m, "timeout")
+		}
+	}
+}
+
+// selectReplica returns the replica with the greatest offset among working ones. invoker should hold s.mu
+func (s *Sentinel) selectReplica(m *monitoredMaster) *instance {
+	var candidates []*instance
+	for _, inst := range m.replicas {
+		if inst.sdown || inst.role != "slave" || time.Since(inst.infoTime) > 5*infoPeriod {
+			continue
+		}
+		candidates = append(candidates, inst)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].offset != candidates[j].offset {
+			return candidates[i].offset > candidates[j].offset
+		}
+		return candidates[i].addr() < candidates[j].addr()
+	})
+	return candidates[0]
+}
+
+// finishFailover switches to the promoted replica with the new config epoch, and repoints other replicas.
+// Other sentinels get the new config by hello messages. invoker should hold s.mu
+func (s *Sentinel) finishFailover(m *monitoredMaster) {
+	promoted := m.promoted
+	logger.Info("+promoted-slave " + promoted.addr() + " of " + m.name)
+	m.configEpoch = m.failoverEpoch
+	s.switchMaster(m, promoted.host, promoted.port)
+	host, port := promoted.host, strconv.Itoa(promoted.port)
+	for _, inst := range m.replicas {
+		inst := inst
+		inst.reconfTime = time.Now()
+		go s.send(inst, "REPLICAOF", host, port)
+	}
+}
+
+func (s *Sentinel) abortFailover(m *monitoredMaster, reason string) {
+	logger.Info("-failover-abort-" + reason + " master " + m.name)
+	s.resetFailover(m)
+}
+
+// resetFailover clears states of failover. invoker should hold s.mu
+func (s *Sentinel) resetFailover(m *monitoredMaster) {
+	m.failoverState = failoverNone
+	m.forced = false
+	m.promoted = nil
+	m.odown = false
+	for _, inst := range m.sentinels {
+		inst.masterDown = false
+	}
+}
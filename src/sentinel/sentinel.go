@@ -0,0 +1,581 @@
+package sentinel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"myGodis/src/config"
+	"myGodis/src/interface/redis"
+	"myGodis/src/lib/logger"
+	"myGodis/src/redis/client"
+	"myGodis/src/redis/parser"
+	"myGodis/src/redis/reply"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Sentinel monitors masters and their replicas, and promotes a replica if a master is down.
+ * Every instance has a goroutine sending PING, INFO and hello messages, cron of sentinel checks states of masters:
+ *   SDOWN: master doesn't reply PING in down-after-milliseconds
+ *   ODOWN: at least quorum sentinels agree on SDOWN by SENTINEL is-master-down-by-addr
+ * Then sentinels vote a leader in a new epoch, the leader promotes the best replica and repoints other replicas.
+ * Sentinels discover each other and new configs by hello messages published on __sentinel__:hello of instances.
+ */
+
+var (
+	pingPeriod  = time.Second
+	infoPeriod  = 10 * time.Second
+	helloPeriod = 2 * time.Second
+	askPeriod   = time.Second
+	cronPeriod  = 100 * time.Millisecond
+	// sentinels start failover after a random delay up to maxDesync, so they are unlikely to split votes
+	maxDesync = time.Second
+	// election fails if no leader is elected in min(failover-timeout, maxElection)
+	maxElection = 10 * time.Second
+)
+
+const helloChannel = "__sentinel__:hello"
+
+const (
+	kindMaster = iota
+	kindReplica
+	kindSentinel
+)
+
+// instance is a master, replica or other sentinel being monitored
+type instance struct {
+	kind  int
+	host  string
+	port  int
+	runid string // of sentinels
+
+	client *client.Client
+	closed chan struct{}
+
+	lastOK time.Time // last valid reply to PING
+	sdown  bool
+
+	// reported by INFO
+	infoTime   time.Time
+	role       string
+	roleTime   time.Time // when role was changed
+	masterHost string
+	masterPort int
+	linkUp     bool
+	offset     int64
+	reconfTime time.Time // last REPLICAOF sent to fix its role
+
+	// subscription of hello channel, for masters and replicas
+	hello   net.Conn
+	helloIP string // local ip of hello connection, announced if announce-ip is not set
+
+	// for sentinels
+	lastHello   time.Time
+	masterDown  bool // reply of is-master-down-by-addr
+	askTime     time.Time
+	leader      string
+	leaderEpoch int64
+}
+
+func (inst *instance) addr() string {
+	return net.JoinHostPort(inst.host, strconv.Itoa(inst.port))
+}
+
+func (inst *instance) isClosed() bool {
+	select {
+	case <-inst.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// states of failover
+const (
+	failoverNone = iota
+	failoverWaitStart
+	failoverSelectReplica
+	failoverWaitPromotion
+)
+
+var failoverStateNames = []string{"none", "wait_start", "select_slave", "wait_promotion"}
+
+type monitoredMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	configEpoch     int64
+
+	inst      *instance
+	replicas  map[string]*instance // addr -> replica
+	sentinels map[string]*instance // runid -> sentinel
+	odown     bool
+	lastAsk   time.Time
+
+	// vote of this sentinel
+	leader      string
+	leaderEpoch int64
+
+	failoverState int
+	failoverEpoch int64
+	failoverStart time.Time
+	nextFailover  time.Time // failover won't start before it
+	forced        bool      // by SENTINEL FAILOVER, no agreement needed
+	promoted      *instance
+}
+
+// Sentinel implements db.DB, it is served as a redis server with sentinel commands
+type Sentinel struct {
+	mu           sync.Mutex
+	myid         string
+	currentEpoch int64
+	masters      map[string]*monitoredMaster
+	announceIP   string
+	announcePort int
+	closeCh      chan struct{}
+}
+
+// MakeSentinel starts monitoring masters in configFile
+func MakeSentinel(configFile string) (*Sentinel, error) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	cfg, err := parseConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	return makeSentinel(cfg), nil
+}
+
+func makeSentinel(cfg *sentinelConfig) *Sentinel {
+	s := &Sentinel{
+		myid:         cfg.myid,
+		masters:      make(map[string]*monitoredMaster),
+		announceIP:   cfg.announceIP,
+		announcePort: cfg.announcePort,
+		closeCh:      make(chan struct{}),
+	}
+	if s.myid == "" {
+		buf := make([]byte, 20)
+		_, _ = rand.Read(buf)
+		s.myid = hex.EncodeToString(buf)
+	}
+	if s.announcePort == 0 {
+		s.announcePort = config.Properties.Port
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, mc := range cfg.masters {
+		m := &monitoredMaster{
+			name:            mc.name,
+			quorum:          mc.quorum,
+			downAfter:       mc.downAfter,
+			failoverTimeout: mc.failoverTimeout,
+			replicas:        make(map[string]*instance),
+			sentinels:       make(map[string]*instance),
+		}
+		m.inst = s.addInstance(m, kindMaster, mc.host, mc.port)
+		for _, addr := range mc.knownReplicas {
+			host, portStr, _ := net.SplitHostPort(addr)
+			port, _ := strconv.Atoi(portStr)
+			m.replicas[addr] = s.addInstance(m, kindReplica, host, port)
+		}
+		for _, known := range mc.knownSentinels {
+			if known.runid == s.myid {
+				continue
+			}
+			inst := s.addInstance(m, kindSentinel, known.host, known.port)
+			inst.runid = known.runid
+			m.sentinels[known.runid] = inst
+		}
+		s.masters[m.name] = m
+		logger.Info("+monitor master " + m.name + " " + m.inst.addr() + " quorum " + strconv.Itoa(m.quorum))
+	}
+	go s.cron()
+	return s
+}
+
+// addInstance starts monitoring an instance. invoker should hold s.mu
+func (s *Sentinel) addInstance(m *monitoredMaster, kind int, host string, port int) *instance {
+	inst := &instance{
+		kind:   kind,
+		host:   host,
+		port:   port,
+		closed: make(chan struct{}),
+		// an instance is not down until down-after-milliseconds passed
+		lastOK: time.Now(),
+	}
+	go s.monitor(m, inst)
+	return inst
+}
+
+// closeInstance stops monitoring inst. invoker should hold s.mu
+func (s *Sentinel) closeInstance(inst *instance) {
+	if inst.isClosed() {
+		return
+	}
+	close(inst.closed)
+	if inst.hello != nil {
+		_ = inst.hello.Close()
+	}
+	if c := inst.client; c != nil {
+		go c.Close()
+	}
+}
+
+// Close stops monitoring
+func (s *Sentinel) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closeCh:
+		return
+	default:
+	}
+	close(s.closeCh)
+	for _, m := range s.masters {
+		s.closeInstance(m.inst)
+		for _, inst := range m.replicas {
+			s.closeInstance(inst)
+		}
+		for _, inst := range m.sentinels {
+			s.closeInstance(inst)
+		}
+	}
+}
+
+func (s *Sentinel) AfterClientClose(c redis.Client) {
+}
+
+// cron checks states of masters every cronPeriod
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closeCh:
+			return
+		}
+		s.mu.Lock()
+		for _, m := range s.masters {
+			s.checkMaster(m)
+		}
+		s.mu.Unlock()
+	}
+}
+
+/* ---- monitoring of instances ---- */
+
+var pingCmd = [][]byte{[]byte("PING")}
+
+// monitor sends PING, INFO and hello to inst until it is closed
+func (s *Sentinel) monitor(m *monitoredMaster, inst *instance) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	var lastInfo, lastHello time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-inst.closed:
+			return
+		}
+		c := s.connect(inst)
+		if c == nil {
+			continue
+		}
+		if isValidPong(c.Send(pingCmd)) {
+			s.mu.Lock()
+			inst.lastOK = time.Now()
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		kind := inst.kind
+		period := infoPeriod
+		// replicas are checked frequently when a failover may happen
+		if kind == kindReplica && (m.inst.sdown || m.failoverState != failoverNone) {
+			period = pingPeriod
+		}
+		subscribed := inst.hello != nil
+		s.mu.Unlock()
+		if kind == kindSentinel {
+			continue
+		}
+		if !subscribed {
+			go s.subscribeHello(inst)
+		}
+		if time.Since(lastInfo) >= period {
+			lastInfo = time.Now()
+			if result, ok := c.Send([][]byte{[]byte("INFO"), []byte("replication")}).(*reply.BulkReply); ok {
+				s.mu.Lock()
+				s.processInfo(m, inst, string(result.Arg))
+				s.mu.Unlock()
+			}
+		}
+		if time.Since(lastHello) >= helloPeriod {
+			lastHello = time.Now()
+			s.mu.Lock()
+			msg := s.helloMsg(m, inst)
+			s.mu.Unlock()
+			if msg != "" {
+				c.Send([][]byte{[]byte("PUBLISH"), []byte(helloChannel), []byte(msg)})
+			}
+		}
+	}
+}
+
+// connect returns client of inst, nil if failed
+func (s *Sentinel) connect(inst *instance) *client.Client {
+	s.mu.Lock()
+	c := inst.client
+	s.mu.Unlock()
+	if c != nil {
+		return c
+	}
+	c, err := client.MakeClient(inst.addr())
+	if err != nil {
+		return nil
+	}
+	c.Start()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if inst.isClosed() {
+		go c.Close()
+		return nil
+	}
+	inst.client = c
+	return c
+}
+
+// send sends a command to inst without waiting for monitor goroutine
+func (s *Sentinel) send(inst *instance, args ...string) redis.Reply {
+	c := s.connect(inst)
+	if c == nil {
+		return reply.MakeErrReply("ERR cannot connect to " + inst.addr())
+	}
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	return c.Send(cmdLine)
+}
+
+// isValidPong accepts PONG, and LOADING or MASTERDOWN errors which mean the instance is working
+func isValidPong(result redis.Reply) bool {
+	switch r := result.(type) {
+	case *reply.StatusReply:
+		return r.Status == "PONG"
+	case *reply.PongReply:
+		return true
+	case reply.ErrorReply:
+		return strings.HasPrefix(r.Error(), "LOADING") || strings.HasPrefix(r.Error(), "MASTERDOWN")
+	}
+	return false
+}
+
+// processInfo updates inst by reply of INFO replication. invoker should hold s.mu
+func (s *Sentinel) processInfo(m *monitoredMaster, inst *instance, info string) {
+	if inst.isClosed() {
+		return
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	now := time.Now()
+	if role := fields["role"]; role != inst.role {
+		inst.role = role
+		inst.roleTime = now
+	}
+	inst.infoTime = now
+
+	if inst.role == "master" && inst.kind == kindMaster {
+		// discover replicas, slave0:ip=127.0.0.1,port=6380,state=online,offset=0,lag=0
+		for key, value := range fields {
+			if !strings.HasPrefix(key, "slave") || strings.IndexByte(value, '=') < 0 {
+				continue
+			}
+			var host, port string
+			for _, kv := range strings.Split(value, ",") {
+				if strings.HasPrefix(kv, "ip=") {
+					host = kv[3:]
+				} else if strings.HasPrefix(kv, "port=") {
+					port = kv[5:]
+				}
+			}
+			portNum, ok := parsePort(port)
+			if host == "" || !ok {
+				continue
+			}
+			addr := net.JoinHostPort(host, port)
+			if _, ok := m.replicas[addr]; !ok && addr != m.inst.addr() {
+				logger.Info("+slave " + addr + " of " + m.name)
+				m.replicas[addr] = s.addInstance(m, kindReplica, host, portNum)
+			}
+		}
+	}
+	if inst.role == "slave" {
+		inst.masterHost = fields["master_host"]
+		inst.masterPort, _ = strconv.Atoi(fields["master_port"])
+		inst.linkUp = fields["master_link_status"] == "up"
+		inst.offset, _ = strconv.ParseInt(fields["slave_repl_offset"], 10, 64)
+	}
+
+	// a replica claiming to be a master, eg. the old master is back after failover, is turned into a replica
+	if inst.kind == kindReplica && inst.role == "master" && !inst.sdown && !m.inst.sdown &&
+		m.failoverState == failoverNone && now.Sub(inst.roleTime) > 4*helloPeriod &&
+		now.Sub(inst.reconfTime) > 4*helloPeriod {
+		inst.reconfTime = now
+		host, port := m.inst.host, strconv.Itoa(m.inst.port)
+		logger.Info("+convert-to-slave " + inst.addr() + " of " + m.name)
+		go s.send(inst, "REPLICAOF", host, port)
+	}
+}
+
+// helloMsg returns ip,port,runid,current_epoch,master_name,master_ip,master_port,master_config_epoch
+// or empty string if ip of this sentinel is unknown. invoker should hold s.mu
+func (s *Sentinel) helloMsg(m *monitoredMaster, inst *instance) string {
+	ip := s.announceIP
+	if ip == "" {
+		ip = inst.helloIP
+	}
+	if ip == "" {
+		return ""
+	}
+	return strings.Join([]string{
+		ip, strconv.Itoa(s.announcePort), s.myid, strconv.FormatInt(s.currentEpoch, 10),
+		m.name, m.inst.host, strconv.Itoa(m.inst.port), strconv.FormatInt(m.configEpoch, 10),
+	}, ",")
+}
+
+// subscribeHello receives hello messages from inst until the connection is broken
+func (s *Sentinel) subscribeHello(inst *instance) {
+	conn, err := net.DialTimeout("tcp", inst.addr(), pingPeriod)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if inst.isClosed() || inst.hello != nil {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	inst.hello = conn
+	if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+		inst.helloIP = host
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if inst.hello == conn {
+			inst.hello = nil
+		}
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	cmd := reply.MakeMultiBulkReply([][]byte{[]byte("SUBSCRIBE"), []byte(helloChannel)})
+	if _, err := conn.Write(cmd.ToBytes()); err != nil {
+		return
+	}
+	ch := parser.ParseStream(conn)
+	for payload := range ch {
+		if payload.Err != nil {
+			_ = conn.Close()
+			for range ch {
+				// wait parser exits
+			}
+			return
+		}
+		msg, ok := payload.Data.(*reply.MultiBulkReply)
+		if ok && len(msg.Args) == 3 && bytes.Equal(msg.Args[0], []byte("message")) {
+			s.processHello(string(msg.Args[2]))
+		}
+	}
+}
+
+// processHello adds unknown sentinels and switches to the newer config of master
+func (s *Sentinel) processHello(msg string) {
+	fields := strings.Split(msg, ",")
+	if len(fields) != 8 {
+		return
+	}
+	port, ok1 := parsePort(fields[1])
+	epoch, err1 := strconv.ParseInt(fields[3], 10, 64)
+	masterPort, ok2 := parsePort(fields[6])
+	masterEpoch, err2 := strconv.ParseInt(fields[7], 10, 64)
+	if !ok1 || !ok2 || err1 != nil || err2 != nil {
+		return
+	}
+	host, runid, name, masterHost := fields[0], fields[2], fields[4], fields[5]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if runid == s.myid {
+		return
+	}
+	m := s.masters[name]
+	if m == nil {
+		return
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	inst := m.sentinels[runid]
+	if inst == nil {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		for id, other := range m.sentinels {
+			// the sentinel restarted with a new runid
+			if other.addr() == addr {
+				s.closeInstance(other)
+				delete(m.sentinels, id)
+			}
+		}
+		logger.Info("+sentinel " + addr + " " + runid + " of " + name)
+		inst = s.addInstance(m, kindSentinel, host, port)
+		inst.runid = runid
+		m.sentinels[runid] = inst
+	}
+	inst.lastHello = time.Now()
+
+	if masterEpoch > m.configEpoch && (masterHost != m.inst.host || masterPort != m.inst.port) {
+		s.switchMaster(m, masterHost, masterPort)
+		m.configEpoch = masterEpoch
+	}
+}
+
+// switchMaster makes host:port the master, the old master and other replicas become replicas. invoker should hold s.mu
+func (s *Sentinel) switchMaster(m *monitoredMaster, host string, port int) {
+	oldAddr := m.inst.addr()
+	newAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	insts := map[string]*instance{oldAddr: m.inst}
+	for addr, inst := range m.replicas {
+		insts[addr] = inst
+	}
+	master := insts[newAddr]
+	if master == nil {
+		master = s.addInstance(m, kindMaster, host, port)
+	}
+	delete(insts, newAddr)
+	master.kind = kindMaster
+	m.inst = master
+	m.replicas = insts
+	for _, inst := range insts {
+		inst.kind = kindReplica
+	}
+	s.resetFailover(m)
+	logger.Info("+switch-master " + m.name + " " + oldAddr + " " + newAddr)
+}
@@ -0,0 +1,241 @@
+package sentinel
+
+import (
+	"context"
+	"myGodis/src/config"
+	DBImpl "myGodis/src/db"
+	"myGodis/src/interface/db"
+	"myGodis/src/redis/client"
+	"myGodis/src/redis/reply"
+	"myGodis/src/redis/server"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(strings.NewReader("port 26379\n" +
+		"sentinel monitor mymaster 127.0.0.1 6379 2\n" +
+		"sentinel down-after-milliseconds mymaster 5000\n" +
+		"sentinel known-replica mymaster 127.0.0.1 6380\n" +
+		"sentinel known-sentinel mymaster 127.0.0.1 26380 abc\n" +
+		"sentinel announce-port 26379\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cfg.getMaster("mymaster")
+	if m == nil || m.port != 6379 || m.quorum != 2 || m.downAfter != 5*time.Second ||
+		m.failoverTimeout != defaultFailoverTimeout || cfg.announcePort != 26379 {
+		t.Errorf("wrong config %+v", m)
+	}
+	if len(m.knownReplicas) != 1 || m.knownReplicas[0] != "127.0.0.1:6380" ||
+		len(m.knownSentinels) != 1 || m.knownSentinels[0].runid != "abc" {
+		t.Errorf("wrong known instances %+v", m)
+	}
+
+	for _, text := range []string{
+		"port 26379\n",
+		"sentinel monitor mymaster 127.0.0.1 6379 0\n",
+		"sentinel down-after-milliseconds mymaster 5000\n",
+		"sentinel monitor mymaster 127.0.0.1 6379 1\nsentinel failover-timeout mymaster x\n",
+	} {
+		if _, err := parseConfig(strings.NewReader(text)); err == nil {
+			t.Errorf("expected error for %q", text)
+		}
+	}
+}
+
+type testServer struct {
+	listener net.Listener
+	handler  *server.Handler
+	once     sync.Once
+}
+
+func (srv *testServer) addr() string {
+	return srv.listener.Addr().String()
+}
+
+func (srv *testServer) close() {
+	srv.once.Do(func() {
+		_ = srv.listener.Close()
+		_ = srv.handler.Close()
+	})
+}
+
+// serve serves d on a random port like tcp.ListenAndServe
+func serve(t *testing.T, d db.DB) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{listener: listener, handler: server.MakeHandlerWithDB(d)}
+	t.Cleanup(srv.close)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handler.Handle(context.Background(), conn)
+		}
+	}()
+	return srv
+}
+
+func makeClient(t *testing.T, addr string) *client.Client {
+	c, err := client.MakeClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	t.Cleanup(c.Close)
+	return c
+}
+
+func send(c *client.Client, args ...string) string {
+	cmdLine := make([][]byte, len(args))
+	for i, arg := range args {
+		cmdLine[i] = []byte(arg)
+	}
+	return string(c.Send(cmdLine).ToBytes())
+}
+
+// waitFor polls until cond returns true
+func waitFor(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + msg)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func masterAddrReply(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return string(reply.MakeMultiBulkReply([][]byte{[]byte(host), []byte(port)}).ToBytes())
+}
+
+func TestFailover(t *testing.T) {
+	pingPeriod = 50 * time.Millisecond
+	infoPeriod = 100 * time.Millisecond
+	helloPeriod = 100 * time.Millisecond
+	askPeriod = 50 * time.Millisecond
+	cronPeriod = 20 * time.Millisecond
+	maxDesync = 200 * time.Millisecond
+	config.Properties.DBFilename = filepath.Join(t.TempDir(), "dump.rdb")
+	config.Properties.AppendOnly = false
+	config.Properties.Save = ""
+	// replicas announce port 0, they are added by known-replica instead
+	config.Properties.Port = 0
+
+	servers := make([]*testServer, 3)
+	clients := make([]*client.Client, 3)
+	for i := range servers {
+		servers[i] = serve(t, DBImpl.MakeDB())
+		clients[i] = makeClient(t, servers[i].addr())
+	}
+	masterHost, masterPort, _ := net.SplitHostPort(servers[0].addr())
+	for _, c := range clients[1:] {
+		if result := send(c, "REPLICAOF", masterHost, masterPort); result != "+OK\r\n" {
+			t.Fatal(result)
+		}
+	}
+	waitFor(t, 5*time.Second, "replicas connected", func() bool {
+		return strings.Contains(send(clients[0], "INFO", "replication"), "connected_slaves:2\r\n")
+	})
+	send(clients[0], "SET", "k", "v")
+
+	var sentinelClients []*client.Client
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		cfg, err := parseConfig(strings.NewReader(
+			"sentinel monitor mymaster " + masterHost + " " + masterPort + " 2\n" +
+				"sentinel down-after-milliseconds mymaster 300\n" +
+				"sentinel failover-timeout mymaster 2000\n" +
+				"sentinel known-replica mymaster " + strings.Replace(servers[1].addr(), ":", " ", 1) + "\n" +
+				"sentinel known-replica mymaster " + strings.Replace(servers[2].addr(), ":", " ", 1) + "\n" +
+				"sentinel announce-port " + port + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := makeSentinel(cfg)
+		srv := &testServer{listener: listener, handler: server.MakeHandlerWithDB(s)}
+		t.Cleanup(srv.close)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go srv.handler.Handle(context.Background(), conn)
+			}
+		}()
+		sentinelClients = append(sentinelClients, makeClient(t, srv.addr()))
+	}
+
+	// sentinels discover each other by hello messages
+	for _, c := range sentinelClients {
+		c := c
+		waitFor(t, 5*time.Second, "sentinels discovered", func() bool {
+			result, ok := c.Send([][]byte{[]byte("SENTINEL"), []byte("sentinels"), []byte("mymaster")}).(*reply.MultiRawReply)
+			return ok && len(result.Replies) == 2
+		})
+		if result := send(c, "SENTINEL", "get-master-addr-by-name", "mymaster"); result != masterAddrReply(servers[0].addr()) {
+			t.Errorf("wrong master address %q", result)
+		}
+	}
+	if result := send(sentinelClients[0], "ROLE"); result != "*2\r\n$8\r\nsentinel\r\n*1\r\n$8\r\nmymaster\r\n" {
+		t.Errorf("wrong role %q", result)
+	}
+
+	// master is down, a replica is promoted
+	servers[0].close()
+	var newMaster string
+	waitFor(t, 15*time.Second, "failover", func() bool {
+		for _, i := range []int{1, 2} {
+			if send(sentinelClients[0], "SENTINEL", "get-master-addr-by-name", "mymaster") == masterAddrReply(servers[i].addr()) {
+				newMaster = servers[i].addr()
+				return true
+			}
+		}
+		return false
+	})
+	for _, c := range sentinelClients[1:] {
+		c := c
+		waitFor(t, 5*time.Second, "new config propagated", func() bool {
+			return send(c, "SENTINEL", "get-master-addr-by-name", "mymaster") == masterAddrReply(newMaster)
+		})
+	}
+
+	promoted, other := clients[1], clients[2]
+	if newMaster == servers[2].addr() {
+		promoted, other = clients[2], clients[1]
+	}
+	if role := send(promoted, "ROLE"); !strings.HasPrefix(role, "*3\r\n$6\r\nmaster\r\n") {
+		t.Errorf("promoted replica is not master: %q", role)
+	}
+	newHost, newPort, _ := net.SplitHostPort(newMaster)
+	waitFor(t, 5*time.Second, "replica repointed", func() bool {
+		role := send(other, "ROLE")
+		return strings.Contains(role, "$"+strconv.Itoa(len(newHost))+"\r\n"+newHost+"\r\n:"+newPort+"\r\n$9\r\nconnected\r\n")
+	})
+	if result := send(promoted, "SET", "k2", "v"); result != "+OK\r\n" {
+		t.Fatalf("write to promoted replica failed: %q", result)
+	}
+	waitFor(t, 5*time.Second, "replication from new master", func() bool {
+		return send(other, "GET", "k2") == "$1\r\nv\r\n"
+	})
+	if result := send(other, "GET", "k"); result != "$1\r\nv\r\n" {
+		t.Errorf("data before failover is lost: %q", result)
+	}
+}